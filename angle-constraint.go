@@ -0,0 +1,348 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"github.com/vugu/vgrouter"
+	"github.com/vugu/vugu"
+)
+
+// angleConstraintPresetTolerance is the largest sine or cosine of a target angle that is still treated as parallel or perpendicular.
+const angleConstraintPresetTolerance = 1e-9
+
+// AngleConstraintLeg is one of the two directions whose angle is constrained.
+type AngleConstraintLeg struct {
+	LineKey string // Key of a line. If this is empty, the direction is given by the points P1 and P2.
+	P1, P2  string
+}
+
+// Points returns the two points that define the direction of the leg.
+// The result is false if any of them doesn't exist.
+func (l AngleConstraintLeg) Points(site *Site) (*Point, *Point, bool) {
+	p1Key, p2Key := l.P1, l.P2
+	if l.LineKey != "" {
+		line, ok := site.Lines[l.LineKey]
+		if !ok {
+			return nil, nil, false
+		}
+		p1Key, p2Key = line.P1, line.P2
+	}
+
+	p1, ok := site.Points[p1Key]
+	if !ok {
+		return nil, nil, false
+	}
+	p2, ok := site.Points[p2Key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	return p1, p2, true
+}
+
+// DisplayName returns the name of the line, or the names of both points.
+func (l AngleConstraintLeg) DisplayName(site *Site) string {
+	if l.LineKey != "" {
+		if line, ok := site.Lines[l.LineKey]; ok {
+			return "Line " + line.DisplayName()
+		}
+		return "Line -"
+	}
+
+	pointName := func(key string) string {
+		if point, ok := site.Points[key]; ok {
+			return point.DisplayName()
+		}
+		return "-"
+	}
+
+	return pointName(l.P1) + " - " + pointName(l.P2)
+}
+
+// AngleConstraint constrains the angle between two lines or point pairs.
+// The lines have no direction, so the angle is always in the range of [0°, 90°].
+type AngleConstraint struct {
+	vgrouter.NavigatorRef `json:"-"`
+
+	site *Site
+	key  string
+
+	CreatedAt time.Time
+
+	A, B AngleConstraintLeg
+
+	Angle    Angle // Target angle between both legs.
+	Accuracy Angle
+}
+
+func (s *Site) NewAngleConstraint() *AngleConstraint {
+	ac := new(AngleConstraint)
+	ac.initData()
+	ac.initReferences(s, s.shortIDGen.MustGenerate())
+
+	return ac
+}
+
+// initData initializes the object with default values and other stuff.
+func (ac *AngleConstraint) initData() {
+	ac.CreatedAt = time.Now()
+	ac.Angle = Angle(math.Pi / 2)
+	ac.Accuracy = Angle(1 * math.Pi / 180)
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (ac *AngleConstraint) initReferences(newParent *Site, newKey string) {
+	ac.site, ac.key = newParent, newKey
+	ac.site.AngleConstraints[ac.Key()] = ac
+}
+
+func (ac *AngleConstraint) Key() string {
+	return ac.key
+}
+
+// DisplayName returns either the name, or if that is empty the key.
+func (ac *AngleConstraint) DisplayName() string {
+	return "(" + ac.Key() + ")"
+}
+
+// Description returns a short description of both legs and the target angle.
+func (ac *AngleConstraint) Description() string {
+	return fmt.Sprintf("%s and %s at %.13g°", ac.A.DisplayName(ac.site), ac.B.DisplayName(ac.site), ac.Angle.Degree())
+}
+
+func (ac *AngleConstraint) Delete() {
+	delete(ac.site.AngleConstraints, ac.Key())
+}
+
+// Copy returns a copy of the given object.
+// Expensive data like images will not be copied, but referenced.
+func (ac *AngleConstraint) Copy(newParent *Site, newKey string) *AngleConstraint {
+	copy := new(AngleConstraint)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.CreatedAt = ac.CreatedAt
+	copy.A = ac.A
+	copy.B = ac.B
+	copy.Angle = ac.Angle
+	copy.Accuracy = ac.Accuracy
+
+	return copy
+}
+
+func (ac *AngleConstraint) UnmarshalJSON(data []byte) error {
+	ac.initData()
+
+	// Unmarshal structure normally. Cast it into a different type to prevent recursion with json.Unmarshal.
+	type tempType *AngleConstraint
+	if err := json.Unmarshal(data, tempType(ac)); err != nil {
+		return err
+	}
+
+	// Update parent references and keys.
+
+	return nil
+}
+
+// HasLine returns whether any leg of the constraint is the line with the given key.
+func (ac *AngleConstraint) HasLine(key string) bool {
+	return ac.A.LineKey == key || ac.B.LineKey == key
+}
+
+func (ac *AngleConstraint) handlePerpendicular(event vugu.DOMEvent) {
+	ac.Angle = Angle(math.Pi / 2)
+}
+
+func (ac *AngleConstraint) handleParallel(event vugu.DOMEvent) {
+	ac.Angle = 0
+}
+
+// directions returns the direction vectors of both legs, and their points.
+func (ac *AngleConstraint) directions() (a, b mgl64.Vec3, a1, a2, b1, b2 *Point, ok bool) {
+	if a1, a2, ok = ac.A.Points(ac.site); !ok {
+		return
+	}
+	if b1, b2, ok = ac.B.Points(ac.site); !ok {
+		return
+	}
+
+	a, b = a2.Position.Vec3().Sub(a1.Position.Vec3()), b2.Position.Vec3().Sub(b1.Position.Vec3())
+	return
+}
+
+// CurrentAngle returns the angle between both legs in the range of [0°, 90°].
+// The result is false if any of the legs is undefined.
+func (ac *AngleConstraint) CurrentAngle() (Angle, bool) {
+	a, b, _, _, _, _, ok := ac.directions()
+	if !ok || a.Len() == 0 || b.Len() == 0 {
+		return 0, false
+	}
+
+	return Angle(math.Atan2(a.Cross(b).Len(), math.Abs(a.Dot(b)))), true
+}
+
+// CurrentAngleDescription returns the current angle between both legs as text.
+func (ac *AngleConstraint) CurrentAngleDescription() string {
+	angle, ok := ac.CurrentAngle()
+	if !ok {
+		return "Current angle: -"
+	}
+
+	return fmt.Sprintf("Current angle: %.4f°", angle.Degree())
+}
+
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (ac *AngleConstraint) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	return nil, []Residualer{ac}
+}
+
+// targetAngle returns the target angle folded into the range of [0°, 90°], as the legs have no direction.
+func (ac *AngleConstraint) targetAngle() float64 {
+	return math.Acos(math.Min(math.Abs(math.Cos(ac.Angle.Radian())), 1))
+}
+
+// Reference directions that define the basis for the residuals of parallel legs.
+// They are oblique, so that the switch from one to the other doesn't happen for lines along the axes or their diagonals.
+var (
+	angleConstraintReference1 = mgl64.Vec3{1, 2, 3}.Normalize()
+	angleConstraintReference2 = mgl64.Vec3{2, -1, 0}.Normalize() // Perpendicular to the first reference.
+)
+
+// parallelReference returns the reference direction k for the given unit vector u.
+// The basis perpendicular to u is (k × u) / |k × u| and u × that.
+func parallelReference(u mgl64.Vec3) mgl64.Vec3 {
+	if math.Abs(angleConstraintReference1.Dot(u)) > 0.95 {
+		return angleConstraintReference2
+	}
+	return angleConstraintReference1
+}
+
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+// There are always two residuals, so that their number doesn't change when the target angle is edited:
+//
+//   - Perpendicular legs: The dot product of both unit directions, the second residual is 0.
+//   - Parallel legs: The cross product of both unit directions, expressed in a basis perpendicular to the first leg.
+//   - Any other angle: The difference of the cosines of the current and the target angle, the second residual is 0.
+//
+// All of them are smooth at the target angle, and approximately the angle difference in radians for small deviations.
+func (ac *AngleConstraint) Residuals() []float64 {
+	a, b, _, _, _, _, ok := ac.directions()
+	if !ok {
+		return []float64{0, 0}
+	}
+	if a.Len() == 0 || b.Len() == 0 {
+		return []float64{1000, 1000}
+	}
+
+	u, w := a.Normalize(), b.Normalize()
+	accuracy := ac.Accuracy.Radian()
+	target := ac.targetAngle()
+	cosTarget, sinTarget := math.Cos(target), math.Sin(target)
+
+	switch {
+	case cosTarget < angleConstraintPresetTolerance:
+		return []float64{u.Dot(w) / accuracy, 0}
+
+	case sinTarget < angleConstraintPresetTolerance:
+		k := parallelReference(u)
+		alpha, beta, gamma := k.Dot(u), k.Dot(w), u.Dot(w)
+		s := math.Sqrt(1 - alpha*alpha)
+		return []float64{(alpha*gamma - beta) / (s * accuracy), k.Dot(u.Cross(w)) / (s * accuracy)}
+	}
+
+	return []float64{(math.Abs(u.Dot(w)) - cosTarget) / (sinTarget * accuracy), 0}
+}
+
+// ActiveResiduals returns the number of residuals that can be non-zero.
+// Only parallel legs use the second residual.
+func (ac *AngleConstraint) ActiveResiduals() int {
+	if _, _, _, _, _, _, ok := ac.directions(); !ok {
+		return 0
+	}
+	if sinTarget := math.Sin(ac.targetAngle()); sinTarget < angleConstraintPresetTolerance {
+		return 2
+	}
+
+	return 1
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (ac *AngleConstraint) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	a, b, a1, a2, b1, b2, ok := ac.directions()
+	if !ok || a.Len() == 0 || b.Len() == 0 {
+		return
+	}
+
+	u, w := a.Normalize(), b.Normalize()
+	accuracy := ac.Accuracy.Radian()
+	target := ac.targetAngle()
+	cosTarget, sinTarget := math.Cos(target), math.Sin(target)
+
+	// add takes the gradients of a residual with respect to the unit directions, and maps them onto the points.
+	// Only the part perpendicular to a direction changes it, scaled by the inverse of the leg's length.
+	add := func(residualIndex int, gradientU, gradientW mgl64.Vec3) {
+		gradientA := gradientU.Sub(u.Mul(u.Dot(gradientU))).Mul(1 / a.Len())
+		gradientB := gradientW.Sub(w.Mul(w.Dot(gradientW))).Mul(1 / b.Len())
+		for i := 0; i < 3; i++ {
+			addFunc(residualIndex, &a2.Position.Coordinate[i], gradientA[i])
+			addFunc(residualIndex, &a1.Position.Coordinate[i], -gradientA[i])
+			addFunc(residualIndex, &b2.Position.Coordinate[i], gradientB[i])
+			addFunc(residualIndex, &b1.Position.Coordinate[i], -gradientB[i])
+		}
+	}
+
+	switch {
+	case cosTarget < angleConstraintPresetTolerance:
+		add(0, w.Mul(1/accuracy), u.Mul(1/accuracy))
+
+	case sinTarget < angleConstraintPresetTolerance:
+		k := parallelReference(u)
+		alpha, beta, gamma := k.Dot(u), k.Dot(w), u.Dot(w)
+		s := math.Sqrt(1 - alpha*alpha)
+
+		// The first residual is (α·γ - β) / s, with α = k·u, β = k·w, γ = u·w and s = √(1 - α²).
+		numerator := alpha*gamma - beta
+		gradientU := k.Mul(gamma).Add(w.Mul(alpha)).Mul(1 / s).Add(k.Mul(numerator * alpha / (s * s * s)))
+		gradientW := u.Mul(alpha).Sub(k).Mul(1 / s)
+		add(0, gradientU.Mul(1/accuracy), gradientW.Mul(1/accuracy))
+
+		// The second residual is k·(u × w) / s.
+		numerator = k.Dot(u.Cross(w))
+		gradientU = w.Cross(k).Mul(1 / s).Add(k.Mul(numerator * alpha / (s * s * s)))
+		gradientW = k.Cross(u).Mul(1 / s)
+		add(1, gradientU.Mul(1/accuracy), gradientW.Mul(1/accuracy))
+
+	default:
+		sign := 1.0
+		if u.Dot(w) < 0 {
+			sign = -1
+		}
+		factor := sign / (sinTarget * accuracy)
+		add(0, w.Mul(factor), u.Mul(factor))
+	}
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (ac *AngleConstraint) ResidualSqr() float64 {
+	return residualsSqr(ac.Residuals())
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	calibrationSignificance   = 3    // A coefficient is significant if it is larger than this multiple of its standard deviation.
+	calibrationMaxCorrelation = 0.95 // Coefficients with a larger absolute correlation can't be separated by the measurements.
+)
+
+// CalibrationCoefficientQuality describes how well a distortion coefficient of a camera is determined by the measurements.
+type CalibrationCoefficientQuality struct {
+	Name              string
+	Value             jsonFloat // Value in the unit of the camera form.
+	StandardDeviation jsonFloat // Standard deviation in the unit of the camera form. Can be infinite, if the coefficient isn't determined.
+	Significance      jsonFloat // Absolute value divided by its standard deviation.
+	Correlation       jsonFloat // Largest absolute correlation with any other intrinsic parameter.
+	CorrelatedWith    string    // Name of the parameter with the largest correlation.
+}
+
+// Significant returns whether the coefficient differs from zero by more than its uncertainty allows.
+func (q CalibrationCoefficientQuality) Significant() bool {
+	return q.Significance >= calibrationSignificance
+}
+
+// Description returns a human readable assessment of the coefficient.
+func (q CalibrationCoefficientQuality) Description() string {
+	text := fmt.Sprintf("%s: %.4g ± %.2g", q.Name, q.Value, q.StandardDeviation)
+
+	switch {
+	case math.IsInf(float64(q.StandardDeviation), 0) || math.IsNaN(float64(q.StandardDeviation)):
+		text += " (not determined by the measurements, lock it)"
+	case q.Significant():
+		text += fmt.Sprintf(" (significant, %.1fσ)", q.Significance)
+	default:
+		text += fmt.Sprintf(" (not significant, %.1fσ, consider locking it at 0)", q.Significance)
+	}
+
+	if q.Correlation > calibrationMaxCorrelation {
+		text += fmt.Sprintf(", correlated with %s (%.3f)", q.CorrelatedWith, q.Correlation)
+	}
+
+	return text
+}
+
+// calibrationParameters returns the names and tweakables of all intrinsic parameters of the camera.
+func (c *Camera) calibrationParameters() ([]string, []Tweakable) {
+	names := []string{"Horizontal AOV", "Principal point X", "Principal point Y"}
+	tweakables := []Tweakable{&c.HorizontalAOV, &c.PrincipalPointOffset[0], &c.PrincipalPointOffset[1]}
+
+	for i := range c.DistortionKs {
+		names, tweakables = append(names, fmt.Sprintf("K%d", i+1)), append(tweakables, &c.DistortionKs[i])
+	}
+	for i := range c.DistortionPs {
+		names, tweakables = append(names, fmt.Sprintf("P%d", i+1)), append(tweakables, &c.DistortionPs[i])
+	}
+	for i := range c.DistortionBs {
+		names, tweakables = append(names, fmt.Sprintf("B%d", i+1)), append(tweakables, &c.DistortionBs[i])
+	}
+
+	return names, tweakables
+}
+
+// CalibrationQuality returns the quality of all optimized distortion coefficients and the principal point offset.
+// The horizontal angle of view is only used to determine correlations, as it is never zero.
+// The result is empty if there is no posterior of a full optimization.
+func (c *Camera) CalibrationQuality(posterior *Posterior) []CalibrationCoefficientQuality {
+	names, tweakables := c.calibrationParameters()
+
+	var qualities []CalibrationCoefficientQuality
+	for i, tweakable := range tweakables {
+		if i == 0 {
+			continue
+		}
+		sigma, ok := posterior.StandardDeviation(tweakable)
+		if !ok {
+			continue
+		}
+
+		value, displaySigma := tweakableDisplayValue(tweakable, tweakable.TweakableValue(), sigma)
+		quality := CalibrationCoefficientQuality{Name: names[i], Value: jsonFloat(value), StandardDeviation: jsonFloat(displaySigma), Significance: jsonFloat(math.Abs(value) / displaySigma)}
+
+		for j, other := range tweakables {
+			if i == j {
+				continue
+			}
+			covariance, ok := posterior.Covariance(tweakable, other)
+			if !ok {
+				continue
+			}
+			otherSigma, _ := posterior.StandardDeviation(other)
+			if correlation := jsonFloat(math.Abs(covariance / (sigma * otherSigma))); correlation > quality.Correlation {
+				quality.Correlation, quality.CorrelatedWith = correlation, names[j]
+			}
+		}
+
+		qualities = append(qualities, quality)
+	}
+
+	return qualities
+}
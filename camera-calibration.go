@@ -0,0 +1,392 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"github.com/vugu/vugu"
+	js "github.com/vugu/vugu/js"
+	"gonum.org/v1/gonum/mat"
+)
+
+// cameraCalibrationMinPhotos is the minimum number of checkerboard photos needed to determine all calibrated parameters.
+const cameraCalibrationMinPhotos = 3
+
+// CalibrationBoard describes the printed checkerboard that is used to calibrate a camera.
+type CalibrationBoard struct {
+	Columns    int      // Number of inner corners along the first side of the board.
+	Rows       int      // Number of inner corners along the second side of the board.
+	SquareSize Distance // Edge length of a single square.
+}
+
+// CameraCalibrationPhoto contains the detected checkerboard corners of a single calibration photo.
+// The image itself isn't stored, as it isn't needed after the detection.
+type CameraCalibrationPhoto struct {
+	camera *Camera
+	key    string
+
+	CreatedAt time.Time
+
+	ImageSize   PixelCoordinate   // Size of the upright image.
+	Orientation int               // EXIF orientation of the stored image.
+	Corners     []PixelCoordinate // Inner corners of the checkerboard in the upright image, row by row.
+
+	// Reprojection errors of the last calibration.
+	RMSError PixelDistance
+	MaxError PixelDistance
+}
+
+// CameraCalibrationResult summarizes the last calibration of a camera.
+type CameraCalibrationResult struct {
+	Date         time.Time
+	Photos       int
+	Corners      int
+	RMSError     PixelDistance                   // Root mean square reprojection error of all corners.
+	Coefficients []CalibrationCoefficientQuality // Uncertainties of the calibrated parameters.
+}
+
+// Description returns a human readable summary of the calibration.
+func (r *CameraCalibrationResult) Description() string {
+	return fmt.Sprintf("Calibrated at %s from %d photos with %d corners. RMS reprojection error: %.3f px.", r.Date.Format("2006-01-02 15:04"), r.Photos, r.Corners, r.RMSError.Pixels())
+}
+
+// newCalibrationPhoto adds a calibration photo with the given detected corners to the camera.
+func (c *Camera) newCalibrationPhoto(imageSize PixelCoordinate, orientation int, corners []PixelCoordinate) *CameraCalibrationPhoto {
+	cp := new(CameraCalibrationPhoto)
+	cp.initData()
+	cp.ImageSize, cp.Orientation, cp.Corners = imageSize, orientation, corners
+	cp.initReferences(c, c.site.shortIDGen.MustGenerate())
+
+	return cp
+}
+
+// initData initializes the object with default values and other stuff.
+func (cp *CameraCalibrationPhoto) initData() {
+	cp.CreatedAt = time.Now()
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (cp *CameraCalibrationPhoto) initReferences(newParent *Camera, newKey string) {
+	cp.camera, cp.key = newParent, newKey
+	cp.camera.CalibrationPhotos[cp.Key()] = cp
+}
+
+func (cp *CameraCalibrationPhoto) Key() string {
+	return cp.key
+}
+
+func (cp *CameraCalibrationPhoto) Delete() {
+	delete(cp.camera.CalibrationPhotos, cp.Key())
+}
+
+// Copy returns a copy of the given object.
+func (cp *CameraCalibrationPhoto) Copy(newParent *Camera, newKey string) *CameraCalibrationPhoto {
+	copy := new(CameraCalibrationPhoto)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.CreatedAt = cp.CreatedAt
+	copy.ImageSize = cp.ImageSize
+	copy.Orientation = cp.Orientation
+	copy.Corners = append([]PixelCoordinate(nil), cp.Corners...)
+	copy.RMSError = cp.RMSError
+	copy.MaxError = cp.MaxError
+
+	return copy
+}
+
+// CalibrationPhotosSorted returns the calibration photos of the camera as a list sorted by date.
+func (c *Camera) CalibrationPhotosSorted() []*CameraCalibrationPhoto {
+	photos := make([]*CameraCalibrationPhoto, 0, len(c.CalibrationPhotos))
+
+	for _, photo := range c.CalibrationPhotos {
+		photos = append(photos, photo)
+	}
+
+	sort.Slice(photos, func(i, j int) bool {
+		if !photos[i].CreatedAt.Equal(photos[j].CreatedAt) {
+			return photos[i].CreatedAt.After(photos[j].CreatedAt)
+		}
+		return photos[i].Key() < photos[j].Key()
+	})
+
+	return photos
+}
+
+// addCalibrationImage detects the checkerboard in the given image, and adds the result as calibration photo.
+func (c *Camera) addCalibrationImage(imageData []byte) (*CameraCalibrationPhoto, error) {
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, err
+	}
+
+	corners, err := detectCheckerboard(img, c.CalibrationBoard.Columns, c.CalibrationBoard.Rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// The corners are detected in the stored image, but all image coordinates refer to the upright image.
+	exif, err := parseExif(imageData)
+	if err != nil {
+		log.Printf("Couldn't read EXIF metadata: %v", err)
+	}
+	storedSize := PixelCoordinate{PixelDistance(img.Bounds().Dx()), PixelDistance(img.Bounds().Dy())}
+	transform := exifOrientationTransform(exif.Orientation, storedSize)
+	for i, corner := range corners {
+		corners[i] = transform.apply(corner)
+	}
+	imageSize := storedSize
+	if transform.swapsAxes() {
+		imageSize = PixelCoordinate{storedSize.Y(), storedSize.X()}
+	}
+
+	return c.newCalibrationPhoto(imageSize, exif.Orientation, corners), nil
+}
+
+func (c *Camera) handleCalibrationFileChange(event vugu.DOMEvent) {
+	files := js.Global().Get("document").Call("getElementById", "calibration-upload").Get("files")
+
+	for i := 0; i < files.Length(); i++ {
+		file := files.Index(i)
+		fileReader := js.Global().Get("FileReader").New()
+		fileReader.Call("addEventListener", "loadend", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			buffer := fileReader.Get("result")
+			uint8Array := js.Global().Get("Uint8Array").New(buffer)
+
+			imageData := make([]byte, uint8Array.Length())
+			js.CopyBytesToGo(imageData, uint8Array)
+
+			event.EventEnv().Lock()
+			defer event.EventEnv().UnlockRender()
+
+			if _, err := c.addCalibrationImage(imageData); err != nil {
+				log.Printf("Calibration photo %q: %v", file.Get("name").String(), err)
+				return nil
+			}
+
+			return js.Undefined()
+		}))
+
+		fileReader.Call("readAsArrayBuffer", file)
+	}
+}
+
+// calibrationPose returns the initial position and orientation of a calibration photo, so that the board's corners project onto the detected ones.
+// The pose is determined from the homography between the board and the image, see Zhang, "A Flexible New Technique for Camera Calibration".
+func calibrationPose(projection cameraProjection, board []Coordinate, corners []PixelCoordinate) (Coordinate, Rotation, error) {
+	// Transform the detected corners into normalized camera coordinates, without distortion.
+	toSensor := projection.transform.inverse()
+	f := projection.focalLength
+	normalized := make([][2]float64, len(corners))
+	for i, corner := range corners {
+		sensor := toSensor.apply(corner)
+		normalized[i] = [2]float64{(sensor.X().Pixels() - projection.imgBase.X().Pixels()) / f, (sensor.Y().Pixels() - projection.imgBase.Y().Pixels()) / f}
+	}
+
+	// Direct linear transformation of the homography, with the board coordinates scaled to about 1.
+	var scale float64
+	for _, b := range board {
+		scale = max(scale, math.Abs(b.X().Meters()), math.Abs(b.Y().Meters()))
+	}
+	if scale == 0 {
+		return Coordinate{}, Rotation{}, errors.New("the board has no size")
+	}
+	a := mat.NewDense(2*len(board), 9, nil)
+	for i, b := range board {
+		X, Y := b.X().Meters()/scale, b.Y().Meters()/scale
+		x, y := normalized[i][0], normalized[i][1]
+		a.SetRow(2*i, []float64{X, Y, 1, 0, 0, 0, -x * X, -x * Y, -x})
+		a.SetRow(2*i+1, []float64{0, 0, 0, X, Y, 1, -y * X, -y * Y, -y})
+	}
+	var svd mat.SVD
+	if !svd.Factorize(a, mat.SVDThin) {
+		return Coordinate{}, Rotation{}, errors.New("homography decomposition failed")
+	}
+	var v mat.Dense
+	svd.VTo(&v)
+	h := mat.Col(nil, 8, &v)
+
+	// The homography is H = λ·[r1 r2 t], undo the scaling of the board coordinates.
+	h1 := mgl64.Vec3{h[0], h[3], h[6]}.Mul(1 / scale)
+	h2 := mgl64.Vec3{h[1], h[4], h[7]}.Mul(1 / scale)
+	h3 := mgl64.Vec3{h[2], h[5], h[8]}
+	lambda := 1 / h1.Len()
+	if h3[2]*lambda < 0 {
+		lambda = -lambda // The board has to be in front of the camera.
+	}
+	r1, r2, t := h1.Mul(lambda), h2.Mul(lambda), h3.Mul(lambda)
+	r3 := r1.Cross(r2)
+
+	// Find the closest rotation matrix.
+	rm := mat.NewDense(3, 3, []float64{r1[0], r2[0], r3[0], r1[1], r2[1], r3[1], r1[2], r2[2], r3[2]})
+	if !svd.Factorize(rm, mat.SVDFull) {
+		return Coordinate{}, Rotation{}, errors.New("rotation decomposition failed")
+	}
+	var u, vt, r mat.Dense
+	svd.UTo(&u)
+	svd.VTo(&vt)
+	r.Mul(&u, vt.T())
+
+	// The rotation from world into camera space is Rx(-ox) * Ry(-oy) * Rz(-oz).
+	b := math.Asin(max(-1, min(1, r.At(0, 2))))
+	aa := math.Atan2(-r.At(1, 2), r.At(2, 2))
+	c := math.Atan2(-r.At(0, 1), r.At(0, 0))
+	orientation := Rotation{Angle(-aa), Angle(-b), Angle(-c)}
+
+	// The camera position is -R^T * t.
+	rotation := mgl64.Mat3{r.At(0, 0), r.At(1, 0), r.At(2, 0), r.At(0, 1), r.At(1, 1), r.At(2, 1), r.At(0, 2), r.At(1, 2), r.At(2, 2)}
+	position := rotation.Transpose().Mul3x1(t).Mul(-1)
+
+	return Coordinate{Distance(position[0]), Distance(position[1]), Distance(position[2])}, orientation, nil
+}
+
+// Calibrate determines the intrinsic parameters of the camera from the checkerboard corners of all calibration photos.
+// The angle of view, the principal point offset, the radial distortion coefficients K1-K3 (K1-K4 for fisheye cameras), the tangential coefficients P1 and P2 and the affinity coefficients are calibrated.
+// All intrinsic parameters are locked afterwards.
+func (c *Camera) Calibrate() (*CameraCalibrationResult, error) {
+	if c.Panoramic() {
+		return nil, errors.New("panoramas don't need to be calibrated")
+	}
+	photos := c.CalibrationPhotosSorted()
+	if len(photos) < cameraCalibrationMinPhotos {
+		return nil, fmt.Errorf("at least %d checkerboard photos are needed, there are %d", cameraCalibrationMinPhotos, len(photos))
+	}
+	board := c.CalibrationBoard
+	if board.SquareSize <= 0 {
+		return nil, errors.New("the square size of the checkerboard has to be set")
+	}
+
+	// Calibrate on a separate site that only contains the board and the calibration photos.
+	site := NewSite("Calibration")
+	camera := site.NewCamera(c.Name)
+	camera.PixelAccuracy = 1
+	camera.Model = c.Model
+	camera.HorizontalAOV, camera.HorizontalAOVLocked = c.HorizontalAOV, false
+	camera.PrincipalPointOffset, camera.PrincipalPointOffsetLocked = c.PrincipalPointOffset, false
+	camera.DistortionKs = c.DistortionKs
+	camera.DistortionPs = c.DistortionPs
+	camera.DistortionBs, camera.DistortionBsLocked = c.DistortionBs, [CameraDistortionBs]bool{}
+	camera.DistortionKsLocked = [CameraDistortionKs]bool{false, false, false, true}
+	camera.DistortionPsLocked = [CameraDistortionPs]bool{false, false, true, true}
+	if c.Model == CameraModelFisheye {
+		camera.DistortionKsLocked = [CameraDistortionKs]bool{}
+	}
+
+	boardCoordinates := make([]Coordinate, 0, board.Columns*board.Rows)
+	boardPoints := make([]*Point, 0, board.Columns*board.Rows)
+	for j := 0; j < board.Rows; j++ {
+		for i := 0; i < board.Columns; i++ {
+			point := site.NewPoint(fmt.Sprintf("Corner %d, %d", i+1, j+1))
+			point.Position.Coordinate = Coordinate{Distance(i) * board.SquareSize, Distance(j) * board.SquareSize, 0}
+			point.Position.Locked = [3]bool{true, true, true}
+			boardCoordinates, boardPoints = append(boardCoordinates, point.Position.Coordinate), append(boardPoints, point)
+		}
+	}
+
+	var poses []OptimizerSelectable
+	calibrationPhotos := map[*CameraPhoto]*CameraCalibrationPhoto{}
+	for _, calibrationPhoto := range photos {
+		if len(calibrationPhoto.Corners) != len(boardPoints) {
+			return nil, fmt.Errorf("calibration photo %s has %d corners, but the board has %d", calibrationPhoto.Key(), len(calibrationPhoto.Corners), len(boardPoints))
+		}
+
+		photo := new(CameraPhoto)
+		photo.initData()
+		photo.imageSize, photo.orientation = calibrationPhoto.ImageSize, calibrationPhoto.Orientation
+		photo.initReferences(camera, calibrationPhoto.Key())
+
+		position, orientation, err := calibrationPose(photo.projection(), boardCoordinates, calibrationPhoto.Corners)
+		if err != nil {
+			return nil, fmt.Errorf("calibration photo %s: %w", calibrationPhoto.Key(), err)
+		}
+		photo.Position.Coordinate, photo.Orientation.Rotation = position, orientation
+
+		for i, corner := range calibrationPhoto.Corners {
+			mapping := photo.NewMapping()
+			mapping.PointKey, mapping.Position = boardPoints[i].Key(), corner
+		}
+
+		poses, calibrationPhotos[photo] = append(poses, photo.Pose()), calibrationPhoto
+	}
+
+	// Refine the poses with the initial intrinsics first, then optimize everything.
+	noProgress := func(OptimizerProgress) bool { return false }
+	selection := map[Tweakable]struct{}{}
+	for _, pose := range poses {
+		tweakables, _ := pose.GetTweakablesAndResiduals()
+		for _, tweakable := range tweakables {
+			selection[tweakable] = struct{}{}
+		}
+	}
+	if _, err := Optimize(site, selection, noProgress); err != nil {
+		return nil, err
+	}
+	outcome, err := Optimize(site, nil, noProgress)
+	if err != nil {
+		return nil, err
+	}
+	if outcome.Termination == OptimizerTerminationFailed {
+		return nil, fmt.Errorf("the optimization failed: %s", outcome.Description())
+	}
+
+	// Reprojection errors of every photo.
+	result := &CameraCalibrationResult{Date: time.Now(), Photos: len(photos), Coefficients: camera.CalibrationQuality(site.posterior)}
+	var sumSqr float64
+	for photo, calibrationPhoto := range calibrationPhotos {
+		var photoSumSqr, photoMax float64
+		for _, mapping := range photo.Mappings {
+			residuals := mapping.Residuals()
+			errSqr := residuals[0]*residuals[0] + residuals[1]*residuals[1]
+			photoSumSqr, photoMax = photoSumSqr+errSqr, max(photoMax, math.Sqrt(errSqr))
+		}
+		calibrationPhoto.RMSError = PixelDistance(math.Sqrt(photoSumSqr / float64(len(photo.Mappings))))
+		calibrationPhoto.MaxError = PixelDistance(photoMax)
+		sumSqr += photoSumSqr
+		result.Corners += len(photo.Mappings)
+	}
+	result.RMSError = PixelDistance(math.Sqrt(sumSqr / float64(result.Corners)))
+
+	// Take over the calibrated intrinsics, and lock them for the survey.
+	c.HorizontalAOV, c.PrincipalPointOffset = camera.HorizontalAOV, camera.PrincipalPointOffset
+	c.DistortionKs, c.DistortionPs, c.DistortionBs = camera.DistortionKs, camera.DistortionPs, camera.DistortionBs
+	c.HorizontalAOVLocked, c.PrincipalPointOffsetLocked = true, true
+	c.DistortionKsLocked = [CameraDistortionKs]bool{true, true, true, true}
+	c.DistortionPsLocked = [CameraDistortionPs]bool{true, true, true, true}
+	c.DistortionBsLocked = [CameraDistortionBs]bool{true, true}
+	c.CalibrationResult = result
+
+	return result, nil
+}
+
+func (c *Camera) handleCalibrate(event vugu.DOMEvent) {
+	result, err := c.Calibrate()
+	if err != nil {
+		log.Printf("Calibration of camera %s failed: %v", c.DisplayName(), err)
+		return
+	}
+
+	log.Printf("Camera %s: %s", c.DisplayName(), result.Description())
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// TestCameraCalibrate calibrates a camera from synthetic checkerboard detections, and checks that the known intrinsics are recovered.
+func TestCameraCalibrate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	board := CalibrationBoard{Columns: 9, Rows: 6, SquareSize: 0.025}
+	center := [2]float64{float64(board.Columns-1) * board.SquareSize.Meters() / 2, float64(board.Rows-1) * board.SquareSize.Meters() / 2}
+	var boardCoordinates []Coordinate
+	for j := 0; j < board.Rows; j++ {
+		for i := 0; i < board.Columns; i++ {
+			boardCoordinates = append(boardCoordinates, Coordinate{Distance(i) * board.SquareSize, Distance(j) * board.SquareSize, 0})
+		}
+	}
+
+	// The camera that took the photos.
+	truthSite := NewSite("truth")
+	truth := truthSite.NewCamera("Truth")
+	truth.HorizontalAOV = Angle(62 * math.Pi / 180)
+	truth.PrincipalPointOffset = PixelCoordinate{12, -9}
+	truth.DistortionKs = [CameraDistortionKs]TweakableFloat{-0.12, 0.05, 0, 0}
+	truth.DistortionPs = [CameraDistortionPs]TweakableFloat{0.001, -0.0015, 0, 0}
+
+	// The camera to calibrate starts without any distortion.
+	site := NewSite("calibration")
+	camera := site.NewCamera("Camera")
+	camera.HorizontalAOV = Angle(55 * math.Pi / 180)
+	camera.CalibrationBoard = board
+
+	views := []struct {
+		orientation int
+		rotation    Rotation
+		distance    float64
+		offset      [2]float64 // Direction of the board center in normalized camera coordinates.
+	}{
+		{1, Rotation{0.05, -0.02, 0.1}, 0.3, [2]float64{0, 0}},
+		{1, Rotation{0.45, 0.1, -0.2}, 0.32, [2]float64{0.1, 0.05}},
+		{1, Rotation{-0.1, 0.5, 0.3}, 0.33, [2]float64{-0.15, 0}},
+		{1, Rotation{-0.4, -0.35, 1.2}, 0.34, [2]float64{0, 0.1}},
+		{6, Rotation{0.2, -0.4, 1.6}, 0.36, [2]float64{0.05, -0.05}},
+	}
+	for i, view := range views {
+		photo := newTestPhoto(truth, PixelCoordinate{1600, 1200}, view.orientation)
+		photo.Orientation.Rotation = view.rotation
+
+		// The camera looks along its z axis, place it so that the board is in front of it.
+		direction := photo.projection().rotation.Transpose().Mul3x1([3]float64{view.offset[0], view.offset[1], 1})
+		photo.Position.Coordinate = Coordinate{Distance(center[0] - direction[0]*view.distance), Distance(center[1] - direction[1]*view.distance), Distance(-direction[2] * view.distance)}
+
+		corners, _ := photo.Project(boardCoordinates)
+		for k, corner := range corners {
+			if corner.X() < 0 || corner.Y() < 0 || corner.X() > photo.imageSize.X() || corner.Y() > photo.imageSize.Y() {
+				t.Fatalf("Corner %d of view %d is outside of the image at %v", k, i, corner)
+			}
+			corners[k] = PixelCoordinate{corner.X() + PixelDistance(rng.NormFloat64()*0.05), corner.Y() + PixelDistance(rng.NormFloat64()*0.05)}
+		}
+		calibrationPhoto := camera.newCalibrationPhoto(photo.imageSize, view.orientation, corners)
+		calibrationPhoto.CreatedAt = calibrationPhoto.CreatedAt.Add(time.Duration(i))
+	}
+
+	result, err := camera.Calibrate()
+	if err != nil {
+		t.Fatalf("Calibrate() failed: %v", err)
+	}
+
+	if result.Photos != len(views) || result.Corners != len(views)*len(boardCoordinates) {
+		t.Errorf("The calibration used %d photos with %d corners, want %d and %d", result.Photos, result.Corners, len(views), len(views)*len(boardCoordinates))
+	}
+	if result.RMSError > 0.1 {
+		t.Errorf("The RMS reprojection error is %v px, want about the noise of 0.05 px", result.RMSError)
+	}
+	if got, want := camera.HorizontalAOV.Degree(), truth.HorizontalAOV.Degree(); math.Abs(got-want) > 0.05 {
+		t.Errorf("The horizontal angle of view is %v°, want %v°", got, want)
+	}
+	if got, want := camera.DistortionKs[0], truth.DistortionKs[0]; math.Abs(float64(got-want)) > 0.005 {
+		t.Errorf("K1 is %v, want %v", got, want)
+	}
+	if got, want := camera.PrincipalPointOffset, truth.PrincipalPointOffset; math.Hypot(float64(got.X()-want.X()), float64(got.Y()-want.Y())) > 1 {
+		t.Errorf("The principal point offset is %v, want %v", got, want)
+	}
+	if !camera.HorizontalAOVLocked || !camera.PrincipalPointOffsetLocked || !camera.DistortionKsLocked[0] {
+		t.Errorf("The calibrated intrinsics aren't locked")
+	}
+}
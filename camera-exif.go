@@ -0,0 +1,124 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// cameraExifFocalLengthTolerance is the relative difference of focal lengths that is still considered to be the same lens setting.
+const cameraExifFocalLengthTolerance = 0.01
+
+// aovFromFocalLength returns the horizontal angle of view of the camera model for the given focal length and image width in pixels.
+func (c *Camera) aovFromFocalLength(focalLength, width float64) (Angle, bool) {
+	if focalLength <= 0 || width <= 0 {
+		return 0, false
+	}
+
+	switch c.Model {
+	case CameraModelFisheye:
+		return Angle(width / focalLength), true
+	case CameraModelEquirectangular:
+		return 0, false
+	default:
+		return Angle(2 * math.Atan(width/2/focalLength)), true
+	}
+}
+
+// ExifAOV returns the horizontal angle of view that is proposed by the EXIF metadata of the oldest photo that contains a focal length.
+// The result is false if no photo contains enough metadata, or if the camera model doesn't use an angle of view.
+func (c *Camera) ExifAOV() (Angle, *CameraPhoto, bool) {
+	photos := c.PhotosSorted()
+	for i := len(photos) - 1; i >= 0; i-- {
+		photo := photos[i]
+		// The angle of view refers to the long side of the sensor.
+		sensorSize, _ := photo.sensorFrame()
+		focalLength, ok := photo.exif.FocalLengthPixels(sensorSize)
+		if !ok {
+			continue
+		}
+		aov, ok := c.aovFromFocalLength(focalLength, sensorSize.X().Pixels())
+		return aov, photo, ok
+	}
+
+	return 0, nil, false
+}
+
+// ApplyExifAOV sets the horizontal angle of view to the one proposed by the EXIF metadata.
+func (c *Camera) ApplyExifAOV() {
+	if aov, _, ok := c.ExifAOV(); ok {
+		c.HorizontalAOV = aov
+	}
+}
+
+// ExifAOVDescription returns a human readable proposal of the horizontal angle of view from the EXIF metadata, or an empty string.
+func (c *Camera) ExifAOVDescription() string {
+	aov, photo, ok := c.ExifAOV()
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("The EXIF metadata of photo %s (%s) proposes a horizontal angle of view of %.2f°.", photo.DisplayName(), photo.exif.Description(), aov.Degree())
+}
+
+// referencePhoto returns the oldest photo of the camera, which the other photos are compared against.
+func (c *Camera) referencePhoto() *CameraPhoto {
+	photos := c.PhotosSorted()
+	if len(photos) == 0 {
+		return nil
+	}
+	return photos[len(photos)-1]
+}
+
+// photoWarning returns a warning if the photo doesn't seem to be taken with the same camera settings as the reference photo, or an empty string.
+func (c *Camera) photoWarning(photo, reference *CameraPhoto) string {
+	if photo == reference {
+		return ""
+	}
+	name, referenceName := photo.exif.CameraName(), reference.exif.CameraName()
+	focalLength, referenceFocalLength := photo.exif.FocalLength, reference.exif.FocalLength
+
+	// Portrait and landscape photos can be mixed, so compare the sizes in the sensor frame.
+	size, _ := photo.sensorFrame()
+	referenceSize, _ := reference.sensorFrame()
+
+	switch {
+	case size != referenceSize:
+		return fmt.Sprintf("Photo %s has a different image size (%.0fx%.0f) than photo %s (%.0fx%.0f).", photo.DisplayName(), size.X().Pixels(), size.Y().Pixels(), reference.DisplayName(), referenceSize.X().Pixels(), referenceSize.Y().Pixels())
+	case name != "" && referenceName != "" && name != referenceName:
+		return fmt.Sprintf("Photo %s was taken with the %s, photo %s with the %s.", photo.DisplayName(), name, reference.DisplayName(), referenceName)
+	case focalLength > 0 && referenceFocalLength > 0 && math.Abs(focalLength-referenceFocalLength) > cameraExifFocalLengthTolerance*referenceFocalLength:
+		return fmt.Sprintf("Photo %s has a different focal length (%.4g mm) than photo %s (%.4g mm).", photo.DisplayName(), focalLength, reference.DisplayName(), referenceFocalLength)
+	}
+
+	return ""
+}
+
+// PhotoWarnings returns a warning for every photo that doesn't seem to be taken with the same camera settings as the oldest photo of this camera.
+// All photos of a camera share the same intrinsic parameters, so different lenses, zoom levels or image sizes need their own camera.
+func (c *Camera) PhotoWarnings() []string {
+	reference := c.referencePhoto()
+
+	var warnings []string
+	for _, photo := range c.PhotosSorted() {
+		if warning := c.photoWarning(photo, reference); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	return warnings
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"math"
 
 	"github.com/vugu/vugu"
@@ -36,10 +37,14 @@ type CameraPhotoComponent struct {
 	canWidth, canHeight       PixelDistance // Width and height in canvas pixels.
 	canWidthDOM, canHeightDOM PixelDistance // Width and height of the canvas in dom pixels.
 
-	cachedImg js.Value // Cached js image object.
+	cachedImg       js.Value        // Cached js image object.
+	cachedLuminance *photoLuminance // Cached luminance of the photo for the corner refinement.
 
 	showLines, showRangefinders, showTripods bool
 
+	snapOnDrop     bool                // Snap mappings to the nearest corner when they are placed or dropped.
+	draggedMapping *CameraPhotoMapping // Mapping that was moved by the current drag.
+
 	ongoingMouseDrags map[int]CameraPhotoComponentEventCoordinate
 	ongoingTouches    map[int]CameraPhotoComponentEventCoordinate
 
@@ -147,10 +152,12 @@ func (c *CameraPhotoComponent) handlePointerMove(event vugu.DOMEvent) {
 		if ongoingMouseDrag, ok := c.ongoingMouseDrags[pointerID]; ok {
 			if c.selectedMapping != nil {
 				// Drag selected point.
-				c.selectedMapping.Position = c.selectedMapping.Position.Add(PixelCoordinate{
+				c.selectedMapping.Position = c.Photo.WrapImageCoordinate(c.selectedMapping.Position.Add(PixelCoordinate{
 					(xCan - ongoingMouseDrag.xCan) / PixelDistance(c.scale),
 					(yCan - ongoingMouseDrag.yCan) / PixelDistance(c.scale),
-				})
+				}))
+				c.selectedMapping.Snap = nil
+				c.draggedMapping = c.selectedMapping
 			} else {
 				// Drag viewport.
 				c.originX += xCan - ongoingMouseDrag.xCan
@@ -175,10 +182,12 @@ func (c *CameraPhotoComponent) handlePointerMove(event vugu.DOMEvent) {
 			if ongoingTouch, ok := c.ongoingTouches[pointerID]; ok {
 				if c.selectedMapping != nil {
 					// Drag selected point.
-					c.selectedMapping.Position = c.selectedMapping.Position.Add(PixelCoordinate{
+					c.selectedMapping.Position = c.Photo.WrapImageCoordinate(c.selectedMapping.Position.Add(PixelCoordinate{
 						(xCan - ongoingTouch.xCan) / PixelDistance(c.scale),
 						(yCan - ongoingTouch.yCan) / PixelDistance(c.scale),
-					})
+					}))
+					c.selectedMapping.Snap = nil
+					c.draggedMapping = c.selectedMapping
 				} else {
 					// Drag viewport.
 					c.originX += xCan - ongoingTouch.xCan
@@ -240,6 +249,7 @@ func (c *CameraPhotoComponent) handlePointerUp(event vugu.DOMEvent) {
 			c.selectedMapping = mapping
 		}
 		delete(c.ongoingMouseDrags, pointerID)
+		c.snapDraggedMapping()
 
 	case "touch":
 		jsCanvas.Call("releasePointerCapture", pointerID)
@@ -251,6 +261,7 @@ func (c *CameraPhotoComponent) handlePointerUp(event vugu.DOMEvent) {
 		}
 
 		delete(c.ongoingTouches, pointerID)
+		c.snapDraggedMapping()
 
 	default:
 		fmt.Printf("Input type %q not supported\n", inputType)
@@ -271,8 +282,62 @@ func (c *CameraPhotoComponent) handleDblClick(event vugu.DOMEvent) {
 	} else {
 		// Create new mapping mapping at event position.
 		mapping := c.Photo.NewMapping()
-		mapping.Position = PixelCoordinate{xVir, yVir}
+		mapping.Position = c.Photo.WrapImageCoordinate(PixelCoordinate{xVir, yVir})
+		if c.snapOnDrop {
+			c.snapMapping(mapping)
+		}
+	}
+}
+
+// luminance returns the decoded luminance of the photo, which is cached as long as the component exists.
+func (c *CameraPhotoComponent) luminance() (*photoLuminance, error) {
+	if c.cachedLuminance == nil {
+		pl, err := c.Photo.decodeLuminance()
+		if err != nil {
+			return nil, err
+		}
+		c.cachedLuminance = pl
+	}
+
+	return c.cachedLuminance, nil
+}
+
+// snapMapping moves the given mapping onto the nearest corner in the photo.
+func (c *CameraPhotoComponent) snapMapping(mapping *CameraPhotoMapping) {
+	pl, err := c.luminance()
+	if err != nil {
+		log.Printf("Couldn't decode photo %s: %v", c.Photo.DisplayName(), err)
+		return
+	}
+
+	if err := mapping.SnapToCorner(pl); err != nil {
+		log.Printf("Couldn't snap mapping %s to a corner: %v", mapping.Key(), err)
+	}
+}
+
+// snapDraggedMapping snaps the mapping of the finished drag, if enabled.
+func (c *CameraPhotoComponent) snapDraggedMapping() {
+	if c.snapOnDrop && c.draggedMapping != nil {
+		c.snapMapping(c.draggedMapping)
 	}
+	c.draggedMapping = nil
+}
+
+func (c *CameraPhotoComponent) handleSnap(event vugu.DOMEvent) {
+	if c.selectedMapping != nil {
+		c.snapMapping(c.selectedMapping)
+	}
+}
+
+func (c *CameraPhotoComponent) handleSnapAll(event vugu.DOMEvent) {
+	pl, err := c.luminance()
+	if err != nil {
+		log.Printf("Couldn't decode photo %s: %v", c.Photo.DisplayName(), err)
+		return
+	}
+
+	snapped := c.Photo.SnapAllToCorners(pl)
+	log.Printf("Snapped %d of the mappings of photo %s to corners", snapped, c.Photo.DisplayName())
 }
 
 func (c *CameraPhotoComponent) handleClick(event vugu.DOMEvent) {
@@ -334,21 +399,49 @@ func (c *CameraPhotoComponent) transformScaled(drawCtx js.Value) {
 	drawCtx.Call("setTransform", c.scale, 0, 0, c.scale, c.originX.Pixels(), c.originY.Pixels())
 }
 
+// imageOffsets returns the horizontal offsets in virtual coordinates at which the photo is drawn.
+// 360° panoramas are repeated left and right of the image, so that points can be mapped across the seam.
+func (c *CameraPhotoComponent) imageOffsets() []PixelDistance {
+	if !c.Photo.camera.Panoramic() {
+		return []PixelDistance{0}
+	}
+
+	width := c.Photo.imageSize.X()
+	return []PixelDistance{-width, 0, width}
+}
+
 // getClosestMapping returns the closest mapped point to the given canvas coordinates.
 func (c *CameraPhotoComponent) getClosestMapping(xCan, yCan PixelDistance, maxDistSqr float64) (minMapping *CameraPhotoMapping, minKey string, minDistSqr float64) {
 	minDistSqr = maxDistSqr
 
 	for key, mapping := range c.Photo.Mappings {
-		pXCan, pYCan := c.transformVirtualToCanvas(mapping.Position.X(), mapping.Position.Y())
-		distSqr := (pXCan - xCan).Sqr() + (pYCan - yCan).Sqr()
-		if minDistSqr > distSqr {
-			minDistSqr, minKey, minMapping = distSqr, key, mapping
+		for _, offset := range c.imageOffsets() {
+			pXCan, pYCan := c.transformVirtualToCanvas(mapping.Position.X()+offset, mapping.Position.Y())
+			distSqr := (pXCan - xCan).Sqr() + (pYCan - yCan).Sqr()
+			if minDistSqr > distSqr {
+				minDistSqr, minKey, minMapping = distSqr, key, mapping
+			}
 		}
 	}
 
 	return
 }
 
+// drawLine draws a line between the given virtual coordinates.
+// For 360° panoramas the second coordinate is taken from the same side of the seam as the first one, and the line is repeated for every image offset.
+func (c *CameraPhotoComponent) drawLine(drawCtx js.Value, p1, p2 PixelCoordinate) {
+	p2 = c.Photo.NearestImageCoordinate(p2, p1)
+
+	for _, offset := range c.imageOffsets() {
+		c.transformUnscaled(drawCtx, p1.X()+offset, p1.Y())
+		drawCtx.Call("beginPath")
+		drawCtx.Call("moveTo", 0, 0)
+		c.transformUnscaled(drawCtx, p2.X()+offset, p2.Y())
+		drawCtx.Call("lineTo", 0, 0)
+		drawCtx.Call("stroke")
+	}
+}
+
 func (c *CameraPhotoComponent) canvasRedraw(canvas js.Value) {
 
 	site := c.Photo.camera.site
@@ -369,7 +462,9 @@ func (c *CameraPhotoComponent) canvasRedraw(canvas js.Value) {
 	drawCtx.Call("clearRect", 0, 0, c.canWidth.Pixels(), c.canHeight.Pixels())
 	c.transformScaled(drawCtx)
 
-	drawCtx.Call("drawImage", c.cachedImg, 0, 0)
+	for _, offset := range c.imageOffsets() {
+		drawCtx.Call("drawImage", c.cachedImg, offset.Pixels(), 0)
+	}
 
 	if c.showLines {
 		drawCtx.Set("lineWidth", 1)
@@ -377,6 +472,20 @@ func (c *CameraPhotoComponent) canvasRedraw(canvas js.Value) {
 		drawCtx.Set("strokeStyle", "blue")
 		drawCtx.Call("setLineDash", []interface{}{})
 		drawCtx.Set("shadowBlur", 0)
+
+		// Lines and point pairs with an angle constraint are highlighted.
+		constrainedLines := map[string]struct{}{}
+		constrainedPairs := [][2]string{}
+		for _, angleConstraint := range site.AngleConstraints {
+			for _, leg := range []AngleConstraintLeg{angleConstraint.A, angleConstraint.B} {
+				if leg.LineKey != "" {
+					constrainedLines[leg.LineKey] = struct{}{}
+				} else {
+					constrainedPairs = append(constrainedPairs, [2]string{leg.P1, leg.P2})
+				}
+			}
+		}
+
 		for _, line := range site.Lines {
 			p1, p2 := line.P1, line.P2
 
@@ -398,12 +507,41 @@ func (c *CameraPhotoComponent) canvasRedraw(canvas js.Value) {
 			}
 
 			if foundM1 != nil && foundM2 != nil {
-				c.transformUnscaled(drawCtx, foundM1.Position.X(), foundM1.Position.Y())
-				drawCtx.Call("beginPath")
-				drawCtx.Call("moveTo", 0, 0)
-				c.transformUnscaled(drawCtx, foundM2.Position.X(), foundM2.Position.Y())
-				drawCtx.Call("lineTo", 0, 0)
-				drawCtx.Call("stroke")
+				if _, ok := constrainedLines[line.Key()]; ok {
+					drawCtx.Set("lineWidth", 2)
+					drawCtx.Set("strokeStyle", "magenta")
+				} else {
+					drawCtx.Set("lineWidth", 1)
+					drawCtx.Set("strokeStyle", "blue")
+				}
+				c.drawLine(drawCtx, foundM1.Position, foundM2.Position)
+			}
+		}
+
+		drawCtx.Set("lineWidth", 2)
+		drawCtx.Set("strokeStyle", "magenta")
+		for _, pair := range constrainedPairs {
+			p1, p2 := pair[0], pair[1]
+
+			var foundM1, foundM2 *CameraPhotoMapping
+			for _, mapping := range c.Photo.Mappings {
+				if mapping.PointKey == "" {
+					continue
+				}
+				if mapping.PointKey == p1 {
+					foundM1 = mapping
+				}
+				if mapping.PointKey == p2 {
+					foundM2 = mapping
+				}
+
+				if foundM1 != nil && foundM2 != nil {
+					break
+				}
+			}
+
+			if foundM1 != nil && foundM2 != nil {
+				c.drawLine(drawCtx, foundM1.Position, foundM2.Position)
 			}
 		}
 	}
@@ -436,12 +574,7 @@ func (c *CameraPhotoComponent) canvasRedraw(canvas js.Value) {
 				}
 
 				if foundM1 != nil && foundM2 != nil {
-					c.transformUnscaled(drawCtx, foundM1.Position.X(), foundM1.Position.Y())
-					drawCtx.Call("beginPath")
-					drawCtx.Call("moveTo", 0, 0)
-					c.transformUnscaled(drawCtx, foundM2.Position.X(), foundM2.Position.Y())
-					drawCtx.Call("lineTo", 0, 0)
-					drawCtx.Call("stroke")
+					c.drawLine(drawCtx, foundM1.Position, foundM2.Position)
 				}
 
 			}
@@ -473,12 +606,7 @@ func (c *CameraPhotoComponent) canvasRedraw(canvas js.Value) {
 				}
 
 				if foundMapping != nil {
-					c.transformUnscaled(drawCtx, foundMapping.Position.X(), foundMapping.Position.Y())
-					drawCtx.Call("beginPath")
-					drawCtx.Call("moveTo", 0, 0)
-					c.transformUnscaled(drawCtx, tripodProjected.X(), tripodProjected.Y())
-					drawCtx.Call("lineTo", 0, 0)
-					drawCtx.Call("stroke")
+					c.drawLine(drawCtx, foundMapping.Position, tripodProjected)
 				}
 
 			}
@@ -493,6 +621,7 @@ func (c *CameraPhotoComponent) canvasRedraw(canvas js.Value) {
 	drawCtx.Set("shadowColor", "white")
 	for _, mapping := range c.Photo.Mappings {
 		point, pointOk := site.Points[mapping.PointKey]
+		projectedPos := c.Photo.NearestImageCoordinate(mapping.projectedPos, mapping.Position)
 
 		if mapping == c.selectedMapping {
 			drawCtx.Set("strokeStyle", "white")
@@ -502,43 +631,45 @@ func (c *CameraPhotoComponent) canvasRedraw(canvas js.Value) {
 			drawCtx.Set("strokeStyle", "black")
 		}
 
-		c.transformUnscaled(drawCtx, mapping.Position.X(), mapping.Position.Y())
-		if mapping.Suggested {
-			drawCtx.Set("fillStyle", "rgba(255, 255, 255, 0.25)")
-		} else {
-			drawCtx.Set("fillStyle", "green")
-		}
-		drawCtx.Call("beginPath")
-		drawCtx.Call("moveTo", 0, 0)
-		drawCtx.Call("lineTo", 0, 0)
-		drawCtx.Call("lineTo", 0, -20)
-		drawCtx.Call("closePath")
-		drawCtx.Set("shadowBlur", 0)
-		drawCtx.Call("stroke")
-
-		drawCtx.Call("rect", 0, -20, 15, 10)
-		drawCtx.Call("fill")
-		drawCtx.Call("stroke")
-
-		drawCtx.Call("beginPath")
-		drawCtx.Call("arc", 0, 0, 5, 0, 2*math.Pi, false)
-		drawCtx.Set("shadowBlur", 5)
-		drawCtx.Call("stroke")
-
-		drawCtx.Set("fillStyle", "black")
-		drawCtx.Set("font", "10px Arial")
-		if pointOk {
-			drawCtx.Call("fillText", point.Name, 8, 0)
-		} else {
-			drawCtx.Call("fillText", "Not mapped!", 8, 0)
-		}
-
-		if !mapping.Suggested {
+		for _, offset := range c.imageOffsets() {
+			c.transformUnscaled(drawCtx, mapping.Position.X()+offset, mapping.Position.Y())
+			if mapping.Suggested {
+				drawCtx.Set("fillStyle", "rgba(255, 255, 255, 0.25)")
+			} else {
+				drawCtx.Set("fillStyle", "green")
+			}
 			drawCtx.Call("beginPath")
 			drawCtx.Call("moveTo", 0, 0)
-			c.transformUnscaled(drawCtx, mapping.projectedPos.X(), mapping.projectedPos.Y())
 			drawCtx.Call("lineTo", 0, 0)
+			drawCtx.Call("lineTo", 0, -20)
+			drawCtx.Call("closePath")
+			drawCtx.Set("shadowBlur", 0)
+			drawCtx.Call("stroke")
+
+			drawCtx.Call("rect", 0, -20, 15, 10)
+			drawCtx.Call("fill")
 			drawCtx.Call("stroke")
+
+			drawCtx.Call("beginPath")
+			drawCtx.Call("arc", 0, 0, 5, 0, 2*math.Pi, false)
+			drawCtx.Set("shadowBlur", 5)
+			drawCtx.Call("stroke")
+
+			drawCtx.Set("fillStyle", "black")
+			drawCtx.Set("font", "10px Arial")
+			if pointOk {
+				drawCtx.Call("fillText", point.Name, 8, 0)
+			} else {
+				drawCtx.Call("fillText", "Not mapped!", 8, 0)
+			}
+
+			if !mapping.Suggested {
+				drawCtx.Call("beginPath")
+				drawCtx.Call("moveTo", 0, 0)
+				c.transformUnscaled(drawCtx, projectedPos.X()+offset, projectedPos.Y())
+				drawCtx.Call("lineTo", 0, 0)
+				drawCtx.Call("stroke")
+			}
 		}
 	}
 
@@ -0,0 +1,289 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// exifFullFrameDiagonal is the diagonal of a 36x24 mm full frame sensor in millimeters, which 35 mm equivalent focal lengths refer to.
+var exifFullFrameDiagonal = math.Hypot(36, 24)
+
+// EXIF and TIFF tags that are used.
+const (
+	exifTagMake                     = 0x010F
+	exifTagModel                    = 0x0110
+	exifTagOrientation              = 0x0112
+	exifTagExifIFD                  = 0x8769
+	exifTagFocalLength              = 0x920A
+	exifTagFocalPlaneXResolution    = 0xA20E
+	exifTagFocalPlaneResolutionUnit = 0xA210
+	exifTagFocalLengthIn35mmFilm    = 0xA405
+)
+
+// PhotoExif contains the EXIF metadata of a photo that is relevant for the camera intrinsics.
+// Values that are not available are zero.
+type PhotoExif struct {
+	Make, Model     string
+	Orientation     int     // EXIF orientation from 1 to 8, see https://www.cipa.jp/std/documents/e/DC-008-2012_E.pdf.
+	FocalLength     float64 // Physical focal length in millimeters.
+	FocalLength35mm float64 // 35 mm equivalent focal length in millimeters.
+
+	focalPlaneResolution float64 // Sensor pixels per millimeter.
+}
+
+// CameraName returns the make and model of the camera that took the photo, or an empty string.
+func (e PhotoExif) CameraName() string {
+	if strings.HasPrefix(e.Model, e.Make) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// FocalLengthPixels returns the focal length in pixels for an image with the given size.
+// The 35 mm equivalent focal length is preferred, as it doesn't depend on the resolution the image was saved with.
+// The result is false if the metadata doesn't contain enough information.
+func (e PhotoExif) FocalLengthPixels(imageSize PixelCoordinate) (float64, bool) {
+	width, height := imageSize.X().Pixels(), imageSize.Y().Pixels()
+	if width <= 0 || height <= 0 {
+		return 0, false
+	}
+
+	switch {
+	case e.FocalLength35mm > 0:
+		// The 35 mm equivalent focal length has the same angle of view on the diagonal of a full frame sensor.
+		return e.FocalLength35mm * math.Hypot(width, height) / exifFullFrameDiagonal, true
+	case e.FocalLength > 0 && e.focalPlaneResolution > 0:
+		return e.FocalLength * e.focalPlaneResolution, true
+	}
+
+	return 0, false
+}
+
+// Description returns the metadata as human readable text.
+func (e PhotoExif) Description() string {
+	var parts []string
+	if name := e.CameraName(); name != "" {
+		parts = append(parts, name)
+	}
+	if e.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("f = %.4g mm", e.FocalLength))
+	}
+	if e.FocalLength35mm > 0 {
+		parts = append(parts, fmt.Sprintf("%.4g mm equivalent", e.FocalLength35mm))
+	}
+	if e.Orientation > 1 {
+		parts = append(parts, fmt.Sprintf("orientation %d", e.Orientation))
+	}
+
+	if len(parts) == 0 {
+		return "No EXIF metadata"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseExif returns the EXIF metadata of the given JPEG image.
+// Images without EXIF metadata result in an empty PhotoExif without error.
+func parseExif(imageData []byte) (PhotoExif, error) {
+	var e PhotoExif
+
+	tiff, err := exifFindTIFF(imageData)
+	if err != nil || tiff == nil {
+		return e, err
+	}
+
+	if len(tiff) < 8 {
+		return e, errors.New("EXIF segment is too short")
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(tiff, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(tiff, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return e, errors.New("invalid TIFF header in EXIF segment")
+	}
+
+	var resolution float64
+	var resolutionUnit int
+	handleEntry := func(tag uint16, value exifValue) {
+		switch tag {
+		case exifTagMake:
+			e.Make = value.string()
+		case exifTagModel:
+			e.Model = value.string()
+		case exifTagOrientation:
+			if orientation := int(value.float()); orientation >= 1 && orientation <= 8 {
+				e.Orientation = orientation
+			}
+		case exifTagFocalLength:
+			e.FocalLength = value.float()
+		case exifTagFocalPlaneXResolution:
+			resolution = value.float()
+		case exifTagFocalPlaneResolutionUnit:
+			resolutionUnit = int(value.float())
+		case exifTagFocalLengthIn35mmFilm:
+			e.FocalLength35mm = value.float()
+		}
+	}
+
+	exifIFD, err := exifReadIFD(tiff, order, order.Uint32(tiff[4:]), handleEntry)
+	if err != nil {
+		return e, fmt.Errorf("failed to read IFD0: %w", err)
+	}
+	if exifIFD > 0 {
+		if _, err := exifReadIFD(tiff, order, exifIFD, handleEntry); err != nil {
+			return e, fmt.Errorf("failed to read EXIF IFD: %w", err)
+		}
+	}
+
+	// The focal plane resolution unit is 2 for inches (default) and 3 for centimeters.
+	switch resolutionUnit {
+	case 2, 0:
+		e.focalPlaneResolution = resolution / 25.4
+	case 3:
+		e.focalPlaneResolution = resolution / 10
+	}
+
+	return e, nil
+}
+
+// exifFindTIFF returns the TIFF structure of the EXIF segment of a JPEG image, or nil if there is none.
+func exifFindTIFF(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return nil, nil
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("invalid JPEG marker at offset %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Padding.
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of the image data or end of the image, there are no more metadata segments.
+			return nil, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, fmt.Errorf("invalid JPEG segment length at offset %d", pos)
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+
+		pos += 2 + length
+	}
+
+	return nil, nil
+}
+
+// exifValue is the raw value of an IFD entry.
+type exifValue struct {
+	order     binary.ByteOrder
+	valueType uint16
+	data      []byte
+}
+
+// string returns the value of an ASCII entry.
+func (v exifValue) string() string {
+	if v.valueType != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(v.data), "\x00"))
+}
+
+// float returns the first value of a numeric entry.
+func (v exifValue) float() float64 {
+	switch {
+	case v.valueType == 3 && len(v.data) >= 2: // SHORT
+		return float64(v.order.Uint16(v.data))
+	case v.valueType == 4 && len(v.data) >= 4: // LONG
+		return float64(v.order.Uint32(v.data))
+	case v.valueType == 5 && len(v.data) >= 8: // RATIONAL
+		numerator, denominator := v.order.Uint32(v.data), v.order.Uint32(v.data[4:])
+		if denominator == 0 {
+			return 0
+		}
+		return float64(numerator) / float64(denominator)
+	case v.valueType == 10 && len(v.data) >= 8: // SRATIONAL
+		numerator, denominator := int32(v.order.Uint32(v.data)), int32(v.order.Uint32(v.data[4:]))
+		if denominator == 0 {
+			return 0
+		}
+		return float64(numerator) / float64(denominator)
+	}
+	return 0
+}
+
+// exifTypeSizes contains the size of a single value of every IFD entry type.
+var exifTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// exifReadIFD calls entryFunc for every entry of the IFD at the given offset.
+// It returns the offset of the EXIF sub IFD, if the IFD references one.
+func exifReadIFD(tiff []byte, order binary.ByteOrder, offset uint32, entryFunc func(tag uint16, value exifValue)) (exifIFD uint32, err error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return 0, fmt.Errorf("IFD offset %d out of range", offset)
+	}
+	count := uint32(order.Uint16(tiff[offset:]))
+	if uint64(offset)+2+uint64(count)*12 > uint64(len(tiff)) {
+		return 0, fmt.Errorf("IFD at offset %d exceeds the EXIF segment", offset)
+	}
+
+	for i := uint32(0); i < count; i++ {
+		entry := tiff[offset+2+i*12:]
+		tag, valueType, valueCount := order.Uint16(entry), order.Uint16(entry[2:]), order.Uint32(entry[4:])
+
+		size, ok := exifTypeSizes[valueType]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(valueCount)
+
+		// Values with up to 4 bytes are stored in the entry itself, otherwise the entry contains their offset.
+		var data []byte
+		if length <= 4 {
+			data = entry[8 : 8+length]
+		} else {
+			valueOffset := uint64(order.Uint32(entry[8:]))
+			if valueOffset+length > uint64(len(tiff)) {
+				continue
+			}
+			data = tiff[valueOffset : valueOffset+length]
+		}
+
+		// The pointer to the EXIF IFD has to be a single LONG value, anything else is broken and ignored.
+		if tag == exifTagExifIFD && valueType == 4 && len(data) >= 4 {
+			exifIFD = order.Uint32(data)
+		}
+		entryFunc(tag, exifValue{order: order, valueType: valueType, data: data})
+	}
+
+	return exifIFD, nil
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// exifTestEntry is an IFD entry of a test file.
+// If data is nil, raw is written as the value or offset field of the entry.
+type exifTestEntry struct {
+	tag, valueType uint16
+	count          uint32
+	data           []byte
+	raw            uint32
+}
+
+// exifTestTIFF returns a TIFF structure with the given entries in IFD0 and the EXIF IFD.
+// A pointer to the EXIF IFD is added to IFD0 if there are any EXIF entries.
+func exifTestTIFF(order binary.ByteOrder, ifd0, exif []exifTestEntry) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(&buf, order, uint32(8))
+
+	ifd0Size := 2 + 12*(len(ifd0)+1) + 4
+	writeIFD := func(entries []exifTestEntry, offset int) {
+		dataOffset := offset + 2 + 12*len(entries) + 4
+		var data bytes.Buffer
+		binary.Write(&buf, order, uint16(len(entries)))
+		for _, entry := range entries {
+			binary.Write(&buf, order, entry.tag)
+			binary.Write(&buf, order, entry.valueType)
+			binary.Write(&buf, order, entry.count)
+			switch {
+			case entry.data == nil:
+				binary.Write(&buf, order, entry.raw)
+			case len(entry.data) <= 4:
+				value := make([]byte, 4)
+				copy(value, entry.data)
+				buf.Write(value)
+			default:
+				binary.Write(&buf, order, uint32(dataOffset+data.Len()))
+				data.Write(entry.data)
+			}
+		}
+		binary.Write(&buf, order, uint32(0)) // Offset of the next IFD.
+		buf.Write(data.Bytes())
+	}
+
+	if len(exif) > 0 {
+		// The size of the data of IFD0 is needed to know where the EXIF IFD starts.
+		var dataSize int
+		for _, entry := range ifd0 {
+			if len(entry.data) > 4 {
+				dataSize += len(entry.data)
+			}
+		}
+		ifd0 = append(ifd0, exifTestEntry{tag: exifTagExifIFD, valueType: 4, count: 1, raw: uint32(8 + ifd0Size + dataSize)})
+		writeIFD(ifd0, 8)
+		writeIFD(exif, buf.Len())
+	} else {
+		writeIFD(ifd0, 8)
+	}
+
+	return buf.Bytes()
+}
+
+// exifTestJPEG returns a JPEG file without image data, but with the given TIFF structure as EXIF segment.
+func exifTestJPEG(tiff []byte) []byte {
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00}) // SOI and an empty APP0 segment.
+	buf.Write([]byte{0xFF, 0xE1})
+	binary.Write(&buf, binary.BigEndian, uint16(len(segment)+2))
+	buf.Write(segment)
+	buf.Write([]byte{0xFF, 0xD9})
+
+	return buf.Bytes()
+}
+
+func exifTestShort(order binary.ByteOrder, value uint16) []byte {
+	data := make([]byte, 2)
+	order.PutUint16(data, value)
+	return data
+}
+
+func exifTestRational(order binary.ByteOrder, numerator, denominator uint32) []byte {
+	data := make([]byte, 8)
+	order.PutUint32(data, numerator)
+	order.PutUint32(data[4:], denominator)
+	return data
+}
+
+// exifTestCompleteTIFF returns a TIFF structure that contains all supported tags.
+func exifTestCompleteTIFF(order binary.ByteOrder) []byte {
+	ifd0 := []exifTestEntry{
+		{tag: exifTagMake, valueType: 2, count: 5, data: []byte("ACME\x00")},
+		{tag: exifTagModel, valueType: 2, count: 13, data: []byte("ACME Phone 9\x00")},
+		{tag: exifTagOrientation, valueType: 3, count: 1, data: exifTestShort(order, 6)},
+	}
+	exif := []exifTestEntry{
+		{tag: exifTagFocalLength, valueType: 5, count: 1, data: exifTestRational(order, 425, 100)},
+		{tag: exifTagFocalPlaneXResolution, valueType: 5, count: 1, data: exifTestRational(order, 4000, 1)},
+		{tag: exifTagFocalPlaneResolutionUnit, valueType: 3, count: 1, data: exifTestShort(order, 3)},
+		{tag: exifTagFocalLengthIn35mmFilm, valueType: 3, count: 1, data: exifTestShort(order, 26)},
+	}
+
+	return exifTestTIFF(order, ifd0, exif)
+}
+
+func TestParseExif(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	complete := PhotoExif{Make: "ACME", Model: "ACME Phone 9", Orientation: 6, FocalLength: 4.25, FocalLength35mm: 26, focalPlaneResolution: 400}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    PhotoExif
+		wantErr bool
+	}{
+		{name: "Little endian", data: exifTestJPEG(exifTestCompleteTIFF(le)), want: complete},
+		{name: "Big endian", data: exifTestJPEG(exifTestCompleteTIFF(be)), want: complete},
+		{name: "Not a JPEG", data: []byte("\x89PNG\r\n\x1a\n"), want: PhotoExif{}},
+		{name: "JPEG without EXIF", data: []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}, want: PhotoExif{}},
+		{name: "Invalid JPEG segment length", data: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 0x00}, wantErr: true},
+		{name: "Invalid TIFF header", data: exifTestJPEG([]byte("XX*\x00\x08\x00\x00\x00")), wantErr: true},
+		{name: "Too short TIFF structure", data: exifTestJPEG([]byte("II*\x00")), wantErr: true},
+		{name: "IFD offset out of range", data: exifTestJPEG([]byte("II*\x00\xFF\x00\x00\x00")), wantErr: true},
+		{
+			name: "EXIF IFD pointer without value",
+			data: exifTestJPEG(exifTestTIFF(le, []exifTestEntry{{tag: exifTagExifIFD, valueType: 4, count: 0}}, nil)),
+			want: PhotoExif{},
+		},
+		{
+			name: "EXIF IFD pointer with wrong type",
+			data: exifTestJPEG(exifTestTIFF(le, []exifTestEntry{{tag: exifTagExifIFD, valueType: 3, count: 1, raw: 8}}, nil)),
+			want: PhotoExif{},
+		},
+		{
+			name:    "EXIF IFD pointer out of range",
+			data:    exifTestJPEG(exifTestTIFF(le, []exifTestEntry{{tag: exifTagExifIFD, valueType: 4, count: 1, raw: 0xFFFFFF}}, nil)),
+			wantErr: true,
+		},
+		{
+			name: "Value offset out of range",
+			data: exifTestJPEG(exifTestTIFF(le, []exifTestEntry{
+				{tag: exifTagModel, valueType: 2, count: 100, raw: 0xFFFF},
+				{tag: exifTagOrientation, valueType: 3, count: 1, data: exifTestShort(le, 3)},
+			}, nil)),
+			want: PhotoExif{Orientation: 3},
+		},
+		{
+			name: "Values without data",
+			data: exifTestJPEG(exifTestTIFF(le, []exifTestEntry{
+				{tag: exifTagOrientation, valueType: 3, count: 0},
+				{tag: exifTagFocalLength, valueType: 5, count: 0},
+			}, nil)),
+			want: PhotoExif{},
+		},
+		{
+			name: "Invalid orientation",
+			data: exifTestJPEG(exifTestTIFF(le, []exifTestEntry{{tag: exifTagOrientation, valueType: 3, count: 1, data: exifTestShort(le, 9)}}, nil)),
+			want: PhotoExif{},
+		},
+		{
+			name: "Unknown value type",
+			data: exifTestJPEG(exifTestTIFF(le, []exifTestEntry{{tag: exifTagOrientation, valueType: 99, count: 1, raw: 6}}, nil)),
+			want: PhotoExif{},
+		},
+		{
+			name: "Rational with zero denominator",
+			data: exifTestJPEG(exifTestTIFF(le, nil, []exifTestEntry{{tag: exifTagFocalLength, valueType: 5, count: 1, data: exifTestRational(le, 425, 0)}})),
+			want: PhotoExif{},
+		},
+		{
+			name: "Focal plane resolution in inches",
+			data: exifTestJPEG(exifTestTIFF(le, nil, []exifTestEntry{{tag: exifTagFocalPlaneXResolution, valueType: 5, count: 1, data: exifTestRational(le, 254, 1)}})),
+			want: PhotoExif{focalPlaneResolution: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExif(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExif() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseExif() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseExifCorrupted checks that truncated or corrupted metadata doesn't cause a panic.
+func TestParseExifCorrupted(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := exifTestJPEG(exifTestCompleteTIFF(order))
+		for i := range data {
+			parseExif(data[:i])
+		}
+		for i := 0; i < 10000; i++ {
+			corrupted := bytes.Clone(data)
+			for j := 0; j < 3; j++ {
+				corrupted[rng.Intn(len(corrupted))] = byte(rng.Intn(256))
+			}
+			parseExif(corrupted)
+		}
+	}
+}
+
+func TestPhotoExifFocalLengthPixels(t *testing.T) {
+	tests := []struct {
+		name      string
+		exif      PhotoExif
+		imageSize PixelCoordinate
+		want      float64
+		wantOK    bool
+	}{
+		{name: "35 mm equivalent", exif: PhotoExif{FocalLength: 4.25, FocalLength35mm: 26}, imageSize: PixelCoordinate{3600, 2400}, want: 2600, wantOK: true},
+		{name: "Focal plane resolution", exif: PhotoExif{FocalLength: 4.25, focalPlaneResolution: 400}, imageSize: PixelCoordinate{4000, 3000}, want: 1700, wantOK: true},
+		{name: "Focal length only", exif: PhotoExif{FocalLength: 4.25}, imageSize: PixelCoordinate{4000, 3000}},
+		{name: "Unknown image size", exif: PhotoExif{FocalLength35mm: 26}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.exif.FocalLengthPixels(tt.imageSize)
+			if ok != tt.wantOK || (ok && (got < tt.want-1e-9 || got > tt.want+1e-9)) {
+				t.Errorf("FocalLengthPixels() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
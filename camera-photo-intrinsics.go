@@ -0,0 +1,136 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+)
+
+// CameraPhotoIntrinsics overrides some intrinsic parameters of the camera for a single photo.
+// This is useful for photos that were taken with a slightly different zoom or focus setting.
+//
+// The overridden values are tied to the ones of the camera by a constraint with the given tolerances.
+// This way the photo can still profit from the calibration of the camera, and the camera from the measurements of the photo.
+type CameraPhotoIntrinsics struct {
+	photo *CameraPhoto
+
+	Enabled bool
+
+	HorizontalAOV          Angle
+	HorizontalAOVLocked    bool
+	HorizontalAOVTolerance Angle // Expected deviation from the camera's value.
+
+	PrincipalPointOffset          PixelCoordinate
+	PrincipalPointOffsetLocked    bool
+	PrincipalPointOffsetTolerance PixelDistance // Expected deviation from the camera's value.
+
+	K1          TweakableFloat
+	K1Locked    bool
+	K1Tolerance float64 // Expected deviation from the camera's value.
+}
+
+// initData initializes the object with default values and other stuff.
+func (i *CameraPhotoIntrinsics) initData(photo *CameraPhoto) {
+	i.photo = photo
+	i.HorizontalAOVTolerance = Angle(0.5 * math.Pi / 180)
+	i.PrincipalPointOffsetTolerance = 5
+	i.K1Tolerance = 0.01
+}
+
+// Active returns whether the photo uses its own intrinsic parameters.
+// Panoramas don't have a lens, so there is nothing to override.
+func (i *CameraPhotoIntrinsics) Active() bool {
+	return i.Enabled && !i.photo.camera.Panoramic()
+}
+
+// Enable starts to override the intrinsic parameters of the camera, beginning with the camera's current values.
+func (i *CameraPhotoIntrinsics) Enable() {
+	camera := i.photo.camera
+
+	i.Enabled = true
+	i.HorizontalAOV = camera.HorizontalAOV
+	i.PrincipalPointOffset = camera.PrincipalPointOffset
+	i.K1 = camera.DistortionKs[0]
+}
+
+// Disable returns to the intrinsic parameters of the camera.
+func (i *CameraPhotoIntrinsics) Disable() {
+	i.Enabled = false
+}
+
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (i *CameraPhotoIntrinsics) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	if !i.Active() {
+		return nil, nil
+	}
+
+	tweakables := []Tweakable{}
+	if !i.HorizontalAOVLocked {
+		tweakables = append(tweakables, &i.HorizontalAOV)
+	}
+	if !i.PrincipalPointOffsetLocked {
+		tweakables = append(tweakables, &i.PrincipalPointOffset[0], &i.PrincipalPointOffset[1])
+	}
+	if !i.K1Locked {
+		tweakables = append(tweakables, &i.K1)
+	}
+
+	return tweakables, []Residualer{i}
+}
+
+// constrainedValues returns the pairs of overridden and camera values, and the tolerance of every pair in optimizer space.
+func (i *CameraPhotoIntrinsics) constrainedValues() (values, cameraValues []Tweakable, tolerances []float64) {
+	camera := i.photo.camera
+
+	values = []Tweakable{&i.HorizontalAOV, &i.PrincipalPointOffset[0], &i.PrincipalPointOffset[1], &i.K1}
+	cameraValues = []Tweakable{&camera.HorizontalAOV, &camera.PrincipalPointOffset[0], &camera.PrincipalPointOffset[1], &camera.DistortionKs[0]}
+	tolerances = []float64{i.HorizontalAOVTolerance.TweakableValue(), i.PrincipalPointOffsetTolerance.TweakableValue(), i.PrincipalPointOffsetTolerance.TweakableValue(), i.K1Tolerance}
+
+	return
+}
+
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+// These are the differences between the overridden values and the ones of the camera.
+// Values without a positive tolerance are not constrained.
+func (i *CameraPhotoIntrinsics) Residuals() []float64 {
+	values, cameraValues, tolerances := i.constrainedValues()
+
+	residuals := make([]float64, len(values))
+	for j := range values {
+		if tolerances[j] > 0 {
+			residuals[j] = (values[j].TweakableValue() - cameraValues[j].TweakableValue()) / tolerances[j]
+		}
+	}
+
+	return residuals
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (i *CameraPhotoIntrinsics) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	values, cameraValues, tolerances := i.constrainedValues()
+
+	for j := range values {
+		if tolerances[j] > 0 {
+			addFunc(j, values[j], 1/tolerances[j])
+			addFunc(j, cameraValues[j], -1/tolerances[j])
+		}
+	}
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (i *CameraPhotoIntrinsics) ResidualSqr() float64 {
+	return residualsSqr(i.Residuals())
+}
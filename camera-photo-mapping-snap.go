@@ -0,0 +1,160 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+)
+
+const (
+	mappingSnapRadius       = 10   // Radius of the window around a mapping that is searched for a corner, in pixels of the stored image.
+	mappingSnapBlur         = 1.0  // Standard deviation of the blur that is applied before the gradients are calculated, in pixels.
+	mappingSnapMinRoundness = 0.25 // Minimum roundness of a corner. Below this, the window contains an edge rather than a corner.
+	mappingSnapMaxPrecision = 1.0  // Maximum standard deviation of a corner in pixels. Above this, the window contains mostly noise.
+	mappingSnapMinContrast  = 0.05 // Minimum luminance difference between the bright and dark parts of the window. Below this, the window contains only noise.
+)
+
+// CameraPhotoMappingSnap describes the result of snapping a mapping to a corner in the photo.
+type CameraPhotoMappingSnap struct {
+	Offset    PixelDistance // Distance the mapping was moved.
+	Precision PixelDistance // Estimated standard deviation of the corner position.
+	Roundness float64       // Förstner roundness between 0 and 1. 1 is an ideal corner, 0 is a straight edge.
+}
+
+// Description returns a short description of the confidence of the snapped corner.
+func (s CameraPhotoMappingSnap) Description() string {
+	return fmt.Sprintf("Snapped to corner: moved %.1f px, σ %.2f px, roundness %.2f", s.Offset.Pixels(), s.Precision.Pixels(), s.Roundness)
+}
+
+// photoLuminance is the decoded luminance of a photo, as needed for the corner detection.
+type photoLuminance struct {
+	luminance luminanceImage
+	toStored  imageTransform // From the upright frame into the stored image frame.
+	toUpright imageTransform // From the stored image frame into the upright frame.
+}
+
+// decodeLuminance decodes the image of the photo.
+func (cp *CameraPhoto) decodeLuminance() (*photoLuminance, error) {
+	img, _, err := image.Decode(bytes.NewReader(cp.ImageData))
+	if err != nil {
+		return nil, err
+	}
+	storedSize := PixelCoordinate{PixelDistance(img.Bounds().Dx()), PixelDistance(img.Bounds().Dy())}
+	toUpright := exifOrientationTransform(cp.orientation, storedSize)
+
+	return &photoLuminance{
+		luminance: newLuminanceImage(img),
+		toStored:  toUpright.inverse(),
+		toUpright: toUpright,
+	}, nil
+}
+
+// snapToCorner finds the corner next to the given position in continuous image coordinates of the stored image.
+// The gradients are taken from a slightly blurred image, otherwise the estimate of corners that aren't saddle points is biased by the antialiasing of their edges.
+func snapToCorner(l luminanceImage, x, y float64, radius int) (float64, float64, CameraPhotoMappingSnap, error) {
+	errNoCorner := errors.New("there is no corner near the mapping")
+
+	// Blurred patch that contains every window the corner can move to.
+	half := 2*radius + 2
+	originX, originY := int(math.Floor(x))-half, int(math.Floor(y))-half
+	patch := &grayImage{width: 2*half + 1, height: 2*half + 1, pix: make([]float64, (2*half+1)*(2*half+1))}
+	for py := 0; py < patch.height; py++ {
+		for px := 0; px < patch.width; px++ {
+			patch.pix[py*patch.width+px] = l.clampedAt(originX+px, originY+py)
+		}
+	}
+	patch = patch.blurred(mappingSnapBlur)
+
+	cx, cy, normals, ok := forstnerCorner(patch.at, x-float64(originX), y-float64(originY), radius)
+	if !ok {
+		return x, y, CameraPhotoMappingSnap{}, errNoCorner
+	}
+
+	// Noise looks like a perfect corner to the estimator, so there has to be some contrast.
+	ix, iy := int(math.Floor(cx)), int(math.Floor(cy))
+	values := make([]float64, 0, (2*radius+1)*(2*radius+1))
+	for wy := -radius; wy <= radius; wy++ {
+		for wx := -radius; wx <= radius; wx++ {
+			values = append(values, patch.at(ix+wx, iy+wy))
+		}
+	}
+	slices.Sort(values)
+	if contrast := values[len(values)*95/100] - values[len(values)*5/100]; contrast < mappingSnapMinContrast {
+		return x, y, CameraPhotoMappingSnap{}, fmt.Errorf("there is not enough contrast near the mapping (%.3f)", contrast)
+	}
+
+	det, trace := normals.a11*normals.a22-normals.a12*normals.a12, normals.a11+normals.a22
+	if det <= 0 || trace <= 0 {
+		return x, y, CameraPhotoMappingSnap{}, errNoCorner
+	}
+	roundness := 4 * det / (trace * trace)
+	if roundness < mappingSnapMinRoundness {
+		return x, y, CameraPhotoMappingSnap{}, fmt.Errorf("the image near the mapping looks like an edge, not like a corner (roundness %.2f)", roundness)
+	}
+
+	// The covariance of the corner is the variance of unit weight times the inverse of the normal matrix.
+	variance := normals.sumSqr / max(normals.sumWeight-2, 1)
+	precision := math.Sqrt(variance * trace / det / 2)
+	if precision > mappingSnapMaxPrecision {
+		return x, y, CameraPhotoMappingSnap{}, fmt.Errorf("the corner near the mapping is too weak (σ %.2f px)", precision)
+	}
+
+	newX, newY := cx+float64(originX), cy+float64(originY)
+	snap := CameraPhotoMappingSnap{Offset: PixelDistance(math.Hypot(newX-x, newY-y)), Precision: PixelDistance(precision), Roundness: roundness}
+
+	return newX, newY, snap, nil
+}
+
+// SnapToCorner moves the mapping onto the nearest corner in the photo, with subpixel precision.
+// The mapping stays unchanged if there is no distinct corner near it.
+func (m *CameraPhotoMapping) SnapToCorner(pl *photoLuminance) error {
+	photo := m.photo
+
+	// Panoramas are repeated horizontally, so use the position inside the image.
+	stored := pl.toStored.apply(photo.WrapImageCoordinate(m.Position))
+
+	x, y, snap, err := snapToCorner(pl.luminance, stored.X().Pixels(), stored.Y().Pixels(), mappingSnapRadius)
+	if err != nil {
+		return err
+	}
+
+	upright := pl.toUpright.apply(PixelCoordinate{PixelDistance(x), PixelDistance(y)})
+	m.Position = photo.NearestImageCoordinate(upright, m.Position)
+	m.Snap = &snap
+
+	return nil
+}
+
+// SnapAllToCorners snaps all mappings of the photo that were placed by the user to their nearest corner.
+// It returns the number of snapped mappings.
+func (cp *CameraPhoto) SnapAllToCorners(pl *photoLuminance) int {
+	var snapped int
+	for _, mapping := range cp.Mappings {
+		if mapping.Suggested {
+			continue
+		}
+		if err := mapping.SnapToCorner(pl); err == nil {
+			snapped++
+		}
+	}
+
+	return snapped
+}
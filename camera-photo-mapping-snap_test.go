@@ -0,0 +1,96 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// renderTestShape renders an anti-aliased image that is dark where inside returns true, with some noise.
+func renderTestShape(width, height int, inside func(x, y float64) bool, rng *rand.Rand) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	const samples = 8
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum float64
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					if inside(float64(x)+(float64(sx)+0.5)/samples, float64(y)+(float64(sy)+0.5)/samples) {
+						sum += 40
+					} else {
+						sum += 210
+					}
+				}
+			}
+			img.Pix[y*img.Stride+x] = uint8(max(0, min(255, math.Round(sum/(samples*samples)+rng.NormFloat64()*2))))
+		}
+	}
+
+	return img
+}
+
+func TestSnapToCorner(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	// Coordinates relative to a rotated corner.
+	cornerX, cornerY, angle := 60.37, 47.81, 0.3
+	local := func(x, y float64) (float64, float64) {
+		dx, dy := x-cornerX, y-cornerY
+		return math.Cos(angle)*dx + math.Sin(angle)*dy, -math.Sin(angle)*dx + math.Cos(angle)*dy
+	}
+
+	// The blurred tip of a single corner pulls the estimate slightly into the corner, saddle points like checkerboard corners are symmetric.
+	shapes := []struct {
+		name        string
+		inside      func(x, y float64) bool
+		maxDistance float64
+	}{
+		{"Saddle", func(x, y float64) bool { u, v := local(x, y); return (u > 0) == (v > 0) }, 0.05},
+		{"Corner", func(x, y float64) bool { u, v := local(x, y); return u > 0 && v > 0 }, 0.25},
+	}
+	for _, shape := range shapes {
+		l := newLuminanceImage(renderTestShape(120, 100, shape.inside, rng))
+		x, y, snap, err := snapToCorner(l, cornerX+5, cornerY-4, mappingSnapRadius)
+		if err != nil {
+			t.Errorf("%s: snapToCorner() failed: %v", shape.name, err)
+			continue
+		}
+		if distance := math.Hypot(x-cornerX, y-cornerY); distance > shape.maxDistance {
+			t.Errorf("%s: The corner was found at (%.3f, %.3f), %.3f px away from the true one", shape.name, x, y, distance)
+		}
+		if snap.Roundness < mappingSnapMinRoundness || snap.Precision <= 0 || snap.Precision > 0.2 {
+			t.Errorf("%s: Unexpected snap result: %s", shape.name, snap.Description())
+		}
+	}
+
+	// A straight edge has a clear gradient, but it's not a corner.
+	edge := newLuminanceImage(renderTestShape(120, 100, func(x, y float64) bool { u, _ := local(x, y); return u > 0 }, rng))
+	if x, y, _, err := snapToCorner(edge, cornerX, cornerY+3, mappingSnapRadius); err == nil || !strings.Contains(err.Error(), "roundness") {
+		t.Errorf("An edge wasn't rejected by its roundness: (%v, %v), %v", x, y, err)
+	} else if x != cornerX || y != cornerY+3 {
+		t.Errorf("The rejected position was moved to (%v, %v)", x, y)
+	}
+
+	// Flat areas only contain noise.
+	flat := newLuminanceImage(renderTestShape(120, 100, func(x, y float64) bool { return false }, rng))
+	if _, _, snap, err := snapToCorner(flat, cornerX, cornerY, mappingSnapRadius); err == nil {
+		t.Errorf("A flat area was accepted as corner: %s", snap.Description())
+	}
+}
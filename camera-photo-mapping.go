@@ -17,6 +17,7 @@ package main
 
 import (
 	"encoding/json"
+	"math"
 	"time"
 )
 
@@ -34,6 +35,8 @@ type CameraPhotoMapping struct {
 	sr           float64         // Current squared residual value.
 
 	Suggested bool // This mapping is just suggested, it wasn't placed or confirmed by the user (yet).
+
+	Snap *CameraPhotoMappingSnap `json:",omitempty"` // Result of the last corner refinement, if the mapping was snapped to a corner and not moved since.
 }
 
 func (cp *CameraPhoto) NewMapping() *CameraPhotoMapping {
@@ -77,6 +80,10 @@ func (m *CameraPhotoMapping) Copy(newParent *CameraPhoto, newKey string) *Camera
 	copy.projectedPos = m.projectedPos
 	copy.sr = m.sr
 	copy.Suggested = m.Suggested
+	if m.Snap != nil {
+		snap := *m.Snap
+		copy.Snap = &snap
+	}
 
 	return copy
 }
@@ -94,3 +101,85 @@ func (m *CameraPhotoMapping) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+// These are the horizontal and vertical pixel distances between the mapped and the projected position of the point.
+func (m *CameraPhotoMapping) Residuals() []float64 {
+	photo := m.photo
+	camera, site := photo.camera, photo.camera.site
+
+	point, ok := site.Points[m.PointKey]
+	if !ok || m.Suggested {
+		return []float64{0, 0}
+	}
+
+	// Project the point.
+	projection := photo.projection()
+	projectedCoordinate, _ := projection.project(point.Position.Coordinate, nil)
+	// Panoramas wrap around horizontally, so use the projection on the same side of the seam as the mapping.
+	projectedCoordinate = photo.NearestImageCoordinate(projectedCoordinate, m.Position)
+
+	// Create a gradient for points that are behind the camera to help the solver.
+	if projectedCoordinate.Z() <= 0 {
+		return []float64{10000, projectedCoordinate.Z().Meters() * 1000}
+	}
+
+	rx := projectedCoordinate.X().Pixels() - m.Position.X().Pixels()
+	ry := projectedCoordinate.Y().Pixels() - m.Position.Y().Pixels()
+	rx, ry = rx/camera.PixelAccuracy.Pixels(), ry/camera.PixelAccuracy.Pixels()
+
+	// Limit the residuals to a length of 10000.
+	if length := math.Sqrt(rx*rx + ry*ry); length > 10000 {
+		rx, ry = rx*10000/length, ry*10000/length
+	}
+
+	return []float64{rx, ry}
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (m *CameraPhotoMapping) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	photo := m.photo
+	camera, site := photo.camera, photo.camera.site
+
+	point, ok := site.Points[m.PointKey]
+	if !ok || m.Suggested {
+		return
+	}
+
+	projection := photo.projection()
+	var jac projectionJacobian
+	projectedCoordinate, _ := projection.project(point.Position.Coordinate, &jac)
+	projectedCoordinate = photo.NearestImageCoordinate(projectedCoordinate, m.Position)
+
+	if projectedCoordinate.Z() <= 0 {
+		jac.forEachDerivative(photo, point, 1, [3]float64{0, 0, 1000}, addFunc)
+		return
+	}
+
+	accuracy := camera.PixelAccuracy.Pixels()
+	rx := (projectedCoordinate.X().Pixels() - m.Position.X().Pixels()) / accuracy
+	ry := (projectedCoordinate.Y().Pixels() - m.Position.Y().Pixels()) / accuracy
+
+	weightsX, weightsY := [3]float64{1 / accuracy, 0, 0}, [3]float64{0, 1 / accuracy, 0}
+
+	// Derivative of the limited residual vector, which only changes its direction.
+	if length := math.Sqrt(rx*rx + ry*ry); length > 10000 {
+		scale, nx, ny := 10000/length/accuracy, rx/length, ry/length
+		weightsX = [3]float64{scale * (1 - nx*nx), -scale * nx * ny, 0}
+		weightsY = [3]float64{-scale * nx * ny, scale * (1 - ny*ny), 0}
+	}
+
+	jac.forEachDerivative(photo, point, 0, weightsX, addFunc)
+	jac.forEachDerivative(photo, point, 1, weightsY, addFunc)
+}
+
+// EffectiveRobustLoss returns the robust loss function that is used for the residuals.
+func (m *CameraPhotoMapping) EffectiveRobustLoss() RobustLoss {
+	return m.photo.camera.EffectiveRobustLoss()
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (m *CameraPhotoMapping) ResidualSqr() float64 {
+	m.sr = residualsSqr(m.Residuals())
+	return m.sr
+}
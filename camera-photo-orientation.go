@@ -0,0 +1,114 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// imageTransform maps image coordinates from one image frame into another.
+// It only consists of rotations by multiples of 90° and mirroring, plus a translation.
+type imageTransform struct {
+	m [2][2]float64
+	t [2]float64
+}
+
+// identityImageTransform doesn't change any coordinate.
+var identityImageTransform = imageTransform{m: [2][2]float64{{1, 0}, {0, 1}}}
+
+// exifOrientationTransform returns the transformation from the stored image frame into the upright image frame, as defined by the EXIF orientation.
+// storedSize is the size of the image as it is stored in the file.
+func exifOrientationTransform(orientation int, storedSize PixelCoordinate) imageTransform {
+	w, h := storedSize.X().Pixels(), storedSize.Y().Pixels()
+
+	switch orientation {
+	case 2: // Mirrored horizontally.
+		return imageTransform{m: [2][2]float64{{-1, 0}, {0, 1}}, t: [2]float64{w, 0}}
+	case 3: // Rotated by 180°.
+		return imageTransform{m: [2][2]float64{{-1, 0}, {0, -1}}, t: [2]float64{w, h}}
+	case 4: // Mirrored vertically.
+		return imageTransform{m: [2][2]float64{{1, 0}, {0, -1}}, t: [2]float64{0, h}}
+	case 5: // Transposed.
+		return imageTransform{m: [2][2]float64{{0, 1}, {1, 0}}}
+	case 6: // Has to be rotated by 90° clockwise.
+		return imageTransform{m: [2][2]float64{{0, -1}, {1, 0}}, t: [2]float64{h, 0}}
+	case 7: // Transversed.
+		return imageTransform{m: [2][2]float64{{0, -1}, {-1, 0}}, t: [2]float64{h, w}}
+	case 8: // Has to be rotated by 90° counterclockwise.
+		return imageTransform{m: [2][2]float64{{0, 1}, {-1, 0}}, t: [2]float64{0, w}}
+	}
+
+	return identityImageTransform
+}
+
+// swapsAxes returns whether the transformation swaps the horizontal and vertical image axes.
+func (t imageTransform) swapsAxes() bool {
+	return t.m[0][0] == 0
+}
+
+// apply transforms the given image coordinate. The z coordinate is kept as is.
+func (t imageTransform) apply(c PixelCoordinate) PixelCoordinate {
+	x, y := c.X().Pixels(), c.Y().Pixels()
+	return PixelCoordinate{
+		PixelDistance(t.m[0][0]*x + t.m[0][1]*y + t.t[0]),
+		PixelDistance(t.m[1][0]*x + t.m[1][1]*y + t.t[1]),
+		c[2],
+	}
+}
+
+// then returns the transformation that applies t first, and o afterwards.
+func (t imageTransform) then(o imageTransform) imageTransform {
+	var result imageTransform
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			result.m[i][j] = o.m[i][0]*t.m[0][j] + o.m[i][1]*t.m[1][j]
+		}
+		result.t[i] = o.m[i][0]*t.t[0] + o.m[i][1]*t.t[1] + o.t[i]
+	}
+	return result
+}
+
+// inverse returns the transformation that reverts t.
+// The matrix of the transformation is orthogonal, so its inverse is its transpose.
+func (t imageTransform) inverse() imageTransform {
+	var result imageTransform
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			result.m[i][j] = t.m[j][i]
+		}
+	}
+	for i := 0; i < 2; i++ {
+		result.t[i] = -(result.m[i][0]*t.t[0] + result.m[i][1]*t.t[1])
+	}
+	return result
+}
+
+// sensorFrame returns the size of the photo in the sensor frame, and the transformation from the sensor frame into the upright image frame that is shown to the user.
+// The sensor frame is always in landscape orientation, so that the intrinsic camera parameters refer to the long side of the sensor.
+// This allows portrait and landscape photos of the same camera to share the same intrinsic parameters.
+//
+// Images that are stored in portrait orientation are assumed to be rotated by 90° clockwise relative to the sensor.
+// The direction of this rotation can't be known, it only affects the sign of the principal point offset and of the tangential and affinity coefficients.
+func (cp *CameraPhoto) sensorFrame() (PixelCoordinate, imageTransform) {
+	storedSize := cp.imageSize
+	if exifOrientationTransform(cp.orientation, storedSize).swapsAxes() {
+		storedSize = PixelCoordinate{storedSize.Y(), storedSize.X()}
+	}
+	orientation := exifOrientationTransform(cp.orientation, storedSize)
+
+	if storedSize.X() >= storedSize.Y() {
+		return storedSize, orientation
+	}
+
+	sensorSize := PixelCoordinate{storedSize.Y(), storedSize.X()}
+	return sensorSize, exifOrientationTransform(6, sensorSize).then(orientation)
+}
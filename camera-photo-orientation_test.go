@@ -0,0 +1,89 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExifOrientationTransform(t *testing.T) {
+	storedSize := PixelCoordinate{400, 300}
+
+	for orientation := 0; orientation <= 8; orientation++ {
+		transform := exifOrientationTransform(orientation, storedSize)
+		uprightSize := storedSize
+		if transform.swapsAxes() {
+			uprightSize = PixelCoordinate{storedSize.Y(), storedSize.X()}
+		}
+		if want := orientation >= 5; transform.swapsAxes() != want {
+			t.Errorf("Orientation %d: swapsAxes() = %v, want %v", orientation, transform.swapsAxes(), want)
+		}
+
+		// The corners of the stored image have to be mapped onto the corners of the upright image.
+		for _, corner := range []PixelCoordinate{{0, 0}, {400, 0}, {0, 300}, {400, 300}} {
+			upright := transform.apply(corner)
+			if (upright[0] != 0 && upright[0] != uprightSize[0]) || (upright[1] != 0 && upright[1] != uprightSize[1]) {
+				t.Errorf("Orientation %d: Corner %v is mapped onto %v, which isn't a corner of the upright image", orientation, corner, upright)
+			}
+		}
+
+		// The inverse has to undo the transformation.
+		position := PixelCoordinate{123.5, 45.25}
+		if back := transform.inverse().apply(transform.apply(position)); math.Abs(float64(back[0]-position[0])) > 1e-12 || math.Abs(float64(back[1]-position[1])) > 1e-12 {
+			t.Errorf("Orientation %d: Inverse maps %v onto %v", orientation, position, back)
+		}
+	}
+}
+
+// TestProjectionOrientation checks that every projection model projects into the upright image of a photo.
+// A photo with an EXIF orientation has to show the same as one without, just transformed.
+func TestProjectionOrientation(t *testing.T) {
+	models := []CameraModel{CameraModelPinhole, CameraModelFisheye, CameraModelEquirectangular}
+
+	for _, model := range models {
+		site := NewSite("orientation")
+		camera := site.NewCamera("Camera")
+		camera.Model = model
+		camera.HorizontalAOV = Angle(70 * math.Pi / 180)
+		camera.DistortionKs = [CameraDistortionKs]TweakableFloat{-0.05, 0.01, 0, 0}
+		camera.DistortionPs = [CameraDistortionPs]TweakableFloat{0.001, -0.002, 0, 0}
+		camera.PrincipalPointOffset = PixelCoordinate{12, -8}
+
+		storedSize := PixelCoordinate{4000, 3000}
+		if camera.Panoramic() {
+			storedSize = PixelCoordinate{4000, 2000}
+		}
+		reference := newTestPhoto(camera, storedSize, 1)
+		reference.Orientation.Rotation = Rotation{0.05, -0.03, 0.4}
+		worldCoordinates := []Coordinate{{0, 0, 10}, {1.5, -1, 8}, {-2, 0.5, 12}, {0.3, 2, 9}}
+		want, _ := reference.Project(worldCoordinates)
+
+		for orientation := 2; orientation <= 8; orientation++ {
+			photo := newTestPhoto(camera, storedSize, orientation)
+			photo.Position, photo.Orientation = reference.Position, reference.Orientation
+			transform := exifOrientationTransform(orientation, storedSize)
+
+			got, _ := photo.Project(worldCoordinates)
+			for i := range worldCoordinates {
+				expected := transform.apply(want[i])
+				if math.Abs(float64(got[i][0]-expected[0])) > 1e-6 || math.Abs(float64(got[i][1]-expected[1])) > 1e-6 {
+					t.Errorf("%s, orientation %d: %v is projected onto %v, want %v", model, orientation, worldCoordinates[i], got[i], expected)
+				}
+			}
+		}
+	}
+}
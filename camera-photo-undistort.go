@@ -0,0 +1,200 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"math"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"github.com/vugu/vugu"
+)
+
+// undistortBorderSamples is the number of samples along every edge of a photo that are used to find the valid area of the undistorted photo.
+const undistortBorderSamples = 100
+
+// UndistortedPhotoInfo describes the ideal pinhole camera of an undistorted photo.
+// It is stored in a sidecar file next to the exported image.
+type UndistortedPhotoInfo struct {
+	Camera, Photo  string
+	Width, Height  int                // Size of the undistorted image in pixels.
+	FocalLength    float64            // Focal length in pixels.
+	PrincipalPoint [2]float64         // Principal point in pixels, relative to the top left corner of the image.
+	HorizontalAOV  float64            // Angle of view along the width of the image in degrees.
+	Interpolation  ImageInterpolation // Interpolation that was used to resample the photo.
+	Cropped        bool               // The image was cropped to the area that only contains valid pixels.
+}
+
+// idealToDistorted returns the image coordinate of the distorted photo for the given ideal coordinate.
+// Both are in the sensor frame, the ideal coordinate is the projection of a pinhole camera without distortion, with its principal point at the image center.
+func (p *cameraProjection) idealToDistorted(ideal PixelCoordinate) PixelCoordinate {
+	x := (ideal.X().Pixels() - p.imageCenter.X().Pixels()) / p.focalLength
+	y := (ideal.Y().Pixels() - p.imageCenter.Y().Pixels()) / p.focalLength
+
+	distorted, _, _ := p.projectPerspective(mgl64.Vec3{x, y, 1}, nil)
+	return distorted
+}
+
+// distortedToIdeal inverts idealToDistorted by using Newton's method.
+// The result is false if there is no ideal coordinate, for example for rays of a fisheye lens that are more than 90° off axis.
+func (p *cameraProjection) distortedToIdeal(distorted PixelCoordinate) (PixelCoordinate, bool) {
+	const h = 1e-3 // Step size of the numerical derivatives in pixels.
+
+	ideal := distorted
+	for i := 0; i < 50; i++ {
+		d := p.idealToDistorted(ideal)
+		ru, rv := d.X().Pixels()-distorted.X().Pixels(), d.Y().Pixels()-distorted.Y().Pixels()
+		if math.Hypot(ru, rv) < 1e-4 {
+			return ideal, true
+		}
+
+		du := p.idealToDistorted(ideal.Add(PixelCoordinate{h, 0}))
+		dv := p.idealToDistorted(ideal.Add(PixelCoordinate{0, h}))
+		a, b := (du.X().Pixels()-d.X().Pixels())/h, (dv.X().Pixels()-d.X().Pixels())/h
+		c, e := (du.Y().Pixels()-d.Y().Pixels())/h, (dv.Y().Pixels()-d.Y().Pixels())/h
+		det := a*e - b*c
+		if det <= 0 || math.IsNaN(det) {
+			return PixelCoordinate{}, false
+		}
+
+		ideal = ideal.Sub(PixelCoordinate{PixelDistance((e*ru - b*rv) / det), PixelDistance((-c*ru + a*rv) / det)})
+	}
+
+	return PixelCoordinate{}, false
+}
+
+// undistortedCrop returns the factor by which the size of the undistorted photo has to be scaled, so that it only contains valid pixels.
+// The cropped area is centered on the principal point and keeps the aspect ratio.
+// The factor is at most 1, cropping never makes the photo larger than the original one.
+func (p *cameraProjection) undistortedCrop() (float64, error) {
+	sensorSize := p.imageCenter.Scaled(2)
+	halfWidth, halfHeight := p.imageCenter.X().Pixels(), p.imageCenter.Y().Pixels()
+
+	// Every point on the border of the photo excludes all centered rectangles that would contain it.
+	scale := math.Inf(1)
+	for i := 0; i <= undistortBorderSamples; i++ {
+		t := PixelDistance(i) / undistortBorderSamples
+		border := []PixelCoordinate{
+			{t * sensorSize.X(), 0}, {t * sensorSize.X(), sensorSize.Y()},
+			{0, t * sensorSize.Y()}, {sensorSize.X(), t * sensorSize.Y()},
+		}
+		for _, b := range border {
+			ideal, ok := p.distortedToIdeal(b)
+			if !ok {
+				continue
+			}
+			x, y := ideal.X().Pixels()-halfWidth, ideal.Y().Pixels()-halfHeight
+			scale = min(scale, max(math.Abs(x)/halfWidth, math.Abs(y)/halfHeight))
+		}
+	}
+
+	if math.IsInf(scale, 0) || scale <= 0 {
+		return 0, errors.New("the photo has no valid area without distortion")
+	}
+
+	return min(scale, 1), nil
+}
+
+// Undistort returns the photo as it would have been taken by an ideal pinhole camera without any lens distortion.
+// The undistorted photo has the same focal length as the photo, and its principal point is in the image center.
+// If crop is true, the result is cropped to the largest area that contains only valid pixels.
+func (cp *CameraPhoto) Undistort(interpolation ImageInterpolation, crop bool) (*image.RGBA, UndistortedPhotoInfo, error) {
+	camera := cp.camera
+	if camera.Panoramic() {
+		return nil, UndistortedPhotoInfo{}, errors.New("panoramas can't be undistorted")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(cp.ImageData))
+	if err != nil {
+		return nil, UndistortedPhotoInfo{}, err
+	}
+	storedSize := PixelCoordinate{PixelDistance(img.Bounds().Dx()), PixelDistance(img.Bounds().Dy())}
+	sampler := newImageSampler(img, interpolation)
+
+	p := cp.projection()
+	sensorToStored := p.transform.then(exifOrientationTransform(cp.orientation, storedSize).inverse())
+	uprightToSensor := p.transform.inverse()
+
+	// The undistorted image in the upright frame, centered on the principal point.
+	scale := 1.0
+	if crop {
+		if scale, err = p.undistortedCrop(); err != nil {
+			return nil, UndistortedPhotoInfo{}, err
+		}
+	}
+	center := cp.imageSize.Scaled(0.5)
+	width, height := int(math.Floor(cp.imageSize.X().Pixels()*scale)), int(math.Floor(cp.imageSize.Y().Pixels()*scale))
+	if width <= 0 || height <= 0 {
+		return nil, UndistortedPhotoInfo{}, fmt.Errorf("the undistorted photo would be empty")
+	}
+	origin := center.Sub(PixelCoordinate{PixelDistance(width) / 2, PixelDistance(height) / 2})
+
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ideal := uprightToSensor.apply(origin.Add(PixelCoordinate{PixelDistance(x) + 0.5, PixelDistance(y) + 0.5}))
+			stored := sensorToStored.apply(p.idealToDistorted(ideal))
+			if c, ok := sampler.at(stored.X().Pixels(), stored.Y().Pixels()); ok {
+				result.SetRGBA(x, y, c)
+			}
+		}
+	}
+
+	info := UndistortedPhotoInfo{
+		Camera:         camera.Key(),
+		Photo:          cp.Key(),
+		Width:          width,
+		Height:         height,
+		FocalLength:    p.focalLength,
+		PrincipalPoint: [2]float64{float64(width) / 2, float64(height) / 2},
+		HorizontalAOV:  Angle(2 * math.Atan(float64(width)/2/p.focalLength)).Degree(),
+		Interpolation:  interpolation,
+		Cropped:        crop,
+	}
+
+	return result, info, nil
+}
+
+func (cp *CameraPhoto) handleUndistortedDownload(event vugu.DOMEvent) {
+	camera := cp.camera
+
+	img, info, err := cp.Undistort(camera.UndistortInterpolation, camera.UndistortCrop)
+	if err != nil {
+		log.Printf("Couldn't undistort photo %s: %v", cp.DisplayName(), err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		log.Printf("jpeg.Encode failed: %v", err)
+		return
+	}
+	sidecar, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		log.Printf("json.Marshal failed: %v", err)
+		return
+	}
+
+	name := fmt.Sprintf("%s %s undistorted", camera.Name, cp.Key())
+	browserDownload(name+".jpg", buf.Bytes(), "image/jpeg")
+	browserDownload(name+".json", sidecar, "application/json")
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// newUndistortTestPhoto returns a photo of a camera with the given model and radial distortion.
+func newUndistortTestPhoto(model CameraModel, ks [CameraDistortionKs]TweakableFloat) *CameraPhoto {
+	site := NewSite("undistort")
+	camera := site.NewCamera("Camera")
+	camera.Model = model
+	camera.HorizontalAOV = Angle(70 * math.Pi / 180)
+	camera.PrincipalPointOffset = PixelCoordinate{7, -5}
+	camera.DistortionKs = ks
+	camera.DistortionPs = [CameraDistortionPs]TweakableFloat{0.002, -0.001, 0, 0}
+	camera.DistortionBs = [CameraDistortionBs]PixelDistance{1, 0.5}
+
+	return newTestPhoto(camera, PixelCoordinate{4000, 3000}, 1)
+}
+
+func TestDistortedToIdeal(t *testing.T) {
+	tests := []struct {
+		model CameraModel
+		ks    [CameraDistortionKs]TweakableFloat
+	}{
+		{CameraModelPinhole, [CameraDistortionKs]TweakableFloat{-0.15, 0.03, 0, 0}},
+		{CameraModelPinhole, [CameraDistortionKs]TweakableFloat{0.1, 0, 0, 0}},
+		{CameraModelFisheye, [CameraDistortionKs]TweakableFloat{0.05, -0.01, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		p := newUndistortTestPhoto(tt.model, tt.ks).projection()
+		for y := PixelDistance(0); y <= 3000; y += 500 {
+			for x := PixelDistance(0); x <= 4000; x += 500 {
+				distorted := PixelCoordinate{x, y}
+				ideal, ok := p.distortedToIdeal(distorted)
+				if !ok {
+					t.Errorf("%s %v: distortedToIdeal(%v) failed", tt.model, tt.ks, distorted)
+					continue
+				}
+				if back := p.idealToDistorted(ideal); back.Distance(distorted) > 1e-4 {
+					t.Errorf("%s %v: %v is mapped onto %v and back onto %v", tt.model, tt.ks, distorted, ideal, back)
+				}
+
+				// The other direction has to be exact as well.
+				if again, ok := p.distortedToIdeal(p.idealToDistorted(ideal)); !ok || again.Distance(ideal) > 1e-4 {
+					t.Errorf("%s %v: Ideal coordinate %v is mapped back onto %v", tt.model, tt.ks, ideal, again)
+				}
+			}
+		}
+	}
+}
+
+func TestUndistortedCrop(t *testing.T) {
+	tests := []struct {
+		model    CameraModel
+		ks       [CameraDistortionKs]TweakableFloat
+		maxScale float64
+	}{
+		{CameraModelPinhole, [CameraDistortionKs]TweakableFloat{}, 1},
+		{CameraModelPinhole, [CameraDistortionKs]TweakableFloat{-0.15, 0.03, 0, 0}, 1}, // Barrel distortion, the border of the photo is outside of the original frame.
+		{CameraModelPinhole, [CameraDistortionKs]TweakableFloat{0.1, 0, 0, 0}, 0.95},   // Pincushion distortion.
+		{CameraModelFisheye, [CameraDistortionKs]TweakableFloat{0.05, -0.01, 0, 0}, 1},
+	}
+
+	for _, tt := range tests {
+		p := newUndistortTestPhoto(tt.model, tt.ks).projection()
+		scale, err := p.undistortedCrop()
+		if err != nil {
+			t.Errorf("%s %v: undistortedCrop() failed: %v", tt.model, tt.ks, err)
+			continue
+		}
+		if scale <= 0 || scale > tt.maxScale {
+			t.Errorf("%s %v: undistortedCrop() = %v, want a factor in (0, %v]", tt.model, tt.ks, scale, tt.maxScale)
+		}
+	}
+}
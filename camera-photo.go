@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"image"
+	"log"
 	"math"
 	"sort"
 	"time"
@@ -36,14 +37,17 @@ type CameraPhoto struct {
 
 	CreatedAt time.Time
 
-	ImageData []byte // TODO: Don't store the image as byte slice. Only store it as a js blob
-	imageSize PixelCoordinate
+	ImageData   []byte          // TODO: Don't store the image as byte slice. Only store it as a js blob
+	imageSize   PixelCoordinate // Size of the upright image, as it is shown to the user.
+	orientation int             // EXIF orientation of the stored image.
+	exif        PhotoExif       // Metadata of the image.
 
 	jsImageBlob js.Value // Blob representing the image on the js side.
 	jsImageURL  js.Value // URL referencing the blob.
 
 	Position    CoordinateOptimizable
 	Orientation RotationOptimizable
+	Intrinsics  CameraPhotoIntrinsics // Optional intrinsic parameters that override the ones of the camera.
 
 	Mappings map[string]*CameraPhotoMapping // List of mapped points.
 }
@@ -63,6 +67,7 @@ func (c *Camera) NewPhoto(imageData []byte) (*CameraPhoto, error) {
 // initData initializes the object with default values and other stuff.
 func (cp *CameraPhoto) initData() {
 	cp.CreatedAt = time.Now()
+	cp.Intrinsics.initData(cp)
 	cp.Mappings = map[string]*CameraPhotoMapping{}
 }
 
@@ -100,10 +105,14 @@ func (cp *CameraPhoto) Copy(newParent *Camera, newKey string) *CameraPhoto {
 	copy.CreatedAt = cp.CreatedAt
 	copy.ImageData = cp.ImageData
 	copy.imageSize = cp.imageSize
+	copy.orientation = cp.orientation
+	copy.exif = cp.exif
 	//copy.jsImageBlob = cp.jsImageBlob
 	//copy.jsImageURL = cp.jsImageURL // Don't copy the URL, as it needs to be freed // TODO: Have a global manager for shared images with JS
 	copy.Position = cp.Position
 	copy.Orientation = cp.Orientation
+	copy.Intrinsics = cp.Intrinsics
+	copy.Intrinsics.photo = copy
 
 	// Generate copies of all children.
 	for k, v := range cp.Mappings {
@@ -123,8 +132,11 @@ func (cp *CameraPhoto) UnmarshalJSON(data []byte) error {
 	}
 
 	// Decode image and make it available on the JS side.
-	if err := cp.decodeImage(); err != nil {
-		return err
+	// Photos without image data are only used by the optimizer worker, which gets the image size separately.
+	if len(cp.ImageData) > 0 {
+		if err := cp.decodeImage(); err != nil {
+			return err
+		}
 	}
 
 	// Update parent references and keys.
@@ -145,6 +157,17 @@ func (cp *CameraPhoto) decodeImage() error {
 	}
 	cp.imageSize = PixelCoordinate{PixelDistance(imageConf.Width), PixelDistance(imageConf.Height)}
 
+	// The metadata is optional, so a broken EXIF block doesn't prevent the photo from being used.
+	if cp.exif, err = parseExif(imageData); err != nil {
+		log.Printf("Couldn't read EXIF metadata: %v", err)
+	}
+
+	// Browsers show images upright according to their EXIF orientation, so all image coordinates refer to the upright image.
+	cp.orientation = cp.exif.Orientation
+	if exifOrientationTransform(cp.orientation, cp.imageSize).swapsAxes() {
+		cp.imageSize = PixelCoordinate{cp.imageSize.Y(), cp.imageSize.X()}
+	}
+
 	if cp.jsImageURL.Truthy() {
 		js.Global().Get("URL").Call("revokeObjectURL", cp.jsImageURL)
 	}
@@ -163,47 +186,53 @@ func (cp *CameraPhoto) JsImageURL() string {
 	return cp.jsImageURL.String()
 }
 
+// Exif returns the metadata of the image.
+func (cp *CameraPhoto) Exif() PhotoExif {
+	return cp.exif
+}
+
 // GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+// Every non suggested point mapping is a residual, and so is the constraint of overridden intrinsic parameters.
 func (cp *CameraPhoto) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
 	tweakables1, _ := cp.Position.GetTweakablesAndResiduals()
 	tweakables2, _ := cp.Orientation.GetTweakablesAndResiduals()
+	tweakables3, residuals := cp.Intrinsics.GetTweakablesAndResiduals()
+
+	for _, mapping := range cp.MappingsSorted() {
+		if !mapping.Suggested {
+			residuals = append(residuals, mapping)
+		}
+	}
 
-	return append(append([]Tweakable{}, tweakables1...), tweakables2...), []Residualer{cp}
+	return append(append(append([]Tweakable{}, tweakables1...), tweakables2...), tweakables3...), residuals
 }
 
-// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
-func (cp *CameraPhoto) ResidualSqr() float64 {
-	camera, site := cp.camera, cp.camera.site
+// cameraPhotoPose selects the position and orientation of a photo for the optimizer.
+type cameraPhotoPose struct {
+	photo *CameraPhoto
+}
 
-	// Generate list of mappings and their coordinates. Ignore suggested mappings.
-	mappings := make([]*CameraPhotoMapping, 0, len(cp.Mappings))
-	worldCoordinates := make([]Coordinate, 0, len(cp.Mappings)) // World coordinates of every point.
-	for _, mapping := range cp.Mappings {
-		if p, ok := site.Points[mapping.PointKey]; ok && !mapping.Suggested {
-			mappings = append(mappings, mapping)
-			worldCoordinates = append(worldCoordinates, p.Position.Coordinate)
-		}
-	}
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (p cameraPhotoPose) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	tweakables1, _ := p.photo.Position.GetTweakablesAndResiduals()
+	tweakables2, _ := p.photo.Orientation.GetTweakablesAndResiduals()
 
-	// Project the points.
-	projectedCoordinates, _ := cp.Project(worldCoordinates) // The world coordinates of every point projected into image coordinates.
+	return append(append([]Tweakable{}, tweakables1...), tweakables2...), nil
+}
 
-	// Calculate the distance in pixels for every point.
-	// Sum up the squared distance residuals.
-	ssr := 0.0
-	for i, mapping := range mappings {
-		projectedCoordinate := projectedCoordinates[i]
+// Pose returns the pose of the photo as selection for the optimizer.
+// Unlike the photo itself, it doesn't contain overridden intrinsic parameters.
+func (cp *CameraPhoto) Pose() OptimizerSelectable {
+	return cameraPhotoPose{photo: cp}
+}
 
-		// Ignore points behind the photo.
-		if projectedCoordinate.Z() <= 0 {
-			ssr += 100000000 + projectedCoordinate.Z().Sqr()*1000000 // Create a gradient for points that are behind the camera to help the solver.
-			continue
+// ResidualSqr returns the sum of squared residuals of all non suggested point mappings. (Each residual is divided by the accuracy of the measurement device).
+func (cp *CameraPhoto) ResidualSqr() float64 {
+	ssr := 0.0
+	for _, mapping := range cp.Mappings {
+		if !mapping.Suggested {
+			ssr += mapping.ResidualSqr()
 		}
-
-		sr := projectedCoordinate.DistanceSqr(mapping.Position) / camera.PixelAccuracy.Sqr()
-		sr = math.Min(sr, 100000000)
-		mapping.sr = sr
-		ssr += sr
 	}
 
 	return ssr
@@ -211,60 +240,40 @@ func (cp *CameraPhoto) ResidualSqr() float64 {
 
 // Project transforms a list of object/world coordinates into a list of (distorted and undistorted) image coordinates.
 func (cp *CameraPhoto) Project(worldCoordinates []Coordinate) (distorted, undistorted []PixelCoordinate) {
-	camera := cp.camera
-
-	k1, k2, k3, k4 := float64(camera.DistortionKs[0]), float64(camera.DistortionKs[1]), float64(camera.DistortionKs[2]), float64(camera.DistortionKs[3])
-	p1, p2, p3, p4 := float64(camera.DistortionPs[0]), float64(camera.DistortionPs[1]), float64(camera.DistortionPs[2]), float64(camera.DistortionPs[3])
-	b1, b2 := camera.DistortionBs[0], camera.DistortionBs[1]
-
-	imageCenter := cp.imageSize.Scaled(0.5)
-
-	focalLength := imageCenter.X().Pixels() / math.Tan(camera.HorizontalAOV.Radian()/2)
-
-	cameraMatrix := cp.GetCameraViewMatrix()
+	projection := cp.projection()
 
 	distortedCoordinates := make([]PixelCoordinate, len(worldCoordinates))
 	undistortedCoordinates := make([]PixelCoordinate, len(worldCoordinates))
 	for i, worldCoordinate := range worldCoordinates {
-		obj4 := worldCoordinate.Vec4(1)
+		distortedCoordinates[i], undistortedCoordinates[i] = projection.project(worldCoordinate, nil)
+	}
 
-		// Rotate and translate the world coordinate into the camera coordinate system.
-		loc4 := cameraMatrix.Mul4x1(obj4)
+	return distortedCoordinates, undistortedCoordinates
+}
 
-		// Scale X and Y camera coordinates on Z distance. (Perspective projection)
-		localCoordinate := PixelCoordinate{
-			PixelDistance(loc4[0] / loc4[2]),
-			PixelDistance(loc4[1] / loc4[2]),
-			PixelDistance(loc4[2]),
-		}
+// WrapImageCoordinate returns the given image coordinate wrapped horizontally into the image, if the photo is a 360° panorama.
+// Otherwise the coordinate is returned unchanged.
+func (cp *CameraPhoto) WrapImageCoordinate(c PixelCoordinate) PixelCoordinate {
+	width := cp.imageSize.X().Pixels()
+	if !cp.camera.Panoramic() || width <= 0 {
+		return c
+	}
 
-		radiusSqr := localCoordinate.LengthSqr()
-
-		// Radial distortion.
-		distortedCoordinate := localCoordinate.Scaled(1 + k1*radiusSqr + k2*radiusSqr*radiusSqr + k3*radiusSqr*radiusSqr*radiusSqr + k4*radiusSqr*radiusSqr*radiusSqr*radiusSqr)
-		// Tangential distortion.
-		lx, ly := localCoordinate.X().Pixels(), localCoordinate.Y().Pixels()
-		lxSqr, lySqr := lx*lx, ly*ly
-		lxy := lx * ly
-		p3p4 := PixelDistance(1 + p3*radiusSqr + p4*radiusSqr*radiusSqr)
-		distortedCoordinate = distortedCoordinate.Add(PixelCoordinate{
-			PixelDistance(p1*(radiusSqr+2*lxSqr)+2*p2*lxy) * p3p4,
-			PixelDistance(p2*(radiusSqr+2*lySqr)+2*p1*lxy) * p3p4,
-		})
-
-		imgBaseCoordinates := imageCenter.Add(camera.PrincipalPointOffset)
-
-		// Transformation into image space and last distortion.
-		imgCoordinate := imgBaseCoordinates.Add(distortedCoordinate.Scaled(focalLength))
-		imgCoordinate[0] += distortedCoordinate.X()*b1 + distortedCoordinate.Y()*b2
-
-		// Store projected and distorted coordinate.
-		distortedCoordinates[i] = imgCoordinate
-		// Store projected but non distorted coordinate.
-		undistortedCoordinates[i] = imgBaseCoordinates.Add(localCoordinate.Scaled(focalLength))
+	c[0] = PixelDistance(c.X().Pixels() - math.Floor(c.X().Pixels()/width)*width)
+	return c
+}
+
+// NearestImageCoordinate returns the given image coordinate shifted by a multiple of the image width, so that it is horizontally closest to the reference.
+// This is needed for 360° panoramas, where the left and right edge of the image are the same direction.
+// For other photos the coordinate is returned unchanged.
+func (cp *CameraPhoto) NearestImageCoordinate(c, reference PixelCoordinate) PixelCoordinate {
+	width := cp.imageSize.X().Pixels()
+	if !cp.camera.Panoramic() || width <= 0 {
+		return c
 	}
 
-	return distortedCoordinates, undistortedCoordinates
+	c[0] -= PixelDistance(math.Round((c.X().Pixels()-reference.X().Pixels())/width) * width)
+	return c
 }
 
 // UpdateSuggestions recreates/updates all "suggested" point mappings.
@@ -351,7 +360,10 @@ func (cp *CameraPhoto) MappingsSorted() []*CameraPhotoMapping {
 	}
 
 	sort.Slice(mappings, func(i, j int) bool {
-		return mappings[i].CreatedAt.After(mappings[j].CreatedAt)
+		if !mappings[i].CreatedAt.Equal(mappings[j].CreatedAt) {
+			return mappings[i].CreatedAt.After(mappings[j].CreatedAt)
+		}
+		return mappings[i].Key() < mappings[j].Key()
 	})
 
 	return mappings
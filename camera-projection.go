@@ -0,0 +1,440 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+// CameraModel describes how a camera maps the directions of incoming light onto its image.
+type CameraModel string
+
+const (
+	CameraModelPinhole CameraModel = "Pinhole" // Perspective projection with Brown-Conrady distortion. Suitable for angles of view up to about 120°.
+	CameraModelFisheye CameraModel = "Fisheye" // Equidistant projection with the distortion polynomial of OpenCV's fisheye model. Suitable for wide-angle and action cameras.
+
+	CameraModelEquirectangular CameraModel = "Equirectangular" // Spherical 360° panorama. The image spans 360° horizontally and 180° vertically.
+)
+
+// CameraModelOptions contains all selectable camera models.
+var CameraModelOptions = SelectOptions{
+	{string(CameraModelPinhole), "Pinhole (Brown-Conrady)"},
+	{string(CameraModelFisheye), "Fisheye (equidistant)"},
+	{string(CameraModelEquirectangular), "360° panorama (equirectangular)"},
+}
+
+// StringValue implements vgform.StringValuer.
+func (cm CameraModel) StringValue() string {
+	return string(cm)
+}
+
+// SetStringValue implements vgform.StringValuer.
+func (cm *CameraModel) SetStringValue(v string) {
+	*cm = CameraModel(v)
+}
+
+// cameraProjection contains everything needed to project world coordinates into the image space of a photo.
+type cameraProjection struct {
+	photo *CameraPhoto
+
+	rotationX, rotationY, rotationZ mgl64.Mat3 // Individual rotations around the axes. Needed for the derivatives.
+	rotation                        mgl64.Mat3 // Rotation from world into camera space.
+	position                        mgl64.Vec3 // Position of the camera in world space.
+
+	model           CameraModel
+	transform       imageTransform  // From the sensor frame into the upright image frame.
+	imageCenter     PixelCoordinate // Center of the image in the sensor frame.
+	imgBase         PixelCoordinate // Image center plus principal point offset.
+	focalLength     float64         // Focal length in pixels.
+	focalLengthDAOV float64         // Derivative of the focal length with respect to the horizontal angle of view.
+	ks              [CameraDistortionKs]float64
+	ps              [CameraDistortionPs]float64
+	bs              [CameraDistortionBs]float64
+}
+
+// projectionJacobian contains the partial derivatives of a projected image coordinate (u, v) and its depth z with respect to all parameters of the projection.
+// The first index is the output: 0 = u, 1 = v, 2 = z.
+type projectionJacobian struct {
+	Point       [3][3]float64 // With respect to the world coordinate of the projected point.
+	Position    [3][3]float64 // With respect to the position of the photo.
+	Orientation [3][3]float64 // With respect to the euler angles of the photo.
+
+	HorizontalAOV        [2]float64
+	PrincipalPointOffset [2][2]float64
+	DistortionKs         [2][CameraDistortionKs]float64
+	DistortionPs         [2][CameraDistortionPs]float64
+	DistortionBs         [2][CameraDistortionBs]float64
+}
+
+// lensDistortion contains the distorted normalized image coordinate (dx, dy) of a lens model, and its partial derivatives.
+type lensDistortion struct {
+	dx, dy                 float64
+	ux, uy                 float64 // Ideal normalized image coordinate of the model without any distortion.
+	dxDx, dxDy, dyDx, dyDy float64 // With respect to the normalized image coordinate (x, y).
+
+	// With respect to the distortion coefficients. The first index is the output: 0 = dx, 1 = dy.
+	ks [2][CameraDistortionKs]float64
+	ps [2][CameraDistortionPs]float64
+}
+
+// projection returns the current projection of the photo.
+// The result has to be recreated whenever any camera or photo parameter changes.
+func (cp *CameraPhoto) projection() cameraProjection {
+	camera := cp.camera
+
+	p := cameraProjection{photo: cp, model: camera.Model}
+
+	// Same as mgl64.AnglesToQuat(-X, -Y, -Z, mgl64.XYZ), but split into its individual rotations.
+	p.rotationX = mgl64.Rotate3DX(float64(-cp.Orientation.X()))
+	p.rotationY = mgl64.Rotate3DY(float64(-cp.Orientation.Y()))
+	p.rotationZ = mgl64.Rotate3DZ(float64(-cp.Orientation.Z()))
+	p.rotation = p.rotationX.Mul3(p.rotationY).Mul3(p.rotationZ)
+	p.position = cp.Position.Vec3()
+
+	// All intrinsic parameters refer to the sensor frame, which is always in landscape orientation.
+	sensorSize, transform := cp.sensorFrame()
+	p.transform = transform
+	p.imageCenter = sensorSize.Scaled(0.5)
+
+	// The photo may override some of the intrinsic parameters.
+	aov, principalPointOffset, k1 := camera.HorizontalAOV.Radian(), camera.PrincipalPointOffset, camera.DistortionKs[0]
+	if cp.Intrinsics.Active() {
+		aov, principalPointOffset, k1 = cp.Intrinsics.HorizontalAOV.Radian(), cp.Intrinsics.PrincipalPointOffset, cp.Intrinsics.K1
+	}
+	p.imgBase = p.imageCenter.Add(principalPointOffset)
+
+	// The horizontal angle of view describes the ideal projection of the model without any distortion.
+	// The focal length is in pixels per radian for the fisheye and the equirectangular model.
+	halfWidth := p.imageCenter.X().Pixels()
+	switch p.model {
+	case CameraModelFisheye:
+		// Equidistant: The image radius is proportional to the angle of incidence.
+		p.focalLength = halfWidth / (aov / 2)
+		p.focalLengthDAOV = -p.focalLength / aov
+	case CameraModelEquirectangular:
+		// The image always spans 360°, the angle of view isn't used.
+		p.focalLength = halfWidth / math.Pi
+	default:
+		aovHalfSin := math.Sin(aov / 2)
+		p.focalLength = halfWidth / math.Tan(aov/2)
+		p.focalLengthDAOV = -halfWidth / (2 * aovHalfSin * aovHalfSin)
+	}
+
+	for i, k := range camera.DistortionKs {
+		p.ks[i] = float64(k)
+	}
+	p.ks[0] = float64(k1)
+	for i, k := range camera.DistortionPs {
+		p.ps[i] = float64(k)
+	}
+	for i, k := range camera.DistortionBs {
+		p.bs[i] = float64(k)
+	}
+
+	return p
+}
+
+// distortBrownConrady applies the radial and tangential Brown-Conrady distortion to the normalized image coordinate (x, y).
+func (p *cameraProjection) distortBrownConrady(x, y float64) lensDistortion {
+	k1, k2, k3, k4 := p.ks[0], p.ks[1], p.ks[2], p.ks[3]
+	p1, p2, p3, p4 := p.ps[0], p.ps[1], p.ps[2], p.ps[3]
+
+	radiusSqr := x*x + y*y
+
+	// Radial distortion.
+	radial := 1 + k1*radiusSqr + k2*radiusSqr*radiusSqr + k3*radiusSqr*radiusSqr*radiusSqr + k4*radiusSqr*radiusSqr*radiusSqr*radiusSqr
+	// Tangential distortion.
+	p3p4 := 1 + p3*radiusSqr + p4*radiusSqr*radiusSqr
+	tx := p1*(radiusSqr+2*x*x) + 2*p2*x*y
+	ty := p2*(radiusSqr+2*y*y) + 2*p1*x*y
+
+	d := lensDistortion{dx: x*radial + tx*p3p4, dy: y*radial + ty*p3p4, ux: x, uy: y}
+
+	// Derivatives of the radial and tangential terms with respect to the squared radius.
+	radialDr := k1 + 2*k2*radiusSqr + 3*k3*radiusSqr*radiusSqr + 4*k4*radiusSqr*radiusSqr*radiusSqr
+	p3p4Dr := p3 + 2*p4*radiusSqr
+
+	// Derivatives of (dx, dy) with respect to (x, y).
+	d.dxDx = radial + 2*x*x*radialDr + (6*p1*x+2*p2*y)*p3p4 + tx*p3p4Dr*2*x
+	d.dxDy = 2*x*y*radialDr + (2*p1*y+2*p2*x)*p3p4 + tx*p3p4Dr*2*y
+	d.dyDx = 2*x*y*radialDr + (2*p2*x+2*p1*y)*p3p4 + ty*p3p4Dr*2*x
+	d.dyDy = radial + 2*y*y*radialDr + (6*p2*y+2*p1*x)*p3p4 + ty*p3p4Dr*2*y
+
+	radiusPow := radiusSqr
+	for i := range d.ks[0] {
+		d.ks[0][i], d.ks[1][i] = x*radiusPow, y*radiusPow
+		radiusPow *= radiusSqr
+	}
+
+	d.ps[0] = [CameraDistortionPs]float64{(radiusSqr + 2*x*x) * p3p4, 2 * x * y * p3p4, tx * radiusSqr, tx * radiusSqr * radiusSqr}
+	d.ps[1] = [CameraDistortionPs]float64{2 * x * y * p3p4, (radiusSqr + 2*y*y) * p3p4, ty * radiusSqr, ty * radiusSqr * radiusSqr}
+
+	return d
+}
+
+// distortFisheye maps the normalized image coordinate (x, y) by the equidistant fisheye model of OpenCV.
+// The distorted radius is θ·(1 + k1·θ² + k2·θ⁴ + k3·θ⁶ + k4·θ⁸), where θ is the angle of incidence.
+// The tangential coefficients are not used by this model.
+func (p *cameraProjection) distortFisheye(x, y float64) lensDistortion {
+	k1, k2, k3, k4 := p.ks[0], p.ks[1], p.ks[2], p.ks[3]
+
+	radius := math.Sqrt(x*x + y*y)
+	theta := math.Atan(radius)
+	thetaSqr := theta * theta
+	thetaD := theta * (1 + k1*thetaSqr + k2*thetaSqr*thetaSqr + k3*thetaSqr*thetaSqr*thetaSqr + k4*thetaSqr*thetaSqr*thetaSqr*thetaSqr)
+	thetaDDtheta := 1 + 3*k1*thetaSqr + 5*k2*thetaSqr*thetaSqr + 7*k3*thetaSqr*thetaSqr*thetaSqr + 9*k4*thetaSqr*thetaSqr*thetaSqr*thetaSqr
+
+	// The radial scale s = θd/r, and c = (ds/dr)/r.
+	// Both are replaced by their limits at the image center.
+	var scale, thetaScale, c float64
+	if radius < 1e-8 {
+		scale, thetaScale, c = 1, 1, 2*(k1-1.0/3)
+	} else {
+		scale, thetaScale = thetaD/radius, theta/radius
+		c = (thetaDDtheta*radius/(1+radius*radius) - thetaD) / (radius * radius * radius)
+	}
+
+	d := lensDistortion{dx: x * scale, dy: y * scale, ux: x * thetaScale, uy: y * thetaScale}
+
+	d.dxDx, d.dxDy = scale+x*x*c, x*y*c
+	d.dyDx, d.dyDy = x*y*c, scale+y*y*c
+
+	thetaPow := thetaScale * thetaSqr
+	for i := range d.ks[0] {
+		d.ks[0][i], d.ks[1][i] = x*thetaPow, y*thetaPow
+		thetaPow *= thetaSqr
+	}
+
+	return d
+}
+
+// project transforms the world coordinate into a distorted and an undistorted image coordinate.
+// The undistorted coordinate is the ideal projection of the camera model without any distortion coefficients.
+// If jac is not nil, it will be filled with the partial derivatives of the distorted image coordinate.
+func (p *cameraProjection) project(worldCoordinate Coordinate, jac *projectionJacobian) (distorted, undistorted PixelCoordinate) {
+	// Rotate and translate the world coordinate into the camera coordinate system.
+	d := worldCoordinate.Vec3().Sub(p.position)
+	loc := p.rotation.Mul3x1(d)
+
+	// Derivatives of (u, v, z) with respect to the local camera coordinate.
+	var locJac [3]mgl64.Vec3
+
+	switch p.model {
+	case CameraModelEquirectangular:
+		distorted, undistorted, locJac = p.projectSpherical(loc, jac)
+	default:
+		distorted, undistorted, locJac = p.projectPerspective(loc, jac)
+	}
+
+	distorted, undistorted = p.transform.apply(distorted), p.transform.apply(undistorted)
+
+	if jac == nil {
+		return
+	}
+
+	// Derivatives of the local camera coordinate with respect to the euler angles.
+	// The rotation is R = Rx(-ox) * Ry(-oy) * Rz(-oz), the derivative of a rotation is the rotation times a cross product with its axis.
+	w3 := p.rotationZ.Mul3x1(d)
+	w2 := p.rotationY.Mul3x1(w3)
+	locDo := [3]mgl64.Vec3{
+		p.rotationX.Mul3x1(mgl64.Vec3{1, 0, 0}.Cross(w2)).Mul(-1),
+		p.rotationX.Mul3x1(p.rotationY.Mul3x1(mgl64.Vec3{0, 1, 0}.Cross(w3))).Mul(-1),
+		p.rotation.Mul3x1(mgl64.Vec3{0, 0, 1}.Cross(d)).Mul(-1),
+	}
+
+	for o := 0; o < 3; o++ {
+		for i := 0; i < 3; i++ {
+			// The derivative of the local coordinate with respect to the world coordinate is the rotation matrix itself.
+			pointD := locJac[o].Dot(p.rotation.Col(i))
+			jac.Point[o][i] = pointD
+			jac.Position[o][i] = -pointD
+			jac.Orientation[o][i] = locJac[o].Dot(locDo[i])
+		}
+	}
+
+	jac.transformImage(p.transform)
+
+	return
+}
+
+// projectPerspective projects the local camera coordinate through a lens with a central perspective, like the pinhole and fisheye models.
+// The returned z is the depth along the optical axis.
+// If jac is not nil, it will be filled with the partial derivatives with respect to the intrinsic parameters, and locJac contains the derivatives with respect to loc.
+func (p *cameraProjection) projectPerspective(loc mgl64.Vec3, jac *projectionJacobian) (distorted, undistorted PixelCoordinate, locJac [3]mgl64.Vec3) {
+	b1, b2 := p.bs[0], p.bs[1]
+	f := p.focalLength
+
+	// Scale X and Y camera coordinates on Z distance. (Perspective projection)
+	x, y, z := loc[0]/loc[2], loc[1]/loc[2], loc[2]
+
+	// Lens distortion.
+	var dist lensDistortion
+	switch p.model {
+	case CameraModelFisheye:
+		dist = p.distortFisheye(x, y)
+	default:
+		dist = p.distortBrownConrady(x, y)
+	}
+	dx, dy := dist.dx, dist.dy
+
+	// Transformation into image space and last distortion.
+	distorted = PixelCoordinate{
+		p.imgBase.X() + PixelDistance(dx*f+dx*b1+dy*b2),
+		p.imgBase.Y() + PixelDistance(dy*f),
+		PixelDistance(z),
+	}
+	undistorted = PixelCoordinate{
+		p.imgBase.X() + PixelDistance(dist.ux*f),
+		p.imgBase.Y() + PixelDistance(dist.uy*f),
+		PixelDistance(z),
+	}
+
+	if jac == nil {
+		return
+	}
+
+	// Derivatives of (u, v) with respect to (dx, dy).
+	uDdx, uDdy := f+b1, b2
+	vDdy := f
+
+	// Derivatives of (u, v) with respect to (x, y).
+	uDx, uDy := uDdx*dist.dxDx+uDdy*dist.dyDx, uDdx*dist.dxDy+uDdy*dist.dyDy
+	vDx, vDy := vDdy*dist.dyDx, vDdy*dist.dyDy
+
+	locJac[0] = mgl64.Vec3{uDx / z, uDy / z, -(uDx*x + uDy*y) / z}
+	locJac[1] = mgl64.Vec3{vDx / z, vDy / z, -(vDx*x + vDy*y) / z}
+	locJac[2] = mgl64.Vec3{0, 0, 1}
+
+	// Derivatives with respect to the intrinsic camera parameters.
+	jac.HorizontalAOV = [2]float64{dx * p.focalLengthDAOV, dy * p.focalLengthDAOV}
+	jac.PrincipalPointOffset = [2][2]float64{{1, 0}, {0, 1}}
+
+	for i := range jac.DistortionKs[0] {
+		jac.DistortionKs[0][i] = uDdx*dist.ks[0][i] + uDdy*dist.ks[1][i]
+		jac.DistortionKs[1][i] = vDdy * dist.ks[1][i]
+	}
+	for i := range jac.DistortionPs[0] {
+		jac.DistortionPs[0][i] = uDdx*dist.ps[0][i] + uDdy*dist.ps[1][i]
+		jac.DistortionPs[1][i] = vDdy * dist.ps[1][i]
+	}
+
+	jac.DistortionBs[0] = [CameraDistortionBs]float64{dx, dy}
+	jac.DistortionBs[1] = [CameraDistortionBs]float64{0, 0}
+
+	return
+}
+
+// projectSpherical projects the local camera coordinate onto an equirectangular panorama.
+// The horizontal image axis is the bearing around the camera's Y axis, and the vertical image axis is the elevation.
+// The horizontal image coordinate is wrapped into the image, and the returned z is the distance to the camera, so every direction is visible.
+// If jac is not nil, it will be filled with the partial derivatives with respect to the intrinsic parameters, and locJac contains the derivatives with respect to loc.
+func (p *cameraProjection) projectSpherical(loc mgl64.Vec3, jac *projectionJacobian) (distorted, undistorted PixelCoordinate, locJac [3]mgl64.Vec3) {
+	f := p.focalLength
+	x, y, z := loc[0], loc[1], loc[2]
+
+	horizontalSqr := x*x + z*z
+	horizontal := math.Max(math.Sqrt(horizontalSqr), 1e-12)
+	distanceSqr := horizontalSqr + y*y
+	distance := math.Sqrt(distanceSqr)
+
+	bearing := math.Atan2(x, z)
+	elevation := math.Atan2(y, horizontal)
+
+	u := p.imgBase.X().Pixels() + bearing*f
+	width := 2 * p.imageCenter.X().Pixels()
+	if width > 0 {
+		u -= math.Floor(u/width) * width
+	}
+
+	distorted = PixelCoordinate{PixelDistance(u), p.imgBase.Y() + PixelDistance(elevation*f), PixelDistance(distance)}
+	undistorted = distorted
+
+	if jac == nil {
+		return
+	}
+
+	locJac[0] = mgl64.Vec3{f * z / (horizontal * horizontal), 0, -f * x / (horizontal * horizontal)}
+	locJac[1] = mgl64.Vec3{-f * x * y / (horizontal * distanceSqr), f * horizontal / distanceSqr, -f * z * y / (horizontal * distanceSqr)}
+	locJac[2] = loc.Mul(1 / distance)
+
+	jac.PrincipalPointOffset = [2][2]float64{{1, 0}, {0, 1}}
+
+	return
+}
+
+// transformImage transforms the derivatives of the image coordinate (u, v) by the rotation and mirroring of the given image transformation.
+func (jac *projectionJacobian) transformImage(t imageTransform) {
+	if t.m == identityImageTransform.m {
+		return
+	}
+
+	transformRows := func(u, v []float64) {
+		for i := range u {
+			u[i], v[i] = t.m[0][0]*u[i]+t.m[0][1]*v[i], t.m[1][0]*u[i]+t.m[1][1]*v[i]
+		}
+	}
+
+	transformRows(jac.Point[0][:], jac.Point[1][:])
+	transformRows(jac.Position[0][:], jac.Position[1][:])
+	transformRows(jac.Orientation[0][:], jac.Orientation[1][:])
+	transformRows(jac.HorizontalAOV[0:1], jac.HorizontalAOV[1:2])
+	transformRows(jac.PrincipalPointOffset[0][:], jac.PrincipalPointOffset[1][:])
+	transformRows(jac.DistortionKs[0][:], jac.DistortionKs[1][:])
+	transformRows(jac.DistortionPs[0][:], jac.DistortionPs[1][:])
+	transformRows(jac.DistortionBs[0][:], jac.DistortionBs[1][:])
+}
+
+// forEachDerivative calls addFunc for every partial derivative of a residual that is a weighted sum of the projected coordinate (u, v, z).
+// point is the projected point, and weights contains the factors for u, v and z.
+func (jac *projectionJacobian) forEachDerivative(photo *CameraPhoto, point *Point, residualIndex int, weights [3]float64, addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	camera := photo.camera
+
+	// sum returns the weighted sum of the derivatives of u, v and z.
+	sum := func(u, v, z float64) float64 {
+		return weights[0]*u + weights[1]*v + weights[2]*z
+	}
+
+	for i := 0; i < 3; i++ {
+		addFunc(residualIndex, &point.Position.Coordinate[i], sum(jac.Point[0][i], jac.Point[1][i], jac.Point[2][i]))
+		addFunc(residualIndex, &photo.Position.Coordinate[i], sum(jac.Position[0][i], jac.Position[1][i], jac.Position[2][i]))
+		addFunc(residualIndex, &photo.Orientation.Rotation[i], sum(jac.Orientation[0][i], jac.Orientation[1][i], jac.Orientation[2][i]))
+	}
+
+	// Overridden intrinsic parameters of the photo replace the ones of the camera.
+	aov, principalPointOffset, ks := &camera.HorizontalAOV, &camera.PrincipalPointOffset, []Tweakable{}
+	for i := range camera.DistortionKs {
+		ks = append(ks, &camera.DistortionKs[i])
+	}
+	if photo.Intrinsics.Active() {
+		aov, principalPointOffset, ks[0] = &photo.Intrinsics.HorizontalAOV, &photo.Intrinsics.PrincipalPointOffset, &photo.Intrinsics.K1
+	}
+
+	addFunc(residualIndex, aov, sum(jac.HorizontalAOV[0], jac.HorizontalAOV[1], 0))
+	for i := range principalPointOffset[:2] {
+		addFunc(residualIndex, &principalPointOffset[i], sum(jac.PrincipalPointOffset[0][i], jac.PrincipalPointOffset[1][i], 0))
+	}
+	for i, k := range ks {
+		addFunc(residualIndex, k, sum(jac.DistortionKs[0][i], jac.DistortionKs[1][i], 0))
+	}
+	for i := range camera.DistortionPs {
+		addFunc(residualIndex, &camera.DistortionPs[i], sum(jac.DistortionPs[0][i], jac.DistortionPs[1][i], 0))
+	}
+	for i := range camera.DistortionBs {
+		addFunc(residualIndex, &camera.DistortionBs[i], sum(jac.DistortionBs[0][i], jac.DistortionBs[1][i], 0))
+	}
+}
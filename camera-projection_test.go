@@ -0,0 +1,93 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestDistortFisheye checks the equidistant fisheye model against its definition, and its derivatives against finite differences.
+func TestDistortFisheye(t *testing.T) {
+	p := cameraProjection{model: CameraModelFisheye, ks: [CameraDistortionKs]float64{0.1, -0.02, 0.003, 0.001}}
+
+	for _, c := range [][2]float64{{0.5, 0.3}, {2, -3}, {1e-10, 2e-10}} {
+		x, y := c[0], c[1]
+		d := p.distortFisheye(x, y)
+
+		// θd = θ·(1 + k1·θ² + k2·θ⁴ + k3·θ⁶ + k4·θ⁸), where θ is the angle of the ray to the optical axis.
+		radius := math.Hypot(x, y)
+		theta := math.Atan(radius)
+		thetaD := theta * (1 + 0.1*math.Pow(theta, 2) - 0.02*math.Pow(theta, 4) + 0.003*math.Pow(theta, 6) + 0.001*math.Pow(theta, 8))
+		if wantX, wantY := thetaD/radius*x, thetaD/radius*y; math.Abs(d.dx-wantX) > 1e-12 || math.Abs(d.dy-wantY) > 1e-12 {
+			t.Errorf("distortFisheye(%v, %v) = (%v, %v), want (%v, %v)", x, y, d.dx, d.dy, wantX, wantY)
+		}
+
+		const h = 1e-7
+		dxPlus, dxMinus := p.distortFisheye(x+h, y), p.distortFisheye(x-h, y)
+		dyPlus, dyMinus := p.distortFisheye(x, y+h), p.distortFisheye(x, y-h)
+		numeric := [4]float64{(dxPlus.dx - dxMinus.dx) / (2 * h), (dyPlus.dx - dyMinus.dx) / (2 * h), (dxPlus.dy - dxMinus.dy) / (2 * h), (dyPlus.dy - dyMinus.dy) / (2 * h)}
+		analytic := [4]float64{d.dxDx, d.dxDy, d.dyDx, d.dyDy}
+		for i := range numeric {
+			if math.Abs(analytic[i]-numeric[i]) > 1e-6 {
+				t.Errorf("Derivative %d at (%v, %v) is %v, want %v", i, x, y, analytic[i], numeric[i])
+			}
+		}
+	}
+}
+
+// TestEquirectangularSeam checks that mappings across the left and right edge of a panorama have small residuals.
+func TestEquirectangularSeam(t *testing.T) {
+	site := NewSite("seam")
+	camera := site.NewCamera("Camera")
+	camera.Model = CameraModelEquirectangular
+	photo := newTestPhoto(camera, PixelCoordinate{4000, 2000}, 1)
+	photo.Orientation.Rotation = Rotation{math.Pi / 2, 0, 0}
+
+	if c := photo.WrapImageCoordinate(PixelCoordinate{-1, 5}); c != (PixelCoordinate{3999, 5}) {
+		t.Errorf("WrapImageCoordinate() returned %v, want {3999, 5}", c)
+	}
+	if c := photo.NearestImageCoordinate(PixelCoordinate{3999.5, 5}, PixelCoordinate{0.5, 5}); c != (PixelCoordinate{-0.5, 5}) {
+		t.Errorf("NearestImageCoordinate() returned %v, want {-0.5, 5}", c)
+	}
+
+	// Find a direction that is projected onto the seam.
+	projection := photo.projection()
+	var seam Coordinate
+	for i := 0; i < 3600; i++ {
+		angle := float64(i) * math.Pi / 1800
+		coordinate := Coordinate{Distance(10 * math.Cos(angle)), Distance(10 * math.Sin(angle)), 1}
+		if projected, _ := projection.project(coordinate, nil); projected[0] < 2 || projected[0] > 3998 {
+			seam = coordinate
+			break
+		}
+	}
+	if seam == (Coordinate{}) {
+		t.Fatalf("No direction is projected onto the seam")
+	}
+
+	point := site.NewPoint("Seam")
+	point.Position.Coordinate = seam
+	projected, _ := projection.project(seam, nil)
+	for _, offset := range []PixelDistance{-3, 3} {
+		mapping := photo.NewMapping()
+		mapping.PointKey = point.Key()
+		mapping.Position = photo.WrapImageCoordinate(PixelCoordinate{projected[0] + offset, projected[1]})
+		if r := mapping.Residuals(); math.Hypot(r[0], r[1]) > 3.01/float64(camera.PixelAccuracy) {
+			t.Errorf("Mapping %v px away from the projection at %v has the residuals %v", offset, projected, r)
+		}
+	}
+}
@@ -43,6 +43,9 @@ type Camera struct {
 	CreatedAt time.Time
 
 	PixelAccuracy PixelDistance // Accuracy of the measurement.
+	RobustLoss    RobustLoss    // Robust loss function for all point mappings. Overrides the site's loss function.
+
+	Model CameraModel // Projection model of the lens.
 
 	HorizontalAOV       Angle // The horizontal angle of view of the camera.
 	HorizontalAOVLocked bool  // Prevent the value from being optimized.
@@ -50,6 +53,8 @@ type Camera struct {
 	// Lens distortion model parameters.
 	// We will the Brown-Conrady model with the transformation direction from undistorted to distorted.
 	// This is similar to what OpenCV uses, see: https://docs.opencv.org/3.4/d9/d0c/group__calib3d.html
+	// The fisheye model uses the radial coefficients on the angle of incidence instead, like OpenCV's fisheye module: https://docs.opencv.org/3.4/db/d58/group__calib3d__fisheye.html
+	// Equirectangular panoramas are stitched images without any lens, so they only use the principal point offset.
 
 	PrincipalPointOffset       PixelCoordinate
 	PrincipalPointOffsetLocked bool
@@ -61,6 +66,13 @@ type Camera struct {
 	DistortionBsLocked         [CameraDistortionBs]bool           // Locked state of the distortion coefficients.
 
 	Photos map[string]*CameraPhoto
+
+	CalibrationBoard  CalibrationBoard                   // Checkerboard that is used for the calibration.
+	CalibrationPhotos map[string]*CameraCalibrationPhoto // Detected checkerboards of the calibration photos.
+	CalibrationResult *CameraCalibrationResult           `json:",omitempty"` // Summary of the last calibration, if any.
+
+	UndistortInterpolation ImageInterpolation // Interpolation that is used to export undistorted photos.
+	UndistortCrop          bool               // Crop undistorted photos to the area with valid pixels.
 }
 
 func (s *Site) NewCamera(name string) *Camera {
@@ -76,6 +88,8 @@ func (s *Site) NewCamera(name string) *Camera {
 func (c *Camera) initData() {
 	c.CreatedAt = time.Now()
 	c.PixelAccuracy = 100
+	c.RobustLoss = RobustLoss{Function: RobustLossFunctionSite, Threshold: 3}
+	c.Model = CameraModelPinhole
 	c.HorizontalAOV = 70 * 2 * math.Pi / 360 // Start with a guess of 70 deg for AOV.
 	c.HorizontalAOVLocked = true             // Lock AOV by default.
 	c.PrincipalPointOffsetLocked = true
@@ -83,6 +97,10 @@ func (c *Camera) initData() {
 	c.DistortionPsLocked = [4]bool{true, true, true, true}
 	c.DistortionBsLocked = [2]bool{true, true}
 	c.Photos = map[string]*CameraPhoto{}
+	c.CalibrationBoard = CalibrationBoard{Columns: 9, Rows: 6, SquareSize: 0.025}
+	c.CalibrationPhotos = map[string]*CameraCalibrationPhoto{}
+	c.UndistortInterpolation = ImageInterpolationBicubic
+	c.UndistortCrop = true
 }
 
 // initReferences updates references from and to this object and its key.
@@ -106,6 +124,20 @@ func (c *Camera) DisplayName() string {
 	return "(" + c.Key() + ")"
 }
 
+// EffectiveRobustLoss returns the robust loss function that is used for all measurements of this device.
+func (c *Camera) EffectiveRobustLoss() RobustLoss {
+	if c.RobustLoss.Function == RobustLossFunctionSite {
+		return c.site.RobustLoss
+	}
+
+	return c.RobustLoss
+}
+
+// Panoramic returns whether the photos of this camera are equirectangular 360° panoramas.
+func (c *Camera) Panoramic() bool {
+	return c.Model == CameraModelEquirectangular
+}
+
 func (c *Camera) Delete() {
 	delete(c.site.Cameras, c.Key())
 }
@@ -119,6 +151,8 @@ func (c *Camera) Copy(newParent *Site, newKey string) *Camera {
 	copy.Name = c.Name
 	copy.CreatedAt = c.CreatedAt
 	copy.PixelAccuracy = c.PixelAccuracy
+	copy.RobustLoss = c.RobustLoss
+	copy.Model = c.Model
 	copy.HorizontalAOV = c.HorizontalAOV
 	copy.HorizontalAOVLocked = c.HorizontalAOVLocked
 	copy.PrincipalPointOffset = c.PrincipalPointOffset
@@ -129,11 +163,18 @@ func (c *Camera) Copy(newParent *Site, newKey string) *Camera {
 	copy.DistortionPsLocked = c.DistortionPsLocked
 	copy.DistortionBs = c.DistortionBs
 	copy.DistortionBsLocked = c.DistortionBsLocked
+	copy.CalibrationBoard = c.CalibrationBoard
+	copy.CalibrationResult = c.CalibrationResult
+	copy.UndistortInterpolation = c.UndistortInterpolation
+	copy.UndistortCrop = c.UndistortCrop
 
 	// Generate copies of all children.
 	for k, v := range c.Photos {
 		v.Copy(copy, k)
 	}
+	for k, v := range c.CalibrationPhotos {
+		v.Copy(copy, k)
+	}
 
 	return copy
 }
@@ -151,6 +192,9 @@ func (c *Camera) UnmarshalJSON(data []byte) error {
 	for k, v := range c.Photos {
 		v.initReferences(c, k)
 	}
+	for k, v := range c.CalibrationPhotos {
+		v.initReferences(c, k)
+	}
 
 	return nil
 }
@@ -174,6 +218,17 @@ func (c *Camera) handleFileChange(event vugu.DOMEvent) {
 			return nil
 		}
 
+		// The first photo of a camera replaces the guessed angle of view with the one from its metadata.
+		if len(c.Photos) == 1 {
+			if aov, _, ok := c.ExifAOV(); ok {
+				log.Printf("Using the horizontal angle of view of %.2f° from the EXIF metadata (%s)", aov.Degree(), photo.exif.Description())
+				c.HorizontalAOV = aov
+			}
+		}
+		if warning := c.photoWarning(photo, c.referencePhoto()); warning != "" {
+			log.Printf("Camera %s: %s", c.DisplayName(), warning)
+		}
+
 		c.Navigate("/camera/"+c.Key()+"/photo/"+photo.Key(), nil)
 
 		return js.Undefined()
@@ -187,7 +242,10 @@ func (c *Camera) handleFileChange(event vugu.DOMEvent) {
 func (c *Camera) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
 	tweakables, residuals := []Tweakable{}, []Residualer{}
 
-	if !c.HorizontalAOVLocked {
+	// Panoramas have a fixed angle of view and no lens distortion.
+	lens := !c.Panoramic()
+
+	if !c.HorizontalAOVLocked && lens {
 		tweakables = append(tweakables, &c.HorizontalAOV)
 	}
 
@@ -197,11 +255,24 @@ func (c *Camera) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
 	}
 
 	for i, locked := range c.DistortionKsLocked {
-		if !locked {
+		if !locked && lens {
 			tweakables = append(tweakables, &c.DistortionKs[i])
 		}
 	}
 
+	// The fisheye model has no tangential distortion.
+	for i, locked := range c.DistortionPsLocked {
+		if !locked && lens && c.Model != CameraModelFisheye {
+			tweakables = append(tweakables, &c.DistortionPs[i])
+		}
+	}
+
+	for i, locked := range c.DistortionBsLocked {
+		if !locked && lens {
+			tweakables = append(tweakables, &c.DistortionBs[i])
+		}
+	}
+
 	for _, photo := range c.PhotosSorted() {
 		newTweakables, newResiduals := photo.GetTweakablesAndResiduals()
 		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
@@ -219,7 +290,10 @@ func (s *Camera) PhotosSorted() []*CameraPhoto {
 	}
 
 	sort.Slice(photos, func(i, j int) bool {
-		return photos[i].CreatedAt.After(photos[j].CreatedAt)
+		if !photos[i].CreatedAt.Equal(photos[j].CreatedAt) {
+			return photos[i].CreatedAt.After(photos[j].CreatedAt)
+		}
+		return photos[i].Key() < photos[j].Key()
 	})
 
 	return photos
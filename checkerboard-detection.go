@@ -0,0 +1,457 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+const (
+	checkerboardDetectionSize = 1024 // Long side of the downscaled image that is used to find corner candidates.
+	checkerboardMaxSeeds      = 30   // Number of the strongest corner candidates that are tried as the start of a grid.
+)
+
+// luminanceImage gives fast access to the luminance of an image, between 0 and 1.
+type luminanceImage struct {
+	bounds image.Rectangle
+	at     func(x, y int) float64 // Luminance at the given pixel. The coordinates must be inside the bounds.
+}
+
+// newLuminanceImage returns the luminance of the given image.
+// The luma channel of JPEG images is used directly.
+func newLuminanceImage(img image.Image) luminanceImage {
+	bounds := img.Bounds()
+
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return luminanceImage{bounds, func(x, y int) float64 { return float64(img.Y[img.YOffset(x, y)]) / 255 }}
+	case *image.Gray:
+		return luminanceImage{bounds, func(x, y int) float64 { return float64(img.Pix[img.PixOffset(x, y)]) / 255 }}
+	}
+
+	return luminanceImage{bounds, func(x, y int) float64 {
+		return float64(color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y) / 65535
+	}}
+}
+
+// clampedAt returns the luminance at the given pixel. Pixels outside of the image are clamped to the border.
+func (l luminanceImage) clampedAt(x, y int) float64 {
+	x = max(l.bounds.Min.X, min(x, l.bounds.Max.X-1))
+	y = max(l.bounds.Min.Y, min(y, l.bounds.Max.Y-1))
+	return l.at(x, y)
+}
+
+// grayImage is a small grayscale image with floating point intensities, used for the corner detection.
+type grayImage struct {
+	width, height int
+	pix           []float64
+}
+
+// newDownscaledGrayImage returns the luminance of the image, downscaled by the given integer factor with a box filter.
+func newDownscaledGrayImage(l luminanceImage, factor int) *grayImage {
+	width, height := l.bounds.Dx()/factor, l.bounds.Dy()/factor
+	g := &grayImage{width: width, height: height, pix: make([]float64, width*height)}
+
+	scale := 1 / float64(factor*factor)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sum := 0.0
+			for sy := 0; sy < factor; sy++ {
+				for sx := 0; sx < factor; sx++ {
+					sum += l.at(l.bounds.Min.X+x*factor+sx, l.bounds.Min.Y+y*factor+sy)
+				}
+			}
+			g.pix[y*width+x] = sum * scale
+		}
+	}
+
+	return g
+}
+
+// at returns the intensity at the given pixel. Pixels outside of the image are clamped to the border.
+func (g *grayImage) at(x, y int) float64 {
+	x, y = max(0, min(x, g.width-1)), max(0, min(y, g.height-1))
+	return g.pix[y*g.width+x]
+}
+
+// blurred returns the image convolved with a gaussian kernel of the given standard deviation.
+func (g *grayImage) blurred(sigma float64) *grayImage {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	// Separable convolution, first horizontally then vertically.
+	temp := &grayImage{width: g.width, height: g.height, pix: make([]float64, len(g.pix))}
+	for y := 0; y < g.height; y++ {
+		for x := 0; x < g.width; x++ {
+			value := 0.0
+			for i, k := range kernel {
+				value += k * g.at(x+i-radius, y)
+			}
+			temp.pix[y*g.width+x] = value
+		}
+	}
+	result := &grayImage{width: g.width, height: g.height, pix: make([]float64, len(g.pix))}
+	for y := 0; y < g.height; y++ {
+		for x := 0; x < g.width; x++ {
+			value := 0.0
+			for i, k := range kernel {
+				value += k * temp.at(x, y+i-radius)
+			}
+			result.pix[y*g.width+x] = value
+		}
+	}
+
+	return result
+}
+
+// checkerboardCandidate is a possible inner corner of a checkerboard.
+type checkerboardCandidate struct {
+	x, y     float64
+	response float64 // Strength of the saddle point.
+}
+
+// checkerboardCandidates returns all saddle points of the blurred image that look like an inner checkerboard corner, sorted by their strength.
+func checkerboardCandidates(g *grayImage, sigma float64) []checkerboardCandidate {
+	// The negative determinant of the hessian is large at saddle points, like where four checkerboard squares meet.
+	response := make([]float64, len(g.pix))
+	maxResponse := 0.0
+	for y := 1; y < g.height-1; y++ {
+		for x := 1; x < g.width-1; x++ {
+			center := g.at(x, y)
+			dxx := g.at(x+1, y) - 2*center + g.at(x-1, y)
+			dyy := g.at(x, y+1) - 2*center + g.at(x, y-1)
+			dxy := (g.at(x+1, y+1) - g.at(x+1, y-1) - g.at(x-1, y+1) + g.at(x-1, y-1)) / 4
+			r := dxy*dxy - dxx*dyy
+			response[y*g.width+x] = r
+			maxResponse = max(maxResponse, r)
+		}
+	}
+
+	// Non maximum suppression, and a check of the intensity pattern around the candidate.
+	radius := max(2, int(math.Round(2*sigma)))
+	circleRadius := 3 * sigma
+	var candidates []checkerboardCandidate
+	for y := radius; y < g.height-radius; y++ {
+		for x := radius; x < g.width-radius; x++ {
+			r := response[y*g.width+x]
+			if r < 0.05*maxResponse {
+				continue
+			}
+			isMax := true
+			for ny := y - radius; ny <= y+radius && isMax; ny++ {
+				for nx := x - radius; nx <= x+radius; nx++ {
+					if response[ny*g.width+nx] > r {
+						isMax = false
+						break
+					}
+				}
+			}
+			if isMax && checkerboardCirclePattern(g, float64(x), float64(y), circleRadius) {
+				candidates = append(candidates, checkerboardCandidate{x: float64(x), y: float64(y), response: r})
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].response > candidates[j].response })
+
+	return candidates
+}
+
+// checkerboardCirclePattern returns whether the intensities on a circle around the given position alternate between dark and bright exactly four times, like around an inner checkerboard corner.
+func checkerboardCirclePattern(g *grayImage, x, y, radius float64) bool {
+	const samples = 32
+
+	values := make([]float64, samples)
+	low, high := math.Inf(1), math.Inf(-1)
+	for i := range values {
+		angle := 2 * math.Pi * float64(i) / samples
+		values[i] = g.at(int(math.Round(x+radius*math.Cos(angle))), int(math.Round(y+radius*math.Sin(angle))))
+		low, high = min(low, values[i]), max(high, values[i])
+	}
+	if high-low < 0.1 {
+		return false
+	}
+
+	threshold := (low + high) / 2
+	transitions := 0
+	for i := range values {
+		if (values[i] > threshold) != (values[(i+1)%samples] > threshold) {
+			transitions++
+		}
+	}
+
+	return transitions == 4
+}
+
+// checkerboardGridIndex is the position of a corner inside the grid of inner corners.
+type checkerboardGridIndex struct {
+	i, j int
+}
+
+// assembleCheckerboardGrid tries to find a regular grid of the given size that starts at the seed candidate.
+// The result contains the candidate indices row by row, or nil if there is no grid of the given size.
+func assembleCheckerboardGrid(candidates []checkerboardCandidate, seed, columns, rows int) []int {
+	position := func(index int) (float64, float64) { return candidates[index].x, candidates[index].y }
+
+	// findNearest returns the unused candidate closest to the given position, if it is within the given distance.
+	used := map[int]bool{seed: true}
+	findNearest := func(x, y, maxDistance float64, accept func(index int) bool) int {
+		best, bestDistSqr := -1, maxDistance*maxDistance
+		for index, candidate := range candidates {
+			if used[index] || (accept != nil && !accept(index)) {
+				continue
+			}
+			if distSqr := (candidate.x-x)*(candidate.x-x) + (candidate.y-y)*(candidate.y-y); distSqr < bestDistSqr {
+				best, bestDistSqr = index, distSqr
+			}
+		}
+		return best
+	}
+
+	// The nearest candidate defines the first grid direction, the nearest one roughly perpendicular to that the second one.
+	sx, sy := position(seed)
+	first := findNearest(sx, sy, math.Inf(1), nil)
+	if first < 0 {
+		return nil
+	}
+	fx, fy := position(first)
+	d1x, d1y := fx-sx, fy-sy
+	d1 := math.Hypot(d1x, d1y)
+	second := findNearest(sx, sy, 2*d1, func(index int) bool {
+		x, y := position(index)
+		dx, dy := x-sx, y-sy
+		return math.Abs(dx*d1x+dy*d1y) < 0.5*d1*math.Hypot(dx, dy)
+	})
+	if second < 0 {
+		return nil
+	}
+
+	grid := map[checkerboardGridIndex]int{{0, 0}: seed, {1, 0}: first, {0, 1}: second}
+	used[first], used[second] = true, true
+
+	// Grow the grid by predicting the position of the neighbors of every known corner.
+	directions := []checkerboardGridIndex{{1, 0}, {-1, 0}, {0, 1}, {0, -1}}
+	for grown := true; grown; {
+		grown = false
+		for index, corner := range grid {
+			cx, cy := position(corner)
+			for _, d := range directions {
+				neighbor := checkerboardGridIndex{index.i + d.i, index.j + d.j}
+				if _, ok := grid[neighbor]; ok {
+					continue
+				}
+
+				// Extrapolate along the same direction, or use the step of a parallel neighbor.
+				var stepX, stepY float64
+				if previous, ok := grid[checkerboardGridIndex{index.i - d.i, index.j - d.j}]; ok {
+					px, py := position(previous)
+					stepX, stepY = cx-px, cy-py
+				} else {
+					found := false
+					for _, side := range []checkerboardGridIndex{{d.j, d.i}, {-d.j, -d.i}} {
+						a, okA := grid[checkerboardGridIndex{index.i + side.i, index.j + side.j}]
+						b, okB := grid[checkerboardGridIndex{index.i + side.i + d.i, index.j + side.j + d.j}]
+						if okA && okB {
+							ax, ay := position(a)
+							bx, by := position(b)
+							stepX, stepY, found = bx-ax, by-ay, true
+							break
+						}
+					}
+					if !found {
+						continue
+					}
+				}
+
+				x, y := cx+stepX, cy+stepY
+				if match := findNearest(x, y, 0.3*math.Hypot(stepX, stepY), nil); match >= 0 {
+					grid[neighbor], used[match], grown = match, true, true
+				}
+			}
+		}
+	}
+
+	// The grid must have exactly the expected size, transposed grids are rotated into place.
+	minI, maxI, minJ, maxJ := math.MaxInt, math.MinInt, math.MaxInt, math.MinInt
+	for index := range grid {
+		minI, maxI, minJ, maxJ = min(minI, index.i), max(maxI, index.i), min(minJ, index.j), max(maxJ, index.j)
+	}
+	width, height := maxI-minI+1, maxJ-minJ+1
+	if len(grid) != columns*rows || width*height != columns*rows {
+		return nil
+	}
+
+	result := make([]int, 0, columns*rows)
+	switch {
+	case width == columns && height == rows:
+		for j := minJ; j <= maxJ; j++ {
+			for i := minI; i <= maxI; i++ {
+				result = append(result, grid[checkerboardGridIndex{i, j}])
+			}
+		}
+	case width == rows && height == columns:
+		for i := minI; i <= maxI; i++ {
+			for j := maxJ; j >= minJ; j-- {
+				result = append(result, grid[checkerboardGridIndex{i, j}])
+			}
+		}
+	default:
+		return nil
+	}
+
+	return result
+}
+
+// forstnerNormals contains the weighted sums of the junction point estimator of Förstner for a window of an image.
+type forstnerNormals struct {
+	a11, a12, a22 float64 // Normal matrix, the sum of the weighted structure tensors.
+	b1, b2        float64 // Right hand side.
+
+	sumSqr, sumWeight float64 // Weighted sum of squared residuals and sum of weights, used to estimate the variance of unit weight.
+}
+
+// newForstnerNormals sums up the estimator for the window with the given radius around (x, y).
+// at returns the luminance of a pixel, the position is in continuous image coordinates, where the center of the top left pixel is at (0.5, 0.5).
+func newForstnerNormals(at func(x, y int) float64, x, y float64, radius int) forstnerNormals {
+	var n forstnerNormals
+	sigma := float64(radius) / 2
+
+	cx, cy := int(math.Floor(x)), int(math.Floor(y))
+	for wy := -radius; wy <= radius; wy++ {
+		for wx := -radius; wx <= radius; wx++ {
+			px, py := cx+wx, cy+wy
+			gx := (at(px+1, py) - at(px-1, py)) / 2
+			gy := (at(px, py+1) - at(px, py-1)) / 2
+
+			// Gaussian weight around the current estimate, with the pixel center at +0.5.
+			qx, qy := float64(px)+0.5, float64(py)+0.5
+			dx, dy := qx-x, qy-y
+			weight := math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+
+			gxx, gxy, gyy := weight*gx*gx, weight*gx*gy, weight*gy*gy
+			n.a11, n.a12, n.a22 = n.a11+gxx, n.a12+gxy, n.a22+gyy
+			n.b1, n.b2 = n.b1+gxx*qx+gxy*qy, n.b2+gxy*qx+gyy*qy
+
+			r := gx*dx + gy*dy
+			n.sumSqr, n.sumWeight = n.sumSqr+weight*r*r, n.sumWeight+weight
+		}
+	}
+
+	return n
+}
+
+// solve returns the position where all gradients of the window are orthogonal to the vector from the position to the gradient.
+// The result is false if the window contains no corner, but only a straight edge or a flat area.
+func (n forstnerNormals) solve() (float64, float64, bool) {
+	det := n.a11*n.a22 - n.a12*n.a12
+	if det <= 1e-12*(n.a11+n.a22)*(n.a11+n.a22) {
+		return 0, 0, false
+	}
+
+	return (n.a22*n.b1 - n.a12*n.b2) / det, (n.a11*n.b2 - n.a12*n.b1) / det, true
+}
+
+// forstnerCorner moves the given corner estimate to the corner in its neighborhood, with subpixel precision.
+// This uses the junction point estimator of Förstner: Every image gradient in the window is orthogonal to the vector from the corner to the gradient's position, this is solved iteratively.
+// Besides the position, it returns the sums of the estimator at that position, which describe the quality of the corner.
+// The result is false if there is no corner, or if it is further away from the estimate than the radius.
+func forstnerCorner(at func(x, y int) float64, x, y float64, radius int) (float64, float64, forstnerNormals, bool) {
+	cx, cy := x, y
+	for iteration := 0; iteration < 20; iteration++ {
+		newX, newY, ok := newForstnerNormals(at, cx, cy, radius).solve()
+		if !ok {
+			return x, y, forstnerNormals{}, false
+		}
+
+		// The corner must not leave the window, otherwise it has found something else.
+		moved := math.Hypot(newX-cx, newY-cy)
+		cx, cy = newX, newY
+		if math.Hypot(cx-x, cy-y) > float64(radius) {
+			return x, y, forstnerNormals{}, false
+		}
+		if moved < 0.005 {
+			break
+		}
+	}
+
+	return cx, cy, newForstnerNormals(at, cx, cy, radius), true
+}
+
+// detectCheckerboard finds all inner corners of a checkerboard with the given amount of inner corners in the image.
+// The corners are returned row by row in continuous image coordinates of the stored image.
+// The columns are along the first grid direction, which may be any direction of the board in the image.
+func detectCheckerboard(img image.Image, columns, rows int) ([]PixelCoordinate, error) {
+	if columns < 2 || rows < 2 {
+		return nil, fmt.Errorf("the checkerboard needs at least 2x2 inner corners, got %dx%d", columns, rows)
+	}
+
+	l := newLuminanceImage(img)
+	factor := max(1, (max(l.bounds.Dx(), l.bounds.Dy())+checkerboardDetectionSize-1)/checkerboardDetectionSize)
+	small := newDownscaledGrayImage(l, factor)
+
+	// Try several scales, as the size of the squares in the image isn't known.
+	for _, sigma := range []float64{1.5, 3, 1} {
+		candidates := checkerboardCandidates(small.blurred(sigma), sigma)
+		if len(candidates) < columns*rows {
+			continue
+		}
+
+		for seed := 0; seed < len(candidates) && seed < checkerboardMaxSeeds; seed++ {
+			grid := assembleCheckerboardGrid(candidates, seed, columns, rows)
+			if grid == nil {
+				continue
+			}
+
+			// The refinement window is limited by the distance to the neighboring corners.
+			spacing := math.Inf(1)
+			for k := 1; k < len(grid); k++ {
+				if k%columns != 0 {
+					a, b := candidates[grid[k-1]], candidates[grid[k]]
+					spacing = min(spacing, math.Hypot(a.x-b.x, a.y-b.y)*float64(factor))
+				}
+			}
+			radius := max(2, min(25, int(spacing/4)))
+
+			corners := make([]PixelCoordinate, 0, len(grid))
+			for _, index := range grid {
+				candidate := candidates[index]
+				x := float64(l.bounds.Min.X) + (candidate.x+0.5)*float64(factor)
+				y := float64(l.bounds.Min.Y) + (candidate.y+0.5)*float64(factor)
+				if refinedX, refinedY, _, ok := forstnerCorner(l.clampedAt, x, y, radius); ok {
+					x, y = refinedX, refinedY
+				}
+				corners = append(corners, PixelCoordinate{PixelDistance(x - float64(l.bounds.Min.X)), PixelDistance(y - float64(l.bounds.Min.Y))})
+			}
+
+			return corners, nil
+		}
+	}
+
+	return nil, fmt.Errorf("couldn't find a checkerboard with %dx%d inner corners", columns, rows)
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// renderTestCheckerboard renders a checkerboard with the given number of inner corners, which is mapped affinely into the image.
+// The inner corner (i, j) is at origin + i·a + j·b in continuous image coordinates.
+// Every pixel is supersampled, so that the edges are anti-aliased like in a real photo.
+func renderTestCheckerboard(width, height, columns, rows int, origin, a, b [2]float64) *image.Gray {
+	det := a[0]*b[1] - a[1]*b[0]
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	const samples = 8
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum float64
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px, py := float64(x)+(float64(sx)+0.5)/samples-origin[0], float64(y)+(float64(sy)+0.5)/samples-origin[1]
+					u, v := (px*b[1]-py*b[0])/det, (a[0]*py-a[1]*px)/det
+
+					value := 120.0 // Background.
+					switch {
+					case u >= -1 && v >= -1 && u < float64(columns) && v < float64(rows):
+						value = 220
+						if (int(math.Floor(u))+int(math.Floor(v)))%2 == 0 {
+							value = 30
+						}
+					case u >= -2 && v >= -2 && u < float64(columns+1) && v < float64(rows+1):
+						value = 220 // White border around the board.
+					}
+					sum += value
+				}
+			}
+			img.Pix[y*img.Stride+x] = uint8(math.Round(sum / (samples * samples)))
+		}
+	}
+
+	return img
+}
+
+// TestDetectCheckerboard checks that all corners of a rotated and sheared synthetic board are found with sub-pixel accuracy.
+func TestDetectCheckerboard(t *testing.T) {
+	const columns, rows = 8, 6
+	origin := [2]float64{170.3, 110.7}
+	a := [2]float64{40 * math.Cos(0.2), 40 * math.Sin(0.2)}
+	b := [2]float64{-38*math.Sin(0.2) + 3, 38 * math.Cos(0.2)}
+	img := renderTestCheckerboard(800, 600, columns, rows, origin, a, b)
+
+	corners, err := detectCheckerboard(img, columns, rows)
+	if err != nil {
+		t.Fatalf("detectCheckerboard() failed: %v", err)
+	}
+	if len(corners) != columns*rows {
+		t.Fatalf("detectCheckerboard() found %d corners, want %d", len(corners), columns*rows)
+	}
+
+	// The order of the grid depends on the direction the detection started in, so every corner is compared with the nearest true one.
+	found := map[[2]int]bool{}
+	for _, corner := range corners {
+		best, bestDistance := [2]int{}, math.Inf(1)
+		for j := 0; j < rows; j++ {
+			for i := 0; i < columns; i++ {
+				x, y := origin[0]+float64(i)*a[0]+float64(j)*b[0], origin[1]+float64(i)*a[1]+float64(j)*b[1]
+				if distance := math.Hypot(corner.X().Pixels()-x, corner.Y().Pixels()-y); distance < bestDistance {
+					best, bestDistance = [2]int{i, j}, distance
+				}
+			}
+		}
+		if bestDistance > 0.05 {
+			t.Errorf("Corner %v is %.3f px away from the true corner %v", corner, bestDistance, best)
+		}
+		if found[best] {
+			t.Errorf("Corner %v was found twice", best)
+		}
+		found[best] = true
+	}
+
+	// A blank image doesn't contain any board.
+	if _, err := detectCheckerboard(image.NewGray(image.Rect(0, 0, 800, 600)), columns, rows); err == nil {
+		t.Errorf("detectCheckerboard() found a board in a blank image")
+	}
+}
@@ -21,6 +21,7 @@ type CoordinateOptimizableComponent struct {
 	AttrMap vugu.AttrMap
 
 	BindValue *CoordinateOptimizable
+	Posterior *Posterior // Optional posterior that is used to show the uncertainty of the coordinate.
 
 	Editable bool
 }
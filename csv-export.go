@@ -0,0 +1,138 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+)
+
+// generateCSV returns the positions of all points, tripods, total stations and photos of the given site as a CSV file.
+// Every position is accompanied by its standard deviations and the semi-axes of its 1σ error ellipsoid, if they are known.
+//
+// Photo orientations and intrinsic parameters of cameras and photos are written as additional rows.
+// Their values are stored in the X, Y and Z columns, and their standard deviations in the sigma columns.
+// Angles are given in degrees, the principal point offset in pixels.
+func generateCSV(site *Site) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"Type", "Key", "Name", "X", "Y", "Z", "SigmaX", "SigmaY", "SigmaZ", "EllipsoidA", "EllipsoidB", "EllipsoidC"})
+
+	writePosition := func(typ, key, name string, position *CoordinateOptimizable) {
+		record := []string{typ, key, name}
+		for i := range position.Coordinate {
+			record = append(record, fmt.Sprintf("%.6f", position.Coordinate[i].Meters()))
+		}
+		for i := range position.Coordinate {
+			if sigma, ok := site.posterior.StandardDeviation(&position.Coordinate[i]); ok {
+				record = append(record, fmt.Sprintf("%.6f", sigma))
+			} else if position.Locked[i] {
+				record = append(record, "0")
+			} else {
+				record = append(record, "")
+			}
+		}
+		if ellipsoid, ok := site.posterior.ErrorEllipsoid(position); ok {
+			for _, semiAxis := range ellipsoid.SemiAxes {
+				record = append(record, fmt.Sprintf("%.6f", semiAxis.Meters()))
+			}
+		} else {
+			record = append(record, "", "", "")
+		}
+		w.Write(record)
+	}
+
+	// exportValue converts a value from optimizer space into the unit used in the table.
+	exportValue := func(tweakable Tweakable, value float64) float64 {
+		if _, ok := tweakable.(*Angle); ok {
+			return Angle(value).Degree()
+		}
+		return value
+	}
+
+	// writeValues writes up to three values and their standard deviations into a single row.
+	writeValues := func(typ, key, name string, tweakables []Tweakable, locked []bool) {
+		record := []string{typ, key, name}
+		for i := 0; i < 3; i++ {
+			if i < len(tweakables) {
+				record = append(record, fmt.Sprintf("%.6f", exportValue(tweakables[i], tweakables[i].TweakableValue())))
+			} else {
+				record = append(record, "")
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if i >= len(tweakables) {
+				record = append(record, "")
+			} else if sigma, ok := site.posterior.StandardDeviation(tweakables[i]); ok {
+				record = append(record, fmt.Sprintf("%.6f", exportValue(tweakables[i], sigma)))
+			} else if locked[i] {
+				record = append(record, "0")
+			} else {
+				record = append(record, "")
+			}
+		}
+		record = append(record, "", "", "")
+		w.Write(record)
+	}
+
+	for _, point := range site.PointsSorted() {
+		writePosition("Point", point.Key(), point.Name, &point.Position)
+	}
+	for _, tripod := range site.TripodsSorted() {
+		writePosition("Tripod", tripod.Key(), tripod.Name, &tripod.Position)
+	}
+	for _, totalStation := range site.TotalStationsSorted() {
+		writePosition("Total station", totalStation.Key(), totalStation.Name, &totalStation.Position)
+	}
+	for _, camera := range site.CamerasSorted() {
+		for _, photo := range camera.PhotosSorted() {
+			writePosition("Photo", photo.Key(), camera.Name, &photo.Position)
+		}
+	}
+	for _, camera := range site.CamerasSorted() {
+		for _, photo := range camera.PhotosSorted() {
+			orientation := &photo.Orientation
+			tweakables := []Tweakable{&orientation.Rotation[0], &orientation.Rotation[1], &orientation.Rotation[2]}
+			writeValues("Photo orientation", photo.Key(), camera.Name, tweakables, orientation.Locked[:])
+		}
+	}
+	for _, camera := range site.CamerasSorted() {
+		names, tweakables := camera.calibrationParameters()
+		locked := []bool{camera.HorizontalAOVLocked, camera.PrincipalPointOffsetLocked, camera.PrincipalPointOffsetLocked}
+		locked = append(locked, camera.DistortionKsLocked[:]...)
+		locked = append(locked, camera.DistortionPsLocked[:]...)
+		locked = append(locked, camera.DistortionBsLocked[:]...)
+		for i, tweakable := range tweakables {
+			writeValues("Camera intrinsic", camera.Key(), camera.Name+" "+names[i], []Tweakable{tweakable}, locked[i:i+1])
+		}
+		for _, photo := range camera.PhotosSorted() {
+			intrinsics := &photo.Intrinsics
+			if !intrinsics.Active() {
+				continue
+			}
+			writeValues("Photo intrinsic", photo.Key(), camera.Name+" Horizontal AOV", []Tweakable{&intrinsics.HorizontalAOV}, []bool{intrinsics.HorizontalAOVLocked})
+			writeValues("Photo intrinsic", photo.Key(), camera.Name+" Principal point X", []Tweakable{&intrinsics.PrincipalPointOffset[0]}, []bool{intrinsics.PrincipalPointOffsetLocked})
+			writeValues("Photo intrinsic", photo.Key(), camera.Name+" Principal point Y", []Tweakable{&intrinsics.PrincipalPointOffset[1]}, []bool{intrinsics.PrincipalPointOffsetLocked})
+			writeValues("Photo intrinsic", photo.Key(), camera.Name+" K1", []Tweakable{&intrinsics.K1}, []bool{intrinsics.K1Locked})
+		}
+	}
+
+	w.Flush()
+
+	return buf.Bytes()
+}
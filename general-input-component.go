@@ -16,6 +16,10 @@
 package main
 
 import (
+	"log"
+	"strconv"
+	"strings"
+
 	"github.com/vugu/vugu"
 )
 
@@ -38,13 +42,56 @@ func (g GeneralInputStringPtr) SetInputValue(strVal string) {
 	*g.Value = strVal
 }
 
+type GeneralInputIntPtr struct {
+	Value *int
+}
+
+// InputValue implements the valuer interface of the general input component.
+func (g GeneralInputIntPtr) InputValue() string {
+	return strconv.Itoa(*g.Value)
+}
+
+// SetInputValue implements the valuer interface of the general input component.
+func (g GeneralInputIntPtr) SetInputValue(strVal string) {
+	val, err := strconv.Atoi(strings.TrimSpace(strVal))
+	if err != nil {
+		log.Printf("strconv.Atoi() failed: %v", err)
+		return
+	}
+
+	*g.Value = val
+}
+
+type GeneralInputFloatPtr struct {
+	Value *float64
+}
+
+// InputValue implements the valuer interface of the general input component.
+func (g GeneralInputFloatPtr) InputValue() string {
+	return strconv.FormatFloat(*g.Value, 'g', 13, 64)
+}
+
+// SetInputValue implements the valuer interface of the general input component.
+func (g GeneralInputFloatPtr) SetInputValue(strVal string) {
+	strVal = strings.ReplaceAll(strings.TrimSpace(strVal), ",", ".")
+
+	val, err := strconv.ParseFloat(strVal, 64)
+	if err != nil {
+		log.Printf("strconv.ParseFloat() failed: %v", err)
+		return
+	}
+
+	*g.Value = val
+}
+
 // GeneralInputComponent is a generalized input component that takes any value that implement the GeneralInputValuer interface.
 // TODO: Replace most input components with the general input component
 type GeneralInputComponent struct {
 	BindValue  GeneralInputValuer
 	BindLocked *bool
 	LabelText  string
-	InputType  string // Input type of the HTML input element. Defaults to "text"
+	InputType  string     // Input type of the HTML input element. Defaults to "text"
+	Posterior  *Posterior // Optional posterior that is used to show the standard deviation of the bound value.
 
 	AttrMap vugu.AttrMap
 }
@@ -69,6 +116,15 @@ func (c *GeneralInputComponent) inputContent() string {
 	return ""
 }
 
+// standardDeviationText returns the formatted standard deviation of the bound value, if there is any.
+func (c *GeneralInputComponent) standardDeviationText() string {
+	if tweakable, ok := c.BindValue.(Tweakable); ok {
+		return c.Posterior.StandardDeviationText(tweakable)
+	}
+
+	return ""
+}
+
 func (c *GeneralInputComponent) handleLockedChange(event vugu.DOMEvent) {
 	*c.BindLocked = event.PropBool("target", "checked")
 }
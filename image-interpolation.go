@@ -0,0 +1,135 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// ImageInterpolation describes how an image is sampled between its pixel centers.
+type ImageInterpolation string
+
+const (
+	ImageInterpolationBilinear ImageInterpolation = "Bilinear" // Linear interpolation between the 4 nearest pixels.
+	ImageInterpolationBicubic  ImageInterpolation = "Bicubic"  // Cubic convolution of the 16 nearest pixels. Sharper, but slower.
+)
+
+// ImageInterpolationOptions contains all selectable interpolation methods.
+var ImageInterpolationOptions = SelectOptions{
+	{string(ImageInterpolationBilinear), "Bilinear"},
+	{string(ImageInterpolationBicubic), "Bicubic"},
+}
+
+// StringValue implements vgform.StringValuer.
+func (ii ImageInterpolation) StringValue() string {
+	return string(ii)
+}
+
+// SetStringValue implements vgform.StringValuer.
+func (ii *ImageInterpolation) SetStringValue(v string) {
+	*ii = ImageInterpolation(v)
+}
+
+// imageSampler returns the color of an image at continuous image coordinates.
+type imageSampler struct {
+	img           *image.RGBA
+	interpolation ImageInterpolation
+}
+
+// newImageSampler returns a sampler for the given image.
+// The image is converted into premultiplied RGBA, so that transparent pixels don't bleed their color into their neighbors.
+func newImageSampler(img image.Image, interpolation ImageInterpolation) imageSampler {
+	rgba, ok := img.(*image.RGBA)
+	if !ok || rgba.Rect.Min != (image.Point{}) {
+		bounds := img.Bounds()
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Rect, img, bounds.Min, draw.Src)
+	}
+
+	return imageSampler{img: rgba, interpolation: interpolation}
+}
+
+// pixel returns the premultiplied color channels of the pixel at (x, y).
+// Coordinates outside of the image are clamped to its border.
+func (s imageSampler) pixel(x, y int) [4]float64 {
+	x, y = max(0, min(s.img.Rect.Dx()-1, x)), max(0, min(s.img.Rect.Dy()-1, y))
+	i := s.img.PixOffset(x, y)
+	pix := s.img.Pix[i : i+4 : i+4]
+	return [4]float64{float64(pix[0]), float64(pix[1]), float64(pix[2]), float64(pix[3])}
+}
+
+// at returns the color at the continuous image coordinate (x, y).
+// The pixel with the index (i, j) covers the area from (i, j) to (i+1, j+1).
+// The result is false if the coordinate is outside of the image.
+func (s imageSampler) at(x, y float64) (color.RGBA, bool) {
+	width, height := float64(s.img.Rect.Dx()), float64(s.img.Rect.Dy())
+	if !(x >= 0 && y >= 0 && x <= width && y <= height) {
+		return color.RGBA{}, false
+	}
+
+	// Position relative to the pixel centers.
+	x, y = x-0.5, y-0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+
+	var sum [4]float64
+	switch s.interpolation {
+	case ImageInterpolationBicubic:
+		wx, wy := cubicWeights(fx), cubicWeights(fy)
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				p, w := s.pixel(ix+i-1, iy+j-1), wx[i]*wy[j]
+				for c := range sum {
+					sum[c] += p[c] * w
+				}
+			}
+		}
+	default:
+		p00, p10, p01, p11 := s.pixel(ix, iy), s.pixel(ix+1, iy), s.pixel(ix, iy+1), s.pixel(ix+1, iy+1)
+		for c := range sum {
+			sum[c] = (p00[c]*(1-fx)+p10[c]*fx)*(1-fy) + (p01[c]*(1-fx)+p11[c]*fx)*fy
+		}
+	}
+
+	// Cubic convolution can overshoot, keep the result a valid premultiplied color.
+	a := math.Round(max(0, min(255, sum[3])))
+	clamp := func(v float64) uint8 {
+		return uint8(math.Round(max(0, min(a, v))))
+	}
+	return color.RGBA{clamp(sum[0]), clamp(sum[1]), clamp(sum[2]), uint8(a)}, true
+}
+
+// cubicWeights returns the weights of the 4 neighboring pixels for a cubic convolution at the fraction t between the 2nd and 3rd pixel.
+// This uses the kernel of Keys, "Cubic convolution interpolation for digital image processing", with a = -0.5.
+func cubicWeights(t float64) [4]float64 {
+	const a = -0.5
+	kernel := func(x float64) float64 {
+		x = math.Abs(x)
+		switch {
+		case x <= 1:
+			return ((a+2)*x-(a+3))*x*x + 1
+		case x < 2:
+			return ((a*x-5*a)*x+8*a)*x - 4*a
+		}
+		return 0
+	}
+
+	return [4]float64{kernel(1 + t), kernel(t), kernel(1 - t), kernel(2 - t)}
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/vugu/vgrouter"
+)
+
+// LevelMeasurement states that point P1 is a given height above point P2.
+// The height is measured along the up axis of the site.
+type LevelMeasurement struct {
+	vgrouter.NavigatorRef `json:"-"`
+
+	level *Level
+	key   string
+
+	CreatedAt time.Time
+
+	P1, P2           string   // Two points the height difference is measured between.
+	HeightDifference Distance // Measured height of P1 above P2.
+}
+
+func (l *Level) NewMeasurement() *LevelMeasurement {
+	lm := new(LevelMeasurement)
+	lm.initData()
+	lm.initReferences(l, l.site.shortIDGen.MustGenerate())
+
+	return lm
+}
+
+// initData initializes the object with default values and other stuff.
+func (lm *LevelMeasurement) initData() {
+	lm.CreatedAt = time.Now()
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (lm *LevelMeasurement) initReferences(newParent *Level, newKey string) {
+	lm.level, lm.key = newParent, newKey
+	lm.level.Measurements[lm.Key()] = lm
+}
+
+func (lm *LevelMeasurement) Key() string {
+	return lm.key
+}
+
+// DisplayName returns either the name, or if that is empty the key.
+func (lm *LevelMeasurement) DisplayName() string {
+	return "(" + lm.Key() + ")"
+}
+
+func (lm *LevelMeasurement) Delete() {
+	delete(lm.level.Measurements, lm.Key())
+}
+
+// Copy returns a copy of the given object.
+// Expensive data like images will not be copied, but referenced.
+func (lm *LevelMeasurement) Copy(newParent *Level, newKey string) *LevelMeasurement {
+	copy := new(LevelMeasurement)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.CreatedAt = lm.CreatedAt
+	copy.P1 = lm.P1
+	copy.P2 = lm.P2
+	copy.HeightDifference = lm.HeightDifference
+
+	return copy
+}
+
+func (lm *LevelMeasurement) UnmarshalJSON(data []byte) error {
+	lm.initData()
+
+	// Unmarshal structure normally. Cast it into a different type to prevent recursion with json.Unmarshal.
+	type tempType *LevelMeasurement
+	if err := json.Unmarshal(data, tempType(lm)); err != nil {
+		return err
+	}
+
+	// Update parent references and keys.
+
+	return nil
+}
+
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (lm *LevelMeasurement) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	return nil, []Residualer{lm}
+}
+
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+func (lm *LevelMeasurement) Residuals() []float64 {
+	site := lm.level.site
+
+	p1, ok := site.Points[lm.P1]
+	if !ok {
+		return []float64{0}
+	}
+	p2, ok := site.Points[lm.P2]
+	if !ok {
+		return []float64{0}
+	}
+
+	return []float64{float64((site.Height(p1.Position.Coordinate) - site.Height(p2.Position.Coordinate) - lm.HeightDifference) / lm.level.Accuracy)}
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (lm *LevelMeasurement) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	site := lm.level.site
+
+	p1, ok := site.Points[lm.P1]
+	if !ok {
+		return
+	}
+	p2, ok := site.Points[lm.P2]
+	if !ok {
+		return
+	}
+
+	up := site.UpDirection()
+	for i := 0; i < 3; i++ {
+		derivative := up[i] / lm.level.Accuracy.Meters()
+		addFunc(0, &p1.Position.Coordinate[i], derivative)
+		addFunc(0, &p2.Position.Coordinate[i], -derivative)
+	}
+}
+
+// EffectiveRobustLoss returns the robust loss function that is used for the residuals.
+func (lm *LevelMeasurement) EffectiveRobustLoss() RobustLoss {
+	return lm.level.EffectiveRobustLoss()
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (lm *LevelMeasurement) ResidualSqr() float64 {
+	return residualsSqr(lm.Residuals())
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/vugu/vgrouter"
+)
+
+// Level is a device that measures height differences, like a spirit level, line laser or water level.
+type Level struct {
+	vgrouter.NavigatorRef `json:"-"`
+
+	site *Site
+	key  string
+
+	Name      string
+	CreatedAt time.Time
+
+	Accuracy   Distance   // Accuracy of the measurement.
+	RobustLoss RobustLoss // Robust loss function for all measurements. Overrides the site's loss function.
+
+	Measurements map[string]*LevelMeasurement // List of measurements.
+
+	groupPointKeys []string // Points that are selected in the UI to be added as a group with the same height.
+}
+
+func (s *Site) NewLevel(name string) *Level {
+	l := new(Level)
+	l.initData()
+	l.initReferences(s, s.shortIDGen.MustGenerate())
+	l.Name = name
+
+	return l
+}
+
+// initData initializes the object with default values and other stuff.
+func (l *Level) initData() {
+	l.CreatedAt = time.Now()
+	l.Accuracy = 0.002
+	l.RobustLoss = RobustLoss{Function: RobustLossFunctionSite, Threshold: 3}
+	l.Measurements = map[string]*LevelMeasurement{}
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (l *Level) initReferences(newParent *Site, newKey string) {
+	l.site, l.key = newParent, newKey
+	l.site.Levels[l.Key()] = l
+}
+
+func (l *Level) handleAdd() {
+	measurement := l.NewMeasurement()
+
+	l.Navigate("/level/"+l.Key()+"/measurement/"+measurement.Key(), nil)
+}
+
+// HasGroupPoint returns whether the point with the given key is selected for a new group with the same height.
+func (l *Level) HasGroupPoint(key string) bool {
+	return slices.Contains(l.groupPointKeys, key)
+}
+
+// ToggleGroupPoint selects or deselects the point with the given key for a new group with the same height.
+func (l *Level) ToggleGroupPoint(key string) {
+	if i := slices.Index(l.groupPointKeys, key); i >= 0 {
+		l.groupPointKeys = slices.Delete(l.groupPointKeys, i, i+1)
+	} else {
+		l.groupPointKeys = append(l.groupPointKeys, key)
+	}
+}
+
+// AddSameHeightGroup adds measurements that state that all the given points have the same height.
+// Every point is measured against the first one, so that each point is constrained by exactly one measurement.
+func (l *Level) AddSameHeightGroup(pointKeys []string) []*LevelMeasurement {
+	createdAt := time.Now()
+
+	var measurements []*LevelMeasurement
+	for i := 1; i < len(pointKeys); i++ {
+		measurement := l.NewMeasurement()
+		measurement.CreatedAt = batchCreationDate(createdAt, i)
+		measurement.P1, measurement.P2 = pointKeys[i], pointKeys[0]
+		measurements = append(measurements, measurement)
+	}
+
+	return measurements
+}
+
+func (l *Level) handleAddSameHeightGroup() {
+	l.AddSameHeightGroup(l.groupPointKeys)
+	l.groupPointKeys = nil
+}
+
+func (l *Level) Key() string {
+	return l.key
+}
+
+// DisplayName returns either the name, or if that is empty the key.
+func (l *Level) DisplayName() string {
+	if l.Name != "" {
+		return l.Name
+	}
+
+	return "(" + l.Key() + ")"
+}
+
+// EffectiveRobustLoss returns the robust loss function that is used for all measurements of this device.
+func (l *Level) EffectiveRobustLoss() RobustLoss {
+	if l.RobustLoss.Function == RobustLossFunctionSite {
+		return l.site.RobustLoss
+	}
+
+	return l.RobustLoss
+}
+
+func (l *Level) Delete() {
+	delete(l.site.Levels, l.Key())
+}
+
+// Copy returns a copy of the given object.
+// Expensive data like images will not be copied, but referenced.
+func (l *Level) Copy(newParent *Site, newKey string) *Level {
+	copy := new(Level)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.Name = l.Name
+	copy.CreatedAt = l.CreatedAt
+	copy.Accuracy = l.Accuracy
+	copy.RobustLoss = l.RobustLoss
+
+	// Generate copies of all children.
+	for k, v := range l.Measurements {
+		v.Copy(copy, k)
+	}
+
+	return copy
+}
+
+func (l *Level) UnmarshalJSON(data []byte) error {
+	l.initData()
+
+	// Unmarshal structure normally. Cast it into a different type to prevent recursion with json.Unmarshal.
+	type tempType *Level
+	if err := json.Unmarshal(data, tempType(l)); err != nil {
+		return err
+	}
+
+	// Update parent references and keys.
+	for k, v := range l.Measurements {
+		v.initReferences(l, k)
+	}
+
+	return nil
+}
+
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (l *Level) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	tweakables, residuals := []Tweakable{}, []Residualer{}
+	for _, measurement := range l.MeasurementsSorted() {
+		newTweakables, newResiduals := measurement.GetTweakablesAndResiduals()
+		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
+	}
+	return tweakables, residuals
+}
+
+// MeasurementsSorted returns the measurements of the level as a list sorted by date.
+// TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
+func (l *Level) MeasurementsSorted() []*LevelMeasurement {
+	measurements := make([]*LevelMeasurement, 0, len(l.Measurements))
+
+	for _, measurement := range l.Measurements {
+		measurements = append(measurements, measurement)
+	}
+
+	sort.Slice(measurements, func(i, j int) bool {
+		if !measurements[i].CreatedAt.Equal(measurements[j].CreatedAt) {
+			return measurements[i].CreatedAt.After(measurements[j].CreatedAt)
+		}
+		return measurements[i].Key() < measurements[j].Key()
+	})
+
+	return measurements
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestLevelAddSameHeightGroup(t *testing.T) {
+	site := NewSite("level")
+	var keys []string
+	for i := 0; i < 5; i++ {
+		keys = append(keys, site.NewPoint("").Key())
+	}
+
+	level := site.NewLevel("Level")
+	measurements := level.AddSameHeightGroup(keys)
+	if len(measurements) != len(keys)-1 {
+		t.Fatalf("AddSameHeightGroup() returned %d measurements, want %d", len(measurements), len(keys)-1)
+	}
+
+	// The measurements are listed in the order of the group, every point is measured against the first one.
+	for i, measurement := range level.MeasurementsSorted() {
+		if measurement != measurements[i] {
+			t.Errorf("Measurement %d of the list is %s, want %s", i, measurement.Key(), measurements[i].Key())
+		}
+		if measurement.P1 != keys[i+1] || measurement.P2 != keys[0] || measurement.HeightDifference != 0 {
+			t.Errorf("Measurement %d is from %s to %s with a height difference of %v, want from %s to %s with 0", i, measurement.P1, measurement.P2, measurement.HeightDifference, keys[i+1], keys[0])
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+// LinePointConstraint ties a point to the straight line through the two points of a line.
+type LinePointConstraint struct {
+	line *Line
+	key  string
+
+	CreatedAt time.Time
+
+	PointKey string   // Point that is on the line.
+	Segment  bool     // Clamp to the segment between P1 and P2 of the line, instead of the infinite line.
+	Accuracy Distance // Expected distance of the point to the line.
+}
+
+func (l *Line) NewPointConstraint(pointKey string) *LinePointConstraint {
+	lpc := new(LinePointConstraint)
+	lpc.initData()
+	lpc.initReferences(l, l.site.shortIDGen.MustGenerate())
+	lpc.PointKey = pointKey
+
+	return lpc
+}
+
+// initData initializes the object with default values and other stuff.
+func (lpc *LinePointConstraint) initData() {
+	lpc.CreatedAt = time.Now()
+	lpc.Accuracy = 0.01
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (lpc *LinePointConstraint) initReferences(newParent *Line, newKey string) {
+	lpc.line, lpc.key = newParent, newKey
+	lpc.line.PointConstraints[lpc.Key()] = lpc
+}
+
+func (lpc *LinePointConstraint) Key() string {
+	return lpc.key
+}
+
+// DisplayName returns either the name, or if that is empty the key.
+func (lpc *LinePointConstraint) DisplayName() string {
+	return "(" + lpc.Key() + ")"
+}
+
+func (lpc *LinePointConstraint) Delete() {
+	delete(lpc.line.PointConstraints, lpc.Key())
+}
+
+// Copy returns a copy of the given object.
+// Expensive data like images will not be copied, but referenced.
+func (lpc *LinePointConstraint) Copy(newParent *Line, newKey string) *LinePointConstraint {
+	copy := new(LinePointConstraint)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.CreatedAt = lpc.CreatedAt
+	copy.PointKey = lpc.PointKey
+	copy.Segment = lpc.Segment
+	copy.Accuracy = lpc.Accuracy
+
+	return copy
+}
+
+func (lpc *LinePointConstraint) UnmarshalJSON(data []byte) error {
+	lpc.initData()
+
+	// Unmarshal structure normally. Cast it into a different type to prevent recursion with json.Unmarshal.
+	type tempType *LinePointConstraint
+	if err := json.Unmarshal(data, tempType(lpc)); err != nil {
+		return err
+	}
+
+	// Update parent references and keys.
+
+	return nil
+}
+
+// closest returns the points of the constraint, and the parameter t of the closest position on the line.
+// The closest position is p1 + t·(p2-p1).
+func (lpc *LinePointConstraint) closest() (point, p1, p2 *Point, t float64, ok bool) {
+	site := lpc.line.site
+
+	if point, ok = site.Points[lpc.PointKey]; !ok {
+		return
+	}
+	if p1, ok = site.Points[lpc.line.P1]; !ok {
+		return
+	}
+	if p2, ok = site.Points[lpc.line.P2]; !ok {
+		return
+	}
+
+	v := p2.Position.Vec3().Sub(p1.Position.Vec3())
+	if lenSqr := v.Dot(v); lenSqr > 0 {
+		t = point.Position.Vec3().Sub(p1.Position.Vec3()).Dot(v) / lenSqr
+	}
+	if lpc.Segment {
+		t = min(max(t, 0), 1)
+	}
+
+	return
+}
+
+// offset returns the vector from the closest position on the line to the point.
+func (lpc *LinePointConstraint) offset() (e mgl64.Vec3, point, p1, p2 *Point, t float64, ok bool) {
+	if point, p1, p2, t, ok = lpc.closest(); !ok {
+		return
+	}
+
+	v := p2.Position.Vec3().Sub(p1.Position.Vec3())
+	e = point.Position.Vec3().Sub(p1.Position.Vec3().Add(v.Mul(t)))
+	return
+}
+
+// Distance returns the distance of the point to the line or segment.
+// The result is false if any of the points doesn't exist.
+func (lpc *LinePointConstraint) Distance() (Distance, bool) {
+	e, _, _, _, _, ok := lpc.offset()
+	if !ok {
+		return 0, false
+	}
+
+	return Distance(e.Len()), true
+}
+
+// DistanceDescription returns the current distance of the point to the line as text.
+func (lpc *LinePointConstraint) DistanceDescription() string {
+	distance, ok := lpc.Distance()
+	if !ok {
+		return "Distance: -"
+	}
+
+	return fmt.Sprintf("Distance: %.4f m", distance.Meters())
+}
+
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (lpc *LinePointConstraint) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	return nil, []Residualer{lpc}
+}
+
+// perpendicularBasis returns two unit vectors that are perpendicular to v and to each other.
+// It also returns their derivatives with respect to v, as matrices of the form ∂b[i]/∂v[j].
+func perpendicularBasis(v mgl64.Vec3) (b1, b2 mgl64.Vec3, db1, db2 mgl64.Mat3) {
+	length := v.Len()
+	u := v.Mul(1 / length)
+
+	// Start with an axis that is far from parallel to v.
+	// Axis aligned lines are common, so the choice must not switch between axes for them.
+	a := mgl64.Vec3{1, 0, 0}
+	if u.Cross(a).Len() < 0.5 {
+		a = mgl64.Vec3{0, 1, 0}
+	}
+
+	projection := mgl64.Ident3().Sub(u.OuterProd3(u))
+	du := projection.Mul(1 / length)
+
+	n1 := a.Sub(u.Mul(u.Dot(a)))
+	n1Len := n1.Len()
+	b1 = n1.Mul(1 / n1Len)
+	b2 = u.Cross(b1)
+
+	dn1 := du.Mul(-u.Dot(a)).Sub(u.OuterProd3(du.Transpose().Mul3x1(a)))
+	db1 = mgl64.Ident3().Sub(b1.OuterProd3(b1)).Mul3(dn1).Mul(1 / n1Len)
+	db2 = crossMatrix(u).Mul3(db1).Sub(crossMatrix(b1).Mul3(du))
+
+	return
+}
+
+// crossMatrix returns the matrix that calculates the cross product v × x when multiplied with x.
+func crossMatrix(v mgl64.Vec3) mgl64.Mat3 {
+	return mgl64.Mat3{0, v[2], -v[1], -v[2], 0, v[0], v[1], -v[0], 0}
+}
+
+// residualCount returns the number of residuals.
+// The offset perpendicular to the line has two components, a segment has an additional one along the line.
+func (lpc *LinePointConstraint) residualCount() int {
+	if lpc.Segment {
+		return 3
+	}
+	return 2
+}
+
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+// These are the components of the offset from the line to the point, their squared sum is the squared distance.
+// The components perpendicular to the line are used instead of the distance itself, as the distance isn't differentiable on the line.
+func (lpc *LinePointConstraint) Residuals() []float64 {
+	residuals := make([]float64, lpc.residualCount())
+
+	point, p1, p2, _, ok := lpc.closest()
+	if !ok {
+		return residuals
+	}
+
+	w, v := point.Position.Vec3().Sub(p1.Position.Vec3()), p2.Position.Vec3().Sub(p1.Position.Vec3())
+	length := v.Len()
+	if length == 0 {
+		for i := range residuals {
+			residuals[i] = 1000
+		}
+		return residuals
+	}
+
+	accuracy := lpc.Accuracy.Meters()
+	b1, b2, _, _ := perpendicularBasis(v)
+	residuals[0], residuals[1] = w.Dot(b1)/accuracy, w.Dot(b2)/accuracy
+
+	// Outside of the segment, the offset along the line is added.
+	if lpc.Segment {
+		along := w.Dot(v) / length
+		switch {
+		case along < 0:
+			residuals[2] = along / accuracy
+		case along > length:
+			residuals[2] = (along - length) / accuracy
+		}
+	}
+
+	return residuals
+}
+
+// ActiveResiduals returns the number of residuals that can be non-zero.
+// The offset along a segment is only used while the point is outside of it.
+func (lpc *LinePointConstraint) ActiveResiduals() int {
+	point, p1, p2, _, ok := lpc.closest()
+	if !ok {
+		return 0
+	}
+	if !lpc.Segment {
+		return 2
+	}
+
+	w, v := point.Position.Vec3().Sub(p1.Position.Vec3()), p2.Position.Vec3().Sub(p1.Position.Vec3())
+	if along := w.Dot(v); along >= 0 && along <= v.LenSqr() {
+		return 2
+	}
+
+	return 3
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (lpc *LinePointConstraint) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	point, p1, p2, _, ok := lpc.closest()
+	if !ok {
+		return
+	}
+
+	w, v := point.Position.Vec3().Sub(p1.Position.Vec3()), p2.Position.Vec3().Sub(p1.Position.Vec3())
+	length := v.Len()
+	if length == 0 {
+		return
+	}
+
+	accuracy := lpc.Accuracy.Meters()
+	add := func(residualIndex int, dPoint, dV mgl64.Vec3) {
+		for i := 0; i < 3; i++ {
+			addFunc(residualIndex, &point.Position.Coordinate[i], dPoint[i]/accuracy)
+			addFunc(residualIndex, &p1.Position.Coordinate[i], (-dPoint[i]-dV[i])/accuracy)
+			addFunc(residualIndex, &p2.Position.Coordinate[i], dV[i]/accuracy)
+		}
+	}
+
+	// The residuals depend on w = point - p1 and v = p2 - p1.
+	b1, b2, db1, db2 := perpendicularBasis(v)
+	add(0, b1, db1.Transpose().Mul3x1(w))
+	add(1, b2, db2.Transpose().Mul3x1(w))
+
+	if lpc.Segment {
+		u := v.Mul(1 / length)
+		along := w.Dot(u)
+		var end float64
+		switch {
+		case along < 0:
+		case along > length:
+			end = 1
+		default:
+			return
+		}
+		dV := w.Sub(u.Mul(along)).Mul(1 / length).Sub(u.Mul(end))
+		add(2, u, dV)
+	}
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (lpc *LinePointConstraint) ResidualSqr() float64 {
+	return residualsSqr(lpc.Residuals())
+}
@@ -18,6 +18,7 @@ package main
 import (
 	"encoding/json"
 	"math"
+	"sort"
 	"time"
 
 	"github.com/vugu/vgrouter"
@@ -37,6 +38,8 @@ type Line struct {
 	DirectionEnabled  bool
 	DirectionVector   Coordinate
 	DirectionAccuracy Angle
+
+	PointConstraints map[string]*LinePointConstraint // Points that are on the line.
 }
 
 func (s *Site) NewLine() *Line {
@@ -52,6 +55,7 @@ func (l *Line) initData() {
 	l.CreatedAt = time.Now()
 	l.DirectionVector = Coordinate{0, 0, 1}
 	l.DirectionAccuracy = Angle(1 * math.Pi / 180)
+	l.PointConstraints = map[string]*LinePointConstraint{}
 }
 
 // initReferences updates references from and to this object and its key.
@@ -88,6 +92,11 @@ func (l *Line) Copy(newParent *Site, newKey string) *Line {
 	copy.DirectionVector = l.DirectionVector
 	copy.DirectionAccuracy = l.DirectionAccuracy
 
+	// Generate copies of all children.
+	for k, v := range l.PointConstraints {
+		v.Copy(copy, k)
+	}
+
 	return copy
 }
 
@@ -101,40 +110,137 @@ func (l *Line) UnmarshalJSON(data []byte) error {
 	}
 
 	// Update parent references and keys.
+	for k, v := range l.PointConstraints {
+		v.initReferences(l, k)
+	}
 
 	return nil
 }
 
 // GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
 func (l *Line) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
-	return nil, []Residualer{l}
+	tweakables, residuals := []Tweakable{}, []Residualer{l}
+	for _, pointConstraint := range l.PointConstraintsSorted() {
+		newTweakables, newResiduals := pointConstraint.GetTweakablesAndResiduals()
+		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
+	}
+
+	return tweakables, residuals
 }
 
-// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
-func (l *Line) ResidualSqr() float64 {
+// PointConstraintsSorted returns the point constraints of the line as a list sorted by date.
+// TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
+func (l *Line) PointConstraintsSorted() []*LinePointConstraint {
+	pointConstraints := make([]*LinePointConstraint, 0, len(l.PointConstraints))
+
+	for _, pointConstraint := range l.PointConstraints {
+		pointConstraints = append(pointConstraints, pointConstraint)
+	}
+
+	sort.Slice(pointConstraints, func(i, j int) bool {
+		if !pointConstraints[i].CreatedAt.Equal(pointConstraints[j].CreatedAt) {
+			return pointConstraints[i].CreatedAt.After(pointConstraints[j].CreatedAt)
+		}
+		return pointConstraints[i].Key() < pointConstraints[j].Key()
+	})
+
+	return pointConstraints
+}
+
+func (l *Line) handleAddPointConstraint() {
+	l.NewPointConstraint("")
+}
+
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+func (l *Line) Residuals() []float64 {
+	if !l.DirectionEnabled {
+		return nil
+	}
+
+	site := l.site
+
+	p1, ok := site.Points[l.P1]
+	if !ok {
+		return []float64{0}
+	}
+	p2, ok := site.Points[l.P2]
+	if !ok {
+		return []float64{0}
+	}
+
+	v1, v2 := l.DirectionVector.Vec3(), p2.Position.Vec3().Sub(p1.Position.Vec3())
+	if v1.Len() == 0 || v2.Len() == 0 {
+		return []float64{1000}
+	}
+
+	// Angle between the direction vector and the line.
+	angle := math.Atan2(v1.Cross(v2).Len(), v1.Dot(v2))
+	r := angle / l.DirectionAccuracy.Radian()
+
+	return []float64{math.Min(r, 1000)}
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (l *Line) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	if !l.DirectionEnabled {
+		return
+	}
+
 	site := l.site
 
 	p1, ok := site.Points[l.P1]
 	if !ok {
-		return 0
+		return
 	}
 	p2, ok := site.Points[l.P2]
 	if !ok {
-		return 0
+		return
 	}
 
-	ssr := 0.0
+	v1, v2 := l.DirectionVector.Vec3(), p2.Position.Vec3().Sub(p1.Position.Vec3())
+	if v1.Len() == 0 || v2.Len() == 0 {
+		return
+	}
+
+	// Ignore the limited region.
+	angle := math.Atan2(v1.Cross(v2).Len(), v1.Dot(v2))
+	if angle/l.DirectionAccuracy.Radian() >= 1000 {
+		return
+	}
 
-	if l.DirectionEnabled {
-		v1, v2 := l.DirectionVector.Vec3(), p2.Position.Vec3().Sub(p1.Position.Vec3())
+	// The gradient of the angle with respect to v2 points away from the direction vector, perpendicular to v2.
+	u, w := v1.Normalize(), v2.Normalize()
+	uPerpendicular := u.Sub(w.Mul(u.Dot(w)))
+	uPerpendicularLen := uPerpendicular.Len()
+	if uPerpendicularLen == 0 {
+		return
+	}
+	gradient := uPerpendicular.Mul(-1 / (uPerpendicularLen * v2.Len() * l.DirectionAccuracy.Radian()))
+
+	for i := 0; i < 3; i++ {
+		addFunc(0, &p2.Position.Coordinate[i], gradient[i])
+		addFunc(0, &p1.Position.Coordinate[i], -gradient[i])
+	}
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (l *Line) ResidualSqr() float64 {
+	return residualsSqr(l.Residuals())
+}
 
-		r := math.Acos(v1.Dot(v2)/v1.Len()/v2.Len()) / float64(l.DirectionAccuracy)
-		sr := r * r
-		if math.IsNaN(sr) {
-			sr = 1000000
+// LineOptions returns all lines of the site as dropdown options.
+// The first option is empty, it stands for no line.
+func (s *Site) LineOptions() SelectOptions {
+	options := SelectOptions{{Key: "", Text: "-"}}
+	for _, line := range s.LinesSorted() {
+		pointName := func(key string) string {
+			if point, ok := s.Points[key]; ok {
+				return point.DisplayName()
+			}
+			return "-"
 		}
-		ssr += math.Min(sr, 1000000)
+		options = append(options, SelectOption{Key: line.Key(), Text: line.DisplayName() + ": " + pointName(line.P1) + " - " + pointName(line.P2)})
 	}
 
-	return ssr
+	return options
 }
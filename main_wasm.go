@@ -14,8 +14,14 @@ import (
 func main() {
 
 	mountPoint := flag.String("mount-point", "#vugu_mount_point", "The query selector for the mount point for the root component, if it is not a full HTML component")
+	worker := flag.Bool("worker", false, "Run as optimizer web worker instead of the UI")
 	flag.Parse()
 
+	if *worker {
+		runOptimizerWorker()
+		return
+	}
+
 	fmt.Printf("Entering main(), -mount-point=%q\n", *mountPoint)
 	defer fmt.Printf("Exiting main()\n")
 
@@ -40,6 +40,22 @@ func generateObj(site *Site) []byte {
 		result += fmt.Sprintf("l %d %d\n", indexP1, indexP2)
 	}
 
+	result += "\n#Planes\n"
+	for _, plane := range site.PlanesSorted() {
+		outline := plane.Outline()
+		if len(outline) < 3 {
+			continue
+		}
+		result += fmt.Sprintf("o Plane_%s_%s\n", plane.Key(), plane.Name)
+		face := "f"
+		for _, v := range outline {
+			result += fmt.Sprintf("v %f %f %f\n", v[0], v[1], v[2])
+			face += fmt.Sprintf(" %d", counter)
+			counter++
+		}
+		result += face + "\n"
+	}
+
 	result += "\n#Rangefinders\n"
 	for _, rangefinder := range site.Rangefinders {
 		result += fmt.Sprintf("o Rangefinder_%s_%s\n", rangefinder.Key(), rangefinder.Name)
@@ -53,6 +69,19 @@ func generateObj(site *Site) []byte {
 		}
 	}
 
+	result += "\n#Levels\n"
+	for _, level := range site.Levels {
+		result += fmt.Sprintf("o Level_%s_%s\n", level.Key(), level.Name)
+		for _, measurement := range level.Measurements {
+			indexP1, ok1 := pointKeyIndices[measurement.P1]
+			indexP2, ok2 := pointKeyIndices[measurement.P2]
+			if !ok1 || !ok2 {
+				continue
+			}
+			result += fmt.Sprintf("l %d %d\n", indexP1, indexP2)
+		}
+	}
+
 	result += "\n#Tripods\n"
 	for _, tripod := range site.Tripods {
 		result += fmt.Sprintf("o Tripod_%s_%s\n", tripod.Key(), tripod.Name)
@@ -69,5 +98,21 @@ func generateObj(site *Site) []byte {
 		}
 	}
 
+	result += "\n#Total stations\n"
+	for _, totalStation := range site.TotalStations {
+		result += fmt.Sprintf("o TotalStation_%s_%s\n", totalStation.Key(), totalStation.Name)
+		pointKeyIndices[totalStation.Key()] = counter
+		counter++
+		result += fmt.Sprintf("v %f %f %f\n", totalStation.Position.X().Meters(), totalStation.Position.Y().Meters(), totalStation.Position.Z().Meters())
+		for _, measurement := range totalStation.Measurements {
+			indexP1, ok1 := pointKeyIndices[totalStation.Key()]
+			indexP2, ok2 := pointKeyIndices[measurement.PointKey]
+			if !ok1 || !ok2 {
+				continue
+			}
+			result += fmt.Sprintf("l %d %d\n", indexP1, indexP2)
+		}
+	}
+
 	return []byte(result)
 }
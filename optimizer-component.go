@@ -23,6 +23,8 @@ type OptimizerComponent struct {
 	AttrMap vugu.AttrMap
 
 	OptimizerState   *OptimizerState
+	Selection        []OptimizerSelectable // If set, only the selected objects are optimized.
+	IdleIcon         string                // Font Awesome class of the icon shown while the optimizer is not running. Defaults to "fas fa-sync".
 	fontAwesomeClass string
 }
 
@@ -37,6 +39,8 @@ func (c *OptimizerComponent) Compute(ctx vugu.ComputeCtx) {
 		default:
 			c.fontAwesomeClass = "fas fa-hourglass-start"
 		}
+	} else if c.IdleIcon != "" {
+		c.fontAwesomeClass = c.IdleIcon
 	} else {
 		c.fontAwesomeClass = "fas fa-sync"
 	}
@@ -45,6 +49,8 @@ func (c *OptimizerComponent) Compute(ctx vugu.ComputeCtx) {
 func (c *OptimizerComponent) handleClick(event vugu.DOMEvent) {
 	if c.OptimizerState.Running() { // Side not: This is not perfectly race condition free, but it doesn't matter here.
 		c.OptimizerState.Stop()
+	} else if c.Selection != nil {
+		c.OptimizerState.StartSelection(event, c.Selection)
 	} else {
 		c.OptimizerState.Start(event)
 	}
@@ -0,0 +1,517 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"gonum.org/v1/gonum/mat"
+)
+
+// datumFreedomTolerance is the largest relative change of the residuals that is still considered as a free direction.
+const datumFreedomTolerance = 1e-6
+
+// Indices of the datum generators: 3 translations, 3 rotations and the scale.
+const (
+	datumTranslation = 0
+	datumRotation    = 3
+	datumScale       = 6
+	datumGenerators  = 7
+)
+
+// DatumAnalysis contains the result of the check that is done before the optimization.
+type DatumAnalysis struct {
+	Observations int // Number of residuals that depend on any tweakable.
+	Unknowns     int // Number of tweakables.
+
+	Errors   []string // Problems that prevent a meaningful solution, like a network that can float around freely.
+	Warnings []string // Problems that only affect parts of the solution.
+}
+
+// OK returns whether the optimization can be started without problems.
+func (da *DatumAnalysis) OK() bool {
+	return len(da.Errors) == 0
+}
+
+// Text returns all errors and warnings as human readable text.
+func (da *DatumAnalysis) Text() string {
+	var sb strings.Builder
+	for _, e := range da.Errors {
+		fmt.Fprintf(&sb, "Error: %s\n", e)
+	}
+	for _, w := range da.Warnings {
+		fmt.Fprintf(&sb, "Warning: %s\n", w)
+	}
+
+	return sb.String()
+}
+
+// datumObject is an object that contains tweakables, like a point or the pose of a photo.
+type datumObject struct {
+	name        string
+	tweakables  []Tweakable
+	position    *Coordinate // Position that moves with the datum, or nil.
+	orientation *Rotation   // Orientation that rotates with the datum, or nil.
+	azimuth     *Angle      // Horizontal direction, clockwise around the up axis, that rotates with the datum, or nil.
+	up          mgl64.Vec3  // Up axis the azimuth is measured around.
+	normal      *Coordinate // Normal of a plane that rotates with the datum, or nil.
+	offset      *Distance   // Offset of a plane along its normal, or nil. Requires normal to be set.
+	camera      *Camera     // Camera whose intrinsics are contained in this object, or nil.
+
+	internalObservations int // Number of observations that only depend on the object itself, like the length of a plane normal.
+}
+
+// datumObjects returns all objects of the site that can contain tweakables.
+func datumObjects(site *Site) []datumObject {
+	var objects []datumObject
+
+	for _, point := range site.PointsSorted() {
+		tweakables, _ := point.GetTweakablesAndResiduals()
+		objects = append(objects, datumObject{name: "Point " + point.DisplayName(), tweakables: tweakables, position: &point.Position.Coordinate})
+	}
+
+	for _, plane := range site.PlanesSorted() {
+		tweakables, _ := plane.GetTweakablesAndResiduals()
+		object := datumObject{name: "Plane " + plane.DisplayName(), tweakables: tweakables, normal: &plane.Normal, offset: &plane.Offset}
+		if !plane.NormalLocked {
+			object.internalObservations = 1
+		}
+		objects = append(objects, object)
+	}
+
+	for _, camera := range site.CamerasSorted() {
+		photoTweakables := map[Tweakable]struct{}{}
+		for _, photo := range camera.PhotosSorted() {
+			tweakables, _ := photo.GetTweakablesAndResiduals()
+			for _, tweakable := range tweakables {
+				photoTweakables[tweakable] = struct{}{}
+			}
+			objects = append(objects, datumObject{
+				name:        fmt.Sprintf("Photo %s of camera %s", photo.DisplayName(), camera.DisplayName()),
+				tweakables:  tweakables,
+				position:    &photo.Position.Coordinate,
+				orientation: &photo.Orientation.Rotation,
+			})
+		}
+
+		var intrinsics []Tweakable
+		tweakables, _ := camera.GetTweakablesAndResiduals()
+		for _, tweakable := range tweakables {
+			if _, ok := photoTweakables[tweakable]; !ok {
+				intrinsics = append(intrinsics, tweakable)
+			}
+		}
+		objects = append(objects, datumObject{name: "Camera " + camera.DisplayName(), tweakables: intrinsics, camera: camera})
+	}
+
+	for _, tripod := range site.TripodsSorted() {
+		tweakables, _ := tripod.GetTweakablesAndResiduals()
+		objects = append(objects, datumObject{name: "Tripod " + tripod.DisplayName(), tweakables: tweakables, position: &tripod.Position.Coordinate})
+	}
+
+	for _, totalStation := range site.TotalStationsSorted() {
+		tweakables, _ := totalStation.GetTweakablesAndResiduals()
+		objects = append(objects, datumObject{
+			name:       "Total station " + totalStation.DisplayName(),
+			tweakables: tweakables,
+			position:   &totalStation.Position.Coordinate,
+			azimuth:    &totalStation.Orientation,
+			up:         site.UpDirection(),
+		})
+	}
+
+	return objects
+}
+
+// datumTangents returns how every tweakable changes under the infinitesimal datum transformations.
+// The rotations and the scale are about the given center.
+func datumTangents(objects []datumObject, center mgl64.Vec3) map[Tweakable][datumGenerators]float64 {
+	tangents := map[Tweakable][datumGenerators]float64{}
+
+	for _, object := range objects {
+		if object.position != nil {
+			p := object.position.Vec3().Sub(center)
+			for i := range object.position {
+				var tangent [datumGenerators]float64
+				tangent[datumTranslation+i] = 1
+				for axis := 0; axis < 3; axis++ {
+					var e mgl64.Vec3
+					e[axis] = 1
+					tangent[datumRotation+axis] = e.Cross(p)[i]
+				}
+				tangent[datumScale] = p[i]
+				tangents[&object.position[i]] = tangent
+			}
+		}
+
+		if object.orientation != nil {
+			orientationTangents := rotationDatumTangents(*object.orientation)
+			for i := range object.orientation {
+				var tangent [datumGenerators]float64
+				for axis := 0; axis < 3; axis++ {
+					tangent[datumRotation+axis] = orientationTangents[axis][i]
+				}
+				tangents[&object.orientation[i]] = tangent
+			}
+		}
+
+		if object.azimuth != nil {
+			// Rotating the world counterclockwise around the up axis decreases the clockwise azimuth.
+			var tangent [datumGenerators]float64
+			for axis := 0; axis < 3; axis++ {
+				tangent[datumRotation+axis] = -object.up[axis]
+			}
+			tangents[object.azimuth] = tangent
+		}
+
+		if object.normal != nil {
+			// The normal only rotates with the datum, its length stays the same.
+			n := object.normal.Vec3()
+			for i := range object.normal {
+				var tangent [datumGenerators]float64
+				for axis := 0; axis < 3; axis++ {
+					var e mgl64.Vec3
+					e[axis] = 1
+					tangent[datumRotation+axis] = e.Cross(n)[i]
+				}
+				tangents[&object.normal[i]] = tangent
+			}
+
+			// The plane contains all x with n̂·x = offset, so the offset changes by n̂·t for a translation t,
+			// by (ω×n̂)·center for a rotation ω about the center, and by s·(offset - n̂·center) for a scale s.
+			if object.offset != nil && n.Len() > 0 {
+				unit := n.Normalize()
+				var tangent [datumGenerators]float64
+				for axis := 0; axis < 3; axis++ {
+					var e mgl64.Vec3
+					e[axis] = 1
+					tangent[datumTranslation+axis] = unit[axis]
+					tangent[datumRotation+axis] = e.Cross(unit).Dot(center)
+				}
+				tangent[datumScale] = object.offset.Meters() - unit.Dot(center)
+				tangents[object.offset] = tangent
+			}
+		}
+	}
+
+	return tangents
+}
+
+// rotationDatumTangents returns the change of the euler angles of a photo when the world is rotated around each axis.
+// The result is zero if the euler angles are in gimbal lock.
+func rotationDatumTangents(r Rotation) (tangents [3][3]float64) {
+	// Rotation from world into camera space, the same as used in the projection.
+	matrix := func(r Rotation) mgl64.Mat3 {
+		return mgl64.Rotate3DX(float64(-r.X())).Mul3(mgl64.Rotate3DY(float64(-r.Y()))).Mul3(mgl64.Rotate3DZ(float64(-r.Z())))
+	}
+	m := matrix(r)
+
+	// Derivatives of the matrix with respect to the euler angles.
+	const h = 1e-6
+	var derivatives [3]mgl64.Mat3
+	for i := range r {
+		rPlus, rMinus := r, r
+		rPlus[i] += h
+		rMinus[i] -= h
+		derivatives[i] = matrix(rPlus).Sub(matrix(rMinus)).Mul(1 / (2 * h))
+	}
+
+	var normal [3][3]float64
+	for i := range derivatives {
+		for j := range derivatives {
+			for k := range derivatives[i] {
+				normal[i][j] += derivatives[i][k] * derivatives[j][k]
+			}
+		}
+	}
+	normalInv, ok := invertSymmetric3(normal, 3)
+	if !ok {
+		return
+	}
+
+	for axis := 0; axis < 3; axis++ {
+		// Rotating the world by ω changes the matrix by -M·[ω]×.
+		var omega mgl64.Vec3
+		omega[axis] = 1
+		skew := mgl64.Mat3{0, omega[2], -omega[1], -omega[2], 0, omega[0], omega[1], -omega[0], 0}
+		target := m.Mul3(skew).Mul(-1)
+
+		// Least squares fit of the change of the euler angles.
+		var rhs [3]float64
+		for i := range derivatives {
+			for k := range target {
+				rhs[i] += derivatives[i][k] * target[k]
+			}
+		}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				tangents[axis][i] += normalInv[i][j] * rhs[j]
+			}
+		}
+	}
+
+	return
+}
+
+// AnalyzeDatum checks whether the given tweakables are determined by the residuals.
+//
+// This counts the observations and unknowns, finds sub-networks that aren't connected by any measurement,
+// and checks for every sub-network if it can be moved, rotated or scaled without changing any residual.
+// The site has to be locked.
+func AnalyzeDatum(site *Site, tweakables []Tweakable, residuals []Residualer) *DatumAnalysis {
+	columns := tweakableColumns(tweakables)
+	rowOffsets, m := residualRowOffsets(residuals)
+	r := make([]float64, 0, m)
+	for _, residual := range residuals {
+		r = append(r, residual.Residuals()...)
+	}
+	rows := make([][]jacobianEntry, m)
+	residualJacobian(tweakables, columns, residuals, rowOffsets, r, rows)
+
+	analysis := &DatumAnalysis{Unknowns: len(tweakables)}
+
+	// Find the connected sub-networks with a union-find over all columns.
+	parents := make([]int, len(tweakables))
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+	columnRows := make([][]int, len(tweakables)) // Rows that depend on every column.
+	for i, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		analysis.Observations++
+		for _, entry := range row {
+			columnRows[entry.column] = append(columnRows[entry.column], i)
+			parents[find(entry.column)] = find(row[0].column)
+		}
+	}
+
+	if analysis.Observations < analysis.Unknowns {
+		analysis.Errors = append(analysis.Errors, fmt.Sprintf("There are fewer observations (%d) than unknowns (%d). Add more measurements or point mappings, or lock some values.", analysis.Observations, analysis.Unknowns))
+	}
+
+	// Check every object on its own.
+	objects := datumObjects(site)
+	objectComponents := make([]int, len(objects))
+	center, centerCount := mgl64.Vec3{}, 0
+	for o, object := range objects {
+		objectComponents[o] = -1
+		objectColumns := 0
+		objectObservations := map[int]struct{}{}
+		for _, tweakable := range object.tweakables {
+			column, ok := columns[tweakable]
+			if !ok {
+				continue
+			}
+			objectColumns++
+			objectComponents[o] = find(column)
+			for _, row := range columnRows[column] {
+				objectObservations[row] = struct{}{}
+			}
+		}
+
+		switch {
+		case objectColumns == 0:
+		case len(objectObservations) <= object.internalObservations:
+			analysis.Warnings = append(analysis.Warnings, fmt.Sprintf("%s isn't determined by any measurement. Map or measure it, or lock its values.", object.name))
+		case len(objectObservations) < objectColumns:
+			analysis.Warnings = append(analysis.Warnings, fmt.Sprintf("%s has %d unknowns, but only %d observations.", object.name, objectColumns, len(objectObservations)))
+		}
+
+		if object.position != nil {
+			center, centerCount = center.Add(object.position.Vec3()), centerCount+1
+		}
+	}
+	if centerCount > 0 {
+		center = center.Mul(1 / float64(centerCount))
+	}
+
+	// Determine the change of the residuals for every datum transformation, for every sub-network.
+	tangents := datumTangents(objects, center)
+	type componentSystem struct {
+		changes    [][datumGenerators]float64 // Change of every row for every datum transformation.
+		magnitudes [datumGenerators]float64   // Sum of squares of the absolute changes, without any cancellation.
+
+		tangents          [][datumGenerators]float64 // Change of every tweakable of the sub-network for every datum transformation.
+		tangentMagnitudes [datumGenerators]float64   // Sum of squares of the tangents.
+	}
+	systems := map[int]*componentSystem{}
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		component := find(row[0].column)
+		system, ok := systems[component]
+		if !ok {
+			system = &componentSystem{}
+			systems[component] = system
+		}
+
+		var change, magnitude [datumGenerators]float64
+		for _, entry := range row {
+			tangent := tangents[tweakables[entry.column]]
+			for g := range tangent {
+				change[g] += entry.derivative * tangent[g]
+				magnitude[g] += math.Abs(entry.derivative * tangent[g])
+			}
+		}
+		system.changes = append(system.changes, change)
+		for g := range magnitude {
+			system.magnitudes[g] += magnitude[g] * magnitude[g]
+		}
+	}
+
+	for column, tweakable := range tweakables {
+		if len(columnRows[column]) == 0 {
+			continue
+		}
+		system := systems[find(column)]
+		tangent := tangents[tweakable]
+		system.tangents = append(system.tangents, tangent)
+		for g := range tangent {
+			system.tangentMagnitudes[g] += tangent[g] * tangent[g]
+		}
+	}
+
+	var floatingComponents int
+	for component, system := range systems {
+		// Combinations of transformations that don't move any tweakable of the sub-network, like moving a plane along itself, aren't free.
+		nullity := func(n int) int {
+			return datumNullity(system.changes, system.magnitudes, n) - datumNullity(system.tangents, system.tangentMagnitudes, n)
+		}
+		translations := nullity(datumRotation)
+		rotations := nullity(datumScale) - translations
+		scales := nullity(datumGenerators) - translations - rotations
+		if translations+rotations+scales == 0 {
+			continue
+		}
+		floatingComponents++
+
+		// Describe the sub-network by its objects.
+		var names []string
+		var unlockedAOVCameras []string
+		for o, object := range objects {
+			if objectComponents[o] != component {
+				continue
+			}
+			names = append(names, object.name)
+			if object.camera != nil && !object.camera.HorizontalAOVLocked && !object.camera.Panoramic() {
+				unlockedAOVCameras = append(unlockedAOVCameras, object.name)
+			}
+		}
+		description := "The sub-network with " + datumListNames(names)
+		if len(systems) == 1 {
+			description = "The whole network"
+		}
+
+		var freedoms []string
+		if translations > 0 {
+			freedoms = append(freedoms, fmt.Sprintf("moved (%d directions)", translations))
+		}
+		if rotations > 0 {
+			freedoms = append(freedoms, fmt.Sprintf("rotated (%d axes)", rotations))
+		}
+		if scales > 0 {
+			freedoms = append(freedoms, "scaled")
+		}
+		message := fmt.Sprintf("%s can be %s freely without changing any residual.", description, datumJoin(freedoms))
+		if translations > 0 || rotations > 0 {
+			message += " Lock the position and orientation of one photo, or the coordinates of at least three points that aren't on a line."
+		}
+		if scales > 0 {
+			message += " Add a rangefinder or tripod measurement, or lock the coordinates of two points to define the scale."
+			if len(unlockedAOVCameras) > 0 {
+				message += fmt.Sprintf(" Also lock the horizontal angle of view of %s, otherwise the solution may collapse into all photos at infinity with an angle of view of 0.", datumJoin(unlockedAOVCameras))
+			}
+		}
+		analysis.Errors = append(analysis.Errors, message)
+	}
+
+	if floatingComponents > 1 {
+		analysis.Warnings = append(analysis.Warnings, fmt.Sprintf("The measurements form %d sub-networks that aren't connected with each other. Connect them by mapping or measuring shared points, or fix the datum of every sub-network.", floatingComponents))
+	}
+
+	return analysis
+}
+
+// datumNullity returns the number of independent combinations of the first n datum transformations that don't change any residual.
+// Transformations that don't touch any tweakable of the sub-network are ignored.
+func datumNullity(changes [][datumGenerators]float64, magnitudes [datumGenerators]float64, n int) int {
+	var generators []int
+	for g := 0; g < n; g++ {
+		if magnitudes[g] > 0 {
+			generators = append(generators, g)
+		}
+	}
+	if len(generators) == 0 {
+		return 0
+	}
+
+	// Normal matrix of the normalized changes.
+	normal := mat.NewSymDense(len(generators), nil)
+	for _, change := range changes {
+		for i, g1 := range generators {
+			for j := i; j < len(generators); j++ {
+				g2 := generators[j]
+				normal.SetSym(i, j, normal.At(i, j)+change[g1]*change[g2]/math.Sqrt(magnitudes[g1]*magnitudes[g2]))
+			}
+		}
+	}
+
+	var eigen mat.EigenSym
+	if ok := eigen.Factorize(normal, false); !ok {
+		return 0
+	}
+
+	nullity := 0
+	for _, value := range eigen.Values(nil) {
+		if value < datumFreedomTolerance*datumFreedomTolerance {
+			nullity++
+		}
+	}
+
+	return nullity
+}
+
+// datumListNames returns a short list of the given names.
+func datumListNames(names []string) string {
+	const maxNames = 3
+	if len(names) <= maxNames {
+		return datumJoin(names)
+	}
+
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:maxNames], ", "), len(names)-maxNames)
+}
+
+// datumJoin joins the given list of words into a sentence, like "a, b and c".
+func datumJoin(words []string) string {
+	if len(words) <= 1 {
+		return strings.Join(words, "")
+	}
+
+	return strings.Join(words[:len(words)-1], ", ") + " and " + words[len(words)-1]
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// newDatumTestPhotoSite returns a site with 6 photos of 10 free points, and a camera with locked intrinsics.
+// The scale is defined by a single rangefinder measurement.
+func newDatumTestPhotoSite(t *testing.T) (*Site, []*Point) {
+	rng := rand.New(rand.NewSource(1))
+	site := NewSite("datum")
+
+	var points []*Point
+	for i := 0; i < 10; i++ {
+		point := site.NewPoint("")
+		point.Position.Coordinate = Coordinate{Distance(rng.Float64()*6 - 3), Distance(rng.Float64()*6 - 3), Distance(rng.Float64() * 2)}
+		points = append(points, point)
+	}
+
+	camera := site.NewCamera("Camera")
+	camera.HorizontalAOV = Angle(70 * math.Pi / 180)
+	for i := 0; i < 6; i++ {
+		photo := newTestPhoto(camera, PixelCoordinate{4000, 3000}, 1)
+		photo.Position.Coordinate = Coordinate{Distance(rng.Float64()*4 - 2), Distance(rng.Float64()*4 - 2), -10}
+		photo.Orientation.Rotation = Rotation{Angle(rng.Float64()*0.2 - 0.1), Angle(rng.Float64()*0.2 - 0.1), Angle(rng.Float64() * 6)}
+
+		projection := photo.projection()
+		for _, point := range points {
+			projected, _ := projection.project(point.Position.Coordinate, nil)
+			if projected[2] <= 0 || projected[0] < 0 || projected[0] > photo.imageSize[0] || projected[1] < 0 || projected[1] > photo.imageSize[1] {
+				continue
+			}
+			mapping := photo.NewMapping()
+			mapping.PointKey = point.Key()
+			mapping.Position = PixelCoordinate{projected[0], projected[1]}
+		}
+		if len(photo.Mappings) < 6 {
+			t.Fatalf("Photo %d only sees %d points", i, len(photo.Mappings))
+		}
+	}
+
+	rangefinder := site.NewRangefinder("Rangefinder")
+	measurement := rangefinder.NewMeasurement()
+	measurement.P1, measurement.P2 = points[0].Key(), points[1].Key()
+	measurement.MeasuredDistance = points[0].Position.Distance(points[1].Position.Coordinate)
+
+	return site, points
+}
+
+// analyzeDatumTestSite runs the datum analysis on all tweakables and residuals of the site.
+func analyzeDatumTestSite(site *Site) *DatumAnalysis {
+	tweakables, residuals := site.GetTweakablesAndResiduals()
+	return AnalyzeDatum(site, tweakables, residuals)
+}
+
+// TestAnalyzeDatumPhotoNetwork checks that a free photo network with a known scale can only be moved and rotated.
+func TestAnalyzeDatumPhotoNetwork(t *testing.T) {
+	site, points := newDatumTestPhotoSite(t)
+
+	analysis := analyzeDatumTestSite(site)
+	if len(analysis.Errors) != 1 {
+		t.Fatalf("The analysis has %d errors, want 1:\n%s", len(analysis.Errors), analysis.Text())
+	}
+	if text := analysis.Errors[0]; !strings.HasPrefix(text, "The whole network can be moved (3 directions) and rotated (3 axes) freely") || strings.Contains(text, "scaled") {
+		t.Errorf("The free photo network isn't reported as moved in 3 directions and rotated around 3 axes:\n%s", text)
+	}
+
+	// Without the rangefinder the scale isn't determined either.
+	for _, rangefinder := range site.RangefindersSorted() {
+		rangefinder.Delete()
+	}
+	if analysis := analyzeDatumTestSite(site); len(analysis.Errors) != 1 || !strings.Contains(analysis.Errors[0], "moved (3 directions), rotated (3 axes) and scaled") {
+		t.Errorf("The photo network without scale isn't reported as moved, rotated and scaled:\n%s", analysis.Text())
+	}
+
+	// Three locked points that aren't on a line fix the datum.
+	for _, point := range points[:3] {
+		point.Position.Locked = [3]bool{true, true, true}
+	}
+	if analysis := analyzeDatumTestSite(site); !analysis.OK() || len(analysis.Warnings) != 0 {
+		t.Errorf("The network with 3 locked points isn't determined:\n%s", analysis.Text())
+	}
+}
+
+// TestAnalyzeDatumDisconnected checks that a group of points that isn't connected to the rest of the network is reported on its own.
+func TestAnalyzeDatumDisconnected(t *testing.T) {
+	site, points := newDatumTestPhotoSite(t)
+	for _, point := range points[:3] {
+		point.Position.Locked = [3]bool{true, true, true}
+	}
+
+	// A tetrahedron of free points that are only measured against each other.
+	var group []*Point
+	for i, coordinate := range []Coordinate{{10, 0, 0}, {12, 0, 0}, {10, 2, 0}, {10, 0, 2}} {
+		point := site.NewPoint("Group" + string(rune('A'+i)))
+		point.Position.Coordinate = coordinate
+		group = append(group, point)
+	}
+	rangefinder := site.NewRangefinder("Group rangefinder")
+	for i, a := range group {
+		for _, b := range group[i+1:] {
+			measurement := rangefinder.NewMeasurement()
+			measurement.P1, measurement.P2 = a.Key(), b.Key()
+			measurement.MeasuredDistance = a.Position.Distance(b.Position.Coordinate)
+		}
+	}
+
+	analysis := analyzeDatumTestSite(site)
+	if len(analysis.Errors) != 1 {
+		t.Fatalf("The analysis has %d errors, want 1:\n%s", len(analysis.Errors), analysis.Text())
+	}
+	if text := analysis.Errors[0]; !strings.HasPrefix(text, "The sub-network with ") || !strings.Contains(text, "moved (3 directions) and rotated (3 axes) freely") || !strings.Contains(text, "Point Group") {
+		t.Errorf("The disconnected group isn't reported as free sub-network:\n%s", text)
+	}
+
+	// If the photo network is free as well, both sub-networks are reported.
+	for _, point := range points[:3] {
+		point.Position.Locked = [3]bool{}
+	}
+	analysis = analyzeDatumTestSite(site)
+	if len(analysis.Errors) != 2 {
+		t.Errorf("The analysis has %d errors, want 2:\n%s", len(analysis.Errors), analysis.Text())
+	}
+	if !strings.Contains(analysis.Text(), "The measurements form 2 sub-networks") {
+		t.Errorf("The analysis doesn't warn about the 2 sub-networks:\n%s", analysis.Text())
+	}
+}
+
+// TestAnalyzeDatumPlane checks networks that are only held together by planes.
+func TestAnalyzeDatumPlane(t *testing.T) {
+	site := NewSite("datum")
+	var points []*Point
+	for _, coordinate := range []Coordinate{{0, 0, 0}, {4, 0, 0.1}, {0, 3, -0.1}, {3, 3, 0}} {
+		point := site.NewPoint("")
+		point.Position.Coordinate = coordinate
+		points = append(points, point)
+	}
+
+	plane := site.NewPlane("Plane")
+	for _, point := range points {
+		plane.PointKeys = append(plane.PointKeys, point.Key())
+	}
+	plane.Normal = Coordinate{0.1, 0.2, 1}
+	plane.Offset = 0.3
+
+	// The points can slide along the plane, and the plane can be moved and rotated with them.
+	analysis := analyzeDatumTestSite(site)
+	if analysis.OK() || !strings.Contains(analysis.Text(), "There are fewer observations") {
+		t.Errorf("The plane-only network isn't reported as underdetermined:\n%s", analysis.Text())
+	}
+	if !strings.Contains(analysis.Text(), "moved (3 directions) and rotated (3 axes) freely") {
+		t.Errorf("The plane-only network isn't reported as moved and rotated:\n%s", analysis.Text())
+	}
+
+	// With locked points the plane is determined, and moving it along itself isn't a datum problem.
+	for _, point := range points {
+		point.Position.Locked = [3]bool{true, true, true}
+	}
+	if analysis := analyzeDatumTestSite(site); !analysis.OK() || len(analysis.Warnings) != 0 {
+		t.Errorf("The plane through locked points isn't determined:\n%s", analysis.Text())
+	}
+
+	// A plane without any point can't be determined, but it's not a free network either.
+	site.NewPlane("Empty")
+	analysis = analyzeDatumTestSite(site)
+	if strings.Contains(analysis.Text(), "freely") || !strings.Contains(analysis.Text(), "Plane Empty isn't determined") {
+		t.Errorf("The empty plane isn't reported as undetermined object:\n%s", analysis.Text())
+	}
+}
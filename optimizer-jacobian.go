@@ -0,0 +1,258 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Parameters of the derivative verification.
+const (
+	jacobianVerifyTolerance  = 1e-4 // Allowed difference between analytic and numeric derivatives, relative to their magnitude.
+	jacobianVerifyMaxReports = 20   // Maximum number of reported mismatches.
+)
+
+// tweakableColumns returns a map that resolves tweakables to their column in the jacobian.
+func tweakableColumns(tweakables []Tweakable) map[Tweakable]int {
+	columns := make(map[Tweakable]int, len(tweakables))
+	for i, tweakable := range tweakables {
+		columns[tweakable] = i
+	}
+
+	return columns
+}
+
+// residualRowOffsets returns the row of the first residual of every residualer, and the total number of residuals.
+// The site has to be locked.
+func residualRowOffsets(residuals []Residualer) ([]int, int) {
+	offsets := make([]int, len(residuals))
+	rows := 0
+	for i, residual := range residuals {
+		offsets[i] = rows
+		rows += len(residual.Residuals())
+	}
+
+	return offsets, rows
+}
+
+// activeResidualCount returns the number of residuals that count as observations.
+// Residuals that are always 0 are left out, see ActiveResidualer.
+func activeResidualCount(residuals []Residualer) int {
+	count := 0
+	for _, residual := range residuals {
+		if activeResidualer, ok := residual.(ActiveResidualer); ok {
+			count += activeResidualer.ActiveResiduals()
+		} else {
+			count += len(residual.Residuals())
+		}
+	}
+
+	return count
+}
+
+// jacobianEntry is a single non-zero element of a row of the jacobian.
+type jacobianEntry struct {
+	column     int
+	derivative float64
+}
+
+// addJacobianEntry adds the derivative to the entry with the given column, or appends a new entry to the row.
+func addJacobianEntry(row []jacobianEntry, column int, derivative float64) []jacobianEntry {
+	for i := range row {
+		if row[i].column == column {
+			row[i].derivative += derivative
+			return row
+		}
+	}
+
+	return append(row, jacobianEntry{column, derivative})
+}
+
+// jacobianColumnScaling returns a factor for every column of the jacobian, that brings all columns to a similar magnitude.
+// Values with a very different influence on the residuals, like the distortion coefficients of a camera, would otherwise result in badly conditioned normal equations.
+// The factor approaches 1 for columns with a small influence, so that undetermined values don't get amplified.
+func jacobianColumnScaling(n int, rows [][]jacobianEntry) []float64 {
+	scaling := make([]float64, n)
+	for _, row := range rows {
+		for _, entry := range row {
+			scaling[entry.column] += entry.derivative * entry.derivative
+		}
+	}
+
+	for i, sumSqr := range scaling {
+		scaling[i] = 1 / (1 + math.Sqrt(sumSqr))
+	}
+
+	return scaling
+}
+
+// scaleJacobianColumns multiplies every column of the jacobian with its factor.
+func scaleJacobianColumns(rows [][]jacobianEntry, scaling []float64) {
+	for _, row := range rows {
+		for i := range row {
+			row[i].derivative *= scaling[row[i].column]
+		}
+	}
+}
+
+// residualJacobian determines the sparse jacobian of all residuals with respect to the given tweakables at their current values.
+// Every row of the jacobian is stored as a list of non-zero entries, rows has to contain one list for every residual.
+// Rows of residualers that don't implement Jacobianer are approximated by forward differences.
+// r has to contain the residuals at the current values, and the site has to be locked.
+//
+// Returns the number of residual evaluations that were needed for the numeric approximation.
+func residualJacobian(tweakables []Tweakable, columns map[Tweakable]int, residuals []Residualer, rowOffsets []int, r []float64, rows [][]jacobianEntry) int {
+	for i := range rows {
+		rows[i] = rows[i][:0]
+	}
+
+	var numeric []int
+	for i, residual := range residuals {
+		jacobianer, ok := residual.(Jacobianer)
+		if !ok {
+			numeric = append(numeric, i)
+			continue
+		}
+
+		rowOffset := rowOffsets[i]
+		jacobianer.Jacobian(func(residualIndex int, tweakable Tweakable, derivative float64) {
+			if column, ok := columns[tweakable]; ok {
+				row := rowOffset + residualIndex
+				rows[row] = addJacobianEntry(rows[row], column, derivative)
+			}
+		})
+	}
+
+	if len(numeric) == 0 {
+		return 0
+	}
+
+	for j, tweakable := range tweakables {
+		value := tweakable.TweakableValue()
+		h := math.Sqrt(2.2e-16) * math.Max(math.Abs(value), 1)
+		tweakable.SetTweakableValue(value + h)
+
+		for _, i := range numeric {
+			for k, rTemp := range residuals[i].Residuals() {
+				row := rowOffsets[i] + k
+				if derivative := (rTemp - r[row]) / h; derivative != 0 {
+					rows[row] = append(rows[row], jacobianEntry{j, derivative})
+				}
+			}
+		}
+
+		tweakable.SetTweakableValue(value)
+	}
+
+	return len(tweakables)
+}
+
+// VerifyJacobians compares the analytic derivatives of all residuals with numeric ones that are determined by central differences.
+// This is used to find errors in the implementations of the Jacobianer interface.
+//
+// Returns an error that lists the mismatching derivatives, if there are any.
+func VerifyJacobians(site *Site) error {
+	tweakables, residuals := site.GetTweakablesAndResiduals()
+
+	site.Lock()
+	defer site.Unlock()
+
+	columns := tweakableColumns(tweakables)
+	rowOffsets, rows := residualRowOffsets(residuals)
+
+	// Collect the analytic derivatives column-wise.
+	analytic := make([]map[int]float64, len(tweakables))
+	for j := range analytic {
+		analytic[j] = map[int]float64{}
+	}
+	for i, residual := range residuals {
+		jacobianer, ok := residual.(Jacobianer)
+		if !ok {
+			continue
+		}
+
+		jacobianer.Jacobian(func(residualIndex int, tweakable Tweakable, derivative float64) {
+			if column, ok := columns[tweakable]; ok {
+				analytic[column][rowOffsets[i]+residualIndex] += derivative
+			}
+		})
+	}
+
+	// Resolve a row to its residualer and the index of the residual.
+	describeRow := func(row int) string {
+		for i := len(rowOffsets) - 1; i >= 0; i-- {
+			if rowOffsets[i] <= row {
+				if keyer, ok := residuals[i].(interface{ Key() string }); ok {
+					return fmt.Sprintf("residual %d of %T %q", row-rowOffsets[i], residuals[i], keyer.Key())
+				}
+				return fmt.Sprintf("residual %d of %T", row-rowOffsets[i], residuals[i])
+			}
+		}
+		return fmt.Sprintf("residual row %d", row)
+	}
+
+	evaluate := func(dst []float64) []float64 {
+		dst = dst[:0]
+		for _, residual := range residuals {
+			dst = append(dst, residual.Residuals()...)
+		}
+		return dst
+	}
+
+	var errs []error
+	var mismatches int
+	rPlus, rMinus := make([]float64, 0, rows), make([]float64, 0, rows)
+
+	for j, tweakable := range tweakables {
+		value := tweakable.TweakableValue()
+		h := 1e-6 * math.Max(math.Abs(value), 1)
+
+		tweakable.SetTweakableValue(value + h)
+		rPlus = evaluate(rPlus)
+		tweakable.SetTweakableValue(value - h)
+		rMinus = evaluate(rMinus)
+		tweakable.SetTweakableValue(value)
+
+		for i, residual := range residuals {
+			if _, ok := residual.(Jacobianer); !ok {
+				continue
+			}
+
+			for row := rowOffsets[i]; row < rowOffsets[i]+len(residual.Residuals()); row++ {
+				numericDerivative := (rPlus[row] - rMinus[row]) / (2 * h)
+				analyticDerivative := analytic[j][row]
+
+				magnitude := math.Max(1, math.Max(math.Abs(numericDerivative), math.Abs(analyticDerivative)))
+				if math.Abs(numericDerivative-analyticDerivative) <= jacobianVerifyTolerance*magnitude {
+					continue
+				}
+
+				mismatches++
+				if mismatches <= jacobianVerifyMaxReports {
+					errs = append(errs, fmt.Errorf("derivative of %s with respect to tweakable %d (%T) is %g, but should be %g", describeRow(row), j, tweakable, analyticDerivative, numericDerivative))
+				}
+			}
+		}
+	}
+
+	if mismatches > jacobianVerifyMaxReports {
+		errs = append(errs, fmt.Errorf("and %d more mismatching derivatives", mismatches-jacobianVerifyMaxReports))
+	}
+
+	return errors.Join(errs...)
+}
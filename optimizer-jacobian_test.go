@@ -0,0 +1,204 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// newTestPhoto adds a photo without image data to the camera.
+// The size is the one of the stored image, the photo's size is the upright one according to the EXIF orientation.
+func newTestPhoto(camera *Camera, storedSize PixelCoordinate, orientation int) *CameraPhoto {
+	photo := new(CameraPhoto)
+	photo.initData()
+	photo.imageSize, photo.orientation = storedSize, orientation
+	if exifOrientationTransform(orientation, storedSize).swapsAxes() {
+		photo.imageSize = PixelCoordinate{storedSize.Y(), storedSize.X()}
+	}
+	photo.initReferences(camera, camera.site.shortIDGen.MustGenerate())
+
+	return photo
+}
+
+// newJacobianTestSite returns a small site that contains every type of residual.
+// All values are moved away from the solution, so that no residual is zero.
+// The camera uses the given projection model, and there is a photo for every EXIF orientation.
+func newJacobianTestSite(t *testing.T, model CameraModel) *Site {
+	rng := rand.New(rand.NewSource(1))
+	site := NewSite("jacobian")
+
+	var points []*Point
+	for i := 0; i < 12; i++ {
+		point := site.NewPoint(fmt.Sprintf("P%d", i+1))
+		point.Position.Coordinate = Coordinate{Distance(rng.Float64()*6 - 3), Distance(rng.Float64()*6 - 3), Distance(rng.Float64() * 2)}
+		point.Position.Locked = [3]bool{i < 3, i < 3, i < 3}
+		points = append(points, point)
+	}
+
+	camera := site.NewCamera("Camera")
+	camera.Model = model
+	camera.PixelAccuracy = 1
+	camera.HorizontalAOV = Angle(70 * math.Pi / 180)
+	camera.DistortionKs = [CameraDistortionKs]TweakableFloat{-0.05, 0.01, -0.002, 0.0005}
+	camera.DistortionPs = [CameraDistortionPs]TweakableFloat{0.001, -0.002, 0.03, 0.01}
+	camera.DistortionBs = [CameraDistortionBs]PixelDistance{0.5, -0.3}
+	camera.PrincipalPointOffset = PixelCoordinate{12, -8}
+	camera.HorizontalAOVLocked, camera.PrincipalPointOffsetLocked = false, false
+	camera.DistortionKsLocked = [CameraDistortionKs]bool{}
+	camera.DistortionPsLocked = [CameraDistortionPs]bool{}
+	camera.DistortionBsLocked = [CameraDistortionBs]bool{}
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		var photo *CameraPhoto
+		if camera.Panoramic() {
+			photo = newTestPhoto(camera, PixelCoordinate{4000, 2000}, orientation)
+			photo.Position.Coordinate = Coordinate{Distance(rng.Float64() - 0.5), Distance(rng.Float64() - 0.5), 1}
+			photo.Orientation.Rotation = Rotation{Angle(math.Pi/2 + rng.Float64()*0.2 - 0.1), Angle(rng.Float64()*0.2 - 0.1), Angle(rng.Float64() * 6)}
+		} else {
+			photo = newTestPhoto(camera, PixelCoordinate{4000, 3000}, orientation)
+			photo.Position.Coordinate = Coordinate{Distance(rng.Float64()*2 - 1), Distance(rng.Float64()*2 - 1), -10}
+			photo.Orientation.Rotation = Rotation{Angle(rng.Float64()*0.2 - 0.1), Angle(rng.Float64()*0.2 - 0.1), Angle(rng.Float64() * 6)}
+		}
+
+		projection := photo.projection()
+		for _, point := range points {
+			projected, _ := projection.project(point.Position.Coordinate, nil)
+			if !camera.Panoramic() && (projected[2] <= 0 || projected[0] < 0 || projected[0] > photo.imageSize[0] || projected[1] < 0 || projected[1] > photo.imageSize[1]) {
+				continue
+			}
+			mapping := photo.NewMapping()
+			mapping.PointKey = point.Key()
+			mapping.Position = photo.WrapImageCoordinate(PixelCoordinate{projected[0] + PixelDistance(rng.NormFloat64()*5), projected[1] + PixelDistance(rng.NormFloat64()*5)})
+		}
+		if len(photo.Mappings) == 0 {
+			t.Fatalf("Photo with orientation %d doesn't see any point", orientation)
+		}
+
+		if orientation == 2 && !camera.Panoramic() {
+			photo.Intrinsics.Enable()
+			photo.Intrinsics.HorizontalAOV += Angle(1 * math.Pi / 180)
+			photo.Intrinsics.PrincipalPointOffset = PixelCoordinate{4, 3}
+			photo.Intrinsics.K1 = -0.04
+		}
+
+		photo.Position.Coordinate[0] += 0.1
+		photo.Orientation.Rotation[2] += 0.01
+	}
+
+	rangefinder := site.NewRangefinder("Rangefinder")
+	for i := 0; i < 3; i++ {
+		measurement := rangefinder.NewMeasurement()
+		measurement.P1, measurement.P2 = points[i].Key(), points[i+5].Key()
+		measurement.MeasuredDistance = points[i].Position.Distance(points[i+5].Position.Coordinate) + 0.05
+	}
+
+	tripod := site.NewTripod("Tripod")
+	tripod.Position.Coordinate = Coordinate{0.3, -0.2, 1.1}
+	tripod.Offset, tripod.OffsetSide = 0.05, 0.02
+	tripod.OffsetLocked, tripod.OffsetSideLocked = false, false
+	for i := 0; i < 4; i++ {
+		measurement := tripod.NewMeasurement()
+		measurement.PointKey = points[i+3].Key()
+		measurement.MeasuredDistance = Distance(2 + 0.1*float64(i))
+	}
+
+	line := site.NewLine()
+	line.P1, line.P2 = points[3].Key(), points[4].Key()
+	line.DirectionEnabled = true
+	line.DirectionVector = Coordinate{0.1, 0.2, 1}
+
+	onLine := line.NewPointConstraint(points[5].Key())
+	onLine.Accuracy = 0.01
+	onSegment := line.NewPointConstraint(points[6].Key())
+	onSegment.Segment = true
+	onSegment.Accuracy = 0.01
+
+	plane := site.NewPlane("Plane")
+	plane.PointKeys = []string{points[7].Key(), points[8].Key(), points[9].Key(), points[10].Key()}
+	plane.Normal = Coordinate{0.1, -0.2, 1}
+	plane.Offset = 0.5
+
+	for _, degrees := range []float64{90, 0, 40} {
+		angleConstraint := site.NewAngleConstraint()
+		angleConstraint.A.LineKey = line.Key()
+		angleConstraint.B.P1, angleConstraint.B.P2 = points[7].Key(), points[11].Key()
+		angleConstraint.Angle.SetDegree(degrees)
+	}
+
+	level := site.NewLevel("Level")
+	level.AddSameHeightGroup([]string{points[0].Key(), points[8].Key(), points[9].Key()})
+	measurement := level.NewMeasurement()
+	measurement.P1, measurement.P2 = points[10].Key(), points[1].Key()
+	measurement.HeightDifference = 0.3
+
+	totalStation := site.NewTotalStation("Total station")
+	totalStation.Position.Coordinate = Coordinate{-0.5, 0.4, 0.2}
+	totalStation.InstrumentHeight, totalStation.InstrumentHeightLocked = 1.5, false
+	totalStation.Orientation.SetDegree(25)
+	for i, point := range points[:4] {
+		measurement := totalStation.NewMeasurement()
+		measurement.PointKey = point.Key()
+		measurement.Hz.SetDegree(40 * float64(i))
+		measurement.V.SetDegree(95 + float64(i))
+		measurement.SlopeDistance = Distance(3 + float64(i))
+	}
+	// Only angles were measured, and one observation in the second face.
+	totalStation.MeasurementsSorted()[0].SlopeDistance = 0
+	totalStation.MeasurementsSorted()[1].V.SetDegree(260)
+
+	return site
+}
+
+// TestResidualJacobians compares the analytic derivatives of every residual type with numeric ones.
+func TestResidualJacobians(t *testing.T) {
+	models := []CameraModel{CameraModelPinhole, CameraModelFisheye, CameraModelEquirectangular}
+
+	for _, model := range models {
+		t.Run(string(model), func(t *testing.T) {
+			site := newJacobianTestSite(t, model)
+
+			// Make sure the site contains every type of residual, so that new ones are added to the test.
+			wanted := []string{"*main.CameraPhotoMapping", "*main.RangefinderMeasurement", "*main.TripodMeasurement", "*main.Line", "*main.LinePointConstraint",
+				"*main.Plane", "*main.AngleConstraint", "*main.LevelMeasurement", "*main.TotalStationMeasurement"}
+			if model != CameraModelEquirectangular {
+				wanted = append(wanted, "*main.CameraPhotoIntrinsics")
+			}
+			types := map[string]int{}
+			_, residuals := site.GetTweakablesAndResiduals()
+			for _, residual := range residuals {
+				types[fmt.Sprintf("%T", residual)]++
+			}
+			for _, typ := range wanted {
+				if types[typ] == 0 {
+					t.Errorf("The test site doesn't contain any residual of type %s", typ)
+				}
+			}
+
+			if err := VerifyJacobians(site); err != nil {
+				t.Errorf("VerifyJacobians() failed: %v", err)
+			}
+
+			// Heights and horizontal directions depend on the up axis.
+			site.UpAxis = Coordinate{0.2, -0.1, 1}
+			if err := VerifyJacobians(site); err != nil {
+				t.Errorf("VerifyJacobians() failed with a tilted up axis: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+)
+
+// Parameters of the Levenberg-Marquardt solver.
+const (
+	lmMaxIterations     = 1000
+	lmInitialDamping    = 1e-3  // Initial damping factor, relative to the largest diagonal element of JᵀJ.
+	lmMaxDamping        = 1e16  // If the damping gets larger than this, the solver can't find any better solution.
+	lmMinDiagonal       = 1e-9  // Lower limit of the diagonal scaling matrix. This prevents singular systems for tweakables without any influence.
+	lmGradientTolerance = 1e-10 // Stop if the largest gradient component is smaller than this.
+	lmStepTolerance     = 1e-12 // Stop if the step is smaller than this, relative to the size of the parameter vector.
+	lmCostTolerance     = 1e-14 // Stop if the relative reduction of the sum of squared residuals is smaller than this.
+)
+
+// optimizeLevenbergMarquardt minimizes the sum of squared residuals by using the Levenberg-Marquardt algorithm.
+//
+// In contrast to the Nelder-Mead method, this works on the individual residuals and their derivatives.
+// If determinePosterior is set, the uncertainties of the solution are stored in the site.
+func optimizeLevenbergMarquardt(site *Site, tweakables []Tweakable, residuals []Residualer, progressFunc func(OptimizerProgress) bool, determinePosterior bool) OptimizerOutcome {
+	site.RLock()
+	losses := residualRobustLosses(site, residuals)
+	site.RUnlock()
+
+	// Redescending loss functions ignore residuals above their threshold completely, so they need a good starting point.
+	// Therefore the solution is approximated with Huber's loss function first.
+	var warmStart OptimizerOutcome
+	if warmStartLosses, ok := robustLossesWarmStart(losses); ok {
+		log.Printf("Levenberg-Marquardt: Approximating the solution with Huber's loss function")
+		if warmStart = levenbergMarquardt(site, tweakables, residuals, warmStartLosses, progressFunc, false); warmStart.Termination == OptimizerTerminationStopped {
+			return warmStart
+		}
+	}
+
+	// Continue the iteration and evaluation counts of the warm start, so that the progress is monotonic.
+	offsetProgressFunc := func(progress OptimizerProgress) bool {
+		progress.Iteration += warmStart.Iterations
+		progress.Evaluations += warmStart.Evaluations
+		return progressFunc(progress)
+	}
+
+	outcome := levenbergMarquardt(site, tweakables, residuals, losses, offsetProgressFunc, determinePosterior)
+	outcome.Iterations += warmStart.Iterations
+	outcome.Evaluations += warmStart.Evaluations
+
+	return outcome
+}
+
+// levenbergMarquardt minimizes the sum of the robust losses of all residuals, starting from the current tweakable values.
+// If determinePosterior is set, the uncertainties of the solution are stored in the site.
+//
+// progressFunc is called once per iteration, the optimization stops if it returns true.
+func levenbergMarquardt(site *Site, tweakables []Tweakable, residuals []Residualer, losses []RobustLoss, progressFunc func(OptimizerProgress) bool, determinePosterior bool) OptimizerOutcome {
+	// apply sets the tweakables to the values of the parameter vector x.
+	// The site has to be locked.
+	apply := func(x []float64) {
+		for i, tweakable := range tweakables {
+			tweakable.SetTweakableValue(x[i])
+		}
+	}
+
+	// evaluate applies the parameter vector x to the tweakables and returns the vector of all residuals.
+	evaluate := func(x []float64, dst []float64) []float64 {
+		site.Lock()
+		defer site.Unlock()
+
+		apply(x)
+
+		dst = dst[:0]
+		for _, residual := range residuals {
+			dst = append(dst, residual.Residuals()...)
+		}
+
+		return dst
+	}
+
+	// Get the initial tweakable variables/parameters.
+	x := make([]float64, 0, len(tweakables))
+	for _, tweakable := range tweakables {
+		x = append(x, tweakable.TweakableValue())
+	}
+
+	columns := tweakableColumns(tweakables)
+	site.RLock()
+	rowOffsets, _ := residualRowOffsets(residuals)
+	pointBlocks := schurPointBlocks(site, columns)
+	groupNames, groupOf := residualGroups(residuals)
+	site.RUnlock()
+
+	// The raw residuals are transformed by the robust loss functions.
+	// This results in a least squares problem where the sum of squared residuals equals the sum of all losses.
+	rRaw := evaluate(x, nil)
+	r := applyRobustLosses(losses, rowOffsets, rRaw, nil)
+	cost := residualsSqr(r)
+	n, m := len(x), len(r)
+
+	if m == 0 {
+		log.Printf("There are no residuals to minimize")
+		return OptimizerOutcome{Termination: OptimizerTerminationConverged, TerminationDetail: "There are no residuals to minimize", Evaluations: 1}
+	}
+
+	// progress returns the current state of the optimization, including the cost of every device.
+	progress := func(iteration, evaluations int, stepSize float64) OptimizerProgress {
+		groupCosts := make([]OptimizerGroupCost, len(groupNames))
+		for i, name := range groupNames {
+			groupCosts[i].Name = name
+		}
+		for i, offset := range rowOffsets {
+			end := m
+			if i+1 < len(rowOffsets) {
+				end = rowOffsets[i+1]
+			}
+			groupCosts[groupOf[i]].Cost += jsonFloat(residualsSqr(r[offset:end]))
+		}
+
+		return OptimizerProgress{Iteration: iteration, Evaluations: evaluations, Cost: jsonFloat(cost), StepSize: jsonFloat(stepSize), GroupCosts: groupCosts}
+	}
+
+	rows := make([][]jacobianEntry, m)
+	var system *schurSystem
+	var scaling []float64
+	step, delta := make([]float64, n), make([]float64, n)
+	xNew := make([]float64, n)
+	var rNew, rRawNew []float64
+
+	damping, dampingFactor, stepSize := 0.0, 2.0, 0.0
+	iteration, evaluations := 0, 1
+	updateJacobian := true
+	outcome := OptimizerOutcome{Termination: OptimizerTerminationIterationLimit, TerminationDetail: fmt.Sprintf("Reached the maximum of %d iterations", lmMaxIterations)}
+
+	for ; iteration < lmMaxIterations; iteration++ {
+		if progressFunc(progress(iteration, evaluations, stepSize)) {
+			outcome.Termination, outcome.TerminationDetail = OptimizerTerminationStopped, ""
+			break
+		}
+
+		if updateJacobian {
+			// The last evaluation may have been a rejected step, so the tweakables have to be set to x again.
+			site.Lock()
+			apply(x)
+			evaluations += residualJacobian(tweakables, columns, residuals, rowOffsets, rRaw, rows)
+			site.Unlock()
+			applyRobustLossesJacobian(losses, rowOffsets, rRaw, rows)
+
+			// The solver works on scaled tweakables, the scaling follows the current jacobian.
+			// This doesn't change the steps, as the damping is relative to the diagonal of JᵀJ, it only keeps the normal equations well conditioned.
+			scaling = jacobianColumnScaling(n, rows)
+			scaleJacobianColumns(rows, scaling)
+
+			system = newSchurSystem(n, pointBlocks, rows, r)
+
+			if floats64NormInf(system.gradient) < lmGradientTolerance {
+				outcome.Termination, outcome.TerminationDetail = OptimizerTerminationConverged, "Gradient is zero"
+				break
+			}
+
+			// Initialize the damping factor relative to the scale of the problem.
+			if damping == 0 {
+				maxDiagonal := 0.0
+				for _, diagonal := range system.diagonal {
+					maxDiagonal = math.Max(maxDiagonal, diagonal)
+				}
+				damping = lmInitialDamping * math.Max(maxDiagonal, lmMinDiagonal)
+			}
+
+			updateJacobian = false
+		}
+
+		// Solve (JᵀJ + λ·D)·δ = -Jᵀr, where D is the diagonal of JᵀJ.
+		// J is the scaled jacobian, so the step has to be scaled back into optimizer space.
+		if ok := system.solve(damping, step); !ok {
+			damping *= dampingFactor
+			dampingFactor *= 2
+			if damping > lmMaxDamping {
+				outcome.Termination, outcome.TerminationDetail = OptimizerTerminationFailed, "Normal equations are singular"
+				break
+			}
+			continue
+		}
+
+		for i := range step {
+			delta[i] = step[i] * scaling[i]
+		}
+
+		// Check if the step got too small.
+		if floats64Norm(delta) <= lmStepTolerance*(floats64Norm(x)+lmStepTolerance) {
+			outcome.Termination, outcome.TerminationDetail = OptimizerTerminationConverged, "Step size is zero"
+			break
+		}
+
+		for i := range x {
+			xNew[i] = x[i] + delta[i]
+		}
+		rRawNew = evaluate(xNew, rRawNew)
+		rNew = applyRobustLosses(losses, rowOffsets, rRawNew, rNew)
+		evaluations++
+		costNew := residualsSqr(rNew)
+
+		// Compare the actual with the predicted reduction of the sum of squared residuals.
+		predicted := 0.0
+		for i := range step {
+			predicted += -step[i]*system.gradient[i] + system.dampedDiagonal(i, damping)*step[i]*step[i]
+		}
+		rho := (cost - costNew) / predicted
+
+		if rho > 0 && !math.IsNaN(costNew) {
+			// Accept the step.
+			relativeReduction := (cost - costNew) / math.Max(cost, math.SmallestNonzeroFloat64)
+			copy(x, xNew)
+			r, rNew = rNew, r
+			rRaw, rRawNew = rRawNew, rRaw
+			cost = costNew
+			stepSize = floats64Norm(delta)
+			damping *= math.Max(1.0/3, 1-math.Pow(2*rho-1, 3))
+			dampingFactor = 2
+			updateJacobian = true
+
+			if relativeReduction < lmCostTolerance {
+				outcome.Termination, outcome.TerminationDetail = OptimizerTerminationConverged, "Sum of squared residuals doesn't change anymore"
+				break
+			}
+		} else {
+			// Reject the step, and try again with a larger damping factor.
+			damping *= dampingFactor
+			dampingFactor *= 2
+			if damping > lmMaxDamping {
+				outcome.Termination, outcome.TerminationDetail = OptimizerTerminationConverged, "No better solution found"
+				break
+			}
+		}
+	}
+
+	outcome.Iterations, outcome.Evaluations, outcome.Cost = iteration, evaluations, jsonFloat(cost)
+	log.Printf("Levenberg-Marquardt: %s. Cost: %v, iterations: %d, residual evaluations: %d", outcome.Description(), cost, iteration, evaluations)
+
+	// Set tweakable values to the solution.
+	evaluate(x, nil)
+
+	// Determine the uncertainties of the solution.
+	if determinePosterior && outcome.Termination != OptimizerTerminationStopped {
+		site.Lock()
+		residualJacobian(tweakables, columns, residuals, rowOffsets, rRaw, rows)
+
+		// The outlier test uses the unweighted measurements, as the robust loss functions would hide the blunders.
+		inv, _ := newSchurSystem(n, pointBlocks, rows, rRaw).inverse()
+		statistics := determineResidualStatistics(residuals, rowOffsets, rRaw, rows, inv)
+
+		applyRobustLossesJacobian(losses, rowOffsets, rRaw, rows)
+		site.posterior = lmPosterior(site, columns, newSchurSystem(n, pointBlocks, rows, r), cost, activeResidualCount(residuals))
+		site.posterior.residuals = statistics
+		site.Unlock()
+	}
+
+	return outcome
+}
+
+// lmPosterior determines the uncertainties of all tweakables from the normal equations at the solution.
+// The site has to be locked.
+func lmPosterior(site *Site, columns map[Tweakable]int, system *schurSystem, cost float64, residualCount int) *Posterior {
+	var tweakableGroups [][]Tweakable
+	var columnGroups [][]int
+	for _, group := range posteriorGroups(site) {
+		var tweakableGroup []Tweakable
+		var columnGroup []int
+		for _, tweakable := range group {
+			if column, ok := columns[tweakable]; ok {
+				tweakableGroup, columnGroup = append(tweakableGroup, tweakable), append(columnGroup, column)
+			}
+		}
+		if len(columnGroup) > 0 {
+			tweakableGroups, columnGroups = append(tweakableGroups, tweakableGroup), append(columnGroups, columnGroup)
+		}
+	}
+
+	covariances, datumDefect := system.covariance(columnGroups)
+	if datumDefect > 0 {
+		log.Printf("The datum is not fully defined (%d undetermined directions), uncertainties are relative to an arbitrary datum", datumDefect)
+	}
+
+	// Scale the covariances by the a posteriori variance factor.
+	redundancy := residualCount - len(columns) + datumDefect
+	varianceFactor := 1.0
+	if redundancy > 0 && cost > 0 {
+		varianceFactor = cost / float64(redundancy)
+	}
+	for _, covariance := range covariances {
+		covariance.ScaleSym(varianceFactor, covariance)
+	}
+
+	posterior := newPosterior(tweakableGroups, covariances)
+	posterior.VarianceFactor, posterior.Redundancy, posterior.DatumDefect = varianceFactor, redundancy, datumDefect
+
+	return posterior
+}
+
+// floats64NormInf returns the largest absolute value of the given vector.
+func floats64NormInf(v []float64) float64 {
+	max := 0.0
+	for _, e := range v {
+		max = math.Max(max, math.Abs(e))
+	}
+
+	return max
+}
+
+// floats64Norm returns the euclidean norm of the given vector.
+func floats64Norm(v []float64) float64 {
+	sum := 0.0
+	for _, e := range v {
+		sum += e * e
+	}
+
+	return math.Sqrt(sum)
+}
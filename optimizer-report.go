@@ -0,0 +1,227 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OptimizerTermination describes why an optimization ended.
+type OptimizerTermination string
+
+const (
+	OptimizerTerminationConverged      OptimizerTermination = "Converged"
+	OptimizerTerminationStopped        OptimizerTermination = "Stopped by user"
+	OptimizerTerminationIterationLimit OptimizerTermination = "Iteration limit reached"
+	OptimizerTerminationFailed         OptimizerTermination = "Failed"
+)
+
+// OptimizerGroupCost contains the cost of all residuals of a device or a group of constraints.
+type OptimizerGroupCost struct {
+	Name string
+	Cost jsonFloat
+}
+
+// OptimizerProgress describes the state of a running optimization.
+type OptimizerProgress struct {
+	Iteration   int
+	Evaluations int                  // Number of residual evaluations so far.
+	Cost        jsonFloat            // Sum of the robust losses of all residuals. Without robust loss function this is the sum of squared residuals.
+	StepSize    jsonFloat            // Length of the last accepted step in optimizer space.
+	Elapsed     time.Duration        // Time since the start of the optimization.
+	GroupCosts  []OptimizerGroupCost `json:",omitempty"` // Cost of every device or group of constraints.
+}
+
+// OptimizerOutcome describes how an optimization ended.
+type OptimizerOutcome struct {
+	Termination       OptimizerTermination
+	TerminationDetail string // Additional human readable reason, like the convergence criterion that was met.
+	Iterations        int
+	Evaluations       int
+	Cost              jsonFloat // Final sum of the robust losses of all residuals.
+}
+
+// Description returns the termination and its reason as human readable text.
+func (o OptimizerOutcome) Description() string {
+	if o.TerminationDetail == "" {
+		return string(o.Termination)
+	}
+
+	return fmt.Sprintf("%s: %s", o.Termination, o.TerminationDetail)
+}
+
+// OptimizerReportDevice contains the sum of squared residuals of a device or a group of constraints, before and after the optimization.
+type OptimizerReportDevice struct {
+	Name      string
+	SSRBefore jsonFloat
+	SSRAfter  jsonFloat
+}
+
+// OptimizerReport summarizes an optimization run.
+type OptimizerReport struct {
+	OptimizerOutcome
+
+	Started  time.Time
+	Duration time.Duration
+
+	// Parameters of the run.
+	Method             OptimizerMethod
+	RobustLoss         RobustLoss
+	VerifyDerivatives  bool
+	Tweakables         int  // Number of optimized values.
+	Residuals          int  // Number of measurements and constraints.
+	SelectionOptimized bool // Only a selection of the site was optimized.
+
+	Devices []OptimizerReportDevice
+	History []OptimizerProgress // Convergence history, one entry per iteration.
+}
+
+// residualGroups returns the names of all devices and groups of constraints, and the group index of every residualer.
+// The site has to be locked.
+func residualGroups(residuals []Residualer) (names []string, groupOf []int) {
+	indices := map[string]int{}
+	groupOf = make([]int, len(residuals))
+
+	for i, residual := range residuals {
+		var name string
+		switch residual := residual.(type) {
+		case *RangefinderMeasurement:
+			name = "Rangefinder " + residual.rangefinder.DisplayName()
+		case *LevelMeasurement:
+			name = "Level " + residual.level.DisplayName()
+		case *TripodMeasurement:
+			name = "Tripod " + residual.tripod.DisplayName()
+		case *TotalStationMeasurement:
+			name = "Total station " + residual.totalStation.DisplayName()
+		case *CameraPhotoMapping:
+			name = "Camera " + residual.photo.camera.DisplayName()
+		case *CameraPhotoIntrinsics:
+			name = "Camera " + residual.photo.camera.DisplayName()
+		case *Line, *LinePointConstraint:
+			name = "Lines"
+		case *Plane:
+			name = "Planes"
+		case *AngleConstraint:
+			name = "Angle constraints"
+		default:
+			name = fmt.Sprintf("%T", residual)
+		}
+
+		index, ok := indices[name]
+		if !ok {
+			index = len(names)
+			indices[name] = index
+			names = append(names, name)
+		}
+		groupOf[i] = index
+	}
+
+	return names, groupOf
+}
+
+// residualGroupSSRs returns the sum of squared residuals of every device or group of constraints.
+// The site has to be locked.
+func residualGroupSSRs(residuals []Residualer) []OptimizerGroupCost {
+	names, groupOf := residualGroups(residuals)
+
+	costs := make([]OptimizerGroupCost, len(names))
+	for i, name := range names {
+		costs[i].Name = name
+	}
+	for i, residual := range residuals {
+		costs[groupOf[i]].Cost += jsonFloat(residual.ResidualSqr())
+	}
+
+	return costs
+}
+
+// newOptimizerReport returns a report with the parameters of a run, and the state of the site before it.
+// The site has to be locked.
+func newOptimizerReport(site *Site, tweakables []Tweakable, residuals []Residualer, selectionOptimized bool) *OptimizerReport {
+	report := &OptimizerReport{
+		Started:            time.Now(),
+		Method:             site.OptimizerMethod,
+		RobustLoss:         site.RobustLoss,
+		VerifyDerivatives:  site.OptimizerVerifyDerivatives,
+		Tweakables:         len(tweakables),
+		Residuals:          len(residuals),
+		SelectionOptimized: selectionOptimized,
+	}
+
+	for _, groupSSR := range residualGroupSSRs(residuals) {
+		report.Devices = append(report.Devices, OptimizerReportDevice{Name: groupSSR.Name, SSRBefore: groupSSR.Cost})
+	}
+
+	return report
+}
+
+// finish completes the report with the outcome of the run, and the state of the site after it.
+// The site has to be locked.
+func (r *OptimizerReport) finish(outcome OptimizerOutcome, residuals []Residualer) {
+	r.OptimizerOutcome = outcome
+	r.Duration = time.Since(r.Started)
+
+	for _, groupSSR := range residualGroupSSRs(residuals) {
+		found := false
+		for i := range r.Devices {
+			if r.Devices[i].Name == groupSSR.Name {
+				r.Devices[i].SSRAfter, found = groupSSR.Cost, true
+				break
+			}
+		}
+		if !found {
+			r.Devices = append(r.Devices, OptimizerReportDevice{Name: groupSSR.Name, SSRAfter: groupSSR.Cost})
+		}
+	}
+}
+
+// Text returns the report as human readable text.
+func (r *OptimizerReport) Text() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "D3surveyor %s optimizer report\n\n", version)
+
+	fmt.Fprintf(&sb, "Started:            %s\n", r.Started.Format(time.RFC3339))
+	fmt.Fprintf(&sb, "Duration:           %s\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(&sb, "Termination:        %s\n", r.Termination)
+	if r.TerminationDetail != "" {
+		fmt.Fprintf(&sb, "Reason:             %s\n", r.TerminationDetail)
+	}
+	fmt.Fprintf(&sb, "Iterations:         %d\n", r.Iterations)
+	fmt.Fprintf(&sb, "Evaluations:        %d\n", r.Evaluations)
+	fmt.Fprintf(&sb, "Final cost:         %g\n\n", r.Cost)
+
+	fmt.Fprintf(&sb, "Method:             %s\n", r.Method)
+	fmt.Fprintf(&sb, "Robust loss:        %s (threshold %g)\n", r.RobustLoss.Function, r.RobustLoss.Threshold)
+	fmt.Fprintf(&sb, "Verify derivatives: %t\n", r.VerifyDerivatives)
+	fmt.Fprintf(&sb, "Optimized values:   %d\n", r.Tweakables)
+	fmt.Fprintf(&sb, "Residualers:        %d\n", r.Residuals)
+	fmt.Fprintf(&sb, "Selection only:     %t\n\n", r.SelectionOptimized)
+
+	fmt.Fprintf(&sb, "%-40s %16s %16s\n", "Device", "SSR before", "SSR after")
+	for _, device := range r.Devices {
+		fmt.Fprintf(&sb, "%-40s %16.6g %16.6g\n", device.Name, device.SSRBefore, device.SSRAfter)
+	}
+
+	fmt.Fprintf(&sb, "\n%9s %12s %16s %16s %12s\n", "Iteration", "Evaluations", "Cost", "Step size", "Elapsed")
+	for _, progress := range r.History {
+		fmt.Fprintf(&sb, "%9d %12d %16.8g %16.6g %12s\n", progress.Iteration, progress.Evaluations, progress.Cost, progress.StepSize, progress.Elapsed.Round(time.Millisecond))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,1064 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// schurSystem contains the normal equations JᵀJ·δ = -Jᵀr of the least squares problem in block form:
+//
+//	| U  W | |δr|    |gr|
+//	| Wᵀ V | |δp| = -|gp|
+//
+// V contains the coordinates of all points, and W their coupling with the remaining values, like camera, photo and other device parameters.
+// The points are eliminated by the Schur complement S = U - W·V⁻¹·Wᵀ, so that only the reduced system S·δr = -gr + W·V⁻¹·gp has to be solved as a whole.
+// The reduced system is usually much smaller than the full system.
+//
+// Points that don't share any residual with other points (e.g. points that are only observed by photos) result in independent 3×3 blocks of V.
+// Points that share residuals with other points (e.g. rangefinder measurements or lines) couple their blocks.
+// This part of V is sparse, it is factorized by a block Cholesky decomposition in an order that keeps the fill-in small.
+type schurSystem struct {
+	gradient []float64 // Jᵀr.
+	diagonal []float64 // Diagonal of JᵀJ.
+
+	reducedColumns []int     // Columns of the reduced system.
+	reducedIndex   []int     // Index into the reduced system for every column, or -1 if the column is eliminated.
+	u              []float64 // Dense row major matrix U.
+
+	blocks       []schurBlock // All points, the coupled ones follow the independent ones in their elimination order.
+	firstCoupled int          // Index of the first block that is coupled with other blocks.
+}
+
+// schurBlock contains the part of the normal equations that belongs to a point.
+type schurBlock struct {
+	columns []int         // Columns of the point's coordinates.
+	v       [3][3]float64 // The point's diagonal block of JᵀJ.
+	reduced []int         // Sorted indices of the reduced system that the point is coupled with.
+	w       [][3]float64  // The point's coupling with the reduced system, one entry for every element of reduced.
+
+	neighbors []int           // Sorted indices of the blocks later in the elimination order that this block is coupled with, including fill-in.
+	couplings [][3][3]float64 // The part of JᵀJ between this and every neighbor block. Fill-in starts as zero.
+
+	// Set by factorize and eliminate.
+	factor          [3][3]float64   // Upper triangular Cholesky factor of the coupled block.
+	factorNeighbors [][3][3]float64 // The factor's part between this and every neighbor block.
+	vInv            [3][3]float64   // Diagonal block of V⁻¹.
+	vInvNeighbors   [][3][3]float64 // The part of V⁻¹ between this and every neighbor block, only set by inverse.
+	hReduced        []int           // Sorted indices of the reduced system that H = V⁻¹·Wᵀ has non-zero entries for.
+	h               [][3]float64    // This block's rows of H, one entry for every element of hReduced.
+}
+
+// schurPointEntry is a non-zero element of a row of the jacobian that belongs to a point.
+type schurPointEntry struct {
+	block, local int
+	derivative   float64
+}
+
+// schurPointBlocks returns the columns of every point's coordinates.
+func schurPointBlocks(site *Site, columns map[Tweakable]int) [][]int {
+	var pointBlocks [][]int
+
+	for _, point := range site.PointsSorted() {
+		tweakables, _ := point.GetTweakablesAndResiduals()
+
+		var block []int
+		for _, tweakable := range tweakables {
+			if column, ok := columns[tweakable]; ok {
+				block = append(block, column)
+			}
+		}
+		if len(block) > 0 {
+			pointBlocks = append(pointBlocks, block)
+		}
+	}
+
+	return pointBlocks
+}
+
+// schurEliminationOrder returns the order in which the coupled points are eliminated, and the neighbors of every point at the time of its elimination.
+// adjacency contains the points that every point shares residuals with.
+//
+// The point with the fewest neighbors is eliminated first (minimum degree heuristic).
+// Eliminating a point couples all its neighbors with each other, these couplings are the fill-in of the factorization.
+func schurEliminationOrder(adjacency map[int]map[int]struct{}) (order []int, neighbors map[int][]int) {
+	nodes := make([]int, 0, len(adjacency))
+	for node := range adjacency {
+		nodes = append(nodes, node)
+	}
+	sort.Ints(nodes)
+
+	neighbors = make(map[int][]int, len(nodes))
+	eliminated := make(map[int]bool, len(nodes))
+	for len(order) < len(nodes) {
+		next := -1
+		for _, node := range nodes {
+			if !eliminated[node] && (next < 0 || len(adjacency[node]) < len(adjacency[next])) {
+				next = node
+			}
+		}
+
+		for a := range adjacency[next] {
+			neighbors[next] = append(neighbors[next], a)
+			delete(adjacency[a], next)
+			for b := range adjacency[next] {
+				if a != b {
+					adjacency[a][b] = struct{}{}
+				}
+			}
+		}
+		order, eliminated[next] = append(order, next), true
+	}
+
+	return order, neighbors
+}
+
+// newSchurSystem builds the normal equations from the sparse jacobian and the residuals r.
+// pointBlocks contains the columns of every point that can be eliminated, a block can have at most 3 columns.
+func newSchurSystem(n int, pointBlocks [][]int, rows [][]jacobianEntry, r []float64) *schurSystem {
+	s := &schurSystem{
+		gradient:     make([]float64, n),
+		diagonal:     make([]float64, n),
+		reducedIndex: make([]int, n),
+	}
+
+	// Map columns to their point.
+	pointOf, localIndex := make([]int, n), make([]int, n)
+	for i := range pointOf {
+		pointOf[i] = -1
+	}
+	for b, block := range pointBlocks {
+		for i, column := range block {
+			pointOf[column], localIndex[column] = b, i
+		}
+	}
+
+	// Determine the points that share residuals with other points.
+	adjacency := map[int]map[int]struct{}{}
+	var rowPoints []int
+	for _, row := range rows {
+		rowPoints = rowPoints[:0]
+		for _, entry := range row {
+			if point := pointOf[entry.column]; point >= 0 && !containsInt(rowPoints, point) {
+				rowPoints = append(rowPoints, point)
+			}
+		}
+		if len(rowPoints) < 2 {
+			continue
+		}
+		for _, a := range rowPoints {
+			if adjacency[a] == nil {
+				adjacency[a] = map[int]struct{}{}
+			}
+			for _, b := range rowPoints {
+				if a != b {
+					adjacency[a][b] = struct{}{}
+				}
+			}
+		}
+	}
+	order, orderNeighbors := schurEliminationOrder(adjacency)
+
+	// Create the blocks, independent points first.
+	blockOfPoint := make([]int, len(pointBlocks))
+	for b, block := range pointBlocks {
+		if _, coupled := adjacency[b]; !coupled {
+			blockOfPoint[b] = len(s.blocks)
+			s.blocks = append(s.blocks, schurBlock{columns: block})
+		}
+	}
+	s.firstCoupled = len(s.blocks)
+	for _, b := range order {
+		blockOfPoint[b] = len(s.blocks)
+		s.blocks = append(s.blocks, schurBlock{columns: pointBlocks[b]})
+	}
+	for _, b := range order {
+		blk := &s.blocks[blockOfPoint[b]]
+		for _, neighbor := range orderNeighbors[b] {
+			blk.neighbors = append(blk.neighbors, blockOfPoint[neighbor])
+		}
+		sort.Ints(blk.neighbors)
+		blk.couplings = make([][3][3]float64, len(blk.neighbors))
+	}
+
+	blockOf := make([]int, n)
+	for i := range blockOf {
+		blockOf[i] = -1
+	}
+	for b, block := range pointBlocks {
+		for _, column := range block {
+			blockOf[column] = blockOfPoint[b]
+		}
+	}
+
+	// All other columns belong to the reduced system.
+	couplings := make([]map[int][3]float64, len(s.blocks))
+	for i := range couplings {
+		couplings[i] = map[int][3]float64{}
+	}
+	for column := 0; column < n; column++ {
+		s.reducedIndex[column] = -1
+		if blockOf[column] < 0 {
+			s.reducedIndex[column] = len(s.reducedColumns)
+			s.reducedColumns = append(s.reducedColumns, column)
+		}
+	}
+
+	nr := len(s.reducedColumns)
+	s.u = make([]float64, nr*nr)
+
+	// Accumulate JᵀJ and Jᵀr row by row.
+	var reducedEntries []jacobianEntry
+	var pointEntries []schurPointEntry
+	for k, row := range rows {
+		reducedEntries, pointEntries = reducedEntries[:0], pointEntries[:0]
+
+		for _, entry := range row {
+			s.gradient[entry.column] += entry.derivative * r[k]
+			s.diagonal[entry.column] += entry.derivative * entry.derivative
+
+			if b := blockOf[entry.column]; b >= 0 {
+				pointEntries = append(pointEntries, schurPointEntry{b, localIndex[entry.column], entry.derivative})
+			} else {
+				reducedEntries = append(reducedEntries, jacobianEntry{s.reducedIndex[entry.column], entry.derivative})
+			}
+		}
+
+		for _, a := range reducedEntries {
+			for _, b := range reducedEntries {
+				s.u[a.column*nr+b.column] += a.derivative * b.derivative
+			}
+		}
+
+		for _, a := range pointEntries {
+			blk := &s.blocks[a.block]
+			for _, b := range pointEntries {
+				switch {
+				case a.block == b.block:
+					blk.v[a.local][b.local] += a.derivative * b.derivative
+				case a.block < b.block:
+					neighbor := sort.SearchInts(blk.neighbors, b.block)
+					blk.couplings[neighbor][a.local][b.local] += a.derivative * b.derivative
+				}
+			}
+			for _, b := range reducedEntries {
+				w := couplings[a.block][b.column]
+				w[a.local] += a.derivative * b.derivative
+				couplings[a.block][b.column] = w
+			}
+		}
+	}
+
+	for i := range s.blocks {
+		blk := &s.blocks[i]
+		for key := range couplings[i] {
+			blk.reduced = append(blk.reduced, key)
+		}
+		sort.Ints(blk.reduced)
+		blk.w = make([][3]float64, len(blk.reduced))
+		for k, key := range blk.reduced {
+			blk.w[k] = couplings[i][key]
+		}
+	}
+
+	return s
+}
+
+// containsInt returns whether the list contains the value.
+func containsInt(list []int, value int) bool {
+	for _, e := range list {
+		if e == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dampedDiagonal returns the damping term that is added to the diagonal element of the given column.
+func (s *schurSystem) dampedDiagonal(column int, damping float64) float64 {
+	return damping * math.Max(s.diagonal[column], lmMinDiagonal)
+}
+
+// factorize inverts the independent blocks and factorizes the coupled part of V, both with the given damping.
+// If singular is not nil, independent blocks that are not positive definite are replaced by their pseudo inverse and marked in singular.
+//
+// Returns false if the damped V is not positive definite.
+func (s *schurSystem) factorize(damping float64, singular []bool) bool {
+	for b := range s.blocks[:s.firstCoupled] {
+		blk := &s.blocks[b]
+		size := len(blk.columns)
+
+		v := blk.v
+		for i, column := range blk.columns {
+			v[i][i] += s.dampedDiagonal(column, damping)
+		}
+		vInv, ok := invertSymmetric3(v, size)
+		if !ok {
+			if singular == nil {
+				return false
+			}
+			var defect int
+			vInv, defect = pseudoInverseSymmetric3(v, size)
+			singular[b] = defect > 0
+		}
+		blk.vInv = vInv
+	}
+
+	// Right-looking block Cholesky decomposition V = Fᵀ·F of the coupled blocks.
+	// The remaining blocks are updated after every step, the fill-in is already part of the neighbor lists.
+	coupled := s.blocks[s.firstCoupled:]
+	vs, couplings := make([][3][3]float64, len(coupled)), make([][][3][3]float64, len(coupled))
+	for i := range coupled {
+		blk := &coupled[i]
+		vs[i] = blk.v
+		for a, column := range blk.columns {
+			vs[i][a][a] += s.dampedDiagonal(column, damping)
+		}
+		couplings[i] = append([][3][3]float64(nil), blk.couplings...)
+	}
+
+	for i := range coupled {
+		blk := &coupled[i]
+		size := len(blk.columns)
+
+		scale := blk.v
+		for a, column := range blk.columns {
+			scale[a][a] += s.dampedDiagonal(column, damping)
+		}
+		factor, ok := cholesky3(vs[i], size, scale)
+		if !ok {
+			return false
+		}
+		blk.factor = factor
+
+		blk.factorNeighbors = make([][3][3]float64, len(blk.neighbors))
+		for k, neighbor := range blk.neighbors {
+			blk.factorNeighbors[k] = solveUpperTransposed3(factor, size, couplings[i][k], len(s.blocks[neighbor].columns))
+		}
+
+		for k, a := range blk.neighbors {
+			fa, sizeA := blk.factorNeighbors[k], len(s.blocks[a].columns)
+			for l := k; l < len(blk.neighbors); l++ {
+				b := blk.neighbors[l]
+				fb, sizeB := blk.factorNeighbors[l], len(s.blocks[b].columns)
+
+				var update *[3][3]float64
+				if a == b {
+					update = &vs[a-s.firstCoupled]
+				} else {
+					update = &couplings[a-s.firstCoupled][sort.SearchInts(s.blocks[a].neighbors, b)]
+				}
+				for x := 0; x < sizeA; x++ {
+					for y := 0; y < sizeB; y++ {
+						sum := 0.0
+						for z := 0; z < size; z++ {
+							sum += fa[z][x] * fb[z][y]
+						}
+						update[x][y] -= sum
+					}
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// eliminate determines the rows of H = V⁻¹·Wᵀ for every block.
+// factorize has to be called before.
+func (s *schurSystem) eliminate() {
+	for b := range s.blocks[:s.firstCoupled] {
+		blk := &s.blocks[b]
+		size := len(blk.columns)
+
+		blk.hReduced, blk.h = blk.reduced, make([][3]float64, len(blk.reduced))
+		for k, w := range blk.w {
+			blk.h[k] = multiplySymmetric3(blk.vInv, size, w)
+		}
+	}
+
+	// Solve Fᵀ·Y = Wᵀ by forward substitution, and F·H = Y by back substitution.
+	// The rows are sparse, they only contain the reduced indices that the points are coupled with directly or through other points.
+	coupled := s.blocks[s.firstCoupled:]
+	rows := make([]map[int][3]float64, len(coupled))
+	for i := range rows {
+		rows[i] = map[int][3]float64{}
+	}
+
+	for i := range coupled {
+		blk := &coupled[i]
+		size := len(blk.columns)
+
+		y := rows[i]
+		for k, index := range blk.reduced {
+			value := y[index]
+			for a := 0; a < size; a++ {
+				value[a] += blk.w[k][a]
+			}
+			y[index] = value
+		}
+		for index, value := range y {
+			y[index] = forwardSubstitute3(blk.factor, size, value)
+		}
+
+		for k, neighbor := range blk.neighbors {
+			f, yNeighbor, sizeNeighbor := blk.factorNeighbors[k], rows[neighbor-s.firstCoupled], len(s.blocks[neighbor].columns)
+			for index, value := range y {
+				update := yNeighbor[index]
+				for c := 0; c < sizeNeighbor; c++ {
+					for a := 0; a < size; a++ {
+						update[c] -= f[a][c] * value[a]
+					}
+				}
+				yNeighbor[index] = update
+			}
+		}
+	}
+
+	for i := len(coupled) - 1; i >= 0; i-- {
+		blk := &coupled[i]
+		size := len(blk.columns)
+
+		h := rows[i]
+		for k, neighbor := range blk.neighbors {
+			f, blkNeighbor := blk.factorNeighbors[k], &s.blocks[neighbor]
+			for l, index := range blkNeighbor.hReduced {
+				value := h[index]
+				for a := 0; a < size; a++ {
+					for c := range blkNeighbor.columns {
+						value[a] -= f[a][c] * blkNeighbor.h[l][c]
+					}
+				}
+				h[index] = value
+			}
+		}
+
+		blk.hReduced = blk.hReduced[:0]
+		for index := range h {
+			blk.hReduced = append(blk.hReduced, index)
+		}
+		sort.Ints(blk.hReduced)
+		blk.h = make([][3]float64, len(blk.hReduced))
+		for l, index := range blk.hReduced {
+			blk.h[l] = backSubstitute3(blk.factor, size, h[index])
+		}
+	}
+}
+
+// solvePoints solves V·x = b in place, where x contains an entry for every block.
+// factorize has to be called before.
+func (s *schurSystem) solvePoints(x [][3]float64) {
+	for b := range s.blocks[:s.firstCoupled] {
+		blk := &s.blocks[b]
+		x[b] = multiplySymmetric3(blk.vInv, len(blk.columns), x[b])
+	}
+
+	for b := s.firstCoupled; b < len(s.blocks); b++ {
+		blk := &s.blocks[b]
+		size := len(blk.columns)
+
+		x[b] = forwardSubstitute3(blk.factor, size, x[b])
+		for k, neighbor := range blk.neighbors {
+			f := blk.factorNeighbors[k]
+			for c := range s.blocks[neighbor].columns {
+				for a := 0; a < size; a++ {
+					x[neighbor][c] -= f[a][c] * x[b][a]
+				}
+			}
+		}
+	}
+
+	for b := len(s.blocks) - 1; b >= s.firstCoupled; b-- {
+		blk := &s.blocks[b]
+		size := len(blk.columns)
+
+		for k, neighbor := range blk.neighbors {
+			f := blk.factorNeighbors[k]
+			for a := 0; a < size; a++ {
+				for c := range s.blocks[neighbor].columns {
+					x[b][a] -= f[a][c] * x[neighbor][c]
+				}
+			}
+		}
+		x[b] = backSubstitute3(blk.factor, size, x[b])
+	}
+}
+
+// reducedSystem returns the upper triangle of the Schur complement S = U - W·V⁻¹·Wᵀ as dense row major matrix.
+// The diagonal is damped by the given damping, eliminate has to be called before.
+func (s *schurSystem) reducedSystem(damping float64) []float64 {
+	nr := len(s.reducedColumns)
+
+	reduced := append([]float64(nil), s.u...)
+	for i, column := range s.reducedColumns {
+		reduced[i*nr+i] += s.dampedDiagonal(column, damping)
+	}
+
+	// W·H is symmetric, so the upper triangle gets the sum of all contributions.
+	for b := range s.blocks {
+		blk := &s.blocks[b]
+		for k, i := range blk.reduced {
+			for l, j := range blk.hReduced {
+				if i > j {
+					continue
+				}
+				sum := 0.0
+				for c := range blk.columns {
+					sum += blk.w[k][c] * blk.h[l][c]
+				}
+				reduced[i*nr+j] -= sum
+			}
+		}
+	}
+
+	return reduced
+}
+
+// solve solves (JᵀJ + λ·D)·δ = -Jᵀr, where D is the diagonal of JᵀJ, and writes δ into step.
+//
+// Returns false if the damped system is not positive definite.
+func (s *schurSystem) solve(damping float64, step []float64) bool {
+	nr := len(s.reducedColumns)
+
+	// Eliminate all points.
+	if !s.factorize(damping, nil) {
+		return false
+	}
+	s.eliminate()
+	reduced := s.reducedSystem(damping)
+
+	// The reduced right hand side is -gr + W·V⁻¹·gp = -gr + Hᵀ·gp.
+	rhs := make([]float64, nr)
+	for i, column := range s.reducedColumns {
+		rhs[i] = -s.gradient[column]
+	}
+	for b := range s.blocks {
+		blk := &s.blocks[b]
+		for l, j := range blk.hReduced {
+			for c, column := range blk.columns {
+				rhs[j] += blk.h[l][c] * s.gradient[column]
+			}
+		}
+	}
+
+	// Solve the reduced system.
+	if nr > 0 {
+		var chol mat.Cholesky
+		if ok := chol.Factorize(mat.NewSymDense(nr, reduced)); !ok {
+			return false
+		}
+		reducedStep := mat.NewVecDense(nr, nil)
+		if err := chol.SolveVecTo(reducedStep, mat.NewVecDense(nr, rhs)); err != nil {
+			return false
+		}
+		for i, column := range s.reducedColumns {
+			step[column] = reducedStep.AtVec(i)
+		}
+	}
+
+	// Back substitution of the points: δp = -V⁻¹·gp - H·δr.
+	x := make([][3]float64, len(s.blocks))
+	for b := range s.blocks {
+		for c, column := range s.blocks[b].columns {
+			x[b][c] = -s.gradient[column]
+		}
+	}
+	s.solvePoints(x)
+	for b := range s.blocks {
+		blk := &s.blocks[b]
+		for l, j := range blk.hReduced {
+			stepReduced := step[s.reducedColumns[j]]
+			for c := range blk.columns {
+				x[b][c] -= blk.h[l][c] * stepReduced
+			}
+		}
+		for c, column := range blk.columns {
+			step[column] = x[b][c]
+		}
+	}
+
+	return true
+}
+
+// invertPoints determines the elements of V⁻¹ that are inside the sparsity pattern of the factorization.
+// This includes all diagonal blocks, and the blocks of all points that share residuals.
+// factorize has to be called before.
+//
+// With V⁻¹ = F⁻¹·F⁻ᵀ it follows that F·V⁻¹ = F⁻ᵀ, which is lower triangular.
+// Therefore the blocks can be determined from the last to the first one (Takahashi's equations).
+func (s *schurSystem) invertPoints() {
+	// at returns the block of V⁻¹ between the blocks a and b, with a and b later than the current block.
+	at := func(a, b int) [3][3]float64 {
+		switch {
+		case a == b:
+			return s.blocks[a].vInv
+		case a < b:
+			return s.blocks[a].vInvNeighbors[sort.SearchInts(s.blocks[a].neighbors, b)]
+		}
+		return transpose3(s.blocks[b].vInvNeighbors[sort.SearchInts(s.blocks[b].neighbors, a)])
+	}
+
+	for b := len(s.blocks) - 1; b >= s.firstCoupled; b-- {
+		blk := &s.blocks[b]
+		size := len(blk.columns)
+
+		// sum returns Σ Fbk·V⁻¹kj over all neighbors k, for the neighbor j or the block itself.
+		sum := func(j, sizeJ int) (result [3][3]float64) {
+			for k, neighbor := range blk.neighbors {
+				f, inv := blk.factorNeighbors[k], at(neighbor, j)
+				for a := 0; a < size; a++ {
+					for c := 0; c < sizeJ; c++ {
+						for x := range s.blocks[neighbor].columns {
+							result[a][c] += f[a][x] * inv[x][c]
+						}
+					}
+				}
+			}
+			return result
+		}
+
+		blk.vInvNeighbors = make([][3][3]float64, len(blk.neighbors))
+		for k, neighbor := range blk.neighbors {
+			sizeNeighbor := len(s.blocks[neighbor].columns)
+			m := sum(neighbor, sizeNeighbor)
+			for c := 0; c < sizeNeighbor; c++ {
+				column := backSubstitute3(blk.factor, size, [3]float64{-m[0][c], -m[1][c], -m[2][c]})
+				for a := 0; a < size; a++ {
+					blk.vInvNeighbors[k][a][c] = column[a]
+				}
+			}
+		}
+
+		// The diagonal block of F⁻ᵀ is the inverse of the transposed diagonal block of F.
+		m := sum(b, size)
+		for c := 0; c < size; c++ {
+			var unit [3]float64
+			unit[c] = 1
+			fInvT := forwardSubstitute3(blk.factor, size, unit)
+			column := backSubstitute3(blk.factor, size, [3]float64{fInvT[0] - m[0][c], fInvT[1] - m[1][c], fInvT[2] - m[2][c]})
+			for a := 0; a < size; a++ {
+				blk.vInv[a][c] = column[a]
+			}
+		}
+	}
+}
+
+// withoutCoupledBlocks returns a copy of the system where the coordinates of all coupled points are part of the reduced system.
+func (s *schurSystem) withoutCoupledBlocks() *schurSystem {
+	n := len(s.gradient)
+	t := &schurSystem{
+		gradient:     s.gradient,
+		diagonal:     s.diagonal,
+		reducedIndex: make([]int, n),
+		blocks:       make([]schurBlock, s.firstCoupled),
+		firstCoupled: s.firstCoupled,
+	}
+
+	eliminated := make([]bool, n)
+	for _, blk := range s.blocks[:s.firstCoupled] {
+		for _, column := range blk.columns {
+			eliminated[column] = true
+		}
+	}
+	for column := 0; column < n; column++ {
+		t.reducedIndex[column] = -1
+		if !eliminated[column] {
+			t.reducedIndex[column] = len(t.reducedColumns)
+			t.reducedColumns = append(t.reducedColumns, column)
+		}
+	}
+
+	nr, nrOld := len(t.reducedColumns), len(s.reducedColumns)
+	t.u = make([]float64, nr*nr)
+	newIndex := func(oldIndex int) int { return t.reducedIndex[s.reducedColumns[oldIndex]] }
+	add := func(c1, c2 int, value float64) {
+		i, j := t.reducedIndex[c1], t.reducedIndex[c2]
+		t.u[i*nr+j] += value
+		if i != j {
+			t.u[j*nr+i] += value
+		}
+	}
+
+	for i := 0; i < nrOld; i++ {
+		for j := 0; j < nrOld; j++ {
+			t.u[newIndex(i)*nr+newIndex(j)] = s.u[i*nrOld+j]
+		}
+	}
+
+	// The indices are mapped monotonically, so the lists stay sorted.
+	for b, blk := range s.blocks[:s.firstCoupled] {
+		reduced := make([]int, len(blk.reduced))
+		for k, i := range blk.reduced {
+			reduced[k] = newIndex(i)
+		}
+		t.blocks[b] = schurBlock{columns: blk.columns, v: blk.v, reduced: reduced, w: blk.w}
+	}
+
+	for _, blk := range s.blocks[s.firstCoupled:] {
+		for a, c1 := range blk.columns {
+			for b := a; b < len(blk.columns); b++ {
+				add(c1, blk.columns[b], blk.v[a][b])
+			}
+			for k, i := range blk.reduced {
+				add(c1, s.reducedColumns[i], blk.w[k][a])
+			}
+			for k, neighbor := range blk.neighbors {
+				for b, c2 := range s.blocks[neighbor].columns {
+					add(c1, c2, blk.couplings[k][a][b])
+				}
+			}
+		}
+	}
+
+	return t
+}
+
+// cholesky3 returns the upper triangular matrix F with Fᵀ·F = m for the upper left size×size part of the symmetric matrix m.
+// The pivots are compared with the diagonal of scale, which is the block before any updates of the decomposition.
+// This detects blocks that are singular up to rounding errors.
+//
+// Returns false if the matrix is not positive definite.
+func cholesky3(m [3][3]float64, size int, scale [3][3]float64) ([3][3]float64, bool) {
+	var f [3][3]float64
+	for i := 0; i < size; i++ {
+		d := m[i][i]
+		for k := 0; k < i; k++ {
+			d -= f[k][i] * f[k][i]
+		}
+		if !(d > 1e-12*scale[i][i]) || d <= 0 {
+			return f, false
+		}
+		f[i][i] = math.Sqrt(d)
+		for j := i + 1; j < size; j++ {
+			sum := m[i][j]
+			for k := 0; k < i; k++ {
+				sum -= f[k][i] * f[k][j]
+			}
+			f[i][j] = sum / f[i][i]
+		}
+	}
+
+	return f, true
+}
+
+// forwardSubstitute3 solves Fᵀ·x = b for the upper triangular matrix F.
+func forwardSubstitute3(f [3][3]float64, size int, b [3]float64) (x [3]float64) {
+	for i := 0; i < size; i++ {
+		sum := b[i]
+		for k := 0; k < i; k++ {
+			sum -= f[k][i] * x[k]
+		}
+		x[i] = sum / f[i][i]
+	}
+
+	return x
+}
+
+// backSubstitute3 solves F·x = b for the upper triangular matrix F.
+func backSubstitute3(f [3][3]float64, size int, b [3]float64) (x [3]float64) {
+	for i := size - 1; i >= 0; i-- {
+		sum := b[i]
+		for k := i + 1; k < size; k++ {
+			sum -= f[i][k] * x[k]
+		}
+		x[i] = sum / f[i][i]
+	}
+
+	return x
+}
+
+// solveUpperTransposed3 solves Fᵀ·X = B for every column of B, where B has size rows and the given number of columns.
+func solveUpperTransposed3(f [3][3]float64, size int, b [3][3]float64, columns int) (x [3][3]float64) {
+	for c := 0; c < columns; c++ {
+		column := forwardSubstitute3(f, size, [3]float64{b[0][c], b[1][c], b[2][c]})
+		for a := 0; a < size; a++ {
+			x[a][c] = column[a]
+		}
+	}
+
+	return x
+}
+
+// multiplySymmetric3 returns m·v for the upper left size×size part of m.
+func multiplySymmetric3(m [3][3]float64, size int, v [3]float64) (result [3]float64) {
+	for a := 0; a < size; a++ {
+		for c := 0; c < size; c++ {
+			result[a] += m[a][c] * v[c]
+		}
+	}
+
+	return result
+}
+
+// transpose3 returns the transposed matrix.
+func transpose3(m [3][3]float64) (result [3][3]float64) {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			result[i][j] = m[j][i]
+		}
+	}
+
+	return result
+}
+
+// invertSymmetric3 inverts the upper left size×size part of the symmetric matrix m.
+//
+// Returns false if the matrix is not positive definite.
+func invertSymmetric3(m [3][3]float64, size int) ([3][3]float64, bool) {
+	sym := mat.NewSymDense(size, nil)
+	for i := 0; i < size; i++ {
+		for j := i; j < size; j++ {
+			sym.SetSym(i, j, m[i][j])
+		}
+	}
+
+	var chol mat.Cholesky
+	if ok := chol.Factorize(sym); !ok {
+		return [3][3]float64{}, false
+	}
+	var inv mat.SymDense
+	if err := chol.InverseTo(&inv); err != nil {
+		return [3][3]float64{}, false
+	}
+
+	var result [3][3]float64
+	for i := 0; i < size; i++ {
+		for j := 0; j < size; j++ {
+			result[i][j] = inv.At(i, j)
+		}
+	}
+
+	return result, true
+}
+
+// schurInverse gives access to the elements of the inverse of the undamped normal matrix JᵀJ.
+type schurInverse struct {
+	system         *schurSystem
+	reducedInv     *mat.SymDense // Inverse of the Schur complement S.
+	hsReduced      [][]float64   // Lazily computed product H·S⁻¹ for every block, stored row-major.
+	singularBlocks []bool        // Blocks that are not determined by the measurements.
+	blockOf        map[int]int   // Block of every eliminated column.
+	localIndex     map[int]int   // Index of every eliminated column inside of its block.
+}
+
+// inverse determines the inverse of the undamped normal matrix JᵀJ.
+//
+// If the reduced system is singular, a generalized inverse is used.
+// In this case the result is relative to an arbitrary datum, and the number of undetermined directions is returned as datum defect.
+func (s *schurSystem) inverse() (inv *schurInverse, datumDefect int) {
+	singularBlocks := make([]bool, len(s.blocks))
+	if !s.factorize(0, singularBlocks) {
+		// The coupled points aren't determined on their own, e.g. in a network of tape measurements without any photo.
+		// Their coordinates are moved into the reduced system, where the undetermined directions are handled by the generalized inverse.
+		return s.withoutCoupledBlocks().inverse()
+	}
+	s.eliminate()
+	s.invertPoints()
+
+	inv = &schurInverse{
+		system:         s,
+		hsReduced:      make([][]float64, len(s.blocks)),
+		singularBlocks: singularBlocks,
+		blockOf:        map[int]int{},
+		localIndex:     map[int]int{},
+	}
+	for b := range s.blocks {
+		for i, column := range s.blocks[b].columns {
+			inv.blockOf[column], inv.localIndex[column] = b, i
+		}
+	}
+
+	// Invert the reduced system.
+	// Gonum doesn't allow empty matrices, so the inverse stays nil if there are only points to be optimized.
+	if nr := len(s.reducedColumns); nr > 0 {
+		reduced := mat.NewSymDense(nr, s.reducedSystem(0))
+		inv.reducedInv = mat.NewSymDense(nr, nil)
+		var chol mat.Cholesky
+		if ok := chol.Factorize(reduced); ok {
+			if err := chol.InverseTo(inv.reducedInv); err != nil {
+				inv.reducedInv, datumDefect = pseudoInverseSymmetric(reduced)
+			}
+		} else {
+			inv.reducedInv, datumDefect = pseudoInverseSymmetric(reduced)
+		}
+	}
+
+	return inv, datumDefect
+}
+
+// hTimesReduced returns the product of the row a of H of block b with the column r of the inverted reduced system.
+func (inv *schurInverse) hTimesReduced(b, a, r int) float64 {
+	nr := len(inv.system.reducedColumns)
+
+	product := inv.hsReduced[b]
+	if product == nil {
+		blk := &inv.system.blocks[b]
+		product = make([]float64, len(blk.columns)*nr)
+		for l, i := range blk.hReduced {
+			for c := range blk.columns {
+				h := blk.h[l][c]
+				for j := 0; j < nr; j++ {
+					product[c*nr+j] += h * inv.reducedInv.At(i, j)
+				}
+			}
+		}
+		inv.hsReduced[b] = product
+	}
+
+	return product[a*nr+r]
+}
+
+// pointsInverse returns the element of V⁻¹ at the given blocks and their local indices.
+func (inv *schurInverse) pointsInverse(b1, a1, b2, a2 int) float64 {
+	s := inv.system
+
+	switch {
+	case b1 == b2:
+		return s.blocks[b1].vInv[a1][a2]
+	case b1 < s.firstCoupled || b2 < s.firstCoupled:
+		return 0
+	case b1 > b2:
+		b1, a1, b2, a2 = b2, a2, b1, a1
+	}
+
+	if k := sort.SearchInts(s.blocks[b1].neighbors, b2); k < len(s.blocks[b1].neighbors) && s.blocks[b1].neighbors[k] == b2 {
+		return s.blocks[b1].vInvNeighbors[k][a1][a2]
+	}
+
+	// The element is outside of the factorization's sparsity pattern, so it has to be determined from a column of V⁻¹.
+	x := make([][3]float64, len(s.blocks))
+	x[b2][a2] = 1
+	s.solvePoints(x)
+
+	return x[b1][a1]
+}
+
+// At returns the element of the inverse at the given columns.
+// Values that belong to a point that is not determined by its measurements have an infinite variance.
+func (inv *schurInverse) At(c1, c2 int) float64 {
+	s := inv.system
+	b1, isBlock1 := inv.blockOf[c1]
+	b2, isBlock2 := inv.blockOf[c2]
+
+	switch {
+	case !isBlock1 && !isBlock2:
+		return inv.reducedInv.At(s.reducedIndex[c1], s.reducedIndex[c2])
+
+	case isBlock1 && !isBlock2:
+		return -inv.hTimesReduced(b1, inv.localIndex[c1], s.reducedIndex[c2])
+
+	case !isBlock1 && isBlock2:
+		return -inv.hTimesReduced(b2, inv.localIndex[c2], s.reducedIndex[c1])
+	}
+
+	if inv.singularBlocks[b1] || inv.singularBlocks[b2] {
+		if c1 == c2 {
+			return math.Inf(1)
+		}
+		return 0
+	}
+
+	// Σ = V⁻¹ + H·S⁻¹·Hᵀ.
+	a1, a2 := inv.localIndex[c1], inv.localIndex[c2]
+	sum := inv.pointsInverse(b1, a1, b2, a2)
+	for l, j := range s.blocks[b2].hReduced {
+		sum += inv.hTimesReduced(b1, a1, j) * s.blocks[b2].h[l][a2]
+	}
+
+	return sum
+}
+
+// covariance returns the inverse of the undamped normal matrix JᵀJ for the given groups of columns, one matrix per group.
+// See inverse for a description of the datum defect.
+func (s *schurSystem) covariance(groups [][]int) (covariances []*mat.SymDense, datumDefect int) {
+	inv, datumDefect := s.inverse()
+
+	covariances = make([]*mat.SymDense, len(groups))
+	for g, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		covariance := mat.NewSymDense(len(group), nil)
+		for i, c1 := range group {
+			for j := i; j < len(group); j++ {
+				covariance.SetSym(i, j, inv.At(c1, group[j]))
+			}
+		}
+		covariances[g] = covariance
+	}
+
+	return covariances, datumDefect
+}
+
+// pseudoInverseSymmetric returns the Moore-Penrose pseudo inverse of the symmetric positive semi-definite matrix m.
+// Eigenvalues that are tiny compared to the largest one are treated as zero, their count is returned as defect.
+func pseudoInverseSymmetric(m *mat.SymDense) (*mat.SymDense, int) {
+	n := m.SymmetricDim()
+	result := mat.NewSymDense(n, nil)
+
+	var eigen mat.EigenSym
+	if ok := eigen.Factorize(m, true); !ok {
+		return result, n
+	}
+	values := eigen.Values(nil)
+	var vectors mat.Dense
+	eigen.VectorsTo(&vectors)
+
+	maxValue := 0.0
+	for _, value := range values {
+		maxValue = math.Max(maxValue, value)
+	}
+
+	defect := 0
+	for k, value := range values {
+		if value <= 1e-12*maxValue || value <= 0 {
+			defect++
+			continue
+		}
+		for i := 0; i < n; i++ {
+			for j := i; j < n; j++ {
+				result.SetSym(i, j, result.At(i, j)+vectors.At(i, k)*vectors.At(j, k)/value)
+			}
+		}
+	}
+
+	return result, defect
+}
+
+// pseudoInverseSymmetric3 returns the pseudo inverse of the upper left size×size part of the symmetric matrix m.
+func pseudoInverseSymmetric3(m [3][3]float64, size int) ([3][3]float64, int) {
+	sym := mat.NewSymDense(size, nil)
+	for i := 0; i < size; i++ {
+		for j := i; j < size; j++ {
+			sym.SetSym(i, j, m[i][j])
+		}
+	}
+
+	inv, defect := pseudoInverseSymmetric(sym)
+
+	var result [3][3]float64
+	for i := 0; i < size; i++ {
+		for j := 0; j < size; j++ {
+			result[i][j] = inv.At(i, j)
+		}
+	}
+
+	return result, defect
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// schurTestRow returns a jacobian row with random derivatives for the given columns.
+func schurTestRow(rng *rand.Rand, columns ...int) []jacobianEntry {
+	row := make([]jacobianEntry, 0, len(columns))
+	for _, column := range columns {
+		row = addJacobianEntry(row, column, rng.NormFloat64())
+	}
+
+	return row
+}
+
+// schurTestNormalEquations returns JᵀJ and Jᵀr as dense matrix and vector.
+func schurTestNormalEquations(n int, rows [][]jacobianEntry, r []float64) (*mat.SymDense, []float64) {
+	normal, gradient := mat.NewSymDense(n, nil), make([]float64, n)
+	for k, row := range rows {
+		for _, a := range row {
+			gradient[a.column] += a.derivative * r[k]
+			for _, b := range row {
+				if a.column <= b.column {
+					normal.SetSym(a.column, b.column, normal.At(a.column, b.column)+a.derivative*b.derivative)
+				}
+			}
+		}
+	}
+
+	return normal, gradient
+}
+
+// newSchurTestProblem returns a random problem with 6 columns of camera parameters and 10 points.
+// Some points are only observed by the camera, others share residuals like rangefinder measurements or planes.
+func newSchurTestProblem(rng *rand.Rand) (n int, pointBlocks [][]int, rows [][]jacobianEntry, r []float64) {
+	n = 6
+	for b := 0; b < 10; b++ {
+		size := 3
+		switch b {
+		case 2:
+			size = 1 // Points can have locked coordinates.
+		case 7:
+			size = 2
+		}
+		var block []int
+		for i := 0; i < size; i++ {
+			block = append(block, n)
+			n++
+		}
+		pointBlocks = append(pointBlocks, block)
+	}
+
+	// Observations of every point by the camera.
+	for _, block := range pointBlocks {
+		for i := 0; i < 3; i++ {
+			rows = append(rows, schurTestRow(rng, append([]int{0, 1, 2, 3, 4, 5}, block...)...))
+		}
+	}
+
+	// Residuals between points, the points 0, 1 and 9 stay independent.
+	couplings := [][]int{{2, 3}, {3, 4}, {4, 5}, {5, 2}, {6, 7}, {3, 7}, {4, 6, 7, 8}}
+	for _, points := range couplings {
+		var columns []int
+		for _, point := range points {
+			columns = append(columns, pointBlocks[point]...)
+		}
+		rows = append(rows, schurTestRow(rng, columns...))
+	}
+
+	// Residuals that only depend on the camera.
+	rows = append(rows, schurTestRow(rng, 0, 3), schurTestRow(rng, 5))
+
+	r = make([]float64, len(rows))
+	for i := range r {
+		r[i] = rng.NormFloat64()
+	}
+
+	return n, pointBlocks, rows, r
+}
+
+// TestSchurSystem compares the steps and the inverse of the Schur complement solver with a dense solution of the normal equations.
+func TestSchurSystem(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	n, pointBlocks, rows, r := newSchurTestProblem(rng)
+	normal, gradient := schurTestNormalEquations(n, rows, r)
+
+	system := newSchurSystem(n, pointBlocks, rows, r)
+	if len(system.reducedColumns) != 6 {
+		t.Errorf("The reduced system has %d columns, but only the 6 camera parameters should remain", len(system.reducedColumns))
+	}
+	if coupled := len(system.blocks) - system.firstCoupled; coupled != 7 {
+		t.Errorf("There are %d coupled points, want 7", coupled)
+	}
+
+	for _, damping := range []float64{0, 1e-3, 10} {
+		damped := mat.NewSymDense(n, nil)
+		damped.CopySym(normal)
+		rhs := mat.NewVecDense(n, nil)
+		for i := 0; i < n; i++ {
+			damped.SetSym(i, i, damped.At(i, i)+damping*math.Max(normal.At(i, i), lmMinDiagonal))
+			rhs.SetVec(i, -gradient[i])
+		}
+		var chol mat.Cholesky
+		if !chol.Factorize(damped) {
+			t.Fatalf("Dense normal equations with damping %v aren't positive definite", damping)
+		}
+		want := mat.NewVecDense(n, nil)
+		if err := chol.SolveVecTo(want, rhs); err != nil {
+			t.Fatalf("Dense solve with damping %v failed: %v", damping, err)
+		}
+
+		step := make([]float64, n)
+		if ok := system.solve(damping, step); !ok {
+			t.Fatalf("solve() with damping %v failed", damping)
+		}
+		for i := range step {
+			if math.Abs(step[i]-want.AtVec(i)) > 1e-9*math.Max(1, math.Abs(want.AtVec(i))) {
+				t.Errorf("Damping %v: Step %d is %v, want %v", damping, i, step[i], want.AtVec(i))
+			}
+		}
+	}
+
+	var want mat.SymDense
+	var chol mat.Cholesky
+	if !chol.Factorize(normal) {
+		t.Fatalf("Dense normal equations aren't positive definite")
+	}
+	if err := chol.InverseTo(&want); err != nil {
+		t.Fatalf("Dense inverse failed: %v", err)
+	}
+
+	inv, datumDefect := system.inverse()
+	if datumDefect != 0 {
+		t.Errorf("inverse() returned a datum defect of %d, want 0", datumDefect)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if got := inv.At(i, j); math.Abs(got-want.At(i, j)) > 1e-9*math.Max(1, math.Abs(want.At(i, j))) {
+				t.Errorf("Element (%d, %d) of the inverse is %v, want %v", i, j, got, want.At(i, j))
+			}
+		}
+	}
+}
+
+// TestSchurSystemDatumDefect checks the inverse of a network that is only determined up to a translation.
+func TestSchurSystemDatumDefect(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	// The residuals only depend on the differences of the point coordinates.
+	n, pointBlocks := 12, [][]int{{0, 1, 2}, {3, 4, 5}, {6, 7, 8}, {9, 10, 11}}
+	var rows [][]jacobianEntry
+	for i := 0; i < 20; i++ {
+		a, b := rng.Intn(4), rng.Intn(3)
+		if b >= a {
+			b++
+		}
+		var row []jacobianEntry
+		for c := 0; c < 3; c++ {
+			derivative := rng.NormFloat64()
+			row = append(row, jacobianEntry{pointBlocks[a][c], derivative}, jacobianEntry{pointBlocks[b][c], -derivative})
+		}
+		rows = append(rows, row)
+	}
+	r := make([]float64, len(rows))
+	normal, _ := schurTestNormalEquations(n, rows, r)
+
+	want, wantDefect := pseudoInverseSymmetric(normal)
+	if wantDefect != 3 {
+		t.Fatalf("The test network has a defect of %d, want 3", wantDefect)
+	}
+
+	inv, datumDefect := newSchurSystem(n, pointBlocks, rows, r).inverse()
+	if datumDefect != wantDefect {
+		t.Errorf("inverse() returned a datum defect of %d, want %d", datumDefect, wantDefect)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if got := inv.At(i, j); math.Abs(got-want.At(i, j)) > 1e-9*math.Max(1, math.Abs(want.At(i, j))) {
+				t.Errorf("Element (%d, %d) of the inverse is %v, want %v", i, j, got, want.At(i, j))
+			}
+		}
+	}
+}
@@ -18,7 +18,6 @@ package main
 import (
 	"log"
 	"sync"
-	"time"
 
 	"github.com/vugu/vugu"
 )
@@ -27,9 +26,13 @@ import (
 type OptimizerState struct {
 	sync.RWMutex
 
-	site     *Site
-	running  bool // Optimizer is running.
-	stopFlag bool // Flag signalling that the optimizer should stop.
+	site      *Site
+	running   bool               // Optimizer is running.
+	worker    *optimizerWorker   // Web worker that runs the optimizer. It's kept for later runs.
+	analysis  *DatumAnalysis     // Result of the check before the last optimization.
+	progress  *OptimizerProgress // Latest progress of the running optimization.
+	report    *OptimizerReport   // Report of the running optimization. It's stored in the site once the optimization has ended.
+	residuals []Residualer       // Residualers of the original site, used to finish the report.
 }
 
 // Running returns whether the optimizer is running or not.
@@ -40,7 +43,40 @@ func (os *OptimizerState) Running() bool {
 	return os.running
 }
 
+// Analysis returns the result of the check that was done before the last optimization, or nil.
+func (os *OptimizerState) Analysis() *DatumAnalysis {
+	os.RLock()
+	defer os.RUnlock()
+
+	return os.analysis
+}
+
+// Progress returns the latest progress of the running optimization, or nil.
+func (os *OptimizerState) Progress() *OptimizerProgress {
+	os.RLock()
+	defer os.RUnlock()
+
+	if !os.running {
+		return nil
+	}
+	return os.progress
+}
+
+// Start optimizes the whole site.
 func (os *OptimizerState) Start(event vugu.DOMEvent) {
+	os.start(event, nil)
+}
+
+// StartSelection optimizes only the given objects, like the pose of a photo, a tripod or a set of points.
+// All other values are treated as locked during the optimization, without changing their locked flags.
+func (os *OptimizerState) StartSelection(event vugu.DOMEvent, selection []OptimizerSelectable) {
+	if selection == nil {
+		selection = []OptimizerSelectable{}
+	}
+	os.start(event, selection)
+}
+
+func (os *OptimizerState) start(event vugu.DOMEvent, selection []OptimizerSelectable) {
 	os.Lock()
 	defer os.Unlock()
 
@@ -48,75 +84,145 @@ func (os *OptimizerState) Start(event vugu.DOMEvent) {
 	if os.running {
 		return
 	}
-	os.running, os.stopFlag = true, false
 
 	// Create clone of site to optimize. Also create a pair of tweakables lists.
 	os.site.RLock()
 	defer os.site.RUnlock()
 	siteClone := os.site.Copy()
-	OriginalTweakables, _ := os.site.GetTweakablesAndResiduals()
-	CloneTweakables, _ := siteClone.GetTweakablesAndResiduals()
-
-	done := make(chan struct{})
+	OriginalTweakables, OriginalResiduals := os.site.GetTweakablesAndResiduals()
+	CloneTweakables, CloneResiduals := siteClone.GetTweakablesAndResiduals()
+
+	// Translate the selection into the indices of the tweakables, which are the same for the clone.
+	var selectionIndices []int
+	var cloneSelection map[Tweakable]struct{}
+	if selection != nil {
+		originalSelection := map[Tweakable]struct{}{}
+		for _, selectable := range selection {
+			tweakables, _ := selectable.GetTweakablesAndResiduals()
+			for _, tweakable := range tweakables {
+				originalSelection[tweakable] = struct{}{}
+			}
+		}
 
-	// Copy the parameters from siteClone to the original site.
-	uiSync := func() {
-		// Lock clone.
-		siteClone.RLock()
-		defer siteClone.RUnlock()
+		selectionIndices, cloneSelection = []int{}, map[Tweakable]struct{}{}
+		for i, tweakable := range OriginalTweakables {
+			if _, ok := originalSelection[tweakable]; ok {
+				selectionIndices, cloneSelection[CloneTweakables[i]] = append(selectionIndices, i), struct{}{}
+			}
+		}
 
-		// Lock original site/event environment.
-		event.EventEnv().Lock()
-		defer event.EventEnv().UnlockRender()
+		if len(selectionIndices) == 0 {
+			log.Printf("The selection doesn't contain any unlocked values to optimize")
+			Alert("The selection doesn't contain any unlocked values to optimize.")
+			return
+		}
+	}
 
-		// Overwrite the value of all globalSite tweakables with siteClone tweakables.
-		for i, tweakable := range CloneTweakables {
-			OriginalTweakables[i].SetTweakableValue(tweakable.TweakableValue())
+	// Check if all values are determined by the measurements.
+	// If not, the solution may float around or collapse into a trivial solution.
+	os.analysis = AnalyzeDatum(siteClone, selectTweakables(CloneTweakables, cloneSelection), CloneResiduals)
+	if !os.analysis.OK() {
+		log.Printf("Optimizer check failed:\n%s", os.analysis.Text())
+		if !Confirm(os.analysis.Text() + "\nOptimize anyway?") {
+			return
 		}
+	} else if len(os.analysis.Warnings) > 0 {
+		log.Printf("Optimizer check:\n%s", os.analysis.Text())
 	}
 
-	checkStop := func() bool {
-		os.RLock()
-		defer os.RUnlock()
+	job, err := newOptimizerJob(siteClone, selectionIndices)
+	if err != nil {
+		log.Printf("Failed to create optimizer job: %v", err)
+		return
+	}
 
-		return os.stopFlag
+	// Reuse the worker of previous runs, as loading the application takes some time.
+	if os.worker == nil {
+		os.worker = newOptimizerWorker()
 	}
+	worker := os.worker
+	eventEnv := event.EventEnv()
+
+	os.running, os.progress = true, nil
+	os.report = newOptimizerReport(os.site, selectTweakables(OriginalTweakables, cloneSelection), OriginalResiduals, selection != nil)
+	os.residuals = OriginalResiduals
+
+	// Copy the values streamed by the worker to the original site.
+	worker.start(job, func(message optimizerMessage) {
+		eventEnv.Lock()
+		defer eventEnv.UnlockRender()
+
+		os.Lock()
+		defer os.Unlock()
 
-	// Call uiSync every now and then until the optimization is done.
-	go func() {
-		ticker := time.NewTicker(250 * time.Millisecond)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-done:
-				uiSync()
-				return
-			case <-ticker.C:
-				uiSync()
+		// Ignore messages of workers that were replaced, their values belong to an outdated state of the site.
+		if os.worker != worker {
+			return
+		}
+
+		for i, value := range message.Values {
+			if i < len(OriginalTweakables) {
+				OriginalTweakables[i].SetTweakableValue(float64(value))
 			}
 		}
-	}()
 
-	// Optimize.
-	go func() {
-		err := Optimize(siteClone, checkStop)
-		if err != nil {
-			log.Printf("Optimize failed: %v", err)
+		os.report.History = append(os.report.History, message.History...)
+		if message.Progress != nil {
+			os.progress = message.Progress
 		}
 
-		os.Lock()
-		defer os.Unlock()
-		os.running = false
+		if message.Type != "done" {
+			return
+		}
 
-		// Stop UI updates.
-		done <- struct{}{}
-	}()
+		outcome := OptimizerOutcome{Termination: OptimizerTerminationFailed}
+		if message.Outcome != nil {
+			outcome = *message.Outcome
+		}
+		if message.Error != "" {
+			log.Printf("Optimize failed: %v", message.Error)
+			outcome.Termination, outcome.TerminationDetail = OptimizerTerminationFailed, message.Error
+		}
+		os.finish(outcome)
+
+		// Transfer the uncertainties of the solution to the original site.
+		// They can only be determined by a full optimization, so keep the ones of the last full run otherwise.
+		if selectionIndices == nil {
+			if message.Posterior != nil {
+				os.site.posterior = message.Posterior.posterior(OriginalTweakables, OriginalResiduals)
+			} else {
+				os.site.posterior = nil
+			}
+		}
+	})
+}
+
+// finish stores the report of the running optimization in the site, and marks the optimizer as stopped.
+// The optimizer state has to be locked.
+func (os *OptimizerState) finish(outcome OptimizerOutcome) {
+	os.report.finish(outcome, os.residuals)
+	os.site.OptimizerReport = os.report
+
+	os.running, os.progress, os.report, os.residuals = false, nil, nil, nil
 }
 
+// Stop stops the optimizer, and keeps the last values it has sent.
 func (os *OptimizerState) Stop() {
 	os.Lock()
 	defer os.Unlock()
 
-	os.stopFlag = true
+	if !os.running {
+		return
+	}
+
+	// The worker doesn't handle any messages while it is optimizing, so it has to be terminated.
+	os.worker.terminate()
+	os.worker = nil
+	log.Printf("Optimization stopped by user")
+
+	outcome := OptimizerOutcome{Termination: OptimizerTerminationStopped}
+	if os.progress != nil {
+		outcome.Iterations, outcome.Evaluations, outcome.Cost = os.progress.Iteration, os.progress.Evaluations, os.progress.Cost
+	}
+	os.finish(outcome)
 }
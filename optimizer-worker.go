@@ -0,0 +1,334 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vugu/vugu/js"
+)
+
+// optimizerWorkerUpdateInterval is the time between two updates of the tweakable values sent by the worker.
+const optimizerWorkerUpdateInterval = 250 * time.Millisecond
+
+// optimizerWorkerScript starts a web worker that runs the application with the "-worker" flag.
+// Messages that arrive before the application is ready are buffered.
+const optimizerWorkerScript = `
+self.pendingMessages = [];
+self.onmessage = (event) => { self.pendingMessages.push(event.data); };
+importScripts(%q);
+const go = new Go();
+go.argv = ["js", "-worker"];
+fetch(%q).then((response) => response.arrayBuffer()).then((buffer) => WebAssembly.instantiate(buffer, go.importObject)).then((result) => {
+	go.run(result.instance);
+});
+`
+
+// jsonFloat is a float64 that can also represent infinity and NaN in JSON.
+type jsonFloat float64
+
+// MarshalJSON implements json.Marshaler.
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	if math.IsInf(float64(f), 0) || math.IsNaN(float64(f)) {
+		return []byte(strconv.Quote(strconv.FormatFloat(float64(f), 'g', -1, 64))), nil
+	}
+
+	return []byte(strconv.FormatFloat(float64(f), 'g', -1, 64)), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *jsonFloat) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return err
+	}
+	*f = jsonFloat(value)
+
+	return nil
+}
+
+// optimizerJobImage contains the properties of a photo's image that are needed for the projection.
+type optimizerJobImage struct {
+	Size        PixelCoordinate
+	Orientation int
+}
+
+// optimizerJob is sent to the worker to start an optimization.
+type optimizerJob struct {
+	Site      *Site                                   // The site without any image data.
+	Images    map[string]map[string]optimizerJobImage // Image properties of every photo, by camera and photo key.
+	Selection []int                                   // Indices of the tweakables to optimize, or nil to optimize all of them.
+}
+
+// newOptimizerJob returns the serialized job to optimize the given site.
+// The images of the site will be removed, so this should only be used on a copy.
+func newOptimizerJob(site *Site, selection []int) ([]byte, error) {
+	job := optimizerJob{Site: site, Images: map[string]map[string]optimizerJobImage{}, Selection: selection}
+
+	// The worker doesn't need the report of the previous optimization.
+	site.OptimizerReport = nil
+
+	for cameraKey, camera := range site.Cameras {
+		images := map[string]optimizerJobImage{}
+		for photoKey, photo := range camera.Photos {
+			images[photoKey] = optimizerJobImage{Size: photo.imageSize, Orientation: photo.orientation}
+			photo.ImageData = nil
+		}
+		job.Images[cameraKey] = images
+
+		// The calibration photos aren't part of the optimization.
+		camera.CalibrationPhotos = map[string]*CameraCalibrationPhoto{}
+	}
+
+	return json.Marshal(job)
+}
+
+// optimizerMessage is sent from the worker to the page.
+type optimizerMessage struct {
+	Type      string              // Either "update" or "done".
+	Values    []jsonFloat         // Values of all tweakables in optimizer space.
+	Progress  *OptimizerProgress  `json:",omitempty"` // Latest state of the optimization.
+	History   []OptimizerProgress `json:",omitempty"` // Progress of all iterations since the last message.
+	Outcome   *OptimizerOutcome   `json:",omitempty"` // How the optimization ended, only for "done".
+	Posterior *posteriorData      `json:",omitempty"` // Uncertainties of the solution, only for "done".
+	Error     string              `json:",omitempty"` // Reason why the optimization failed, only for "done".
+}
+
+// optimizerWorker runs the optimizer in a web worker with its own instance of the application.
+// This keeps the UI responsive, even while the optimizer is busy.
+type optimizerWorker struct {
+	sync.Mutex
+
+	worker             js.Value
+	workerURL          js.Value
+	onMessage, onError js.Func
+	handler            func(message optimizerMessage) // Handler for the messages of the current job.
+	queue              []string                       // Received messages that are not handled yet.
+	signal             chan struct{}
+	terminated         bool
+}
+
+// newOptimizerWorker starts a new web worker.
+// The worker loads the same WASM binary as the page.
+func newOptimizerWorker() *optimizerWorker {
+	w := &optimizerWorker{signal: make(chan struct{}, 1)}
+
+	// Find the scripts relative to the already loaded wasm_exec.js.
+	wasmExecURL := js.Global().Get("document").Call("querySelector", `script[src$="wasm_exec.js"]`).Get("src").String()
+	mainWasmURL := strings.TrimSuffix(wasmExecURL, "wasm_exec.js") + "main.wasm"
+
+	script := fmt.Sprintf(optimizerWorkerScript, wasmExecURL, mainWasmURL)
+	blob := js.Global().Get("Blob").New(js.Global().Get("Array").New(script), js.ValueOf(map[string]interface{}{"type": "text/javascript"}))
+	w.workerURL = js.Global().Get("URL").Call("createObjectURL", blob) // This has to be freed when the worker is terminated.
+	w.worker = js.Global().Get("Worker").New(w.workerURL)
+
+	// Blocking inside of callbacks would block the JS event loop, so the messages are handled in their own goroutine.
+	w.onMessage = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		w.enqueue(args[0].Get("data").String())
+		return nil
+	})
+	w.onError = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		data, _ := json.Marshal(optimizerMessage{Type: "done", Error: "Optimizer worker failed: " + args[0].Get("message").String()})
+		w.enqueue(string(data))
+		return nil
+	})
+	w.worker.Set("onmessage", w.onMessage)
+	w.worker.Set("onerror", w.onError)
+
+	go w.handleMessages()
+
+	return w
+}
+
+// enqueue adds a received message to the queue.
+func (w *optimizerWorker) enqueue(data string) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.terminated {
+		return
+	}
+	w.queue = append(w.queue, data)
+
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// handleMessages passes all received messages in order to the handler of the current job.
+func (w *optimizerWorker) handleMessages() {
+	for range w.signal {
+		w.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.Unlock()
+
+		for _, data := range queue {
+			var message optimizerMessage
+			if err := json.Unmarshal([]byte(data), &message); err != nil {
+				log.Printf("Failed to decode optimizer worker message: %v", err)
+				continue
+			}
+
+			w.Lock()
+			handler := w.handler
+			w.Unlock()
+			if handler != nil {
+				handler(message)
+			}
+		}
+	}
+}
+
+// start sends the job to the worker.
+// The handler is called for every message the worker sends back, until the next job is started or the worker is terminated.
+func (w *optimizerWorker) start(job []byte, handler func(message optimizerMessage)) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.handler = handler
+	w.worker.Call("postMessage", string(job))
+}
+
+// terminate stops the worker immediately.
+func (w *optimizerWorker) terminate() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.terminated {
+		return
+	}
+	w.terminated, w.handler = true, nil
+
+	w.worker.Call("terminate")
+	w.onMessage.Release()
+	w.onError.Release()
+	js.Global().Get("URL").Call("revokeObjectURL", w.workerURL)
+	close(w.signal)
+}
+
+// runOptimizerWorker handles optimizer jobs when the application runs as web worker.
+// This never returns.
+func runOptimizerWorker() {
+	// The page only sends a new job once the previous one is done.
+	handler := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		go handleOptimizerJob(args[0].Get("data").String())
+		return nil
+	})
+	js.Global().Set("onmessage", handler)
+
+	pending := js.Global().Get("pendingMessages")
+	for i := 0; i < pending.Length(); i++ {
+		go handleOptimizerJob(pending.Index(i).String())
+	}
+
+	select {}
+}
+
+// handleOptimizerJob optimizes the site of the given job, and sends the results back to the page.
+func handleOptimizerJob(data string) {
+	post := func(message optimizerMessage) {
+		data, err := json.Marshal(message)
+		if err != nil {
+			log.Printf("Failed to encode optimizer worker message: %v", err)
+			return
+		}
+		js.Global().Call("postMessage", string(data))
+	}
+
+	var job optimizerJob
+	if err := json.Unmarshal([]byte(data), &job); err != nil || job.Site == nil {
+		post(optimizerMessage{Type: "done", Error: fmt.Sprintf("Failed to decode optimizer job: %v", err)})
+		return
+	}
+	site := job.Site
+
+	for cameraKey, images := range job.Images {
+		if camera, ok := site.Cameras[cameraKey]; ok {
+			for photoKey, image := range images {
+				if photo, ok := camera.Photos[photoKey]; ok {
+					photo.imageSize, photo.orientation = image.Size, image.Orientation
+				}
+			}
+		}
+	}
+
+	tweakables, residuals := site.GetTweakablesAndResiduals()
+
+	values := func() []jsonFloat {
+		site.RLock()
+		defer site.RUnlock()
+
+		values := make([]jsonFloat, 0, len(tweakables))
+		for _, tweakable := range tweakables {
+			values = append(values, jsonFloat(tweakable.TweakableValue()))
+		}
+		return values
+	}
+
+	var selection map[Tweakable]struct{}
+	if job.Selection != nil {
+		selection = map[Tweakable]struct{}{}
+		for _, i := range job.Selection {
+			if i < len(tweakables) {
+				selection[tweakables[i]] = struct{}{}
+			}
+		}
+	}
+
+	// Stream the current values and the progress to the page every now and then.
+	// The page stops the optimization by terminating the worker, so this never signals a stop.
+	var history []OptimizerProgress
+	lastUpdate := time.Now()
+	progressFunc := func(progress OptimizerProgress) bool {
+		// The group costs are only interesting for the live view, they would bloat the history.
+		historyEntry := progress
+		historyEntry.GroupCosts = nil
+		history = append(history, historyEntry)
+
+		if time.Since(lastUpdate) >= optimizerWorkerUpdateInterval {
+			post(optimizerMessage{Type: "update", Values: values(), Progress: &progress, History: history})
+			history, lastUpdate = nil, time.Now()
+		}
+		return false
+	}
+
+	outcome, err := Optimize(site, selection, progressFunc)
+	message := optimizerMessage{Type: "done", Outcome: &outcome, History: history}
+	if err != nil {
+		message.Error = err.Error()
+	}
+	message.Values = values()
+	if site.posterior != nil {
+		posterior := site.posterior.data(tweakables, residuals)
+		message.Posterior = &posterior
+	}
+
+	post(message)
+}
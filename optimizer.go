@@ -92,32 +92,132 @@ func (t *TweakablePositiveFloat) SetInputValue(strVal string) {
 
 // Residualer is implemented by objects that can have residuals of measurements or constraints.
 type Residualer interface {
+	Residuals() []float64 // Returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
 	ResidualSqr() float64 // Returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
 }
 
-func Optimize(site *Site, stopFunc func() bool) error {
+// ActiveResidualer is implemented by residualers that return residuals which are always 0 in some configurations.
+// This keeps the number of residuals constant, but these residuals don't count as observations.
+type ActiveResidualer interface {
+	ActiveResiduals() int // Returns the number of residuals that can currently be non-zero.
+}
+
+// Jacobianer is implemented by residualers that can determine the partial derivatives of their residuals analytically.
+type Jacobianer interface {
+	// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+	// The derivatives are with respect to the tweakable's value in optimizer space.
+	// Derivatives with respect to locked values are ignored, and multiple derivatives for the same residual and tweakable are summed up.
+	Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64))
+}
+
+// residualsSqr returns the sum of the squared residuals.
+func residualsSqr(residuals []float64) float64 {
+	ssr := 0.0
+	for _, r := range residuals {
+		ssr += r * r
+	}
+
+	return ssr
+}
+
+// OptimizerMethod describes the algorithm that is used to minimize the residuals.
+type OptimizerMethod string
+
+const (
+	OptimizerMethodLevenbergMarquardt OptimizerMethod = "LevenbergMarquardt" // Least squares solver that works on the individual residuals.
+	OptimizerMethodNelderMead         OptimizerMethod = "NelderMead"         // Derivative free solver that works on the sum of squared residuals.
+)
+
+// OptimizerMethodOptions contains all selectable optimizer methods.
+var OptimizerMethodOptions = SelectOptions{
+	{string(OptimizerMethodLevenbergMarquardt), "Levenberg-Marquardt"},
+	{string(OptimizerMethodNelderMead), "Nelder-Mead (legacy)"},
+}
+
+// StringValue implements vgform.StringValuer.
+func (om OptimizerMethod) StringValue() string {
+	return string(om)
+}
+
+// SetStringValue implements vgform.StringValuer.
+func (om *OptimizerMethod) SetStringValue(v string) {
+	*om = OptimizerMethod(v)
+}
+
+// OptimizerSelectable is implemented by objects that can be optimized on their own, like points, photos or tripods.
+type OptimizerSelectable interface {
+	GetTweakablesAndResiduals() ([]Tweakable, []Residualer)
+}
+
+// selectTweakables returns the tweakables that are contained in the selection, in their original order.
+// If selection is nil, all tweakables are returned.
+func selectTweakables(tweakables []Tweakable, selection map[Tweakable]struct{}) []Tweakable {
+	if selection == nil {
+		return tweakables
+	}
+
+	selectedTweakables := make([]Tweakable, 0, len(selection))
+	for _, tweakable := range tweakables {
+		if _, ok := selection[tweakable]; ok {
+			selectedTweakables = append(selectedTweakables, tweakable)
+		}
+	}
+
+	return selectedTweakables
+}
+
+// Optimize adjusts the tweakables of the site so that the residuals are minimized.
+//
+// If selection is not nil, only the tweakables contained in it are optimized.
+// All other values are treated as if they were locked, and the uncertainties of the site are not determined.
+//
+// progressFunc is called regularly with the current state of the optimization, the optimization stops if it returns true.
+func Optimize(site *Site, selection map[Tweakable]struct{}, progressFunc func(OptimizerProgress) bool) (OptimizerOutcome, error) {
+	failed := OptimizerOutcome{Termination: OptimizerTerminationFailed}
+
 	tweakables, residuals := site.GetTweakablesAndResiduals()
+	tweakables = selectTweakables(tweakables, selection)
 
 	if len(tweakables) == 0 {
-		return fmt.Errorf("there are no tweakable variables")
+		return failed, fmt.Errorf("there are no tweakable variables")
 	}
 	if len(residuals) == 0 {
-		return fmt.Errorf("there are no residuals to be determined")
+		return failed, fmt.Errorf("there are no residuals to be determined")
+	}
+
+	if site.OptimizerVerifyDerivatives {
+		if err := VerifyJacobians(site); err != nil {
+			return failed, fmt.Errorf("analytic derivatives don't match numeric ones: %w", err)
+		}
+		log.Printf("All analytic derivatives match numeric ones")
+	}
+
+	started := time.Now()
+	timedProgressFunc := func(progress OptimizerProgress) bool {
+		progress.Elapsed = time.Since(started)
+		return progressFunc(progress)
 	}
 
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+	switch site.OptimizerMethod {
+	case OptimizerMethodNelderMead:
+		return optimizeNelderMead(site, tweakables, residuals, timedProgressFunc)
+	case OptimizerMethodLevenbergMarquardt, "":
+		return optimizeLevenbergMarquardt(site, tweakables, residuals, timedProgressFunc, selection == nil), nil
+	}
+
+	return failed, fmt.Errorf("unknown optimizer method %q", site.OptimizerMethod)
+}
+
+// optimizeNelderMead minimizes the sum of squared residuals by using the Nelder-Mead method.
+func optimizeNelderMead(site *Site, tweakables []Tweakable, residuals []Residualer, progressFunc func(OptimizerProgress) bool) (OptimizerOutcome, error) {
+	site.RLock()
+	losses := residualRobustLosses(site, residuals)
+	site.RUnlock()
+
+	recorder := &nelderMeadRecorder{progressFunc: progressFunc}
 
 	// Function to optimize.
 	optimizeFunc := func(x []float64) float64 {
-		// Do some silly sleep every now and then to prevent the UI from locking up.
-		// TODO: Remove optimizer sleep once WASM threads are fully supported
-		select {
-		case <-ticker.C:
-			time.Sleep(1 * time.Millisecond)
-		default:
-		}
-
 		site.Lock()
 		defer site.Unlock()
 
@@ -126,18 +226,18 @@ func Optimize(site *Site, stopFunc func() bool) error {
 			tweakable.SetTweakableValue(x[i])
 		}
 
-		// Get sum of squared residuals.
-		ssr := 0.0
-		for _, residual := range residuals {
-			ssr += residual.ResidualSqr()
+		// Get the sum of the robust losses of all squared residuals.
+		cost := 0.0
+		for i, residual := range residuals {
+			cost += losses[i].Loss(residual.ResidualSqr())
 		}
 
-		return ssr
+		return cost
 	}
 
 	// Function to end the optimization prematurely.
 	statusFunc := func() (optimize.Status, error) {
-		if stopFunc() {
+		if recorder.stopped {
 			return optimize.Success, nil
 		}
 
@@ -157,20 +257,56 @@ func Optimize(site *Site, stopFunc func() bool) error {
 	}
 
 	//res, err := optimize.Minimize(p, init, nil, &optimize.CmaEsChol{InitStepSize: 0.01})
-	res, err := optimize.Minimize(p, init, &optimize.Settings{Converger: &optimize.FunctionConverge{Absolute: 1e-10, Iterations: 100000}}, &optimize.NelderMead{})
+	res, err := optimize.Minimize(p, init, &optimize.Settings{Converger: &optimize.FunctionConverge{Absolute: 1e-10, Iterations: 100000}, Recorder: recorder}, &optimize.NelderMead{})
 	if err != nil {
 		log.Printf("Optimization failed: %v", err)
 	}
-	if err = res.Status.Err(); err != nil {
-		log.Printf("Optimization status error: %v", err)
+
+	outcome := OptimizerOutcome{Termination: OptimizerTerminationConverged, TerminationDetail: res.Status.String(), Iterations: res.MajorIterations, Evaluations: res.FuncEvaluations, Cost: jsonFloat(res.F)}
+	switch {
+	case recorder.stopped:
+		outcome.Termination, outcome.TerminationDetail = OptimizerTerminationStopped, ""
+	case err != nil:
+		outcome.Termination, outcome.TerminationDetail = OptimizerTerminationFailed, err.Error()
+	case res.Status == optimize.IterationLimit || res.Status == optimize.FunctionEvaluationLimit || res.Status == optimize.RuntimeLimit:
+		outcome.Termination = OptimizerTerminationIterationLimit
+	case res.Status.Err() != nil:
+		outcome.Termination, outcome.TerminationDetail = OptimizerTerminationFailed, res.Status.Err().Error()
 	}
 
-	log.Println(res.F, res.X, res.FuncEvaluations, res.MajorIterations)
+	log.Printf("Nelder-Mead: %s. Cost: %v, iterations: %d, function evaluations: %d", outcome.Description(), res.F, res.MajorIterations, res.FuncEvaluations)
+
+	site.Lock()
+	defer site.Unlock()
 
 	// Set tweakable values to the solution.
 	for i, tweakable := range tweakables {
 		tweakable.SetTweakableValue(res.X[i])
 	}
 
+	return outcome, nil
+}
+
+// nelderMeadRecorder reports the progress of the Nelder-Mead method once per major iteration.
+type nelderMeadRecorder struct {
+	progressFunc func(OptimizerProgress) bool
+	stopped      bool // progressFunc requested to stop the optimization.
+}
+
+// Init implements optimize.Recorder.
+func (r *nelderMeadRecorder) Init() error {
+	return nil
+}
+
+// Record implements optimize.Recorder.
+func (r *nelderMeadRecorder) Record(location *optimize.Location, operation optimize.Operation, stats *optimize.Stats) error {
+	if operation&optimize.MajorIteration == 0 {
+		return nil
+	}
+
+	if r.progressFunc(OptimizerProgress{Iteration: stats.MajorIterations, Evaluations: stats.FuncEvaluations, Cost: jsonFloat(location.F)}) {
+		r.stopped = true
+	}
+
 	return nil
 }
@@ -0,0 +1,175 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+// orthophotoMaxPixels limits the size of generated orthophotos, as they have to fit into the memory of the browser.
+const orthophotoMaxPixels = 50_000_000
+
+// orthophotoSource is a photo that is projected onto the plane of an orthophoto.
+type orthophotoSource struct {
+	photo      *CameraPhoto
+	projection cameraProjection
+	sampler    imageSampler
+	toStored   imageTransform // From the upright frame into the stored image frame.
+}
+
+// newOrthophotoSource decodes the image of the given photo.
+func newOrthophotoSource(photo *CameraPhoto, interpolation ImageInterpolation) (orthophotoSource, error) {
+	img, _, err := image.Decode(bytes.NewReader(photo.ImageData))
+	if err != nil {
+		return orthophotoSource{}, fmt.Errorf("couldn't decode photo %s: %w", photo.DisplayName(), err)
+	}
+	storedSize := PixelCoordinate{PixelDistance(img.Bounds().Dx()), PixelDistance(img.Bounds().Dy())}
+
+	return orthophotoSource{
+		photo:      photo,
+		projection: photo.projection(),
+		sampler:    newImageSampler(img, interpolation),
+		toStored:   exifOrientationTransform(photo.orientation, storedSize).inverse(),
+	}, nil
+}
+
+// sample returns the color of the photo at the given world coordinate.
+// The result is false if the coordinate isn't visible in the photo.
+func (s *orthophotoSource) sample(world Coordinate) (color.RGBA, bool) {
+	distorted, undistorted := s.projection.project(world, nil)
+	if distorted.Z() <= 0 {
+		return color.RGBA{}, false
+	}
+
+	// Far outside of the angle of view, the distortion polynomials can fold back into the image.
+	if !s.photo.camera.Panoramic() {
+		size := s.photo.imageSize
+		if undistorted.X() < -size.X()/2 || undistorted.Y() < -size.Y()/2 || undistorted.X() > size.X()*3/2 || undistorted.Y() > size.Y()*3/2 {
+			return color.RGBA{}, false
+		}
+	}
+
+	stored := s.toStored.apply(distorted)
+	return s.sampler.at(stored.X().Pixels(), stored.Y().Pixels())
+}
+
+// orthophotoFrame describes how the pixels of an orthophoto are placed on its plane.
+type orthophotoFrame struct {
+	Origin        mgl64.Vec3 // World coordinate of the top left corner of the image.
+	Right, Down   mgl64.Vec3 // Unit vectors along the image axes.
+	PixelSize     float64    // Edge length of a pixel in meters.
+	Width, Height int
+}
+
+// world returns the world coordinate of the image coordinate (x, y).
+func (f orthophotoFrame) world(x, y float64) Coordinate {
+	w := f.Origin.Add(f.Right.Mul(x * f.PixelSize)).Add(f.Down.Mul(y * f.PixelSize))
+	return Coordinate{Distance(w[0]), Distance(w[1]), Distance(w[2])}
+}
+
+// renderOrthophoto projects the given photos onto the plane of the frame.
+// Every pixel is taken from the photo that sees the plane at that position with the finest resolution.
+// Occlusions by objects in front of the plane are not considered.
+func renderOrthophoto(frame orthophotoFrame, normal mgl64.Vec3, sources []orthophotoSource) *image.RGBA {
+	result := image.NewRGBA(image.Rect(0, 0, frame.Width, frame.Height))
+
+	for y := 0; y < frame.Height; y++ {
+		for x := 0; x < frame.Width; x++ {
+			world := frame.world(float64(x)+0.5, float64(y)+0.5)
+
+			var best color.RGBA
+			bestScore := 0.0
+			for i := range sources {
+				source := &sources[i]
+				c, ok := source.sample(world)
+				if !ok {
+					continue
+				}
+
+				// The resolution on the plane is proportional to the cosine of the angle of incidence divided by the distance.
+				ray := world.Vec3().Sub(source.projection.position)
+				distance := ray.Len()
+				if distance == 0 {
+					continue
+				}
+				if score := math.Abs(ray.Dot(normal)) / (distance * distance); score > bestScore {
+					best, bestScore = c, score
+				}
+			}
+
+			if bestScore > 0 {
+				result.SetRGBA(x, y, best)
+			}
+		}
+	}
+
+	return result
+}
+
+// scaleBarLength returns a length of 1, 2 or 5 times a power of ten that is at most the given length.
+func scaleBarLength(maxLength float64) float64 {
+	if maxLength <= 0 {
+		return 0
+	}
+
+	magnitude := math.Pow(10, math.Floor(math.Log10(maxLength)))
+	for _, factor := range []float64{5, 2, 1} {
+		if factor*magnitude <= maxLength {
+			return factor * magnitude
+		}
+	}
+
+	return magnitude
+}
+
+// drawScaleBar draws a bar with 4 alternating black and white segments of the given length in pixels into the bottom left corner of the image.
+func drawScaleBar(img *image.RGBA, length int) {
+	bounds := img.Bounds()
+	thickness := max(4, bounds.Dx()/150)
+	margin := 2 * thickness
+	x0, y0 := bounds.Min.X+margin, bounds.Max.Y-margin-thickness
+	if length <= 0 || x0+length+1 > bounds.Max.X || y0-1 < bounds.Min.Y {
+		return
+	}
+
+	black, white := color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}
+
+	// Outline, so that the bar is visible on any background.
+	for x := x0 - 1; x <= x0+length; x++ {
+		img.SetRGBA(x, y0-1, black)
+		img.SetRGBA(x, y0+thickness, black)
+	}
+	for y := y0 - 1; y <= y0+thickness; y++ {
+		img.SetRGBA(x0-1, y, black)
+		img.SetRGBA(x0+length, y, black)
+	}
+
+	for x := 0; x < length; x++ {
+		c := white
+		if x*4/length%2 == 0 {
+			c = black
+		}
+		for y := 0; y < thickness; y++ {
+			img.SetRGBA(x0+x, y0+y, c)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"github.com/vugu/vgrouter"
+	"github.com/vugu/vugu"
+	js "github.com/vugu/vugu/js"
+)
+
+// Orthophoto is a rectified and metrically scaled image of a plane, like a facade.
+// The plane is fitted through a set of points, and the photos are projected onto it by using their solved pose and distortion.
+type Orthophoto struct {
+	vgrouter.NavigatorRef `json:"-"`
+
+	site *Site
+	key  string
+
+	CreatedAt time.Time
+
+	PointKeys []string // Points that define the plane.
+	PhotoKeys []string // Photos that are projected onto the plane.
+
+	UpVector            Coordinate         // Direction that is shown upwards in the image.
+	MillimetersPerPixel float64            // Size of a pixel on the plane.
+	Margin              Distance           // Extends the image beyond the area spanned by the points.
+	Interpolation       ImageInterpolation // Interpolation that is used to resample the photos.
+
+	result     OrthophotoInfo // Description of the last generated image.
+	resultPNG  []byte         // Last generated image.
+	resultBlob js.Value       // Blob representing the generated image on the js side.
+	resultURL  js.Value       // URL referencing the blob.
+}
+
+// OrthophotoInfo describes how the pixels of a generated orthophoto are placed in world space.
+// It is stored in a sidecar file next to the exported image.
+type OrthophotoInfo struct {
+	Orthophoto    string
+	Width, Height int        // Size of the image in pixels.
+	PixelSize     float64    // Edge length of a pixel on the plane in meters.
+	Origin        [3]float64 // World coordinate of the top left corner of the image.
+	Right, Down   [3]float64 // Unit vectors along the image axes in world space.
+	ScaleBar      float64    // Length of the scale bar in the bottom left corner in meters.
+}
+
+// OrthophotoPlaneResidual is the signed distance of a point to the fitted plane.
+type OrthophotoPlaneResidual struct {
+	Point    *Point
+	Distance Distance
+}
+
+func (s *Site) NewOrthophoto() *Orthophoto {
+	o := new(Orthophoto)
+	o.initData()
+	o.initReferences(s, s.shortIDGen.MustGenerate())
+
+	return o
+}
+
+// initData initializes the object with default values and other stuff.
+func (o *Orthophoto) initData() {
+	o.CreatedAt = time.Now()
+	o.UpVector = Coordinate{0, 0, 1}
+	o.MillimetersPerPixel = 5
+	o.Margin = 0.1
+	o.Interpolation = ImageInterpolationBilinear
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (o *Orthophoto) initReferences(newParent *Site, newKey string) {
+	o.site, o.key = newParent, newKey
+	o.site.Orthophotos[o.Key()] = o
+}
+
+func (o *Orthophoto) Key() string {
+	return o.key
+}
+
+// DisplayName returns either the name, or if that is empty the key.
+func (o *Orthophoto) DisplayName() string {
+	return "(" + o.Key() + ")"
+}
+
+func (o *Orthophoto) Delete() {
+	delete(o.site.Orthophotos, o.Key())
+
+	o.setResult(OrthophotoInfo{}, nil)
+}
+
+// Copy returns a copy of the given object.
+// Expensive data like images will not be copied, but referenced.
+func (o *Orthophoto) Copy(newParent *Site, newKey string) *Orthophoto {
+	copy := new(Orthophoto)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.CreatedAt = o.CreatedAt
+	copy.PointKeys = slices.Clone(o.PointKeys)
+	copy.PhotoKeys = slices.Clone(o.PhotoKeys)
+	copy.UpVector = o.UpVector
+	copy.MillimetersPerPixel = o.MillimetersPerPixel
+	copy.Margin = o.Margin
+	copy.Interpolation = o.Interpolation
+
+	return copy
+}
+
+func (o *Orthophoto) UnmarshalJSON(data []byte) error {
+	o.initData()
+
+	// Unmarshal structure normally. Cast it into a different type to prevent recursion with json.Unmarshal.
+	type tempType *Orthophoto
+	if err := json.Unmarshal(data, tempType(o)); err != nil {
+		return err
+	}
+
+	// Update parent references and keys.
+
+	return nil
+}
+
+// HasPoint returns whether the point with the given key is used to fit the plane.
+func (o *Orthophoto) HasPoint(key string) bool {
+	return slices.Contains(o.PointKeys, key)
+}
+
+// TogglePoint adds or removes the point with the given key.
+func (o *Orthophoto) TogglePoint(key string) {
+	if i := slices.Index(o.PointKeys, key); i >= 0 {
+		o.PointKeys = slices.Delete(o.PointKeys, i, i+1)
+	} else {
+		o.PointKeys = append(o.PointKeys, key)
+	}
+}
+
+// HasPhoto returns whether the photo with the given key is projected onto the plane.
+func (o *Orthophoto) HasPhoto(key string) bool {
+	return slices.Contains(o.PhotoKeys, key)
+}
+
+// TogglePhoto adds or removes the photo with the given key.
+func (o *Orthophoto) TogglePhoto(key string) {
+	if i := slices.Index(o.PhotoKeys, key); i >= 0 {
+		o.PhotoKeys = slices.Delete(o.PhotoKeys, i, i+1)
+	} else {
+		o.PhotoKeys = append(o.PhotoKeys, key)
+	}
+}
+
+// Points returns all existing points that define the plane.
+func (o *Orthophoto) Points() []*Point {
+	points := []*Point{}
+	for _, key := range o.PointKeys {
+		if point, ok := o.site.Points[key]; ok {
+			points = append(points, point)
+		}
+	}
+
+	return points
+}
+
+// Photos returns all existing photos that are projected onto the plane.
+func (o *Orthophoto) Photos() []*CameraPhoto {
+	photos := []*CameraPhoto{}
+	for _, key := range o.PhotoKeys {
+		for _, camera := range o.site.Cameras {
+			if photo, ok := camera.Photos[key]; ok {
+				photos = append(photos, photo)
+			}
+		}
+	}
+
+	return photos
+}
+
+// Plane returns the plane fitted through the points, and the distance of every point to it.
+// The normal of the plane points towards the photos, so that the orthophoto isn't mirrored.
+func (o *Orthophoto) Plane() (fittedPlane, []OrthophotoPlaneResidual, error) {
+	points := o.Points()
+	positions := make([]mgl64.Vec3, 0, len(points))
+	for _, point := range points {
+		positions = append(positions, point.Position.Vec3())
+	}
+
+	plane, err := fitPlane(positions)
+	if err != nil {
+		return fittedPlane{}, nil, err
+	}
+
+	var side float64
+	for _, photo := range o.Photos() {
+		side += plane.Distance(photo.Position.Vec3())
+	}
+	if side < 0 {
+		plane.Normal = plane.Normal.Mul(-1)
+	}
+
+	residuals := make([]OrthophotoPlaneResidual, 0, len(points))
+	for i, point := range points {
+		residuals = append(residuals, OrthophotoPlaneResidual{Point: point, Distance: Distance(plane.Distance(positions[i]))})
+	}
+
+	return plane, residuals, nil
+}
+
+// PlaneResiduals returns the distance of every point to the fitted plane, or nil if there is no plane.
+func (o *Orthophoto) PlaneResiduals() []OrthophotoPlaneResidual {
+	_, residuals, _ := o.Plane()
+	return residuals
+}
+
+// PlaneDescription returns a short summary of the plane fit.
+func (o *Orthophoto) PlaneDescription() string {
+	_, residuals, err := o.Plane()
+	if err != nil {
+		return fmt.Sprintf("There is no plane: %v.", err)
+	}
+
+	var sum, maxDistance float64
+	for _, r := range residuals {
+		sum, maxDistance = sum+r.Distance.Sqr(), max(maxDistance, math.Abs(r.Distance.Meters()))
+	}
+
+	return fmt.Sprintf("Plane fitted through %d points. The points are %.4g m RMS and at most %.4g m away from it.", len(residuals), math.Sqrt(sum/float64(len(residuals))), maxDistance)
+}
+
+// frame returns the placement of the image on the given plane.
+// The image covers the area spanned by the points plus the margin.
+func (o *Orthophoto) frame(plane fittedPlane) (orthophotoFrame, error) {
+	pixelSize := o.MillimetersPerPixel / 1000
+	if pixelSize <= 0 {
+		return orthophotoFrame{}, errors.New("the resolution has to be positive")
+	}
+
+	// Project the up vector into the plane. If it is perpendicular to the plane, like for floor plans, the Y axis is used instead.
+	up := mgl64.Vec3{}
+	for _, v := range []mgl64.Vec3{o.UpVector.Vec3(), {0, 1, 0}, {1, 0, 0}} {
+		if v.Len() == 0 {
+			continue
+		}
+		v = v.Normalize()
+		if up = v.Sub(plane.Normal.Mul(v.Dot(plane.Normal))); up.Len() > 1e-3 {
+			break
+		}
+	}
+	up = up.Normalize()
+	right := up.Cross(plane.Normal)
+
+	// Bounds of the points in plane coordinates.
+	uMin, uMax, vMin, vMax := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	for _, point := range o.Points() {
+		d := point.Position.Vec3().Sub(plane.Centroid)
+		u, v := d.Dot(right), d.Dot(up)
+		uMin, uMax, vMin, vMax = min(uMin, u), max(uMax, u), min(vMin, v), max(vMax, v)
+	}
+	margin := o.Margin.Meters()
+	uMin, uMax, vMin, vMax = uMin-margin, uMax+margin, vMin-margin, vMax+margin
+
+	width, height := math.Ceil((uMax-uMin)/pixelSize), math.Ceil((vMax-vMin)/pixelSize)
+	if !(width >= 1 && height >= 1) {
+		return orthophotoFrame{}, errors.New("the orthophoto would be empty")
+	}
+	if width*height > orthophotoMaxPixels {
+		return orthophotoFrame{}, fmt.Errorf("the orthophoto would have %.0f × %.0f pixels, choose a coarser resolution", width, height)
+	}
+
+	return orthophotoFrame{
+		Origin:    plane.Centroid.Add(right.Mul(uMin)).Add(up.Mul(vMax)),
+		Right:     right,
+		Down:      up.Mul(-1),
+		PixelSize: pixelSize,
+		Width:     int(width),
+		Height:    int(height),
+	}, nil
+}
+
+// Render projects the photos onto the fitted plane and returns the resulting image with a scale bar.
+func (o *Orthophoto) Render() (*image.RGBA, OrthophotoInfo, error) {
+	plane, _, err := o.Plane()
+	if err != nil {
+		return nil, OrthophotoInfo{}, err
+	}
+	frame, err := o.frame(plane)
+	if err != nil {
+		return nil, OrthophotoInfo{}, err
+	}
+
+	photos := o.Photos()
+	if len(photos) == 0 {
+		return nil, OrthophotoInfo{}, errors.New("there are no photos to project")
+	}
+	sources := make([]orthophotoSource, 0, len(photos))
+	for _, photo := range photos {
+		source, err := newOrthophotoSource(photo, o.Interpolation)
+		if err != nil {
+			return nil, OrthophotoInfo{}, err
+		}
+		sources = append(sources, source)
+	}
+
+	img := renderOrthophoto(frame, plane.Normal, sources)
+
+	// The scale bar spans about a quarter of the image width.
+	scaleBar := scaleBarLength(float64(frame.Width) * frame.PixelSize / 4)
+	drawScaleBar(img, int(math.Round(scaleBar/frame.PixelSize)))
+
+	info := OrthophotoInfo{
+		Orthophoto: o.Key(),
+		Width:      frame.Width,
+		Height:     frame.Height,
+		PixelSize:  frame.PixelSize,
+		Origin:     frame.Origin,
+		Right:      frame.Right,
+		Down:       frame.Down,
+		ScaleBar:   scaleBar,
+	}
+
+	return img, info, nil
+}
+
+// setResult replaces the last generated image.
+func (o *Orthophoto) setResult(info OrthophotoInfo, pngData []byte) {
+	if o.resultURL.Truthy() {
+		js.Global().Get("URL").Call("revokeObjectURL", o.resultURL)
+	}
+	o.result, o.resultPNG, o.resultBlob, o.resultURL = info, pngData, js.Value{}, js.Value{}
+
+	if pngData == nil {
+		return
+	}
+
+	dst := js.Global().Get("Uint8Array").New(len(pngData))
+	js.CopyBytesToJS(dst, pngData)
+	dstArray := js.Global().Get("Array").New(dst)
+
+	o.resultBlob = js.Global().Get("Blob").New(dstArray, js.ValueOf(map[string]interface{}{"type": "image/png"}))
+	o.resultURL = js.Global().Get("URL").Call("createObjectURL", o.resultBlob) // This has to be freed when the orthophoto is deleted or regenerated.
+}
+
+// ResultURL returns the URL of the last generated image, or an empty string.
+func (o *Orthophoto) ResultURL() string {
+	if !o.resultURL.Truthy() {
+		return ""
+	}
+
+	return o.resultURL.String()
+}
+
+// ResultDescription returns a short description of the last generated image.
+func (o *Orthophoto) ResultDescription() string {
+	info := o.result
+
+	return fmt.Sprintf("%d × %d pixels at %.4g mm per pixel (%.4g × %.4g m). The scale bar is %.4g m long, with 4 segments of %.4g m.",
+		info.Width, info.Height, info.PixelSize*1000, float64(info.Width)*info.PixelSize, float64(info.Height)*info.PixelSize, info.ScaleBar, info.ScaleBar/4)
+}
+
+func (o *Orthophoto) handleGenerate(event vugu.DOMEvent) {
+	img, info, err := o.Render()
+	if err != nil {
+		log.Printf("Couldn't generate orthophoto %s: %v", o.DisplayName(), err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		log.Printf("png.Encode failed: %v", err)
+		return
+	}
+
+	o.setResult(info, buf.Bytes())
+}
+
+func (o *Orthophoto) handleDownload(event vugu.DOMEvent) {
+	if o.resultPNG == nil {
+		return
+	}
+
+	sidecar, err := json.MarshalIndent(o.result, "", "\t")
+	if err != nil {
+		log.Printf("json.Marshal failed: %v", err)
+		return
+	}
+
+	name := fmt.Sprintf("%s orthophoto %s", o.site.Name, o.Key())
+	browserDownload(name+".png", o.resultPNG, "image/png")
+	browserDownload(name+".json", sidecar, "application/json")
+}
@@ -15,12 +15,17 @@
 
 package main
 
-import "github.com/vugu/vgrouter"
+import (
+	"github.com/vugu/vgrouter"
+	"github.com/vugu/vugu"
+)
 
 type PagePoints struct {
 	vgrouter.NavigatorRef `json:"-"`
 
 	Site *Site
+
+	selected map[string]bool // Keys of the points that are selected for optimization.
 }
 
 func (c *PagePoints) handleAdd() {
@@ -28,3 +33,23 @@ func (c *PagePoints) handleAdd() {
 
 	c.Navigate("/point/"+p.Key(), nil)
 }
+
+func (c *PagePoints) handleSelect(event vugu.DOMEvent, key string) {
+	if c.selected == nil {
+		c.selected = map[string]bool{}
+	}
+
+	c.selected[key] = event.PropBool("target", "checked")
+}
+
+// selection returns the points that are selected for optimization.
+func (c *PagePoints) selection() []OptimizerSelectable {
+	selection := []OptimizerSelectable{}
+	for _, point := range c.Site.PointsSorted() {
+		if c.selected[point.Key()] {
+			selection = append(selection, point)
+		}
+	}
+
+	return selection
+}
@@ -21,6 +21,7 @@ type PixelCoordinateComponent struct {
 	AttrMap vugu.AttrMap
 
 	BindValue *PixelCoordinate
+	Posterior *Posterior // Optional posterior that is used to show the uncertainty of the coordinate.
 
 	Editable, HideZ bool
 }
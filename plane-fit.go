@@ -0,0 +1,68 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"gonum.org/v1/gonum/mat"
+)
+
+// fittedPlane is a plane that is fitted through a set of points by least squares.
+type fittedPlane struct {
+	Centroid mgl64.Vec3 // Mean of all points, which lies on the plane.
+	Normal   mgl64.Vec3 // Unit normal vector.
+}
+
+// fitPlane returns the plane that minimizes the sum of the squared distances to the given points.
+// At least 3 points that aren't on a line are needed.
+func fitPlane(points []mgl64.Vec3) (fittedPlane, error) {
+	if len(points) < 3 {
+		return fittedPlane{}, fmt.Errorf("at least 3 points are needed to fit a plane, there are %d", len(points))
+	}
+
+	var centroid mgl64.Vec3
+	for _, p := range points {
+		centroid = centroid.Add(p)
+	}
+	centroid = centroid.Mul(1 / float64(len(points)))
+
+	// The normal is the direction with the least variance of the centered points.
+	centered := mat.NewDense(len(points), 3, nil)
+	for i, p := range points {
+		d := p.Sub(centroid)
+		centered.SetRow(i, d[:])
+	}
+	var svd mat.SVD
+	if !svd.Factorize(centered, mat.SVDThinV) {
+		return fittedPlane{}, errors.New("plane fit failed")
+	}
+	values := svd.Values(nil)
+	if values[1] <= 1e-9*values[0] {
+		return fittedPlane{}, errors.New("the points are on a line, they don't define a plane")
+	}
+	var v mat.Dense
+	svd.VTo(&v)
+
+	return fittedPlane{Centroid: centroid, Normal: mgl64.Vec3{v.At(0, 2), v.At(1, 2), v.At(2, 2)}.Normalize()}, nil
+}
+
+// Distance returns the signed distance of the given point to the plane.
+func (p fittedPlane) Distance(point mgl64.Vec3) float64 {
+	return point.Sub(p.Centroid).Dot(p.Normal)
+}
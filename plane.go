@@ -0,0 +1,364 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"github.com/vugu/vgrouter"
+	"github.com/vugu/vugu"
+)
+
+// Plane constrains a group of points to lie on a common plane, like a wall, floor or ceiling.
+// The plane contains all coordinates x with Normal·x = Offset, where the normal is normalized.
+type Plane struct {
+	vgrouter.NavigatorRef `json:"-"`
+
+	site *Site
+	key  string
+
+	Name      string
+	CreatedAt time.Time
+
+	PointKeys []string // Points that are on the plane.
+
+	Normal       Coordinate // Direction perpendicular to the plane. Its length doesn't matter.
+	NormalLocked bool       // Use the normal as it is, instead of optimizing it.
+	Offset       Distance   // Signed distance of the plane to the origin, along the normal.
+	OffsetLocked bool
+
+	Accuracy Distance // Expected distance of the points to the plane.
+}
+
+func (s *Site) NewPlane(name string) *Plane {
+	p := new(Plane)
+	p.initData()
+	p.initReferences(s, s.shortIDGen.MustGenerate())
+	p.Name = name
+
+	return p
+}
+
+// initData initializes the object with default values and other stuff.
+func (p *Plane) initData() {
+	p.CreatedAt = time.Now()
+	p.Normal = Coordinate{0, 0, 1}
+	p.Accuracy = 0.01
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (p *Plane) initReferences(newParent *Site, newKey string) {
+	p.site, p.key = newParent, newKey
+	p.site.Planes[p.Key()] = p
+}
+
+func (p *Plane) Key() string {
+	return p.key
+}
+
+// DisplayName returns either the name, or if that is empty the key.
+func (p *Plane) DisplayName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+
+	return "(" + p.Key() + ")"
+}
+
+func (p *Plane) Delete() {
+	delete(p.site.Planes, p.Key())
+}
+
+// Copy returns a copy of the given object.
+// Expensive data like images will not be copied, but referenced.
+func (p *Plane) Copy(newParent *Site, newKey string) *Plane {
+	copy := new(Plane)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.Name = p.Name
+	copy.CreatedAt = p.CreatedAt
+	copy.PointKeys = slices.Clone(p.PointKeys)
+	copy.Normal = p.Normal
+	copy.NormalLocked = p.NormalLocked
+	copy.Offset = p.Offset
+	copy.OffsetLocked = p.OffsetLocked
+	copy.Accuracy = p.Accuracy
+
+	return copy
+}
+
+func (p *Plane) UnmarshalJSON(data []byte) error {
+	p.initData()
+
+	// Unmarshal structure normally. Cast it into a different type to prevent recursion with json.Unmarshal.
+	type tempType *Plane
+	if err := json.Unmarshal(data, tempType(p)); err != nil {
+		return err
+	}
+
+	// Update parent references and keys.
+
+	return nil
+}
+
+// HasPoint returns whether the point with the given key is on the plane.
+func (p *Plane) HasPoint(key string) bool {
+	return slices.Contains(p.PointKeys, key)
+}
+
+// TogglePoint adds or removes the point with the given key.
+func (p *Plane) TogglePoint(key string) {
+	if i := slices.Index(p.PointKeys, key); i >= 0 {
+		p.PointKeys = slices.Delete(p.PointKeys, i, i+1)
+	} else {
+		p.PointKeys = append(p.PointKeys, key)
+	}
+}
+
+// Points returns all existing points that are on the plane.
+func (p *Plane) Points() []*Point {
+	points := []*Point{}
+	for _, key := range p.PointKeys {
+		if point, ok := p.site.Points[key]; ok {
+			points = append(points, point)
+		}
+	}
+
+	return points
+}
+
+// Distance returns the signed distance of the given point to the plane.
+func (p *Plane) Distance(point *Point) Distance {
+	normal := p.Normal.Vec3()
+	if normal.Len() == 0 {
+		return 0
+	}
+
+	return Distance(point.Position.Vec3().Dot(normal.Normalize())) - p.Offset
+}
+
+// FitToPoints sets the plane to the best fit through the current positions of its points.
+// A locked normal stays as it is, then only the offset is fitted.
+// This gives the optimizer a good starting point.
+func (p *Plane) FitToPoints() error {
+	points := p.Points()
+	positions := make([]mgl64.Vec3, 0, len(points))
+	for _, point := range points {
+		positions = append(positions, point.Position.Vec3())
+	}
+
+	normal := p.Normal.Vec3()
+	if !p.NormalLocked {
+		fitted, err := fitPlane(positions)
+		if err != nil {
+			return err
+		}
+		// Keep the side the normal is pointing to.
+		if fitted.Normal.Dot(normal) < 0 {
+			fitted.Normal = fitted.Normal.Mul(-1)
+		}
+		normal = fitted.Normal
+		p.Normal = Coordinate{Distance(normal[0]), Distance(normal[1]), Distance(normal[2])}
+	}
+
+	if !p.OffsetLocked && len(positions) > 0 && normal.Len() > 0 {
+		var sum float64
+		for _, position := range positions {
+			sum += position.Dot(normal.Normalize())
+		}
+		p.Offset = Distance(sum / float64(len(positions)))
+	}
+
+	return nil
+}
+
+// handleTogglePoint adds or removes the point with the given key, and refits an optimizable plane to give the optimizer a good starting point.
+func (p *Plane) handleTogglePoint(key string) {
+	p.TogglePoint(key)
+
+	if !p.NormalLocked && len(p.Points()) >= 3 {
+		p.FitToPoints()
+	}
+}
+
+func (p *Plane) handleFit(event vugu.DOMEvent) {
+	if err := p.FitToPoints(); err != nil {
+		log.Printf("Couldn't fit plane %s to its points: %v", p.DisplayName(), err)
+	}
+}
+
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (p *Plane) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	tweakables := []Tweakable{}
+	if !p.NormalLocked {
+		tweakables = append(tweakables, &p.Normal[0], &p.Normal[1], &p.Normal[2])
+	}
+	if !p.OffsetLocked {
+		tweakables = append(tweakables, &p.Offset)
+	}
+
+	return tweakables, []Residualer{p}
+}
+
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+// These are the signed distances of the points to the plane, in the order of the point keys.
+// An optimizable normal has one additional residual, which keeps its length at 1. Otherwise its length would be undetermined.
+func (p *Plane) Residuals() []float64 {
+	residuals := make([]float64, 0, len(p.PointKeys)+1)
+
+	normal := p.Normal.Vec3()
+	length := normal.Len()
+	if length == 0 {
+		for range p.PointKeys {
+			residuals = append(residuals, 1000)
+		}
+	} else {
+		unit := normal.Mul(1 / length)
+		for _, key := range p.PointKeys {
+			point, ok := p.site.Points[key]
+			if !ok {
+				residuals = append(residuals, 0)
+				continue
+			}
+			residuals = append(residuals, (point.Position.Vec3().Dot(unit)-p.Offset.Meters())/p.Accuracy.Meters())
+		}
+	}
+
+	if !p.NormalLocked {
+		residuals = append(residuals, length-1)
+	}
+
+	return residuals
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (p *Plane) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	normal := p.Normal.Vec3()
+	length := normal.Len()
+	if length == 0 {
+		return
+	}
+	unit := normal.Mul(1 / length)
+	accuracy := p.Accuracy.Meters()
+
+	for i, key := range p.PointKeys {
+		point, ok := p.site.Points[key]
+		if !ok {
+			continue
+		}
+		position := point.Position.Vec3()
+
+		// The derivative of the normalized normal is the projection onto the plane, divided by the length.
+		dNormal := position.Sub(unit.Mul(unit.Dot(position))).Mul(1 / (length * accuracy))
+		for j := 0; j < 3; j++ {
+			addFunc(i, &point.Position.Coordinate[j], unit[j]/accuracy)
+			addFunc(i, &p.Normal[j], dNormal[j])
+		}
+		addFunc(i, &p.Offset, -1/accuracy)
+	}
+
+	if !p.NormalLocked {
+		for j := 0; j < 3; j++ {
+			addFunc(len(p.PointKeys), &p.Normal[j], unit[j])
+		}
+	}
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (p *Plane) ResidualSqr() float64 {
+	return residualsSqr(p.Residuals())
+}
+
+// Outline returns the member points projected onto the plane, ordered along their convex hull.
+// This is used to show the plane as a polygon.
+func (p *Plane) Outline() []mgl64.Vec3 {
+	normal := p.Normal.Vec3()
+	if normal.Len() == 0 {
+		return nil
+	}
+	normal = normal.Normalize()
+
+	// Two axes inside the plane.
+	axis := mgl64.Vec3{1, 0, 0}
+	if normal.Cross(axis).Len() < 0.5 {
+		axis = mgl64.Vec3{0, 1, 0}
+	}
+	u := normal.Cross(axis).Normalize()
+	v := normal.Cross(u)
+
+	type planePoint struct {
+		position mgl64.Vec3
+		u, v     float64
+	}
+	points := []planePoint{}
+	for _, point := range p.Points() {
+		position := point.Position.Vec3()
+		projected := position.Sub(normal.Mul(position.Dot(normal) - p.Offset.Meters()))
+		points = append(points, planePoint{projected, projected.Dot(u), projected.Dot(v)})
+	}
+	if len(points) < 3 {
+		return nil
+	}
+
+	// Monotone chain convex hull, counterclockwise when looking against the normal.
+	slices.SortFunc(points, func(a, b planePoint) int {
+		if a.u != b.u {
+			if a.u < b.u {
+				return -1
+			}
+			return 1
+		}
+		if a.v < b.v {
+			return -1
+		} else if a.v > b.v {
+			return 1
+		}
+		return 0
+	})
+	cross := func(o, a, b planePoint) float64 {
+		return (a.u-o.u)*(b.v-o.v) - (a.v-o.v)*(b.u-o.u)
+	}
+	hull := make([]planePoint, 0, 2*len(points))
+	for _, point := range points {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], point) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, point)
+	}
+	for i, lower := len(points)-2, len(hull)+1; i >= 0; i-- {
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], points[i]) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, points[i])
+	}
+	hull = hull[:len(hull)-1]
+	if len(hull) < 3 {
+		return nil
+	}
+
+	outline := make([]mgl64.Vec3, 0, len(hull))
+	for _, point := range hull {
+		outline = append(outline, point.position)
+	}
+
+	return outline
+}
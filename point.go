@@ -32,6 +32,8 @@ type Point struct {
 	CreatedAt time.Time
 
 	Position CoordinateOptimizable
+
+	constraintLineKey string // Line that is selected in the UI to add a new line constraint to.
 }
 
 func (s *Site) NewPoint(name string) *Point {
@@ -136,6 +138,30 @@ func (p *Point) Lines() []*Line {
 	return lines
 }
 
+// LinePointConstraints returns a list of all constraints that tie this point to a line.
+func (p *Point) LinePointConstraints() []*LinePointConstraint {
+	constraints := make([]*LinePointConstraint, 0)
+
+	for _, line := range p.site.LinesSorted() {
+		for _, constraint := range line.PointConstraintsSorted() {
+			if constraint.PointKey == p.key {
+				constraints = append(constraints, constraint)
+			}
+		}
+	}
+
+	return constraints
+}
+
+func (p *Point) handleAddLinePointConstraint() {
+	line, ok := p.site.Lines[p.constraintLineKey]
+	if !ok {
+		return
+	}
+
+	line.NewPointConstraint(p.Key())
+}
+
 // RangefinderMeasurements returns a list of all Rangefinder measurements that are related to this point.
 func (p *Point) RangefinderMeasurements() []*RangefinderMeasurement {
 	measurements := make([]*RangefinderMeasurement, 0)
@@ -151,6 +177,21 @@ func (p *Point) RangefinderMeasurements() []*RangefinderMeasurement {
 	return measurements
 }
 
+// LevelMeasurements returns a list of all level measurements that are related to this point.
+func (p *Point) LevelMeasurements() []*LevelMeasurement {
+	measurements := make([]*LevelMeasurement, 0)
+
+	for _, level := range p.site.LevelsSorted() {
+		for _, measurement := range level.MeasurementsSorted() {
+			if measurement.P1 == p.key || measurement.P2 == p.key {
+				measurements = append(measurements, measurement)
+			}
+		}
+	}
+
+	return measurements
+}
+
 // TripodMeasurements returns a list of all tripod measurements that are related to this point.
 func (p *Point) TripodMeasurements() []*TripodMeasurement {
 	measurements := make([]*TripodMeasurement, 0)
@@ -165,3 +206,18 @@ func (p *Point) TripodMeasurements() []*TripodMeasurement {
 
 	return measurements
 }
+
+// TotalStationMeasurements returns a list of all total station measurements that are related to this point.
+func (p *Point) TotalStationMeasurements() []*TotalStationMeasurement {
+	measurements := make([]*TotalStationMeasurement, 0)
+
+	for _, totalStation := range p.site.TotalStationsSorted() {
+		for _, measurement := range totalStation.MeasurementsSorted() {
+			if measurement.PointKey == p.key {
+				measurements = append(measurements, measurement)
+			}
+		}
+	}
+
+	return measurements
+}
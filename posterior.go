@@ -0,0 +1,335 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Posterior contains the uncertainties of the optimized values, as determined after the last optimization.
+//
+// The covariances are scaled by the a posteriori variance factor.
+// Covariances are only stored between values of the same object, like the coordinates of a point or the pose of a photo.
+type Posterior struct {
+	VarianceFactor float64 // A posteriori variance of unit weight σ₀².
+	Redundancy     int     // Number of residuals minus the number of determined tweakables.
+	DatumDefect    int     // Number of directions in parameter space that aren't determined by any measurement.
+
+	covariances map[Tweakable]map[Tweakable]float64
+	residuals   []ResidualStatistics // Outlier test results, sorted by the normalized residual in descending order.
+}
+
+// posteriorGroups returns the lists of tweakables whose covariances are stored in the posterior.
+func posteriorGroups(site *Site) [][]Tweakable {
+	var groups [][]Tweakable
+
+	for _, point := range site.PointsSorted() {
+		tweakables, _ := point.GetTweakablesAndResiduals()
+		groups = append(groups, tweakables)
+	}
+
+	for _, camera := range site.CamerasSorted() {
+		photoTweakables := map[Tweakable]struct{}{}
+		for _, photo := range camera.PhotosSorted() {
+			tweakables, _ := photo.GetTweakablesAndResiduals()
+			groups = append(groups, tweakables)
+			for _, tweakable := range tweakables {
+				photoTweakables[tweakable] = struct{}{}
+			}
+		}
+
+		// Everything else is an intrinsic parameter of the camera.
+		var intrinsics []Tweakable
+		tweakables, _ := camera.GetTweakablesAndResiduals()
+		for _, tweakable := range tweakables {
+			if _, ok := photoTweakables[tweakable]; !ok {
+				intrinsics = append(intrinsics, tweakable)
+			}
+		}
+		groups = append(groups, intrinsics)
+	}
+
+	for _, tripod := range site.TripodsSorted() {
+		tweakables, _ := tripod.GetTweakablesAndResiduals()
+		groups = append(groups, tweakables)
+	}
+
+	for _, totalStation := range site.TotalStationsSorted() {
+		tweakables, _ := totalStation.GetTweakablesAndResiduals()
+		groups = append(groups, tweakables)
+	}
+
+	for _, plane := range site.PlanesSorted() {
+		tweakables, _ := plane.GetTweakablesAndResiduals()
+		groups = append(groups, tweakables)
+	}
+
+	return groups
+}
+
+// newPosterior creates a posterior from the covariance matrices of the given groups.
+func newPosterior(groups [][]Tweakable, covariances []*mat.SymDense) *Posterior {
+	p := &Posterior{covariances: map[Tweakable]map[Tweakable]float64{}}
+
+	for g, group := range groups {
+		covariance := covariances[g]
+		if covariance == nil {
+			continue
+		}
+		for i, a := range group {
+			row := map[Tweakable]float64{}
+			for j, b := range group {
+				row[b] = covariance.At(i, j)
+			}
+			p.covariances[a] = row
+		}
+	}
+
+	return p
+}
+
+// posteriorData is the serializable form of a posterior.
+// Tweakables and residualers are replaced by their index in the lists returned by Site.GetTweakablesAndResiduals.
+type posteriorData struct {
+	VarianceFactor float64
+	Redundancy     int
+	DatumDefect    int
+
+	Covariances []posteriorCovarianceData
+	Residuals   []posteriorResidualData
+}
+
+type posteriorCovarianceData struct {
+	A, B  int
+	Value jsonFloat // Can be infinite for values that aren't determined by the measurements.
+}
+
+type posteriorResidualData struct {
+	Residualer         int
+	Residual           float64
+	NormalizedResidual float64
+	RedundancyNumber   float64
+}
+
+// data returns the serializable form of the posterior.
+func (p *Posterior) data(tweakables []Tweakable, residuals []Residualer) posteriorData {
+	tweakableIndices := make(map[Tweakable]int, len(tweakables))
+	for i, tweakable := range tweakables {
+		tweakableIndices[tweakable] = i
+	}
+	residualIndices := make(map[Residualer]int, len(residuals))
+	for i, residual := range residuals {
+		residualIndices[residual] = i
+	}
+
+	d := posteriorData{VarianceFactor: p.VarianceFactor, Redundancy: p.Redundancy, DatumDefect: p.DatumDefect}
+
+	for a, row := range p.covariances {
+		for b, value := range row {
+			d.Covariances = append(d.Covariances, posteriorCovarianceData{A: tweakableIndices[a], B: tweakableIndices[b], Value: jsonFloat(value)})
+		}
+	}
+
+	for _, statistics := range p.residuals {
+		d.Residuals = append(d.Residuals, posteriorResidualData{
+			Residualer:         residualIndices[statistics.Residualer],
+			Residual:           statistics.Residual,
+			NormalizedResidual: statistics.NormalizedResidual,
+			RedundancyNumber:   statistics.RedundancyNumber,
+		})
+	}
+
+	return d
+}
+
+// posterior restores the posterior from its serializable form.
+// The given lists have to match the ones that were used to create the data.
+func (d posteriorData) posterior(tweakables []Tweakable, residuals []Residualer) *Posterior {
+	p := &Posterior{
+		VarianceFactor: d.VarianceFactor,
+		Redundancy:     d.Redundancy,
+		DatumDefect:    d.DatumDefect,
+		covariances:    map[Tweakable]map[Tweakable]float64{},
+	}
+
+	for _, covariance := range d.Covariances {
+		if covariance.A >= len(tweakables) || covariance.B >= len(tweakables) {
+			continue
+		}
+		a, b := tweakables[covariance.A], tweakables[covariance.B]
+		row, ok := p.covariances[a]
+		if !ok {
+			row = map[Tweakable]float64{}
+			p.covariances[a] = row
+		}
+		row[b] = float64(covariance.Value)
+	}
+
+	for _, statistics := range d.Residuals {
+		if statistics.Residualer >= len(residuals) {
+			continue
+		}
+		p.residuals = append(p.residuals, ResidualStatistics{
+			Residualer:         residuals[statistics.Residualer],
+			Residual:           statistics.Residual,
+			NormalizedResidual: statistics.NormalizedResidual,
+			RedundancyNumber:   statistics.RedundancyNumber,
+		})
+	}
+
+	return p
+}
+
+// ResidualStatistics returns the outlier test results of all tested measurements, the most suspect measurement first.
+func (p *Posterior) ResidualStatistics() []ResidualStatistics {
+	if p == nil {
+		return nil
+	}
+
+	return p.residuals
+}
+
+// Suspects returns the outlier test results of all measurements that failed the test, the most suspect measurement first.
+func (p *Posterior) Suspects() []ResidualStatistics {
+	var suspects []ResidualStatistics
+	for _, statistics := range p.ResidualStatistics() {
+		if statistics.Suspect() {
+			suspects = append(suspects, statistics)
+		}
+	}
+
+	return suspects
+}
+
+// Covariance returns the covariance between the two given values.
+// The result is only valid if both values were optimized and belong to the same object.
+func (p *Posterior) Covariance(a, b Tweakable) (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+
+	value, ok := p.covariances[a][b]
+	return value, ok
+}
+
+// StandardDeviation returns the standard deviation of the given value in optimizer space.
+// The result is infinite for values that aren't determined by the measurements.
+func (p *Posterior) StandardDeviation(t Tweakable) (float64, bool) {
+	variance, ok := p.Covariance(t, t)
+	if !ok {
+		return 0, false
+	}
+
+	return math.Sqrt(variance), true
+}
+
+// StandardDeviationText returns the formatted standard deviation of the given value, or an empty string if it is not known.
+func (p *Posterior) StandardDeviationText(t Tweakable) string {
+	sigma, ok := p.StandardDeviation(t)
+	if !ok {
+		return ""
+	}
+
+	switch t.(type) {
+	case *Distance:
+		return fmt.Sprintf("σ %.4f", sigma)
+	case *Angle:
+		return fmt.Sprintf("σ %.4f°", Angle(sigma).Degree())
+	case *PixelDistance:
+		return fmt.Sprintf("σ %.3f px", sigma)
+	}
+
+	_, sigma = tweakableDisplayValue(t, t.TweakableValue(), sigma)
+	return fmt.Sprintf("σ %.3g", sigma)
+}
+
+// tweakableDisplayValue converts a value and its standard deviation from optimizer space into the unit that is shown in the user interface.
+func tweakableDisplayValue(t Tweakable, value, sigma float64) (float64, float64) {
+	switch t.(type) {
+	case *Angle:
+		return Angle(value).Degree(), Angle(sigma).Degree()
+	case *TweakablePositiveFloat:
+		// The optimizer works on the logarithm, the standard deviation is propagated linearly.
+		value = math.Exp(value)
+		return value, value * sigma
+	}
+
+	return value, sigma
+}
+
+// CoordinateCovariance returns the 3×3 covariance matrix of the given coordinate.
+// Locked axes have a variance of zero.
+// The result is only valid if at least one axis was optimized.
+func (p *Posterior) CoordinateCovariance(c *CoordinateOptimizable) (*mat.SymDense, bool) {
+	covariance := mat.NewSymDense(3, nil)
+	valid := false
+
+	for i := range c.Coordinate {
+		for j := i; j < len(c.Coordinate); j++ {
+			if value, ok := p.Covariance(&c.Coordinate[i], &c.Coordinate[j]); ok {
+				covariance.SetSym(i, j, value)
+				valid = true
+			}
+		}
+	}
+
+	return covariance, valid
+}
+
+// ErrorEllipsoid describes the 1σ error ellipsoid of a coordinate.
+type ErrorEllipsoid struct {
+	SemiAxes [3]Distance   // Length of the semi-axes, sorted from the largest to the smallest.
+	Axes     [3]Coordinate // Unit direction of every semi-axis.
+}
+
+// ErrorEllipsoid returns the 1σ error ellipsoid of the given coordinate.
+func (p *Posterior) ErrorEllipsoid(c *CoordinateOptimizable) (ErrorEllipsoid, bool) {
+	covariance, ok := p.CoordinateCovariance(c)
+	if !ok {
+		return ErrorEllipsoid{}, false
+	}
+
+	var eigen mat.EigenSym
+	if ok := eigen.Factorize(covariance, true); !ok {
+		return ErrorEllipsoid{}, false
+	}
+	values := eigen.Values(nil)
+	var vectors mat.Dense
+	eigen.VectorsTo(&vectors)
+
+	// The eigenvalues are sorted in ascending order.
+	var ellipsoid ErrorEllipsoid
+	for i := 0; i < 3; i++ {
+		k := 2 - i
+		ellipsoid.SemiAxes[i] = Distance(math.Sqrt(math.Max(values[k], 0)))
+		ellipsoid.Axes[i] = Coordinate{Distance(vectors.At(0, k)), Distance(vectors.At(1, k)), Distance(vectors.At(2, k))}
+	}
+
+	return ellipsoid, true
+}
+
+// ErrorEllipsoidText returns the formatted semi-axes of the error ellipsoid of the given coordinate, or an empty string if it is not known.
+func (p *Posterior) ErrorEllipsoidText(c *CoordinateOptimizable) string {
+	ellipsoid, ok := p.ErrorEllipsoid(c)
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("Error ellipsoid: %.4f × %.4f × %.4f", ellipsoid.SemiAxes[0], ellipsoid.SemiAxes[1], ellipsoid.SemiAxes[2])
+}
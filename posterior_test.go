@@ -0,0 +1,252 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// newPosteriorTestSite returns an octahedron of 6 points around a center point, measured with a rangefinder with an accuracy of 1 cm.
+// The distances from the center along every axis are measured as 1 m plus the given error, in both directions.
+// If edges is set, the 12 edges of the octahedron are measured as well.
+func newPosteriorTestSite(errors Coordinate, edges bool) (*Site, *Point, []*Point) {
+	site := NewSite("posterior")
+
+	center := site.NewPoint("Center")
+	center.Position.Coordinate = Coordinate{0.001, -0.002, 0.003}
+
+	var outer []*Point
+	for axis := 0; axis < 3; axis++ {
+		for _, sign := range []Distance{1, -1} {
+			point := site.NewPoint("")
+			point.Position.Coordinate[axis] = sign
+			outer = append(outer, point)
+		}
+	}
+
+	rangefinder := site.NewRangefinder("Rangefinder")
+	rangefinder.Accuracy = 0.01
+	for i, point := range outer {
+		measurement := rangefinder.NewMeasurement()
+		measurement.P1, measurement.P2 = center.Key(), point.Key()
+		measurement.MeasuredDistance = 1 + errors[i/2]
+	}
+	if edges {
+		for i, a := range outer {
+			for _, b := range outer[i+1:] {
+				if a.Position.Distance(b.Position.Coordinate) < 1.5 {
+					measurement := rangefinder.NewMeasurement()
+					measurement.P1, measurement.P2 = a.Key(), b.Key()
+					measurement.MeasuredDistance = a.Position.Distance(b.Position.Coordinate)
+				}
+			}
+		}
+	}
+
+	return site, center, outer
+}
+
+// TestPosteriorFixedDatum checks the uncertainty of a point that is measured from 6 fixed points.
+func TestPosteriorFixedDatum(t *testing.T) {
+	errors := Coordinate{0.003, -0.005, 0.004}
+	site, center, outer := newPosteriorTestSite(errors, false)
+	for _, point := range outer {
+		point.Position.Locked = [3]bool{true, true, true}
+	}
+
+	if _, err := Optimize(site, nil, func(OptimizerProgress) bool { return false }); err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+	if center.Position.Coordinate.Vec3().Len() > 1e-9 {
+		t.Errorf("The center is at %v, want the origin", center.Position.Coordinate)
+	}
+
+	// Every pair of opposing measurements has two residuals of -error/accuracy.
+	// There are 6 measurements and 3 unknowns.
+	posterior := site.posterior
+	cost := 2 * errors.Vec3().LenSqr() / (0.01 * 0.01)
+	wantVarianceFactor := cost / 3
+	if posterior.Redundancy != 3 || posterior.DatumDefect != 0 {
+		t.Errorf("The redundancy is %d with a datum defect of %d, want 3 and 0", posterior.Redundancy, posterior.DatumDefect)
+	}
+	if math.Abs(posterior.VarianceFactor-wantVarianceFactor) > 1e-9*wantVarianceFactor {
+		t.Errorf("The variance factor is %v, want %v", posterior.VarianceFactor, wantVarianceFactor)
+	}
+
+	// Every axis is determined by two measurements with a standard deviation of 1 cm: σ² = σ₀²·(0.01 m)²/2.
+	wantVariance := wantVarianceFactor * 0.01 * 0.01 / 2
+	for i := range center.Position.Coordinate {
+		for j := range center.Position.Coordinate {
+			want := 0.0
+			if i == j {
+				want = wantVariance
+			}
+			if got, ok := posterior.Covariance(&center.Position.Coordinate[i], &center.Position.Coordinate[j]); !ok || math.Abs(got-want) > 1e-9*wantVariance {
+				t.Errorf("Covariance (%d, %d) of the center is %v, want %v", i, j, got, want)
+			}
+		}
+	}
+
+	for _, point := range outer {
+		if _, ok := posterior.StandardDeviation(&point.Position.Coordinate[0]); ok {
+			t.Errorf("Locked point %s has an uncertainty", point.Key())
+		}
+	}
+}
+
+// TestPosteriorFreeDatum checks the uncertainties of a network without any fixed point.
+// They are relative to an arbitrary datum, which has to be the one of the pseudo inverse of the normal equations.
+func TestPosteriorFreeDatum(t *testing.T) {
+	site, center, _ := newPosteriorTestSite(Coordinate{0.003, -0.005, 0.004}, true)
+
+	if _, err := Optimize(site, nil, func(OptimizerProgress) bool { return false }); err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+
+	// 7 points with 21 coordinates, 18 measurements, and 3 translations and 3 rotations that aren't determined.
+	posterior := site.posterior
+	if posterior.Redundancy != 3 || posterior.DatumDefect != 6 {
+		t.Errorf("The redundancy is %d with a datum defect of %d, want 3 and 6", posterior.Redundancy, posterior.DatumDefect)
+	}
+
+	tweakables, residuals := site.GetTweakablesAndResiduals()
+	columns := tweakableColumns(tweakables)
+	rowOffsets, m := residualRowOffsets(residuals)
+	var r []float64
+	for _, residual := range residuals {
+		r = append(r, residual.Residuals()...)
+	}
+	if wantVarianceFactor := residualsSqr(r) / 3; math.Abs(posterior.VarianceFactor-wantVarianceFactor) > 1e-6*wantVarianceFactor {
+		t.Errorf("The variance factor is %v, want %v", posterior.VarianceFactor, wantVarianceFactor)
+	}
+
+	rows := make([][]jacobianEntry, m)
+	residualJacobian(tweakables, columns, residuals, rowOffsets, r, rows)
+	normal, _ := schurTestNormalEquations(len(tweakables), rows, r)
+	pseudoInverse, defect := pseudoInverseSymmetric(normal)
+	if defect != 6 {
+		t.Fatalf("The normal equations have a defect of %d, want 6", defect)
+	}
+
+	for _, point := range site.PointsSorted() {
+		for i := range point.Position.Coordinate {
+			for j := range point.Position.Coordinate {
+				a, b := &point.Position.Coordinate[i], &point.Position.Coordinate[j]
+				want := posterior.VarianceFactor * pseudoInverse.At(columns[a], columns[b])
+				if got, ok := posterior.Covariance(a, b); !ok || math.Abs(got-want) > 1e-6*math.Abs(want)+1e-15 {
+					t.Errorf("Covariance (%d, %d) of point %s is %v, want %v", i, j, point.Key(), got, want)
+				}
+			}
+		}
+	}
+
+	// The error ellipsoid of the center is a sphere, as the network is symmetric.
+	if ellipsoid, ok := posterior.ErrorEllipsoid(&center.Position); !ok || ellipsoid.SemiAxes[0] <= 0 || math.Abs(float64(ellipsoid.SemiAxes[0]-ellipsoid.SemiAxes[2])) > 0.05*float64(ellipsoid.SemiAxes[0]) {
+		t.Errorf("The error ellipsoid of the center has the semi-axes %v, want a sphere", ellipsoid.SemiAxes)
+	}
+}
+
+// TestTweakableDisplayValue checks the conversion of values and standard deviations from optimizer space into the units of the user interface.
+func TestTweakableDisplayValue(t *testing.T) {
+	var angle Angle
+	var positive TweakablePositiveFloat
+	var float TweakableFloat
+	tests := []struct {
+		tweakable            Tweakable
+		value, sigma         float64
+		wantValue, wantSigma float64
+	}{
+		{&angle, math.Pi / 2, math.Pi / 180, 90, 1},
+		{&positive, math.Log(4), 0.01, 4, 0.04},
+		{&float, -0.05, 0.002, -0.05, 0.002},
+	}
+
+	for _, tt := range tests {
+		value, sigma := tweakableDisplayValue(tt.tweakable, tt.value, tt.sigma)
+		if math.Abs(value-tt.wantValue) > 1e-12 || math.Abs(sigma-tt.wantSigma) > 1e-12 {
+			t.Errorf("tweakableDisplayValue(%T, %v, %v) = %v, %v, want %v, %v", tt.tweakable, tt.value, tt.sigma, value, sigma, tt.wantValue, tt.wantSigma)
+		}
+	}
+}
+
+// TestPosteriorRedundancy checks that residuals which are always 0 don't count as observations.
+// Without any constraint, the redundancy is 3.
+func TestPosteriorRedundancy(t *testing.T) {
+	angle := func(degrees float64) func(site *Site, center *Point, outer []*Point) {
+		return func(site *Site, center *Point, outer []*Point) {
+			// The angle between the direction from the center to the first point and the x axis.
+			angleConstraint := site.NewAngleConstraint()
+			angleConstraint.A.P1, angleConstraint.A.P2 = center.Key(), outer[0].Key()
+			angleConstraint.B.P1, angleConstraint.B.P2 = outer[1].Key(), outer[0].Key()
+			angleConstraint.Angle.SetDegree(degrees)
+		}
+	}
+	onLine := func(end Coordinate, segment bool) func(site *Site, center *Point, outer []*Point) {
+		return func(site *Site, center *Point, outer []*Point) {
+			// A line from the first point to a fixed end point.
+			p2 := site.NewPoint("End")
+			p2.Position.Coordinate, p2.Position.Locked = end, [3]bool{true, true, true}
+			line := site.NewLine()
+			line.P1, line.P2 = outer[0].Key(), p2.Key()
+			constraint := line.NewPointConstraint(center.Key())
+			constraint.Segment = segment
+		}
+	}
+
+	totalStation := func(slopeDistance Distance) func(site *Site, center *Point, outer []*Point) {
+		return func(site *Site, center *Point, outer []*Point) {
+			// A fixed and oriented instrument that observes the center.
+			totalStation := site.NewTotalStation("Total station")
+			totalStation.Position.Coordinate, totalStation.Position.Locked = Coordinate{3, 2, 1}, [3]bool{true, true, true}
+			totalStation.OrientationLocked = true
+			measurement := totalStation.NewMeasurement()
+			measurement.PointKey = center.Key()
+			measurement.Hz, measurement.V, _, _ = totalStation.Polar(center.Position.Vec3())
+			measurement.SlopeDistance = slopeDistance
+		}
+	}
+
+	tests := []struct {
+		name           string
+		constrain      func(site *Site, center *Point, outer []*Point)
+		wantRedundancy int
+	}{
+		{"Perpendicular", angle(90), 4}, // Only the first residual is used.
+		{"Oblique", angle(40), 4},
+		{"Parallel", angle(0), 5}, // Parallel legs have two residuals.
+		{"On line", onLine(Coordinate{2, 0, 0}, false), 5},
+		{"Inside of segment", onLine(Coordinate{-2, 0, 0}, true), 5}, // The offset along the segment is 0.
+		{"Outside of segment", onLine(Coordinate{2, 0, 0}, true), 6},
+		{"Total station angles", totalStation(0), 5}, // Without a slope distance only the angles are used.
+		{"Total station distance", totalStation(3.7), 6},
+	}
+
+	for _, tt := range tests {
+		site, center, outer := newPosteriorTestSite(Coordinate{0.003, -0.005, 0.004}, false)
+		for _, point := range outer {
+			point.Position.Locked = [3]bool{true, true, true}
+		}
+		tt.constrain(site, center, outer)
+
+		if _, err := Optimize(site, nil, func(OptimizerProgress) bool { return false }); err != nil {
+			t.Fatalf("%s: Optimize() failed: %v", tt.name, err)
+		}
+		if got := site.posterior.Redundancy; got != tt.wantRedundancy {
+			t.Errorf("%s: The redundancy is %d, want %d", tt.name, got, tt.wantRedundancy)
+		}
+	}
+}
@@ -28,3 +28,13 @@ func Prompt(promptText string, bindValue GeneralInputValuer) {
 		bindValue.SetInputValue(result.String())
 	}
 }
+
+// Confirm opens a js confirmation dialog with the given text, and returns whether the user accepted it.
+func Confirm(text string) bool {
+	return js.Global().Call("confirm", text).Bool()
+}
+
+// Alert opens a js message dialog with the given text.
+func Alert(text string) {
+	js.Global().Call("alert", text)
+}
@@ -101,18 +101,54 @@ func (rm *RangefinderMeasurement) GetTweakablesAndResiduals() ([]Tweakable, []Re
 	return nil, []Residualer{rm}
 }
 
-// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
-func (rm *RangefinderMeasurement) ResidualSqr() float64 {
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+func (rm *RangefinderMeasurement) Residuals() []float64 {
+	site := rm.rangefinder.site
+
+	p1, ok := site.Points[rm.P1]
+	if !ok {
+		return []float64{0}
+	}
+	p2, ok := site.Points[rm.P2]
+	if !ok {
+		return []float64{0}
+	}
+
+	return []float64{float64((p1.Position.Distance(p2.Position.Coordinate) - rm.MeasuredDistance) / rm.rangefinder.Accuracy)}
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (rm *RangefinderMeasurement) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
 	site := rm.rangefinder.site
 
 	p1, ok := site.Points[rm.P1]
 	if !ok {
-		return 0
+		return
 	}
 	p2, ok := site.Points[rm.P2]
 	if !ok {
-		return 0
+		return
+	}
+
+	diff := p1.Position.Vec3().Sub(p2.Position.Vec3())
+	length := diff.Len()
+	if length == 0 {
+		return
 	}
 
-	return ((p1.Position.Distance(p2.Position.Coordinate) - rm.MeasuredDistance) / rm.rangefinder.Accuracy).Sqr() // TODO: Check if this can be optimized
+	for i := 0; i < 3; i++ {
+		derivative := diff[i] / length / rm.rangefinder.Accuracy.Meters()
+		addFunc(0, &p1.Position.Coordinate[i], derivative)
+		addFunc(0, &p2.Position.Coordinate[i], -derivative)
+	}
+}
+
+// EffectiveRobustLoss returns the robust loss function that is used for the residuals.
+func (rm *RangefinderMeasurement) EffectiveRobustLoss() RobustLoss {
+	return rm.rangefinder.EffectiveRobustLoss()
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (rm *RangefinderMeasurement) ResidualSqr() float64 {
+	return residualsSqr(rm.Residuals())
 }
@@ -32,7 +32,8 @@ type Rangefinder struct {
 	Name      string
 	CreatedAt time.Time
 
-	Accuracy Distance // Accuracy of the measurement.
+	Accuracy   Distance   // Accuracy of the measurement.
+	RobustLoss RobustLoss // Robust loss function for all measurements. Overrides the site's loss function.
 
 	Measurements map[string]*RangefinderMeasurement // List of measurements.
 }
@@ -50,6 +51,7 @@ func (s *Site) NewRangefinder(name string) *Rangefinder {
 func (r *Rangefinder) initData() {
 	r.CreatedAt = time.Now()
 	r.Accuracy = 0.01
+	r.RobustLoss = RobustLoss{Function: RobustLossFunctionSite, Threshold: 3}
 	r.Measurements = map[string]*RangefinderMeasurement{}
 }
 
@@ -80,6 +82,15 @@ func (r *Rangefinder) DisplayName() string {
 	return "(" + r.Key() + ")"
 }
 
+// EffectiveRobustLoss returns the robust loss function that is used for all measurements of this device.
+func (r *Rangefinder) EffectiveRobustLoss() RobustLoss {
+	if r.RobustLoss.Function == RobustLossFunctionSite {
+		return r.site.RobustLoss
+	}
+
+	return r.RobustLoss
+}
+
 func (r *Rangefinder) Delete() {
 	delete(r.site.Rangefinders, r.Key())
 }
@@ -93,6 +104,7 @@ func (r *Rangefinder) Copy(newParent *Site, newKey string) *Rangefinder {
 	copy.Name = r.Name
 	copy.CreatedAt = r.CreatedAt
 	copy.Accuracy = r.Accuracy
+	copy.RobustLoss = r.RobustLoss
 
 	// Generate copies of all children.
 	for k, v := range r.Measurements {
@@ -139,7 +151,10 @@ func (s *Rangefinder) MeasurementsSorted() []*RangefinderMeasurement {
 	}
 
 	sort.Slice(measurements, func(i, j int) bool {
-		return measurements[i].CreatedAt.After(measurements[j].CreatedAt)
+		if !measurements[i].CreatedAt.Equal(measurements[j].CreatedAt) {
+			return measurements[i].CreatedAt.After(measurements[j].CreatedAt)
+		}
+		return measurements[i].Key() < measurements[j].Key()
 	})
 
 	return measurements
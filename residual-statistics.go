@@ -0,0 +1,153 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Parameters of the outlier test.
+const (
+	dataSnoopingCriticalValue = 3.29 // Critical value of the normalized residual. This corresponds to a two-sided significance level of 0.1%.
+	minRedundancyNumber       = 1e-6 // Residuals with a smaller redundancy number aren't controlled by other measurements, and can't be tested.
+)
+
+// ResidualStatistics contains the result of the outlier test (data snooping) of a single measurement or photo mapping.
+type ResidualStatistics struct {
+	Residualer Residualer
+
+	Residual           float64 // Residual with the largest normalized residual. (Divided by the accuracy of the measurement device).
+	NormalizedResidual float64 // Baarda's test statistic w = v/√r. This is roughly normal distributed if the measurement is not a blunder.
+	RedundancyNumber   float64 // Part of an error in the measurement that shows up in its residual. Values close to 0 mean that the measurement is not controlled by other measurements.
+}
+
+// determineResidualStatistics runs the outlier test on all residuals.
+// The rows contain the jacobian of the residuals r, and inv is the inverse of the normal matrix built from the same jacobian.
+// Residualers whose residuals can't be tested are omitted.
+func determineResidualStatistics(residuals []Residualer, rowOffsets []int, r []float64, rows [][]jacobianEntry, inv *schurInverse) []ResidualStatistics {
+	var result []ResidualStatistics
+
+	for i, residual := range residuals {
+		end := len(r)
+		if i+1 < len(rowOffsets) {
+			end = rowOffsets[i+1]
+		}
+
+		statistics, tested := ResidualStatistics{Residualer: residual}, false
+		for row := rowOffsets[i]; row < end; row++ {
+			// The diagonal element of the hat matrix J·(JᵀJ)⁻¹·Jᵀ.
+			hat := 0.0
+			for _, e1 := range rows[row] {
+				for _, e2 := range rows[row] {
+					hat += e1.derivative * e2.derivative * inv.At(e1.column, e2.column)
+				}
+			}
+
+			redundancyNumber := 1 - hat
+			if math.IsNaN(redundancyNumber) || math.IsInf(redundancyNumber, 0) || redundancyNumber < minRedundancyNumber {
+				continue
+			}
+
+			normalizedResidual := r[row] / math.Sqrt(redundancyNumber)
+			if !tested || math.Abs(normalizedResidual) > math.Abs(statistics.NormalizedResidual) {
+				statistics.Residual, statistics.NormalizedResidual, statistics.RedundancyNumber = r[row], normalizedResidual, redundancyNumber
+				tested = true
+			}
+		}
+
+		if tested {
+			result = append(result, statistics)
+		}
+	}
+
+	// Sort by the normalized residual, the most suspect measurement first.
+	sort.SliceStable(result, func(i, j int) bool {
+		return math.Abs(result[i].NormalizedResidual) > math.Abs(result[j].NormalizedResidual)
+	})
+
+	return result
+}
+
+// Suspect returns whether the measurement failed the outlier test.
+func (rs ResidualStatistics) Suspect() bool {
+	return math.Abs(rs.NormalizedResidual) > dataSnoopingCriticalValue
+}
+
+// Description returns a human readable description of the measurement.
+func (rs ResidualStatistics) Description() string {
+	switch residualer := rs.Residualer.(type) {
+	case *RangefinderMeasurement:
+		return fmt.Sprintf("Rangefinder %s, measurement %s", residualer.rangefinder.DisplayName(), residualer.DisplayName())
+	case *LevelMeasurement:
+		return fmt.Sprintf("Level %s, measurement %s", residualer.level.DisplayName(), residualer.DisplayName())
+	case *TripodMeasurement:
+		return fmt.Sprintf("Tripod %s, measurement %s", residualer.tripod.DisplayName(), residualer.DisplayName())
+	case *TotalStationMeasurement:
+		return fmt.Sprintf("Total station %s, measurement %s", residualer.totalStation.DisplayName(), residualer.DisplayName())
+	case *CameraPhotoMapping:
+		pointName := "(" + residualer.PointKey + ")"
+		if point, ok := residualer.photo.camera.site.Points[residualer.PointKey]; ok {
+			pointName = point.DisplayName()
+		}
+		return fmt.Sprintf("Camera %s, photo %s, point %s", residualer.photo.camera.DisplayName(), residualer.photo.DisplayName(), pointName)
+	case *CameraPhotoIntrinsics:
+		return fmt.Sprintf("Camera %s, photo %s, intrinsic parameters", residualer.photo.camera.DisplayName(), residualer.photo.DisplayName())
+	case *Line:
+		return fmt.Sprintf("Line %s", residualer.DisplayName())
+	case *LinePointConstraint:
+		pointName := "-"
+		if point, ok := residualer.line.site.Points[residualer.PointKey]; ok {
+			pointName = point.DisplayName()
+		}
+		return fmt.Sprintf("Line %s, point %s", residualer.line.DisplayName(), pointName)
+	case *Plane:
+		return fmt.Sprintf("Plane %s", residualer.DisplayName())
+	case *AngleConstraint:
+		return fmt.Sprintf("Angle constraint %s", residualer.DisplayName())
+	}
+
+	return fmt.Sprintf("%T", rs.Residualer)
+}
+
+// Link returns the path of the editor of the measurement, or an empty string if there is none.
+func (rs ResidualStatistics) Link() string {
+	switch residualer := rs.Residualer.(type) {
+	case *RangefinderMeasurement:
+		return "/rangefinder/" + residualer.rangefinder.Key() + "/measurement/" + residualer.Key()
+	case *LevelMeasurement:
+		return "/level/" + residualer.level.Key() + "/measurement/" + residualer.Key()
+	case *TripodMeasurement:
+		return "/tripod/" + residualer.tripod.Key() + "/measurement/" + residualer.Key()
+	case *TotalStationMeasurement:
+		return "/total-station/" + residualer.totalStation.Key() + "/measurement/" + residualer.Key()
+	case *CameraPhotoMapping:
+		return "/camera/" + residualer.photo.camera.Key() + "/photo/" + residualer.photo.Key()
+	case *CameraPhotoIntrinsics:
+		return "/camera/" + residualer.photo.camera.Key() + "/photo/" + residualer.photo.Key()
+	case *Line:
+		return "/line/" + residualer.Key()
+	case *LinePointConstraint:
+		return "/line/" + residualer.line.Key()
+	case *Plane:
+		return "/plane/" + residualer.Key()
+	case *AngleConstraint:
+		return "/angle-constraint/" + residualer.Key()
+	}
+
+	return ""
+}
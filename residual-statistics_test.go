@@ -0,0 +1,105 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestDataSnooping injects a blunder into a redundant rangefinder network and checks that the outlier test finds it.
+func TestDataSnooping(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	site := NewSite("snooping")
+
+	// 4 fixed and 5 free points, where all distances between them are measured.
+	var points []*Point
+	for i := 0; i < 9; i++ {
+		point := site.NewPoint("")
+		point.Position.Coordinate = Coordinate{Distance(rng.Float64() * 10), Distance(rng.Float64() * 10), Distance(rng.Float64() * 10)}
+		if i < 4 {
+			point.Position.Locked = [3]bool{true, true, true}
+		}
+		points = append(points, point)
+	}
+
+	rangefinder := site.NewRangefinder("Rangefinder")
+	rangefinder.Accuracy = 0.01
+	measure := func(a, b *Point, err Distance) *RangefinderMeasurement {
+		measurement := rangefinder.NewMeasurement()
+		measurement.P1, measurement.P2 = a.Key(), b.Key()
+		measurement.MeasuredDistance = a.Position.Distance(b.Position.Coordinate) + err
+		return measurement
+	}
+
+	var clean []*RangefinderMeasurement
+	for i, a := range points {
+		for j, b := range points[i+1:] {
+			if i < 4 && i+1+j < 4 {
+				continue
+			}
+			clean = append(clean, measure(a, b, Distance(rng.NormFloat64()*0.003)))
+		}
+	}
+	blunder := clean[7]
+	clean = append(clean[:7], clean[8:]...)
+	blunder.MeasuredDistance += 0.1
+
+	// A point that is only determined by 3 distances to fixed points, those measurements aren't controlled by anything else.
+	uncontrolled := site.NewPoint("Uncontrolled")
+	uncontrolled.Position.Coordinate = Coordinate{5, 5, -5}
+	var unredundant []*RangefinderMeasurement
+	for _, point := range points[:3] {
+		unredundant = append(unredundant, measure(point, uncontrolled, 0))
+	}
+
+	// Move the free points away from their true positions.
+	for _, point := range append(points[4:], uncontrolled) {
+		for i := range point.Position.Coordinate {
+			point.Position.Coordinate[i] += Distance(rng.NormFloat64() * 0.05)
+		}
+	}
+
+	if _, err := Optimize(site, nil, func(OptimizerProgress) bool { return false }); err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+
+	statistics := site.posterior.ResidualStatistics()
+	if len(statistics) != len(clean)+1 {
+		t.Errorf("%d measurements were tested, want %d", len(statistics), len(clean)+1)
+	}
+	if len(statistics) == 0 || statistics[0].Residualer != blunder || !statistics[0].Suspect() {
+		t.Fatalf("The blunder isn't the most suspect measurement: %+v", statistics)
+	}
+	if w := statistics[0].NormalizedResidual; math.Abs(w) <= dataSnoopingCriticalValue {
+		t.Errorf("The blunder has a normalized residual of %v, want more than %v", w, dataSnoopingCriticalValue)
+	}
+
+	for _, s := range statistics[1:] {
+		if s.Suspect() {
+			t.Errorf("Clean measurement %s failed the outlier test with w = %v", s.Description(), s.NormalizedResidual)
+		}
+		if s.RedundancyNumber < minRedundancyNumber || s.RedundancyNumber > 1 {
+			t.Errorf("Measurement %s has a redundancy number of %v", s.Description(), s.RedundancyNumber)
+		}
+		for _, measurement := range unredundant {
+			if s.Residualer == measurement {
+				t.Errorf("Measurement %s isn't controlled by other measurements, but was tested", s.Description())
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "github.com/vugu/vugu"
+
+// RobustLossComponent lets the user select a robust loss function and its threshold.
+type RobustLossComponent struct {
+	AttrMap vugu.AttrMap
+
+	BindValue *RobustLoss
+	Options   SelectOptions // Selectable loss functions.
+}
+
+// thresholdVisible returns whether the selected loss function uses a threshold.
+func (c *RobustLossComponent) thresholdVisible() bool {
+	switch c.BindValue.Function {
+	case RobustLossFunctionSite, RobustLossFunctionNone:
+		return false
+	}
+
+	return true
+}
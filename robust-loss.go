@@ -0,0 +1,214 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "math"
+
+// RobustLossFunction describes a function that reduces the influence of large residuals on the solution.
+type RobustLossFunction string
+
+const (
+	RobustLossFunctionSite   RobustLossFunction = ""       // Use the robust loss function of the site. Only valid for devices.
+	RobustLossFunctionNone   RobustLossFunction = "None"   // Plain least squares.
+	RobustLossFunctionHuber  RobustLossFunction = "Huber"  // Quadratic for small residuals, linear for large ones.
+	RobustLossFunctionCauchy RobustLossFunction = "Cauchy" // Logarithmic growth for large residuals.
+	RobustLossFunctionTukey  RobustLossFunction = "Tukey"  // Residuals above the threshold are ignored completely.
+)
+
+// RobustLossFunctionOptions contains all selectable robust loss functions of a site.
+var RobustLossFunctionOptions = SelectOptions{
+	{string(RobustLossFunctionNone), "None (least squares)"},
+	{string(RobustLossFunctionHuber), "Huber"},
+	{string(RobustLossFunctionCauchy), "Cauchy"},
+	{string(RobustLossFunctionTukey), "Tukey"},
+}
+
+// RobustLossFunctionDeviceOptions contains all selectable robust loss functions of a device.
+var RobustLossFunctionDeviceOptions = append(SelectOptions{
+	{string(RobustLossFunctionSite), "Site default"},
+}, RobustLossFunctionOptions...)
+
+func (f RobustLossFunction) StringValue() string {
+	return string(f)
+}
+
+func (f *RobustLossFunction) SetStringValue(v string) {
+	*f = RobustLossFunction(v)
+}
+
+// RobustLoss describes a robust loss function and its threshold.
+type RobustLoss struct {
+	Function  RobustLossFunction
+	Threshold float64 // Residual length where the loss function starts to deviate from least squares. This is a multiple of the measurement accuracy.
+}
+
+// rho returns ρ(s) and its derivative ρ'(s) for the squared length s of a residual vector.
+//
+// All loss functions behave like least squares for small residuals, so that ρ(s) ≈ s.
+func (l RobustLoss) rho(s float64) (rho, rhoDerivative float64) {
+	c2 := l.Threshold * l.Threshold
+	if c2 <= 0 {
+		return s, 1
+	}
+
+	switch l.Function {
+	case RobustLossFunctionHuber:
+		if s <= c2 {
+			return s, 1
+		}
+		c, sqrtS := math.Sqrt(c2), math.Sqrt(s)
+		return 2*c*sqrtS - c2, c / sqrtS
+
+	case RobustLossFunctionCauchy:
+		return c2 * math.Log1p(s/c2), 1 / (1 + s/c2)
+
+	case RobustLossFunctionTukey:
+		if s >= c2 {
+			return c2 / 3, 0
+		}
+		t := 1 - s/c2
+		return c2 / 3 * (1 - t*t*t), t * t
+	}
+
+	return s, 1
+}
+
+// active returns whether the loss function differs from least squares.
+func (l RobustLoss) active() bool {
+	switch l.Function {
+	case RobustLossFunctionHuber, RobustLossFunctionCauchy, RobustLossFunctionTukey:
+		return l.Threshold > 0
+	}
+
+	return false
+}
+
+// Loss returns ρ(s) for the given sum of squared residuals.
+func (l RobustLoss) Loss(ssr float64) float64 {
+	rho, _ := l.rho(ssr)
+	return rho
+}
+
+// RobustLosser is implemented by residualers whose residuals are subject to a robust loss function.
+type RobustLosser interface {
+	EffectiveRobustLoss() RobustLoss // Returns the robust loss function that is used for the residuals.
+}
+
+// residualRobustLosses returns the robust loss function of every residualer.
+func residualRobustLosses(site *Site, residuals []Residualer) []RobustLoss {
+	losses := make([]RobustLoss, len(residuals))
+	for i, residual := range residuals {
+		if losser, ok := residual.(RobustLosser); ok {
+			losses[i] = losser.EffectiveRobustLoss()
+		} else {
+			losses[i] = site.RobustLoss
+		}
+	}
+
+	return losses
+}
+
+// robustLossesWarmStart returns a copy of the given loss functions where redescending functions are replaced by Huber's loss function.
+// Returns false if there are no redescending loss functions.
+func robustLossesWarmStart(losses []RobustLoss) ([]RobustLoss, bool) {
+	result, redescending := make([]RobustLoss, len(losses)), false
+	for i, loss := range losses {
+		result[i] = loss
+		if loss.Function == RobustLossFunctionTukey && loss.active() {
+			result[i].Function, redescending = RobustLossFunctionHuber, true
+		}
+	}
+
+	return result, redescending
+}
+
+// robustScale returns the factor f(s) = √(ρ(s)/s) that scales a residual vector with the squared length s, so that its squared length becomes ρ(s).
+// It also returns the derivative f'(s).
+func (l RobustLoss) robustScale(s float64) (f, fDerivative float64) {
+	if s <= 0 {
+		return 1, 0
+	}
+
+	rho, rhoDerivative := l.rho(s)
+	f = math.Sqrt(rho / s)
+
+	return f, (rhoDerivative*s - rho) / (2 * s * s * f)
+}
+
+// applyRobustLosses writes the robustified residuals of rRaw into dst.
+// Every residualer's residual vector r is scaled so that its squared length becomes ρ(|r|²).
+func applyRobustLosses(losses []RobustLoss, rowOffsets []int, rRaw, dst []float64) []float64 {
+	dst = append(dst[:0], rRaw...)
+
+	for i, loss := range losses {
+		if !loss.active() {
+			continue
+		}
+
+		block := robustLossBlock(rowOffsets, i, rRaw)
+		f, _ := loss.robustScale(residualsSqr(block))
+		for k := range block {
+			dst[rowOffsets[i]+k] *= f
+		}
+	}
+
+	return dst
+}
+
+// applyRobustLossesJacobian transforms the jacobian rows of the raw residuals rRaw into the jacobian of the robustified residuals.
+//
+// With the robustified residual vector r̃ = f(s)·r, its jacobian is J̃ = f(s)·J + 2·f'(s)·r·rᵀ·J.
+func applyRobustLossesJacobian(losses []RobustLoss, rowOffsets []int, rRaw []float64, rows [][]jacobianEntry) {
+	var rTJ []jacobianEntry
+
+	for i, loss := range losses {
+		if !loss.active() {
+			continue
+		}
+
+		block := robustLossBlock(rowOffsets, i, rRaw)
+		f, fDerivative := loss.robustScale(residualsSqr(block))
+
+		// Determine rᵀ·J.
+		rTJ = rTJ[:0]
+		for k, r := range block {
+			for _, entry := range rows[rowOffsets[i]+k] {
+				rTJ = addJacobianEntry(rTJ, entry.column, r*entry.derivative)
+			}
+		}
+
+		for k, r := range block {
+			row := rows[rowOffsets[i]+k]
+			for e := range row {
+				row[e].derivative *= f
+			}
+			for _, entry := range rTJ {
+				row = addJacobianEntry(row, entry.column, 2*fDerivative*r*entry.derivative)
+			}
+			rows[rowOffsets[i]+k] = row
+		}
+	}
+}
+
+// robustLossBlock returns the residuals of the i-th residualer.
+func robustLossBlock(rowOffsets []int, i int, r []float64) []float64 {
+	end := len(r)
+	if i+1 < len(rowOffsets) {
+		end = rowOffsets[i+1]
+	}
+
+	return r[rowOffsets[i]:end]
+}
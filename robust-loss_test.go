@@ -0,0 +1,119 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+var robustLossTestFunctions = []RobustLossFunction{RobustLossFunctionHuber, RobustLossFunctionCauchy, RobustLossFunctionTukey}
+
+func TestRobustLossRho(t *testing.T) {
+	tests := []struct {
+		loss RobustLoss
+		s    float64
+		want float64
+	}{
+		{RobustLoss{RobustLossFunctionNone, 2}, 100, 100},
+		{RobustLoss{RobustLossFunctionHuber, 0}, 100, 100},
+		{RobustLoss{RobustLossFunctionHuber, 2}, 3, 3},
+		{RobustLoss{RobustLossFunctionHuber, 2}, 16, 2*2*4 - 4},
+		{RobustLoss{RobustLossFunctionCauchy, 2}, 4, 4 * math.Log(2)},
+		{RobustLoss{RobustLossFunctionTukey, 2}, 2, 4.0 / 3 * (1 - 0.5*0.5*0.5)},
+		{RobustLoss{RobustLossFunctionTukey, 2}, 100, 4.0 / 3},
+	}
+
+	for _, tt := range tests {
+		if got := tt.loss.Loss(tt.s); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%v: Loss(%v) = %v, want %v", tt.loss, tt.s, got, tt.want)
+		}
+	}
+
+	// All functions behave like least squares for small residuals, and ρ'(s) is the derivative of ρ(s).
+	for _, function := range robustLossTestFunctions {
+		loss := RobustLoss{Function: function, Threshold: 2}
+		if rho, weight := loss.rho(1e-9); math.Abs(rho-1e-9) > 1e-15 || math.Abs(weight-1) > 1e-9 {
+			t.Errorf("%s: ρ(s) = %v, ρ'(s) = %v for a tiny residual, want least squares", function, rho, weight)
+		}
+
+		for _, s := range []float64{0.5, 3, 5, 20} {
+			const h = 1e-6
+			rhoPlus, _ := loss.rho(s + h)
+			rhoMinus, _ := loss.rho(s - h)
+			if _, weight := loss.rho(s); math.Abs(weight-(rhoPlus-rhoMinus)/(2*h)) > 1e-6 {
+				t.Errorf("%s: ρ'(%v) = %v, want %v", function, s, weight, (rhoPlus-rhoMinus)/(2*h))
+			}
+		}
+	}
+}
+
+// TestApplyRobustLossesJacobian checks the jacobian of the robustified residuals against finite differences.
+func TestApplyRobustLossesJacobian(t *testing.T) {
+	// Three residualers with two residuals each, some of them are beyond the threshold at x.
+	residuals := func(x []float64) []float64 {
+		return []float64{
+			x[0] + 0.5*x[1], x[1] * x[2],
+			3 * x[0] * x[0], x[2] - x[1],
+			math.Sin(x[0]) + 2, x[0] * x[1] * x[2],
+		}
+	}
+	jacobian := func(x []float64) [][]jacobianEntry {
+		return [][]jacobianEntry{
+			{{0, 1}, {1, 0.5}}, {{1, x[2]}, {2, x[1]}},
+			{{0, 6 * x[0]}}, {{1, -1}, {2, 1}},
+			{{0, math.Cos(x[0])}}, {{0, x[1] * x[2]}, {1, x[0] * x[2]}, {2, x[0] * x[1]}},
+		}
+	}
+	x := []float64{0.3, -0.7, 1.2}
+	rowOffsets := []int{0, 2, 4}
+
+	for _, function := range robustLossTestFunctions {
+		losses := []RobustLoss{{function, 1}, {function, 1}, {function, 3}}
+		rRaw := residuals(x)
+
+		r := applyRobustLosses(losses, rowOffsets, rRaw, nil)
+		for i, loss := range losses {
+			if got, want := residualsSqr(robustLossBlock(rowOffsets, i, r)), loss.Loss(residualsSqr(robustLossBlock(rowOffsets, i, rRaw))); math.Abs(got-want) > 1e-12 {
+				t.Errorf("%s: Residualer %d has a squared length of %v, want ρ(s) = %v", function, i, got, want)
+			}
+		}
+
+		rows := jacobian(x)
+		applyRobustLossesJacobian(losses, rowOffsets, rRaw, rows)
+
+		for column := range x {
+			const h = 1e-6
+			xPlus, xMinus := append([]float64(nil), x...), append([]float64(nil), x...)
+			xPlus[column] += h
+			xMinus[column] -= h
+			rPlus := applyRobustLosses(losses, rowOffsets, residuals(xPlus), nil)
+			rMinus := applyRobustLosses(losses, rowOffsets, residuals(xMinus), nil)
+
+			for row := range rows {
+				analytic := 0.0
+				for _, entry := range rows[row] {
+					if entry.column == column {
+						analytic += entry.derivative
+					}
+				}
+				if numeric := (rPlus[row] - rMinus[row]) / (2 * h); math.Abs(analytic-numeric) > 1e-6*math.Max(1, math.Abs(numeric)) {
+					t.Errorf("%s: Derivative of row %d with respect to column %d is %v, want %v", function, row, column, analytic, numeric)
+				}
+			}
+		}
+	}
+}
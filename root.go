@@ -94,3 +94,9 @@ func (r *Root) handleExport(event vugu.DOMEvent) {
 
 	browserDownload(fmt.Sprintf("%v.obj", globalSite.Name), data, "application/octet-stream")
 }
+
+func (r *Root) handleExportCSV(event vugu.DOMEvent) {
+	data := generateCSV(globalSite)
+
+	browserDownload(fmt.Sprintf("%v.csv", globalSite.Name), data, "text/csv")
+}
@@ -21,6 +21,7 @@ type RotationOptimizableComponent struct {
 	AttrMap vugu.AttrMap
 
 	BindValue *RotationOptimizable
+	Posterior *Posterior // Optional posterior that is used to show the uncertainty of the rotation.
 
 	Editable bool
 }
@@ -60,6 +60,12 @@ func vuguSetup(buildEnv *vugu.BuildEnv, eventEnv vugu.EventEnv) vugu.Builder {
 			root.sidebarDisplay = "none"
 		}))
 
+	router.MustAddRouteExact("/problems",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			root.Body = &PageProblems{Site: globalSite}
+			root.sidebarDisplay = "none"
+		}))
+
 	router.MustAddRouteExact("/points",
 		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
 			root.Body = &PagePoints{Site: globalSite}
@@ -104,6 +110,72 @@ func vuguSetup(buildEnv *vugu.BuildEnv, eventEnv vugu.EventEnv) vugu.Builder {
 			root.sidebarDisplay = "none"
 		}))
 
+	router.MustAddRouteExact("/orthophotos",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			root.Body = &PageOrthophotos{Site: globalSite}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRoute("/orthophoto/:key",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			keyParams := rm.Params["key"]
+			if len(keyParams) < 1 {
+				root.Body = &PageNotFound{}
+				return
+			}
+			key := keyParams[0]
+			if orthophoto, ok := globalSite.Orthophotos[key]; ok {
+				root.Body = orthophoto
+			} else {
+				root.Body = &PageNonExistant{}
+			}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRouteExact("/planes",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			root.Body = &PagePlanes{Site: globalSite}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRoute("/plane/:key",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			keyParams := rm.Params["key"]
+			if len(keyParams) < 1 {
+				root.Body = &PageNotFound{}
+				return
+			}
+			key := keyParams[0]
+			if plane, ok := globalSite.Planes[key]; ok {
+				root.Body = plane
+			} else {
+				root.Body = &PageNonExistant{}
+			}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRouteExact("/angle-constraints",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			root.Body = &PageAngleConstraints{Site: globalSite}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRoute("/angle-constraint/:key",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			keyParams := rm.Params["key"]
+			if len(keyParams) < 1 {
+				root.Body = &PageNotFound{}
+				return
+			}
+			key := keyParams[0]
+			if angleConstraint, ok := globalSite.AngleConstraints[key]; ok {
+				root.Body = angleConstraint
+			} else {
+				root.Body = &PageNonExistant{}
+			}
+			root.sidebarDisplay = "none"
+		}))
+
 	router.MustAddRouteExact("/cameras",
 		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
 			root.Body = &PageCameras{Site: globalSite}
@@ -190,6 +262,49 @@ func vuguSetup(buildEnv *vugu.BuildEnv, eventEnv vugu.EventEnv) vugu.Builder {
 			root.sidebarDisplay = "none"
 		}))
 
+	router.MustAddRouteExact("/levels",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			root.Body = &PageLevels{Site: globalSite}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRoute("/level/:key",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			keyParams := rm.Params["key"]
+			if len(keyParams) < 1 {
+				root.Body = &PageNotFound{}
+				return
+			}
+			key := keyParams[0]
+			if level, ok := globalSite.Levels[key]; ok {
+				root.Body = level
+			} else {
+				root.Body = &PageNonExistant{}
+			}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRoute("/level/:key1/measurement/:key2",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+
+			key1Params, key2Params := rm.Params["key1"], rm.Params["key2"]
+			if len(key1Params) < 1 || len(key2Params) < 1 {
+				root.Body = &PageNotFound{}
+				return
+			}
+			key1, key2 := key1Params[0], key2Params[0]
+			if level, ok := globalSite.Levels[key1]; ok {
+				if levelMeasurement, ok := level.Measurements[key2]; ok {
+					root.Body = levelMeasurement
+				} else {
+					root.Body = &PageNonExistant{}
+				}
+			} else {
+				root.Body = &PageNonExistant{}
+			}
+			root.sidebarDisplay = "none"
+		}))
+
 	router.MustAddRouteExact("/tripods",
 		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
 			root.Body = &PageTripods{Site: globalSite}
@@ -233,6 +348,49 @@ func vuguSetup(buildEnv *vugu.BuildEnv, eventEnv vugu.EventEnv) vugu.Builder {
 			root.sidebarDisplay = "none"
 		}))
 
+	router.MustAddRouteExact("/total-stations",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			root.Body = &PageTotalStations{Site: globalSite}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRoute("/total-station/:key",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+			keyParams := rm.Params["key"]
+			if len(keyParams) < 1 {
+				root.Body = &PageNotFound{}
+				return
+			}
+			key := keyParams[0]
+			if totalStation, ok := globalSite.TotalStations[key]; ok {
+				root.Body = totalStation
+			} else {
+				root.Body = &PageNonExistant{}
+			}
+			root.sidebarDisplay = "none"
+		}))
+
+	router.MustAddRoute("/total-station/:key1/measurement/:key2",
+		vgrouter.RouteHandlerFunc(func(rm *vgrouter.RouteMatch) {
+
+			key1Params, key2Params := rm.Params["key1"], rm.Params["key2"]
+			if len(key1Params) < 1 || len(key2Params) < 1 {
+				root.Body = &PageNotFound{}
+				return
+			}
+			key1, key2 := key1Params[0], key2Params[0]
+			if totalStation, ok := globalSite.TotalStations[key1]; ok {
+				if totalStationMeasurement, ok := totalStation.Measurements[key2]; ok {
+					root.Body = totalStationMeasurement
+				} else {
+					root.Body = &PageNonExistant{}
+				}
+			} else {
+				root.Body = &PageNonExistant{}
+			}
+			root.sidebarDisplay = "none"
+		}))
+
 	router.SetNotFound(vgrouter.RouteHandlerFunc(
 		func(rm *vgrouter.RouteMatch) {
 			root.Body = &PageNotFound{}
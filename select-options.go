@@ -0,0 +1,45 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// SelectOption is a single entry of a dropdown list.
+type SelectOption struct {
+	Key, Text string
+}
+
+// SelectOptions contains a list of sorted options that can be used with vgform.Select.
+type SelectOptions []SelectOption
+
+// KeyList implements vgform.KeyLister.
+func (o SelectOptions) KeyList() []string {
+	keys := make([]string, 0, len(o))
+	for _, option := range o {
+		keys = append(keys, option.Key)
+	}
+
+	return keys
+}
+
+// TextMap implements vgform.TextMapper.
+func (o SelectOptions) TextMap(key string) string {
+	for _, option := range o {
+		if option.Key == key {
+			return option.Text
+		}
+	}
+
+	return key
+}
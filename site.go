@@ -17,10 +17,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/go-gl/mathgl/mgl64"
 	"github.com/teris-io/shortid"
+	"github.com/vugu/vugu"
 )
 
 // Site is the root container for all measurements, points and constraints of a place/site.
@@ -30,15 +34,31 @@ type Site struct {
 	shortIDGen *shortid.Shortid
 
 	optimizerState OptimizerState
+	posterior      *Posterior // Uncertainties of the last optimization result.
 
 	Name string
 
+	// Optimizer settings.
+	OptimizerMethod            OptimizerMethod
+	OptimizerVerifyDerivatives bool       // Compare analytic derivatives with numeric ones before optimizing.
+	RobustLoss                 RobustLoss // Default robust loss function for all measurements and constraints.
+	UpAxis                     Coordinate // Direction that points up. Heights are measured along it.
+
+	OptimizerReport *OptimizerReport `json:",omitempty"` // Summary and convergence history of the last optimization.
+
 	// Geometry data and measurements.
-	Points       map[string]*Point
-	Lines        map[string]*Line
-	Cameras      map[string]*Camera
-	Rangefinders map[string]*Rangefinder
-	Tripods      map[string]*Tripod
+	Points           map[string]*Point
+	Lines            map[string]*Line
+	Planes           map[string]*Plane
+	AngleConstraints map[string]*AngleConstraint
+	Cameras          map[string]*Camera
+	Rangefinders     map[string]*Rangefinder
+	Levels           map[string]*Level
+	Tripods          map[string]*Tripod
+	TotalStations    map[string]*TotalStation
+
+	// Products derived from the geometry data.
+	Orthophotos map[string]*Orthophoto
 }
 
 func NewSite(name string) *Site {
@@ -64,11 +84,19 @@ func NewSiteFromJSON(data []byte) (*Site, error) {
 func (s *Site) initData() {
 	s.shortIDGen = shortid.MustNew(0, shortid.DefaultABC, 1234)
 	s.optimizerState.site = s
+	s.OptimizerMethod = OptimizerMethodLevenbergMarquardt
+	s.RobustLoss = RobustLoss{Function: RobustLossFunctionNone, Threshold: 3}
+	s.UpAxis = Coordinate{0, 0, 1}
 	s.Points = map[string]*Point{}
 	s.Lines = map[string]*Line{}
+	s.Planes = map[string]*Plane{}
+	s.AngleConstraints = map[string]*AngleConstraint{}
 	s.Cameras = map[string]*Camera{}
 	s.Rangefinders = map[string]*Rangefinder{}
+	s.Levels = map[string]*Level{}
 	s.Tripods = map[string]*Tripod{}
+	s.TotalStations = map[string]*TotalStation{}
+	s.Orthophotos = map[string]*Orthophoto{}
 }
 
 // Copy returns a copy of the given object.
@@ -78,6 +106,11 @@ func (s *Site) Copy() *Site {
 	copy.initData()
 	//copy.updateReferences(newParent, newKey)
 	copy.Name = s.Name
+	copy.OptimizerMethod = s.OptimizerMethod
+	copy.OptimizerVerifyDerivatives = s.OptimizerVerifyDerivatives
+	copy.RobustLoss = s.RobustLoss
+	copy.UpAxis = s.UpAxis
+	copy.OptimizerReport = s.OptimizerReport
 
 	// Generate copies of all children. Also update their parent reference and key.
 	for k, v := range s.Points {
@@ -86,15 +119,30 @@ func (s *Site) Copy() *Site {
 	for k, v := range s.Lines {
 		v.Copy(copy, k)
 	}
+	for k, v := range s.Planes {
+		v.Copy(copy, k)
+	}
+	for k, v := range s.AngleConstraints {
+		v.Copy(copy, k)
+	}
 	for k, v := range s.Cameras {
 		v.Copy(copy, k)
 	}
 	for k, v := range s.Rangefinders {
 		v.Copy(copy, k)
 	}
+	for k, v := range s.Levels {
+		v.Copy(copy, k)
+	}
 	for k, v := range s.Tripods {
 		v.Copy(copy, k)
 	}
+	for k, v := range s.TotalStations {
+		v.Copy(copy, k)
+	}
+	for k, v := range s.Orthophotos {
+		v.Copy(copy, k)
+	}
 
 	return copy
 }
@@ -115,19 +163,72 @@ func (s *Site) UnmarshalJSON(data []byte) error {
 	for k, v := range s.Lines {
 		v.initReferences(s, k)
 	}
+	for k, v := range s.Planes {
+		v.initReferences(s, k)
+	}
+	for k, v := range s.AngleConstraints {
+		v.initReferences(s, k)
+	}
 	for k, v := range s.Cameras {
 		v.initReferences(s, k)
 	}
 	for k, v := range s.Rangefinders {
 		v.initReferences(s, k)
 	}
+	for k, v := range s.Levels {
+		v.initReferences(s, k)
+	}
 	for k, v := range s.Tripods {
 		v.initReferences(s, k)
 	}
+	for k, v := range s.TotalStations {
+		v.initReferences(s, k)
+	}
+	for k, v := range s.Orthophotos {
+		v.initReferences(s, k)
+	}
 
 	return nil
 }
 
+func (s *Site) handleReportDownload(event vugu.DOMEvent) {
+	if s.OptimizerReport == nil {
+		return
+	}
+
+	browserDownload(fmt.Sprintf("%v optimizer report.txt", s.Name), []byte(s.OptimizerReport.Text()), "text/plain")
+}
+
+// UpDirection returns the normalized up axis of the site.
+func (s *Site) UpDirection() mgl64.Vec3 {
+	up := s.UpAxis.Vec3()
+	if up.Len() == 0 {
+		return mgl64.Vec3{0, 0, 1}
+	}
+
+	return up.Normalize()
+}
+
+// Height returns the height of the given coordinate along the up axis of the site.
+func (s *Site) Height(c Coordinate) Distance {
+	return Distance(c.Vec3().Dot(s.UpDirection()))
+}
+
+// HorizontalAxes returns two orthonormal directions that are perpendicular to the up axis of the site.
+// The first one is the x axis projected onto the horizontal plane, or the y axis if the up axis is close to the x axis.
+// Together with the up direction, both form a right-handed coordinate system.
+func (s *Site) HorizontalAxes() (mgl64.Vec3, mgl64.Vec3) {
+	up := s.UpDirection()
+
+	axis := mgl64.Vec3{1, 0, 0}
+	if up.Cross(axis).Len() < 0.5 {
+		axis = mgl64.Vec3{0, 1, 0}
+	}
+	first := axis.Sub(up.Mul(up.Dot(axis))).Normalize()
+
+	return first, up.Cross(first)
+}
+
 // Global site data structure that contains all data about a specific site/place.
 var globalSite *Site = NewSite("New")
 
@@ -145,6 +246,16 @@ func (s *Site) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
 		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
 	}
 
+	for _, plane := range s.PlanesSorted() {
+		newTweakables, newResiduals := plane.GetTweakablesAndResiduals()
+		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
+	}
+
+	for _, angleConstraint := range s.AngleConstraintsSorted() {
+		newTweakables, newResiduals := angleConstraint.GetTweakablesAndResiduals()
+		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
+	}
+
 	for _, camera := range s.CamerasSorted() {
 		newTweakables, newResiduals := camera.GetTweakablesAndResiduals()
 		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
@@ -155,15 +266,32 @@ func (s *Site) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
 		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
 	}
 
+	for _, level := range s.LevelsSorted() {
+		newTweakables, newResiduals := level.GetTweakablesAndResiduals()
+		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
+	}
+
 	for _, tripod := range s.TripodsSorted() {
 		newTweakables, newResiduals := tripod.GetTweakablesAndResiduals()
 		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
 	}
 
+	for _, totalStation := range s.TotalStationsSorted() {
+		newTweakables, newResiduals := totalStation.GetTweakablesAndResiduals()
+		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
+	}
+
 	return tweakables, residuals
 }
 
+// batchCreationDate returns the creation date of the i-th of several objects that are created at once.
+// The dates decrease by 1 ns, so that the lists sorted by date, newest first, show the objects in the order they were created in.
+func batchCreationDate(createdAt time.Time, i int) time.Time {
+	return createdAt.Add(-time.Duration(i))
+}
+
 // PointsSorted returns the points of the site as a list sorted by date.
+// Objects with the same creation date are sorted by their key, as the optimizer relies on the order being the same everywhere.
 // TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
 func (s *Site) PointsSorted() []*Point {
 	points := make([]*Point, 0, len(s.Points))
@@ -173,7 +301,10 @@ func (s *Site) PointsSorted() []*Point {
 	}
 
 	sort.Slice(points, func(i, j int) bool {
-		return points[i].CreatedAt.After(points[j].CreatedAt)
+		if !points[i].CreatedAt.Equal(points[j].CreatedAt) {
+			return points[i].CreatedAt.After(points[j].CreatedAt)
+		}
+		return points[i].Key() < points[j].Key()
 	})
 
 	return points
@@ -189,12 +320,53 @@ func (s *Site) LinesSorted() []*Line {
 	}
 
 	sort.Slice(lines, func(i, j int) bool {
-		return lines[i].CreatedAt.After(lines[j].CreatedAt)
+		if !lines[i].CreatedAt.Equal(lines[j].CreatedAt) {
+			return lines[i].CreatedAt.After(lines[j].CreatedAt)
+		}
+		return lines[i].Key() < lines[j].Key()
 	})
 
 	return lines
 }
 
+// PlanesSorted returns the planes of the site as a list sorted by date.
+// TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
+func (s *Site) PlanesSorted() []*Plane {
+	planes := make([]*Plane, 0, len(s.Planes))
+
+	for _, plane := range s.Planes {
+		planes = append(planes, plane)
+	}
+
+	sort.Slice(planes, func(i, j int) bool {
+		if !planes[i].CreatedAt.Equal(planes[j].CreatedAt) {
+			return planes[i].CreatedAt.After(planes[j].CreatedAt)
+		}
+		return planes[i].Key() < planes[j].Key()
+	})
+
+	return planes
+}
+
+// AngleConstraintsSorted returns the angle constraints of the site as a list sorted by date.
+// TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
+func (s *Site) AngleConstraintsSorted() []*AngleConstraint {
+	angleConstraints := make([]*AngleConstraint, 0, len(s.AngleConstraints))
+
+	for _, angleConstraint := range s.AngleConstraints {
+		angleConstraints = append(angleConstraints, angleConstraint)
+	}
+
+	sort.Slice(angleConstraints, func(i, j int) bool {
+		if !angleConstraints[i].CreatedAt.Equal(angleConstraints[j].CreatedAt) {
+			return angleConstraints[i].CreatedAt.After(angleConstraints[j].CreatedAt)
+		}
+		return angleConstraints[i].Key() < angleConstraints[j].Key()
+	})
+
+	return angleConstraints
+}
+
 // RangefindersSorted returns the rangefinders of the site as a list sorted by date.
 // TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
 func (s *Site) RangefindersSorted() []*Rangefinder {
@@ -205,12 +377,34 @@ func (s *Site) RangefindersSorted() []*Rangefinder {
 	}
 
 	sort.Slice(rangefinders, func(i, j int) bool {
-		return rangefinders[i].CreatedAt.After(rangefinders[j].CreatedAt)
+		if !rangefinders[i].CreatedAt.Equal(rangefinders[j].CreatedAt) {
+			return rangefinders[i].CreatedAt.After(rangefinders[j].CreatedAt)
+		}
+		return rangefinders[i].Key() < rangefinders[j].Key()
 	})
 
 	return rangefinders
 }
 
+// LevelsSorted returns the levels of the site as a list sorted by date.
+// TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
+func (s *Site) LevelsSorted() []*Level {
+	levels := make([]*Level, 0, len(s.Levels))
+
+	for _, level := range s.Levels {
+		levels = append(levels, level)
+	}
+
+	sort.Slice(levels, func(i, j int) bool {
+		if !levels[i].CreatedAt.Equal(levels[j].CreatedAt) {
+			return levels[i].CreatedAt.After(levels[j].CreatedAt)
+		}
+		return levels[i].Key() < levels[j].Key()
+	})
+
+	return levels
+}
+
 // CamerasSorted returns the cameras of the site as a list sorted by date.
 // TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
 func (s *Site) CamerasSorted() []*Camera {
@@ -221,7 +415,10 @@ func (s *Site) CamerasSorted() []*Camera {
 	}
 
 	sort.Slice(cameras, func(i, j int) bool {
-		return cameras[i].CreatedAt.After(cameras[j].CreatedAt)
+		if !cameras[i].CreatedAt.Equal(cameras[j].CreatedAt) {
+			return cameras[i].CreatedAt.After(cameras[j].CreatedAt)
+		}
+		return cameras[i].Key() < cameras[j].Key()
 	})
 
 	return cameras
@@ -237,8 +434,49 @@ func (s *Site) TripodsSorted() []*Tripod {
 	}
 
 	sort.Slice(tripods, func(i, j int) bool {
-		return tripods[i].CreatedAt.After(tripods[j].CreatedAt)
+		if !tripods[i].CreatedAt.Equal(tripods[j].CreatedAt) {
+			return tripods[i].CreatedAt.After(tripods[j].CreatedAt)
+		}
+		return tripods[i].Key() < tripods[j].Key()
 	})
 
 	return tripods
 }
+
+// TotalStationsSorted returns the total stations of the site as a list sorted by date.
+// TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
+func (s *Site) TotalStationsSorted() []*TotalStation {
+	totalStations := make([]*TotalStation, 0, len(s.TotalStations))
+
+	for _, totalStation := range s.TotalStations {
+		totalStations = append(totalStations, totalStation)
+	}
+
+	sort.Slice(totalStations, func(i, j int) bool {
+		if !totalStations[i].CreatedAt.Equal(totalStations[j].CreatedAt) {
+			return totalStations[i].CreatedAt.After(totalStations[j].CreatedAt)
+		}
+		return totalStations[i].Key() < totalStations[j].Key()
+	})
+
+	return totalStations
+}
+
+// OrthophotosSorted returns the orthophotos of the site as a list sorted by date.
+// TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
+func (s *Site) OrthophotosSorted() []*Orthophoto {
+	orthophotos := make([]*Orthophoto, 0, len(s.Orthophotos))
+
+	for _, orthophoto := range s.Orthophotos {
+		orthophotos = append(orthophotos, orthophoto)
+	}
+
+	sort.Slice(orthophotos, func(i, j int) bool {
+		if !orthophotos[i].CreatedAt.Equal(orthophotos[j].CreatedAt) {
+			return orthophotos[i].CreatedAt.After(orthophotos[j].CreatedAt)
+		}
+		return orthophotos[i].Key() < orthophotos[j].Key()
+	})
+
+	return orthophotos
+}
@@ -0,0 +1,295 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TotalStationObservation is a single observation as read from a raw file of a total station.
+type TotalStationObservation struct {
+	PointName     string
+	Hz, V         Angle
+	SlopeDistance Distance // 0 if only the angles were measured.
+	TargetHeight  Distance
+}
+
+// parseTotalStationObservations reads the observations of a raw file.
+// Leica GSI-8 and GSI-16 files are detected automatically, everything else is read as delimited text.
+// Text files have one observation per line with the columns point name, Hz, V, slope distance and target height, where the last two are optional.
+// Their angles are in degrees, or in gon if gon is set. Lines that start with # and lines with unreadable angles, like headers, are skipped.
+func parseTotalStationObservations(data []byte, gon bool) ([]TotalStationObservation, error) {
+	var observations []TotalStationObservation
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var observation TotalStationObservation
+		var ok bool
+		var err error
+		if isGSILine(line) {
+			observation, ok, err = parseGSILine(line)
+		} else {
+			observation, ok, err = parseTextObservationLine(line, gon)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if ok {
+			observations = append(observations, observation)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(observations) == 0 {
+		return nil, errors.New("the file doesn't contain any observations")
+	}
+
+	return observations, nil
+}
+
+// isGSILine returns whether the line consists of GSI words, which start with a two digit word index, followed by 4 information characters and a sign.
+func isGSILine(line string) bool {
+	line = strings.TrimPrefix(line, "*")
+	if len(line) < 8 {
+		return false
+	}
+	for _, c := range line[:2] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return line[6] == '+' || line[6] == '-'
+}
+
+// parseGSILine reads the point number (word 11), Hz (21), V (22), slope distance (31) and reflector height (87) of a GSI line.
+// Lines without angles, like station or coordinate records, are skipped.
+func parseGSILine(line string) (TotalStationObservation, bool, error) {
+	var observation TotalStationObservation
+	var hasHz, hasV bool
+
+	for _, word := range strings.Fields(strings.TrimPrefix(line, "*")) {
+		if len(word) < 8 {
+			return observation, false, fmt.Errorf("GSI word %q is too short", word)
+		}
+		index, unit, sign, value := word[:2], word[5], word[6], word[7:]
+
+		var err error
+		switch index {
+		case "11":
+			observation.PointName = strings.TrimLeft(value, "0")
+			if observation.PointName == "" {
+				observation.PointName = "0"
+			}
+		case "21":
+			observation.Hz, err = parseGSIAngle(unit, sign, value)
+			hasHz = true
+		case "22":
+			observation.V, err = parseGSIAngle(unit, sign, value)
+			hasV = true
+		case "31":
+			observation.SlopeDistance, err = parseGSIDistance(unit, sign, value)
+		case "87":
+			observation.TargetHeight, err = parseGSIDistance(unit, sign, value)
+		}
+		if err != nil {
+			return observation, false, fmt.Errorf("GSI word %q: %w", word, err)
+		}
+	}
+
+	return observation, hasHz && hasV, nil
+}
+
+// parseGSIValue returns the signed integer value of a GSI word.
+func parseGSIValue(sign byte, value string) (int64, error) {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if sign == '-' {
+		v = -v
+	}
+
+	return v, nil
+}
+
+// parseGSIAngle converts the value of a GSI angle word according to its unit.
+func parseGSIAngle(unit, sign byte, value string) (Angle, error) {
+	v, err := parseGSIValue(sign, value)
+	if err != nil {
+		return 0, err
+	}
+
+	var angle Angle
+	switch unit {
+	case '2': // 400 gon, in 0.00001 gon.
+		angle = Angle(float64(v) / 100000 * math.Pi / 200)
+	case '3': // 360° decimal, in 0.00001°.
+		angle.SetDegree(float64(v) / 100000)
+	case '4': // 360° sexagesimal, as dddmmss with tenths of seconds.
+		abs := v
+		if abs < 0 {
+			abs = -abs
+		}
+		deg := float64(abs/100000) + float64(abs/1000%100)/60 + float64(abs%1000)/10/3600
+		if v < 0 {
+			deg = -deg
+		}
+		angle.SetDegree(deg)
+	case '5': // 6400 mil, in 0.0001 mil.
+		angle = Angle(float64(v) / 10000 * math.Pi / 3200)
+	default:
+		return 0, fmt.Errorf("unknown angle unit %q", unit)
+	}
+
+	return angle, nil
+}
+
+// parseGSIDistance converts the value of a GSI distance word according to its unit.
+func parseGSIDistance(unit, sign byte, value string) (Distance, error) {
+	v, err := parseGSIValue(sign, value)
+	if err != nil {
+		return 0, err
+	}
+
+	switch unit {
+	case '0': // Meters, in mm.
+		return Distance(float64(v) / 1000), nil
+	case '1': // Feet, in 0.001 ft.
+		return Distance(float64(v) / 1000 * 0.3048), nil
+	case '6': // Meters, in 0.1 mm.
+		return Distance(float64(v) / 10000), nil
+	case '7': // Feet, in 0.0001 ft.
+		return Distance(float64(v) / 10000 * 0.3048), nil
+	case '8': // Meters, in 0.01 mm.
+		return Distance(float64(v) / 100000), nil
+	}
+
+	return 0, fmt.Errorf("unknown distance unit %q", unit)
+}
+
+// parseTextObservationLine reads a line of a delimited text file.
+// The columns can be separated by semicolons, tabs, commas or spaces. Decimal commas are allowed if the columns aren't separated by commas.
+// Lines whose angles can't be read are skipped, as they are most likely headers.
+func parseTextObservationLine(line string, gon bool) (TotalStationObservation, bool, error) {
+	var fields []string
+	switch {
+	case strings.Contains(line, ";"):
+		fields = strings.Split(line, ";")
+	case strings.Contains(line, "\t"):
+		fields = strings.Split(line, "\t")
+	case strings.Contains(line, ","):
+		fields = strings.Split(line, ",")
+	default:
+		fields = strings.Fields(line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 3 {
+		return TotalStationObservation{}, false, nil
+	}
+
+	parse := func(s string) (float64, error) {
+		return strconv.ParseFloat(strings.ReplaceAll(s, ",", "."), 64)
+	}
+	toAngle := func(v float64) Angle {
+		if gon {
+			return Angle(v * math.Pi / 200)
+		}
+		return Angle(v * math.Pi / 180)
+	}
+
+	hz, err := parse(fields[1])
+	if err != nil {
+		return TotalStationObservation{}, false, nil
+	}
+	v, err := parse(fields[2])
+	if err != nil {
+		return TotalStationObservation{}, false, nil
+	}
+	observation := TotalStationObservation{PointName: fields[0], Hz: toAngle(hz), V: toAngle(v)}
+
+	if len(fields) > 3 && fields[3] != "" {
+		slopeDistance, err := parse(fields[3])
+		if err != nil {
+			return observation, false, fmt.Errorf("invalid slope distance %q", fields[3])
+		}
+		observation.SlopeDistance = Distance(slopeDistance)
+	}
+	if len(fields) > 4 && fields[4] != "" {
+		targetHeight, err := parse(fields[4])
+		if err != nil {
+			return observation, false, fmt.Errorf("invalid target height %q", fields[4])
+		}
+		observation.TargetHeight = Distance(targetHeight)
+	}
+
+	return observation, true, nil
+}
+
+// ImportObservations adds a measurement for every observation.
+// The points are found by their name or key. Points that don't exist yet are created at the position given by the observation and the current setup of the total station.
+// It returns the new measurements and the number of created points.
+func (ts *TotalStation) ImportObservations(observations []TotalStationObservation) ([]*TotalStationMeasurement, int) {
+	pointsByName := map[string]*Point{}
+	for _, point := range ts.site.PointsSorted() {
+		pointsByName[point.Name] = point
+	}
+
+	createdAt := time.Now()
+
+	var measurements []*TotalStationMeasurement
+	var newPoints int
+	for i, observation := range observations {
+		measurement := ts.NewMeasurement()
+		measurement.CreatedAt = batchCreationDate(createdAt, i)
+		measurement.Hz, measurement.V = observation.Hz, observation.V
+		measurement.SlopeDistance, measurement.TargetHeight = observation.SlopeDistance, observation.TargetHeight
+		measurements = append(measurements, measurement)
+
+		point, ok := pointsByName[observation.PointName]
+		if !ok {
+			point, ok = ts.site.Points[observation.PointName]
+		}
+		if !ok {
+			point = ts.site.NewPoint(observation.PointName)
+			point.CreatedAt = measurement.CreatedAt
+			if position, ok := measurement.PolarPosition(); ok {
+				point.Position.Coordinate = position
+			}
+			pointsByName[point.Name] = point
+			newPoints++
+		}
+		measurement.PointKey = point.Key()
+	}
+
+	return measurements, newPoints
+}
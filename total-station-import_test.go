@@ -0,0 +1,176 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// testObservation describes an expected observation, with the angles in degrees.
+type testObservation struct {
+	pointName                   string
+	hz, v                       float64
+	slopeDistance, targetHeight float64
+}
+
+func TestParseTotalStationObservations(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		gon     bool
+		want    []testObservation
+		wantErr bool
+	}{
+		{
+			name: "GSI-16 in gon",
+			data: "*110001+0000000000000A01 21.322+0000000010000000 22.322+0000000009000000 31..00+0000000000012345 87..10+0000000000001500\n",
+			want: []testObservation{{"A01", 90, 81, 12.345, 1.5}},
+		},
+		{
+			name: "GSI-16 sexagesimal, second face",
+			data: "*110002+0000000000000012 21.324+0000000004530150 22.324+0000000027000000\n",
+			want: []testObservation{{"12", 45 + 30.0/60 + 15.0/3600, 270, 0, 0}},
+		},
+		{
+			name: "GSI-8 in decimal degrees, 0.1 mm",
+			data: "110003+000000P3 21.323+04500000 22.323+09000000 31..06+00123456\n",
+			want: []testObservation{{"P3", 45, 90, 12.3456, 0}},
+		},
+		{
+			name: "GSI in mil and feet",
+			data: "110004+00000004 21.325+16000000 22.325+16000000 31..01+00010000\n",
+			want: []testObservation{{"4", 90, 90, 3.048, 0}},
+		},
+		{
+			name: "GSI point number 0",
+			data: "110005+00000000 21.323+00000000 22.323+09000000\n",
+			want: []testObservation{{"0", 0, 90, 0, 0}},
+		},
+		{
+			name: "GSI records without angles are skipped",
+			data: "410001+00000000 42....+0000STN1\n110006+0000000B 21.323+01000000 22.323+09500000\n",
+			want: []testObservation{{"B", 10, 95, 0, 0}},
+		},
+		{
+			name:    "GSI with unknown angle unit",
+			data:    "110007+0000000B 21.329+01000000 22.323+09500000\n",
+			wantErr: true,
+		},
+		{
+			name:    "GSI with unknown distance unit",
+			data:    "110007+0000000B 21.323+01000000 22.323+09500000 31..09+00001000\n",
+			wantErr: true,
+		},
+		{
+			name:    "GSI with invalid value",
+			data:    "110007+0000000B 21.323+0100X000 22.323+09500000\n",
+			wantErr: true,
+		},
+		{
+			name: "Semicolons, header and decimal commas",
+			data: "Point;Hz;V;S;th\n# Comment\nA;100,5;99;12,3;1,2\nB;50;100;;\n",
+			gon:  true,
+			want: []testObservation{{"A", 90.45, 89.1, 12.3, 1.2}, {"B", 45, 90, 0, 0}},
+		},
+		{
+			name: "Spaces and commas",
+			data: "C 10 90 5\nD,20,80,6,0.1\n",
+			want: []testObservation{{"C", 10, 90, 5, 0}, {"D", 20, 80, 6, 0.1}},
+		},
+		{
+			name: "Tabs",
+			data: "E\t30.5\t91.25\t7.125\n",
+			want: []testObservation{{"E", 30.5, 91.25, 7.125, 0}},
+		},
+		{
+			name:    "No observations",
+			data:    "foo\n",
+			wantErr: true,
+		},
+		{
+			name:    "Empty file",
+			data:    "",
+			wantErr: true,
+		},
+		{
+			name:    "Invalid slope distance",
+			data:    "A;1;2;x\n",
+			wantErr: true,
+		},
+		{
+			name:    "Invalid target height",
+			data:    "A;1;2;3;x\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTotalStationObservations([]byte(tt.data), tt.gon)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTotalStationObservations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseTotalStationObservations() returned %d observations, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				observation := got[i]
+				if observation.PointName != want.pointName ||
+					math.Abs(observation.Hz.Degree()-want.hz) > 1e-9 || math.Abs(observation.V.Degree()-want.v) > 1e-9 ||
+					math.Abs(observation.SlopeDistance.Meters()-want.slopeDistance) > 1e-9 || math.Abs(observation.TargetHeight.Meters()-want.targetHeight) > 1e-9 {
+					t.Errorf("Observation %d is {%q %v° %v° %v m %v m}, want %v", i, observation.PointName, observation.Hz.Degree(), observation.V.Degree(), observation.SlopeDistance.Meters(), observation.TargetHeight.Meters(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestTotalStationImportObservations(t *testing.T) {
+	site := NewSite("import")
+	existing := site.NewPoint("A")
+	totalStation := site.NewTotalStation("Total station")
+	totalStation.InstrumentHeight = 1.5
+
+	observations := []TotalStationObservation{
+		{PointName: "A", Hz: Angle(1), V: Angle(1.5), SlopeDistance: 12.3},
+		{PointName: "B", Hz: Angle(2), V: Angle(1.4), SlopeDistance: 5, TargetHeight: 0.1},
+		{PointName: "C", Hz: Angle(3), V: Angle(1.6)},
+		{PointName: existing.Key(), Hz: Angle(4), V: Angle(1.5)},
+	}
+	measurements, created := totalStation.ImportObservations(observations)
+	if len(measurements) != len(observations) || created != 2 || len(site.Points) != 3 {
+		t.Fatalf("ImportObservations() returned %d measurements and %d new points, the site has %d points", len(measurements), created, len(site.Points))
+	}
+
+	// Existing points are found by name or key.
+	if measurements[0].PointKey != existing.Key() || measurements[3].PointKey != existing.Key() {
+		t.Errorf("Observations of existing points aren't assigned to them")
+	}
+
+	// New points are created at the observed position, if there is a distance.
+	if residuals := measurements[1].Residuals(); math.Abs(residuals[0])+math.Abs(residuals[1])+math.Abs(residuals[2]) > 1e-6 {
+		t.Errorf("New point isn't at the observed position, residuals %v", residuals)
+	}
+
+	// The order of the file is kept.
+	sorted := totalStation.MeasurementsSorted()
+	for i, measurement := range measurements {
+		if sorted[i] != measurement {
+			t.Errorf("Measurement %d isn't sorted in the order of the file", i)
+		}
+	}
+}
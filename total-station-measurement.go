@@ -0,0 +1,299 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"github.com/vugu/vgrouter"
+	"github.com/vugu/vugu"
+)
+
+// TotalStationMeasurement is a single observation of a point by a total station.
+type TotalStationMeasurement struct {
+	vgrouter.NavigatorRef `json:"-"`
+
+	totalStation *TotalStation
+	key          string
+
+	CreatedAt time.Time
+
+	PointKey      string
+	Hz            Angle    // Horizontal direction, read clockwise from the zero of the horizontal circle.
+	V             Angle    // Zenith angle. 0° points up, 90° is horizontal. Values above 180° were measured in the second face.
+	SlopeDistance Distance // Measured distance along the line of sight. 0 if only the angles were measured.
+	TargetHeight  Distance // Height of the reflector or target mark above the point.
+}
+
+func (ts *TotalStation) NewMeasurement() *TotalStationMeasurement {
+	tsm := new(TotalStationMeasurement)
+	tsm.initData()
+	tsm.initReferences(ts, ts.site.shortIDGen.MustGenerate())
+
+	return tsm
+}
+
+// initData initializes the object with default values and other stuff.
+func (tsm *TotalStationMeasurement) initData() {
+	tsm.CreatedAt = time.Now()
+	tsm.V = Angle(math.Pi / 2)
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (tsm *TotalStationMeasurement) initReferences(newParent *TotalStation, newKey string) {
+	tsm.totalStation, tsm.key = newParent, newKey
+	tsm.totalStation.Measurements[tsm.Key()] = tsm
+}
+
+func (tsm *TotalStationMeasurement) Key() string {
+	return tsm.key
+}
+
+// DisplayName returns either the name, or if that is empty the key.
+func (tsm *TotalStationMeasurement) DisplayName() string {
+	return "(" + tsm.Key() + ")"
+}
+
+func (tsm *TotalStationMeasurement) Delete() {
+	delete(tsm.totalStation.Measurements, tsm.Key())
+}
+
+// Copy returns a copy of the given object.
+// Expensive data like images will not be copied, but referenced.
+func (tsm *TotalStationMeasurement) Copy(newParent *TotalStation, newKey string) *TotalStationMeasurement {
+	copy := new(TotalStationMeasurement)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.CreatedAt = tsm.CreatedAt
+	copy.PointKey = tsm.PointKey
+	copy.Hz = tsm.Hz
+	copy.V = tsm.V
+	copy.SlopeDistance = tsm.SlopeDistance
+	copy.TargetHeight = tsm.TargetHeight
+
+	return copy
+}
+
+func (tsm *TotalStationMeasurement) UnmarshalJSON(data []byte) error {
+	tsm.initData()
+
+	// Unmarshal structure normally. Cast it into a different type to prevent recursion with json.Unmarshal.
+	type tempType *TotalStationMeasurement
+	if err := json.Unmarshal(data, tempType(tsm)); err != nil {
+		return err
+	}
+
+	// Update parent references and keys.
+
+	return nil
+}
+
+// FirstFace returns the horizontal direction and zenith angle reduced to the first face of the instrument.
+func (tsm *TotalStationMeasurement) FirstFace() (hz, v Angle) {
+	if v := tsm.V.Normalized(); v > math.Pi {
+		return (tsm.Hz + math.Pi).Normalized(), 2*math.Pi - v
+	}
+
+	return tsm.Hz.Normalized(), tsm.V.Normalized()
+}
+
+// target returns the point and the position of the target above it.
+func (tsm *TotalStationMeasurement) target() (*Point, mgl64.Vec3, bool) {
+	site := tsm.totalStation.site
+
+	point, ok := site.Points[tsm.PointKey]
+	if !ok {
+		return nil, mgl64.Vec3{}, false
+	}
+
+	return point, point.Position.Vec3().Add(site.UpDirection().Mul(tsm.TargetHeight.Meters())), true
+}
+
+// PolarPosition returns the position of the point as given by the observation and the current setup of the total station.
+// The result is false if no distance was measured.
+func (tsm *TotalStationMeasurement) PolarPosition() (Coordinate, bool) {
+	if tsm.SlopeDistance <= 0 {
+		return Coordinate{}, false
+	}
+
+	ts := tsm.totalStation
+	hz, v := tsm.FirstFace()
+	target := ts.InstrumentCenter().Add(ts.Direction(hz, v).Mul(tsm.SlopeDistance.Meters()))
+	position := target.Sub(ts.site.UpDirection().Mul(tsm.TargetHeight.Meters()))
+
+	return Coordinate{Distance(position[0]), Distance(position[1]), Distance(position[2])}, true
+}
+
+// UseAsBacksight rotates the horizontal circle of the total station, so that the observation matches the current position of its point.
+func (tsm *TotalStationMeasurement) UseAsBacksight() bool {
+	ts := tsm.totalStation
+
+	_, target, ok := tsm.target()
+	if !ok {
+		return false
+	}
+	computedHz, _, _, ok := ts.Polar(target)
+	if !ok {
+		return false
+	}
+
+	hz, _ := tsm.FirstFace()
+	ts.Orientation = (ts.Orientation + computedHz - hz).Normalized()
+
+	return true
+}
+
+func (tsm *TotalStationMeasurement) handleBacksight(event vugu.DOMEvent) {
+	tsm.UseAsBacksight()
+}
+
+// ObservationDescription returns the measured values as text.
+func (tsm *TotalStationMeasurement) ObservationDescription() string {
+	if tsm.SlopeDistance <= 0 {
+		return fmt.Sprintf("Hz %.4f°, V %.4f°", tsm.Hz.Degree(), tsm.V.Degree())
+	}
+
+	return fmt.Sprintf("Hz %.4f°, V %.4f°, %.4f m", tsm.Hz.Degree(), tsm.V.Degree(), tsm.SlopeDistance.Meters())
+}
+
+// CurrentDescription returns the observation as it would be measured with the current positions.
+func (tsm *TotalStationMeasurement) CurrentDescription() string {
+	_, target, ok := tsm.target()
+	if !ok {
+		return "Current: -"
+	}
+	hz, v, slopeDistance, ok := tsm.totalStation.Polar(target)
+	if !ok {
+		return "Current: -"
+	}
+
+	return fmt.Sprintf("Current: Hz %.4f°, V %.4f°, %.4f m", hz.Degree(), v.Degree(), slopeDistance.Meters())
+}
+
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (tsm *TotalStationMeasurement) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	return nil, []Residualer{tsm}
+}
+
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+// These are the differences of the horizontal direction, the zenith angle and the slope distance.
+// The residual of the slope distance is 0 if no distance was measured.
+func (tsm *TotalStationMeasurement) Residuals() []float64 {
+	ts := tsm.totalStation
+
+	_, target, ok := tsm.target()
+	if !ok {
+		return []float64{0, 0, 0}
+	}
+	computedHz, computedV, computedDistance, ok := ts.Polar(target)
+	if !ok {
+		return []float64{1000, 1000, 1000}
+	}
+
+	hz, v := tsm.FirstFace()
+	residuals := []float64{
+		math.Remainder((computedHz-hz).Radian(), 2*math.Pi) / ts.HzAccuracy.Radian(),
+		(computedV - v).Radian() / ts.VAccuracy.Radian(),
+		0,
+	}
+
+	// The horizontal direction is undefined directly above or below the instrument.
+	if computedV == 0 || computedV == math.Pi {
+		residuals[0] = 0
+	}
+
+	if tsm.SlopeDistance > 0 {
+		residuals[2] = (computedDistance - tsm.SlopeDistance).Meters() / ts.DistanceAccuracy.Meters()
+	}
+
+	return residuals
+}
+
+// ActiveResiduals returns the number of residuals that can be non-zero.
+// Observations without a slope distance only use the two angles.
+func (tsm *TotalStationMeasurement) ActiveResiduals() int {
+	if _, _, ok := tsm.target(); !ok {
+		return 0
+	}
+	if tsm.SlopeDistance <= 0 {
+		return 2
+	}
+
+	return 3
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (tsm *TotalStationMeasurement) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	ts := tsm.totalStation
+	site := ts.site
+
+	point, target, ok := tsm.target()
+	if !ok {
+		return
+	}
+
+	first, second := site.HorizontalAxes()
+	up := site.UpDirection()
+
+	d := target.Sub(ts.InstrumentCenter())
+	distance := d.Len()
+	if distance == 0 {
+		return
+	}
+	h1, h2, z := d.Dot(first), d.Dot(second), d.Dot(up)
+	horizontal := math.Hypot(h1, h2)
+
+	// All residuals depend on d = target - instrument center.
+	add := func(residualIndex int, gradient mgl64.Vec3) {
+		for i := 0; i < 3; i++ {
+			addFunc(residualIndex, &point.Position.Coordinate[i], gradient[i])
+			addFunc(residualIndex, &ts.Position.Coordinate[i], -gradient[i])
+		}
+		addFunc(residualIndex, &ts.InstrumentHeight, -gradient.Dot(up))
+	}
+
+	if horizontal > 0 {
+		// The horizontal direction is atan2(-h2, h1) minus the orientation.
+		gradientHz := first.Mul(h2).Sub(second.Mul(h1)).Mul(1 / (horizontal * horizontal * ts.HzAccuracy.Radian()))
+		add(0, gradientHz)
+		addFunc(0, &ts.Orientation, -1/ts.HzAccuracy.Radian())
+
+		// The zenith angle is atan2(horizontal, z).
+		horizontalDirection := first.Mul(h1).Add(second.Mul(h2)).Mul(1 / horizontal)
+		gradientV := horizontalDirection.Mul(z).Sub(up.Mul(horizontal)).Mul(1 / (distance * distance * ts.VAccuracy.Radian()))
+		add(1, gradientV)
+	}
+
+	if tsm.SlopeDistance > 0 {
+		add(2, d.Mul(1/(distance*ts.DistanceAccuracy.Meters())))
+	}
+}
+
+// EffectiveRobustLoss returns the robust loss function that is used for the residuals.
+func (tsm *TotalStationMeasurement) EffectiveRobustLoss() RobustLoss {
+	return tsm.totalStation.EffectiveRobustLoss()
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (tsm *TotalStationMeasurement) ResidualSqr() float64 {
+	return residualsSqr(tsm.Residuals())
+}
@@ -0,0 +1,275 @@
+// Copyright (C) 2025 David Vogel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl64"
+	"github.com/vugu/vgrouter"
+	"github.com/vugu/vugu"
+	js "github.com/vugu/vugu/js"
+)
+
+// TotalStation is an instrument that measures the horizontal direction, the zenith angle and the slope distance to points.
+// The instrument is assumed to be leveled, so its vertical axis is the up axis of the site.
+type TotalStation struct {
+	vgrouter.NavigatorRef `json:"-"`
+
+	site *Site
+	key  string
+
+	Name      string
+	CreatedAt time.Time
+
+	Position               CoordinateOptimizable // Ground mark the instrument is set up over.
+	InstrumentHeight       Distance              // Height of the tilting axis above the ground mark.
+	InstrumentHeightLocked bool                  // Prevent the value from being optimized.
+	Orientation            Angle                 // Direction of the zero of the horizontal circle. Measured clockwise from the first horizontal axis of the site when looking down.
+	OrientationLocked      bool                  // Prevent the value from being optimized.
+
+	HzAccuracy       Angle      // Accuracy of the horizontal directions.
+	VAccuracy        Angle      // Accuracy of the zenith angles.
+	DistanceAccuracy Distance   // Accuracy of the slope distances.
+	RobustLoss       RobustLoss // Robust loss function for all measurements. Overrides the site's loss function.
+
+	Measurements map[string]*TotalStationMeasurement // List of measurements.
+
+	importGon bool // Angles in imported text files are in gon instead of degrees.
+}
+
+func (s *Site) NewTotalStation(name string) *TotalStation {
+	ts := new(TotalStation)
+	ts.initData()
+	ts.initReferences(s, s.shortIDGen.MustGenerate())
+	ts.Name = name
+
+	return ts
+}
+
+// initData initializes the object with default values and other stuff.
+func (ts *TotalStation) initData() {
+	ts.CreatedAt = time.Now()
+	ts.InstrumentHeightLocked = true
+	ts.HzAccuracy.SetDegree(5.0 / 3600)
+	ts.VAccuracy.SetDegree(5.0 / 3600)
+	ts.DistanceAccuracy = 0.003
+	ts.RobustLoss = RobustLoss{Function: RobustLossFunctionSite, Threshold: 3}
+	ts.Measurements = map[string]*TotalStationMeasurement{}
+}
+
+// initReferences updates references from and to this object and its key.
+// This is only used internally to update references for copies or marshalled objects.
+// This can't be used on its own to transfer an object from one parent to another.
+func (ts *TotalStation) initReferences(newParent *Site, newKey string) {
+	ts.site, ts.key = newParent, newKey
+	ts.site.TotalStations[ts.Key()] = ts
+}
+
+func (ts *TotalStation) handleAdd(event vugu.DOMEvent) {
+	measurement := ts.NewMeasurement()
+
+	ts.Navigate("/total-station/"+ts.Key()+"/measurement/"+measurement.Key(), nil)
+}
+
+func (ts *TotalStation) Key() string {
+	return ts.key
+}
+
+// DisplayName returns either the name, or if that is empty the key.
+func (ts *TotalStation) DisplayName() string {
+	if ts.Name != "" {
+		return ts.Name
+	}
+
+	return "(" + ts.Key() + ")"
+}
+
+// EffectiveRobustLoss returns the robust loss function that is used for all measurements of this device.
+func (ts *TotalStation) EffectiveRobustLoss() RobustLoss {
+	if ts.RobustLoss.Function == RobustLossFunctionSite {
+		return ts.site.RobustLoss
+	}
+
+	return ts.RobustLoss
+}
+
+func (ts *TotalStation) Delete() {
+	delete(ts.site.TotalStations, ts.Key())
+}
+
+// Copy returns a copy of the given object.
+// Expensive data like images will not be copied, but referenced.
+func (ts *TotalStation) Copy(newParent *Site, newKey string) *TotalStation {
+	copy := new(TotalStation)
+	copy.initData()
+	copy.initReferences(newParent, newKey)
+	copy.Name = ts.Name
+	copy.CreatedAt = ts.CreatedAt
+	copy.Position = ts.Position
+	copy.InstrumentHeight = ts.InstrumentHeight
+	copy.InstrumentHeightLocked = ts.InstrumentHeightLocked
+	copy.Orientation = ts.Orientation
+	copy.OrientationLocked = ts.OrientationLocked
+	copy.HzAccuracy = ts.HzAccuracy
+	copy.VAccuracy = ts.VAccuracy
+	copy.DistanceAccuracy = ts.DistanceAccuracy
+	copy.RobustLoss = ts.RobustLoss
+
+	// Generate copies of all children.
+	for k, v := range ts.Measurements {
+		v.Copy(copy, k)
+	}
+
+	return copy
+}
+
+func (ts *TotalStation) UnmarshalJSON(data []byte) error {
+	ts.initData()
+
+	// Unmarshal structure normally. Cast it into a different type to prevent recursion with json.Unmarshal.
+	type tempType *TotalStation
+	if err := json.Unmarshal(data, tempType(ts)); err != nil {
+		return err
+	}
+
+	// Update parent references and keys.
+	for k, v := range ts.Measurements {
+		v.initReferences(ts, k)
+	}
+
+	return nil
+}
+
+// InstrumentCenter returns the position of the tilting axis of the instrument.
+func (ts *TotalStation) InstrumentCenter() mgl64.Vec3 {
+	return ts.Position.Vec3().Add(ts.site.UpDirection().Mul(ts.InstrumentHeight.Meters()))
+}
+
+// Direction returns the unit vector of the line of sight for the given horizontal direction and zenith angle.
+func (ts *TotalStation) Direction(hz, v Angle) mgl64.Vec3 {
+	first, second := ts.site.HorizontalAxes()
+	up := ts.site.UpDirection()
+
+	// Clockwise when looking down means from the first towards the negative second axis.
+	azimuth := (ts.Orientation + hz).Radian()
+	horizontal := first.Mul(math.Cos(azimuth)).Sub(second.Mul(math.Sin(azimuth)))
+
+	return horizontal.Mul(math.Sin(v.Radian())).Add(up.Mul(math.Cos(v.Radian())))
+}
+
+// Polar returns the horizontal direction, the zenith angle and the slope distance from the instrument center to the given position.
+// The horizontal direction is in the range of [0, 2π), and is 0 if the position is directly above or below the instrument.
+// The result is false if the position coincides with the instrument center.
+func (ts *TotalStation) Polar(position mgl64.Vec3) (hz, v Angle, slopeDistance Distance, ok bool) {
+	first, second := ts.site.HorizontalAxes()
+	up := ts.site.UpDirection()
+
+	d := position.Sub(ts.InstrumentCenter())
+	if d.Len() == 0 {
+		return 0, 0, 0, false
+	}
+	h1, h2, z := d.Dot(first), d.Dot(second), d.Dot(up)
+
+	if h1 != 0 || h2 != 0 {
+		hz = (Angle(math.Atan2(-h2, h1)) - ts.Orientation).Normalized()
+	}
+
+	return hz, Angle(math.Atan2(math.Hypot(h1, h2), z)), Distance(d.Len()), true
+}
+
+// GetTweakablesAndResiduals returns a list of tweakable variables and residuals.
+func (ts *TotalStation) GetTweakablesAndResiduals() ([]Tweakable, []Residualer) {
+	tweakables, residuals := []Tweakable{}, []Residualer{}
+
+	if !ts.InstrumentHeightLocked {
+		tweakables = append(tweakables, &ts.InstrumentHeight)
+	}
+	if !ts.OrientationLocked {
+		tweakables = append(tweakables, &ts.Orientation)
+	}
+
+	for _, measurement := range ts.MeasurementsSorted() {
+		newTweakables, newResiduals := measurement.GetTweakablesAndResiduals()
+		tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
+	}
+
+	newTweakables, newResiduals := ts.Position.GetTweakablesAndResiduals()
+	tweakables, residuals = append(tweakables, newTweakables...), append(residuals, newResiduals...)
+
+	return tweakables, residuals
+}
+
+// MeasurementsSorted returns the measurements of the total station as a list sorted by date.
+// TODO: Replace with generics once they are available. It's one of the few cases where they are really needed
+func (ts *TotalStation) MeasurementsSorted() []*TotalStationMeasurement {
+	measurements := make([]*TotalStationMeasurement, 0, len(ts.Measurements))
+
+	for _, measurement := range ts.Measurements {
+		measurements = append(measurements, measurement)
+	}
+
+	sort.Slice(measurements, func(i, j int) bool {
+		if !measurements[i].CreatedAt.Equal(measurements[j].CreatedAt) {
+			return measurements[i].CreatedAt.After(measurements[j].CreatedAt)
+		}
+		return measurements[i].Key() < measurements[j].Key()
+	})
+
+	return measurements
+}
+
+func (ts *TotalStation) handleImportClick(event vugu.DOMEvent) {
+	js.Global().Get("document").Call("getElementById", "total-station-upload").Call("click")
+}
+
+func (ts *TotalStation) handleImport(event vugu.DOMEvent) {
+	fileReader := js.Global().Get("FileReader").New()
+	fileReader.Call("addEventListener", "loadend", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		buffer := fileReader.Get("result")
+		uint8Array := js.Global().Get("Uint8Array").New(buffer)
+
+		data := make([]byte, uint8Array.Length())
+		js.CopyBytesToGo(data, uint8Array)
+
+		event.EventEnv().Lock()
+		defer event.EventEnv().UnlockRender()
+
+		observations, err := parseTotalStationObservations(data, ts.importGon)
+		if err != nil {
+			log.Printf("Couldn't import observations: %v", err)
+			// TODO: Somehow tell the user the file couldn't be loaded
+			return js.Undefined()
+		}
+
+		measurements, newPoints := ts.ImportObservations(observations)
+		log.Printf("Imported %d observations into total station %s, %d of them to new points", len(measurements), ts.DisplayName(), newPoints)
+
+		return js.Undefined()
+	}))
+
+	files := js.Global().Get("document").Call("getElementById", "total-station-upload").Get("files")
+	if files.Length() != 1 {
+		log.Printf("Wrong amount of files: Expected %v, got %v", 1, files.Length())
+		// TODO: Somehow forward the error to the user
+		return
+	}
+	fileReader.Call("readAsArrayBuffer", files.Index(0))
+}
@@ -117,8 +117,8 @@ func (tm *TripodMeasurement) GetTweakablesAndResiduals() ([]Tweakable, []Residua
 	return nil, []Residualer{tm}
 }
 
-// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
-func (tm *TripodMeasurement) ResidualSqr() float64 {
+// Residuals returns the list of signed residuals. (Each residual is divided by the accuracy of the measurement device).
+func (tm *TripodMeasurement) Residuals() []float64 {
 	tripod := tm.tripod
 	site := tripod.site
 
@@ -126,8 +126,50 @@ func (tm *TripodMeasurement) ResidualSqr() float64 {
 		// Determine distance, add offset
 		directDistance := tm.MeasuredDistance + tripod.Offset
 		pivotDistance := Distance(math.Sqrt(directDistance.Sqr() + tripod.OffsetSide.Sqr()))
-		return ((pivotDistance - point.Position.Distance(tripod.Position.Coordinate)) / tripod.Accuracy).Sqr()
+		return []float64{float64((pivotDistance - point.Position.Distance(tripod.Position.Coordinate)) / tripod.Accuracy)}
+	}
+
+	return []float64{0}
+}
+
+// Jacobian calls addFunc for every partial derivative of the residuals returned by Residuals().
+func (tm *TripodMeasurement) Jacobian(addFunc func(residualIndex int, tweakable Tweakable, derivative float64)) {
+	tripod := tm.tripod
+	site := tripod.site
+
+	point, ok := site.Points[tm.PointKey]
+	if !ok {
+		return
 	}
 
-	return 0
+	accuracy := tripod.Accuracy.Meters()
+
+	// Derivatives of the pivot distance with respect to the offsets.
+	directDistance := tm.MeasuredDistance + tripod.Offset
+	pivotDistance := math.Sqrt(directDistance.Sqr() + tripod.OffsetSide.Sqr())
+	if pivotDistance > 0 {
+		addFunc(0, &tripod.Offset, directDistance.Meters()/pivotDistance/accuracy)
+		addFunc(0, &tripod.OffsetSide, tripod.OffsetSide.Meters()/pivotDistance/accuracy)
+	}
+
+	// Derivatives of the distance between the point and the pivot point.
+	diff := point.Position.Vec3().Sub(tripod.Position.Vec3())
+	length := diff.Len()
+	if length > 0 {
+		for i := 0; i < 3; i++ {
+			derivative := diff[i] / length / accuracy
+			addFunc(0, &point.Position.Coordinate[i], -derivative)
+			addFunc(0, &tripod.Position.Coordinate[i], derivative)
+		}
+	}
+}
+
+// EffectiveRobustLoss returns the robust loss function that is used for the residuals.
+func (tm *TripodMeasurement) EffectiveRobustLoss() RobustLoss {
+	return tm.tripod.EffectiveRobustLoss()
+}
+
+// ResidualSqr returns the sum of squared residuals. (Each residual is divided by the accuracy of the measurement device).
+func (tm *TripodMeasurement) ResidualSqr() float64 {
+	return residualsSqr(tm.Residuals())
 }
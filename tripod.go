@@ -38,6 +38,7 @@ type Tripod struct {
 	Accuracy                       Distance              // Accuracy of the measurement.
 	Offset, OffsetSide             Distance              // Offset of the rangefinder from the pivot point.
 	OffsetLocked, OffsetSideLocked bool                  // Prevent the values from being optimized.
+	RobustLoss                     RobustLoss            // Robust loss function for all measurements. Overrides the site's loss function.
 
 	Measurements  map[string]*TripodMeasurement // List of measurements.
 	ignoredPoints []string                      // List of point keys that will not be suggested anymore.
@@ -58,6 +59,7 @@ func (t *Tripod) initData() {
 	t.Accuracy = 0.01
 	t.OffsetLocked = false
 	t.OffsetSideLocked = true
+	t.RobustLoss = RobustLoss{Function: RobustLossFunctionSite, Threshold: 3}
 	t.Measurements = map[string]*TripodMeasurement{}
 }
 
@@ -88,6 +90,15 @@ func (t *Tripod) DisplayName() string {
 	return "(" + t.Key() + ")"
 }
 
+// EffectiveRobustLoss returns the robust loss function that is used for all measurements of this device.
+func (t *Tripod) EffectiveRobustLoss() RobustLoss {
+	if t.RobustLoss.Function == RobustLossFunctionSite {
+		return t.site.RobustLoss
+	}
+
+	return t.RobustLoss
+}
+
 func (t *Tripod) Delete() {
 	delete(t.site.Tripods, t.Key())
 }
@@ -106,6 +117,7 @@ func (t *Tripod) Copy(newParent *Site, newKey string) *Tripod {
 	copy.OffsetSide = t.OffsetSide
 	copy.OffsetLocked = t.OffsetLocked
 	copy.OffsetSideLocked = t.OffsetSideLocked
+	copy.RobustLoss = t.RobustLoss
 
 	// Generate copies of all children.
 	for k, v := range t.Measurements {
@@ -164,7 +176,10 @@ func (t *Tripod) MeasurementsSorted() []*TripodMeasurement {
 	}
 
 	sort.Slice(measurements, func(i, j int) bool {
-		return measurements[i].CreatedAt.After(measurements[j].CreatedAt)
+		if !measurements[i].CreatedAt.Equal(measurements[j].CreatedAt) {
+			return measurements[i].CreatedAt.After(measurements[j].CreatedAt)
+		}
+		return measurements[i].Key() < measurements[j].Key()
 	})
 
 	return measurements